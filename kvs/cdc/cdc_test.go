@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/rpc"
+	"testing"
+
+	"github.com/rstutsman/cs6450-labs/kvs"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeServer serves a fixed change log. Records at or below oldest have been
+// dropped.
+type fakeServer struct {
+	records []kvs.CommitRecord
+	oldest  uint64
+}
+
+func (f *fakeServer) ChangeLog(req *kvs.ChangeLogRequest, resp *kvs.ChangeLogResponse) error {
+	resp.Version = f.records[len(f.records)-1].Version
+	from := req.FromVersion
+	if from < f.oldest {
+		resp.Compacted = true
+		from = f.oldest
+	}
+	for _, r := range f.records {
+		if r.Version > from {
+			resp.Records = append(resp.Records, r)
+		}
+		if req.MaxRecords > 0 && len(resp.Records) == req.MaxRecords {
+			resp.Version = r.Version
+			break
+		}
+	}
+	if len(resp.Records) == 0 {
+		resp.Version = max(resp.Version, req.FromVersion)
+	}
+	return nil
+}
+
+func startFakeServer(t *testing.T, f *fakeServer) string {
+	server := rpc.NewServer()
+	server.RegisterName("KVService", f)
+	l, err := net.Listen("tcp", "localhost:0")
+	assert.Nil(t, err)
+	go http.Serve(l, server)
+	t.Cleanup(func() { l.Close() })
+	return l.Addr().String()
+}
+
+func tail(t *testing.T, host string, from uint64) []Record {
+	buf := bytes.Buffer{}
+	tailer := &Tailer{host: host, from: from, batch: 2, out: &Output{enc: json.NewEncoder(&buf)}}
+	assert.Nil(t, tailer.Run())
+
+	var records []Record
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var record Record
+		assert.Nil(t, dec.Decode(&record))
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestTailInBatches(t *testing.T) {
+	host := startFakeServer(t, &fakeServer{records: []kvs.CommitRecord{
+		{Version: 1, TransactionID: "tx1", Writes: []kvs.CommittedWrite{{Key: "a", Value: []byte("1")}}},
+		{Version: 2, TransactionID: "tx2", Writes: []kvs.CommittedWrite{{Key: "b", Value: []byte("2")}}},
+		{Version: 3, TransactionID: "tx3", Writes: []kvs.CommittedWrite{{Key: "c", Value: []byte("3")}}},
+		{Version: 4, Writes: []kvs.CommittedWrite{{Key: "a", Deleted: true}}},
+	}})
+
+	records := tail(t, host, 1)
+	assert.Equal(t, 3, len(records))
+	assert.Equal(t, "tx2", records[0].TransactionID)
+	assert.Equal(t, uint64(4), records[2].Version)
+	assert.Equal(t, []Write{{Key: "a", Deleted: true}}, records[2].Writes)
+	for _, record := range records {
+		assert.Equal(t, host, record.Server)
+	}
+}
+
+func TestTailMarksCompactedGap(t *testing.T) {
+	host := startFakeServer(t, &fakeServer{oldest: 2, records: []kvs.CommitRecord{
+		{Version: 1, TransactionID: "tx1"},
+		{Version: 2, TransactionID: "tx2"},
+		{Version: 3, TransactionID: "tx3"},
+		{Version: 4, TransactionID: "tx4"},
+	}})
+
+	// The tailer says where the gap is and carries on from the oldest
+	// record the server still has, rather than stopping or skipping it
+	records := tail(t, host, 0)
+	assert.Equal(t, []Record{
+		{Server: host, Version: 0, Writes: []Write{}, Gap: true},
+		{Server: host, Version: 3, TransactionID: "tx3", Writes: []Write{}},
+		{Server: host, Version: 4, TransactionID: "tx4", Writes: []Write{}},
+	}, records)
+}
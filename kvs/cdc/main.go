@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/rpc"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rstutsman/cs6450-labs/kvs"
+)
+
+// Record is one committed transaction as written to the output, one JSON
+// object per line. A gap record, with Gap set and no writes, marks changes
+// the server no longer had when they were asked for, or lost in a restart:
+// anything Server committed after Version may be missing up to the next
+// record, so consumers should resync their copy of its keys.
+type Record struct {
+	Server        string  `json:"server"`
+	Version       uint64  `json:"version"`
+	TransactionID string  `json:"txid"`
+	Writes        []Write `json:"writes"`
+	Gap           bool    `json:"gap,omitempty"`
+}
+
+// Write is one key written by a transaction, or deleted when its TTL ran
+// out. Values are arbitrary bytes, so they are base64-encoded in the JSON
+// output.
+type Write struct {
+	Key     string `json:"key"`
+	Value   []byte `json:"value"`
+	TTLMs   int64  `json:"ttl_ms,omitempty"`
+	Deleted bool   `json:"deleted,omitempty"`
+}
+
+// Tailer follows the change log of one server.
+type Tailer struct {
+	host        string
+	from        uint64
+	incarnation uint64 // numbering from belongs to, once the server has returned it
+	batch       int
+	follow      bool
+	out         *Output
+	timeout     time.Duration
+}
+
+// Output serializes lines written by concurrent tailers.
+type Output struct {
+	sync.Mutex
+	enc *json.Encoder
+}
+
+func (o *Output) Write(record *Record) error {
+	o.Lock()
+	defer o.Unlock()
+	return o.enc.Encode(record)
+}
+
+func (t *Tailer) Run() error {
+	conn, err := rpc.DialHTTP("tcp", t.host)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for {
+		req := kvs.ChangeLogRequest{
+			FromVersion: t.from,
+			Incarnation: t.incarnation,
+			MaxRecords:  t.batch,
+			Timeout:     t.timeout,
+		}
+		if !t.follow {
+			req.Timeout = 0
+		}
+		resp := kvs.ChangeLogResponse{}
+		if err := conn.Call("KVService.ChangeLog", &req, &resp); err != nil {
+			return err
+		}
+
+		if resp.Compacted {
+			// The records that are left follow the gap
+			log.Printf("%s: records after version %d were compacted", t.host, t.from)
+			gap := &Record{Server: t.host, Version: t.from, Writes: []Write{}, Gap: true}
+			if err := t.out.Write(gap); err != nil {
+				return err
+			}
+		}
+
+		for _, r := range resp.Records {
+			record := &Record{
+				Server:        t.host,
+				Version:       r.Version,
+				TransactionID: r.TransactionID,
+				Writes:        make([]Write, 0, len(r.Writes)),
+			}
+			for _, w := range r.Writes {
+				record.Writes = append(record.Writes, Write{
+					Key:     w.Key,
+					Value:   w.Value,
+					TTLMs:   w.TTL.Milliseconds(),
+					Deleted: w.Deleted,
+				})
+			}
+			if err := t.out.Write(record); err != nil {
+				return err
+			}
+		}
+		t.from = resp.Version
+		t.incarnation = resp.Incarnation
+
+		if !t.follow && len(resp.Records) == 0 && !resp.Compacted {
+			return nil
+		}
+	}
+}
+
+func main() {
+	hosts := flag.String("hosts", "localhost:8080", "Comma-separated list of host:ports to read change logs from")
+	from := flag.Uint64("from", 0, "Only export transactions committed after this version")
+	outPath := flag.String("out", "", "File to append JSON lines to (default stdout)")
+	batch := flag.Int("batch", 1000, "Maximum records to fetch per request")
+	follow := flag.Bool("follow", true, "Keep tailing new commits; otherwise exit once caught up")
+	flag.Parse()
+
+	var w io.Writer = os.Stdout
+	if *outPath != "" {
+		f, err := os.OpenFile(*outPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		w = f
+	}
+	out := &Output{enc: json.NewEncoder(w)}
+
+	var wg sync.WaitGroup
+	for _, host := range strings.Split(*hosts, ",") {
+		tailer := &Tailer{
+			host:    host,
+			from:    *from,
+			batch:   *batch,
+			follow:  *follow,
+			out:     out,
+			timeout: 5 * time.Second,
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := tailer.Run(); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", tailer.host, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
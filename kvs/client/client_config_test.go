@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/rpc"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rstutsman/cs6450-labs/kvs"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeConfig stands in for the config service, serving whatever map the
+// test gives it.
+type fakeConfig struct {
+	sync.Mutex
+	m kvs.ShardMap
+}
+
+func (f *fakeConfig) Map(req *kvs.ShardMapRequest, resp *kvs.ShardMapResponse) error {
+	f.Lock()
+	defer f.Unlock()
+	resp.Map = f.m
+	return nil
+}
+
+func (f *fakeConfig) publish(epoch uint64) {
+	f.Lock()
+	defer f.Unlock()
+	f.m = kvs.ShardMap{Epoch: epoch, Shards: hosts, Ranges: []kvs.RangeInfo{{Owner: hosts[0]}}}
+}
+
+func TestConfiguredClientRefreshesStaleMap(t *testing.T) {
+	// Start from whatever epoch earlier runs left the server at
+	server, err := rpc.DialHTTP("tcp", hosts[0])
+	assert.Nil(t, err)
+	defer server.Close()
+	rangesResp := kvs.RangesResponse{}
+	assert.Nil(t, server.Call("KVService.Ranges", &kvs.RangesRequest{}, &rangesResp))
+	epoch := rangesResp.Epoch + 1
+
+	config := &fakeConfig{}
+	config.publish(epoch)
+	rpcServer := rpc.NewServer()
+	rpcServer.RegisterName("Config", config)
+	l, err := net.Listen("tcp", "localhost:0")
+	assert.Nil(t, err)
+	go http.Serve(l, rpcServer)
+	defer l.Close()
+
+	client, err := NewConfiguredClient(l.Addr().String())
+	assert.Nil(t, err)
+	key := fmt.Sprintf("config-%d", time.Now().UnixNano())
+	client.Begin()
+	assert.Nil(t, client.Put(key, "1"))
+	assert.Nil(t, client.Commit())
+
+	// The server moves on to a newer map; the client's is rejected until it
+	// fetches that map too
+	config.publish(epoch + 1)
+	assignReq := kvs.AssignRangesRequest{Ranges: []kvs.RangeInfo{{}}, Epoch: epoch + 1}
+	assert.Nil(t, server.Call("KVService.AssignRanges", &assignReq, &kvs.AssignRangesResponse{}))
+
+	client.Begin()
+	assert.ErrorIs(t, client.Put(key, "2"), kvs.ErrStaleEpoch)
+	client.Abort()
+	assert.Equal(t, epoch+1, client.epoch())
+
+	client.Begin()
+	assert.Nil(t, client.Put(key, "2"))
+	assert.Nil(t, client.Commit())
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/rstutsman/cs6450-labs/kvs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdempotentCommit(t *testing.T) {
+	client := NewClient(hosts)
+	key := fmt.Sprintf("idempotent-%d", time.Now().UnixNano())
+
+	client.Begin()
+	assert.Nil(t, client.Put(key, "a"))
+	txID := client.activeTransaction
+	addr := client.participants[0]
+	assert.Nil(t, client.Commit())
+
+	client.Begin()
+	_, version, err := client.GetVersion(key)
+	assert.Nil(t, err)
+	assert.Nil(t, client.Commit())
+
+	// A retried commit succeeds again without reapplying the write set
+	commit := kvs.CommitRequest{TransactionID: txID}
+	commitResp := kvs.CommitResponse{}
+	assert.Nil(t, client.callWithRetry(addr, "KVService.Commit", &commit, &commitResp))
+	assert.Equal(t, kvs.StatusOK, commitResp.Status)
+
+	client.Begin()
+	_, again, err := client.GetVersion(key)
+	assert.Nil(t, err)
+	assert.Nil(t, client.Commit())
+	assert.Equal(t, version, again)
+
+	// It's too late to abort
+	abort := kvs.AbortRequest{TransactionID: txID}
+	abortResp := kvs.AbortResponse{}
+	assert.Nil(t, client.callWithRetry(addr, "KVService.Abort", &abort, &abortResp))
+	assert.Equal(t, kvs.StatusTransactionCommitted, abortResp.Status)
+}
+
+func TestIdempotentAbort(t *testing.T) {
+	client := NewClient(hosts)
+	key := fmt.Sprintf("idempotent-abort-%d", time.Now().UnixNano())
+
+	client.Begin()
+	assert.Nil(t, client.Put(key, "a"))
+	txID := client.activeTransaction
+	addr := client.participants[0]
+	client.Abort()
+
+	abort := kvs.AbortRequest{TransactionID: txID}
+	abortResp := kvs.AbortResponse{}
+	assert.Nil(t, client.callWithRetry(addr, "KVService.Abort", &abort, &abortResp))
+	assert.Equal(t, kvs.StatusOK, abortResp.Status)
+
+	commit := kvs.CommitRequest{TransactionID: txID}
+	commitResp := kvs.CommitResponse{}
+	assert.Nil(t, client.callWithRetry(addr, "KVService.Commit", &commit, &commitResp))
+	assert.Equal(t, kvs.StatusTransactionAborted, commitResp.Status)
+
+	assert.Equal(t, "", client.GetTx(key))
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLatencies(t *testing.T) {
+	client := NewClient(hosts)
+	latencies := NewLatencies()
+	client.UseLatencies(latencies)
+	key := fmt.Sprintf("latency-%d", time.Now().UnixNano())
+
+	client.Begin()
+	assert.Nil(t, client.Put(key, "1"))
+	_, err := client.Get(key)
+	assert.Nil(t, err)
+	assert.Nil(t, client.Commit())
+	client.Begin()
+	client.Get(key)
+	client.Abort()
+
+	// Reading the transaction's own write doesn't go to the server
+	snapshot := latencies.Snapshot()
+	for op, count := range map[string]uint64{"tx": 1, "get": 1, "put": 1, "scan": 0, "commit": 1, "abort": 1} {
+		h := snapshot[op]
+		assert.Equal(t, count, h.Count(), op)
+	}
+	tx := snapshot["tx"]
+	assert.True(t, tx.Quantile(0.5) > 0)
+}
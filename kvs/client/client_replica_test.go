@@ -0,0 +1,27 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplicaFailover(t *testing.T) {
+	// Nothing listens on the second replica, so once the client has been
+	// pointed at it, it has to fail over back to the first
+	client := NewClient([]string{hosts[0] + "|localhost:1"})
+	key := fmt.Sprintf("failover-%d", time.Now().UnixNano())
+	assert.Equal(t, "localhost:1", client.failover(hosts[0]))
+
+	client.Begin()
+	assert.NotNil(t, client.Put(key, "value"))
+	client.Abort()
+	assert.Equal(t, hosts[0], client.getServerForKey(key))
+
+	client.Begin()
+	assert.Nil(t, client.Put(key, "value"))
+	assert.Nil(t, client.Commit())
+	assert.Equal(t, "value", client.GetTx(key))
+}
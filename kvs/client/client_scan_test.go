@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScanInOrder(t *testing.T) {
+	client := NewClient(hosts)
+	assert.Nil(t, client.LoadShardMap())
+	prefix := fmt.Sprintf("scan-%d/", time.Now().UnixNano())
+
+	client.Begin()
+	for _, key := range []string{"c", "a", "b", "d"} {
+		assert.Nil(t, client.Put(prefix+key, key))
+	}
+	assert.Nil(t, client.Commit())
+
+	client.Begin()
+	entries, err := client.Scan(prefix+"b", prefix+"~", 2)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(entries))
+	assert.Equal(t, prefix+"b", entries[0].Key)
+	assert.Equal(t, []byte("b"), entries[0].Value)
+	assert.Equal(t, prefix+"c", entries[1].Key)
+	assert.Nil(t, client.Commit())
+
+	// Scans see the transaction's own writes
+	client.Begin()
+	assert.Nil(t, client.Put(prefix+"e", "e"))
+	entries, err = client.Scan(prefix, prefix+"~", 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, len(entries))
+	assert.Equal(t, prefix+"e", entries[4].Key)
+	assert.Nil(t, client.Abort())
+}
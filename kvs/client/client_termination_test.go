@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/rpc"
+	"testing"
+	"time"
+
+	"github.com/rstutsman/cs6450-labs/kvs"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeParticipant stands in for another server that already knows the
+// outcome of every transaction.
+type fakeParticipant struct {
+	state string
+}
+
+func (f *fakeParticipant) TxStatus(req *kvs.TxStatusRequest, resp *kvs.TxStatusResponse) error {
+	resp.State = f.state
+	return nil
+}
+
+func startFakeParticipant(t *testing.T, state string) string {
+	server := rpc.NewServer()
+	server.RegisterName("KVService", &fakeParticipant{state: state})
+	l, err := net.Listen("tcp", "localhost:0")
+	assert.Nil(t, err)
+	go http.Serve(l, server)
+	t.Cleanup(func() { l.Close() })
+	return l.Addr().String()
+}
+
+// Prepares a transaction that writes key, then abandons it the way a
+// crashed client would.
+func prepareAndAbandon(t *testing.T, key string, peer string) {
+	client := NewClient(hosts)
+	client.Begin()
+	assert.Nil(t, client.Put(key, "in-doubt"))
+
+	req := kvs.PrepareRequest{
+		TransactionID: client.activeTransaction,
+		Participants:  []string{client.participants[0], peer},
+	}
+	resp := kvs.PrepareResponse{}
+	assert.Nil(t, client.callWithRetry(client.participants[0], "KVService.Prepare", &req, &resp))
+	assert.Equal(t, kvs.StatusOK, resp.Status)
+}
+
+// Waits for the key's write lock to be released and returns its value.
+func waitForResolution(t *testing.T, key string) string {
+	client := NewClient(hosts)
+	deadline := time.Now().Add(15 * time.Second)
+	for time.Now().Before(deadline) {
+		client.Begin()
+		value, err := client.Get(key)
+		client.Commit()
+		if err == nil {
+			return value
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	t.Fatalf("%s is still locked", key)
+	return ""
+}
+
+func TestTerminationLearnsCommit(t *testing.T) {
+	key := fmt.Sprintf("termination-commit-%d", time.Now().UnixNano())
+	prepareAndAbandon(t, key, startFakeParticipant(t, kvs.TxCommitted))
+	assert.Equal(t, "in-doubt", waitForResolution(t, key))
+}
+
+func TestTerminationLearnsAbort(t *testing.T) {
+	key := fmt.Sprintf("termination-abort-%d", time.Now().UnixNano())
+	prepareAndAbandon(t, key, startFakeParticipant(t, kvs.TxAborted))
+	assert.Equal(t, "", waitForResolution(t, key))
+}
@@ -3,7 +3,9 @@ package main
 import (
 	"fmt"
 	"testing"
+	"time"
 
+	"github.com/rstutsman/cs6450-labs/kvs"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -150,3 +152,73 @@ func TestRWConflict(t *testing.T) {
 
 	c2.Abort()
 }
+
+func TestBinaryValues(t *testing.T) {
+	client := NewClient(hosts)
+
+	key := string([]byte{0xff, 0x00, 'k', 0xfe})
+	value := []byte{0x00, 0x01, 0xff, 0x80, 0x00}
+
+	client.Begin()
+	assert.Nil(t, client.PutBytes(key, value))
+	assert.Nil(t, client.Commit())
+
+	client.Begin()
+	got, err := client.GetBytes(key)
+	assert.Nil(t, err)
+	assert.Equal(t, value, got)
+	client.Commit()
+}
+
+func TestValueTooLarge(t *testing.T) {
+	client := NewClient(hosts)
+
+	client.Begin()
+	err := client.PutBytes("too-large", make([]byte, client.maxValueSize+1))
+	assert.NotNil(t, err)
+	client.Abort()
+
+	// The server enforces its own limit too
+	client.maxValueSize *= 2
+	client.Begin()
+	err = client.PutBytes("too-large", make([]byte, client.maxValueSize))
+	assert.NotNil(t, err)
+	client.Abort()
+}
+
+func TestStatusErrors(t *testing.T) {
+	c1 := NewClient(hosts)
+	c2 := NewClient(hosts)
+	key := fmt.Sprintf("status-%d", time.Now().UnixNano())
+
+	// Writer blocks a reader
+	c1.Begin()
+	c2.Begin()
+	assert.Nil(t, c1.Put(key, "c1"))
+	_, err := c2.Get(key)
+	assert.ErrorIs(t, err, kvs.ErrReadLockConflict)
+	assert.ErrorIs(t, err, kvs.ErrLockConflict)
+	assert.True(t, kvs.IsRetryable(err))
+	assert.Nil(t, c1.Commit())
+	c2.Abort()
+
+	// Two readers block each other's upgrade
+	c1.Begin()
+	c2.Begin()
+	_, err = c1.Get(key)
+	assert.Nil(t, err)
+	_, err = c2.Get(key)
+	assert.Nil(t, err)
+	err = c1.Put(key, "c1")
+	assert.ErrorIs(t, err, kvs.ErrUpgradeConflict)
+	assert.ErrorIs(t, err, kvs.ErrLockConflict)
+	c1.Abort()
+	c2.Abort()
+
+	// A failed precondition isn't worth retrying
+	c1.Begin()
+	err = c1.PutIfVersion(key, []byte("c1"), 0)
+	assert.ErrorIs(t, err, kvs.ErrPreconditionFailed)
+	assert.False(t, kvs.IsRetryable(err))
+	c1.Abort()
+}
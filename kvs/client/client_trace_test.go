@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rstutsman/cs6450-labs/kvs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTracing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.json")
+	tracer, err := kvs.NewTracer(path, "kvsclient")
+	assert.Nil(t, err)
+	client := NewClient(hosts)
+	client.UseTracer(tracer, 1)
+	key := fmt.Sprintf("trace-%d", time.Now().UnixNano())
+
+	client.Begin()
+	traceID := client.traceID
+	assert.NotEqual(t, "", traceID)
+	assert.Nil(t, client.Put(key, "1"))
+	assert.Nil(t, client.Commit())
+
+	// Untraced transactions record nothing
+	client.UseTracer(tracer, 0)
+	client.Begin()
+	assert.Equal(t, "", client.traceID)
+	client.Get(key)
+	client.Abort()
+	assert.Nil(t, tracer.Close())
+
+	file, err := os.Open(path)
+	assert.Nil(t, err)
+	defer file.Close()
+	events, err := kvs.ReadTrace(file)
+	assert.Nil(t, err)
+	var spans []string
+	for _, event := range events {
+		if event.Phase == "X" {
+			spans = append(spans, event.Name)
+			assert.Equal(t, traceID, event.Args["trace_id"])
+		}
+	}
+	assert.Equal(t, []string{"Put", "Commit", "commit fan-out", "transaction"}, spans)
+}
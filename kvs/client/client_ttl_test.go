@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTTLExpiry(t *testing.T) {
+	client := NewClient(hosts)
+	key := fmt.Sprintf("ttl-%d", time.Now().UnixNano())
+
+	client.Begin()
+	err := client.PutTTL(key, []byte("session"), 200*time.Millisecond)
+	assert.Nil(t, err)
+	assert.Nil(t, client.Commit())
+
+	assert.Equal(t, "session", client.GetTx(key))
+
+	time.Sleep(300 * time.Millisecond)
+	assert.Equal(t, "", client.GetTx(key))
+}
+
+func TestTTLRespectsReadLock(t *testing.T) {
+	client := NewClient(hosts)
+	key := fmt.Sprintf("ttl-locked-%d", time.Now().UnixNano())
+
+	client.Begin()
+	assert.Nil(t, client.PutTTL(key, []byte("session"), 200*time.Millisecond))
+	assert.Nil(t, client.Commit())
+
+	// A transaction holding a read lock keeps seeing the value past its
+	// expiry time.
+	client.Begin()
+	got, err := client.Get(key)
+	assert.Nil(t, err)
+	assert.Equal(t, "session", got)
+
+	time.Sleep(1500 * time.Millisecond)
+
+	got, err = client.Get(key)
+	assert.Nil(t, err)
+	assert.Equal(t, "session", got)
+	assert.Nil(t, client.Commit())
+
+	assert.Equal(t, "", client.GetTx(key))
+}
+
+func TestTTLExpiresForNewReadersOfLockedKey(t *testing.T) {
+	client := NewClient(hosts)
+	key := fmt.Sprintf("ttl-reader-%d", time.Now().UnixNano())
+
+	client.Begin()
+	assert.Nil(t, client.PutTTL(key, []byte("session"), 200*time.Millisecond))
+	assert.Nil(t, client.Commit())
+
+	client.Begin()
+	got, err := client.Get(key)
+	assert.Nil(t, err)
+	assert.Equal(t, "session", got)
+
+	time.Sleep(300 * time.Millisecond)
+
+	// The read lock keeps the entry around for the first reader, but a
+	// reader that arrives after the expiry doesn't see it.
+	other := NewClient(hosts)
+	assert.Equal(t, "", other.GetTx(key))
+
+	got, err = client.Get(key)
+	assert.Nil(t, err)
+	assert.Equal(t, "session", got)
+	assert.Nil(t, client.Commit())
+}
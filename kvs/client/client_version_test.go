@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVersions(t *testing.T) {
+	client := NewClient(hosts)
+	key := fmt.Sprintf("version-%d", time.Now().UnixNano())
+
+	client.Begin()
+	_, v0, err := client.GetVersion(key)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), v0)
+	assert.Nil(t, client.PutIfVersion(key, []byte("a"), 0))
+	assert.Nil(t, client.Commit())
+
+	client.Begin()
+	got, v1, err := client.GetVersion(key)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("a"), got)
+	assert.True(t, v1 > 0)
+	assert.Nil(t, client.Put(key, "b"))
+	assert.Nil(t, client.Commit())
+
+	client.Begin()
+	got, v2, err := client.GetVersion(key)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("b"), got)
+	assert.True(t, v2 > v1)
+	assert.Nil(t, client.Commit())
+
+	// A stale version fails the precondition
+	client.Begin()
+	assert.NotNil(t, client.PutIfVersion(key, []byte("c"), v1))
+	client.Abort()
+
+	client.Begin()
+	assert.Nil(t, client.PutIfVersion(key, []byte("c"), v2))
+	assert.Nil(t, client.Commit())
+
+	assert.Equal(t, "c", client.GetTx(key))
+}
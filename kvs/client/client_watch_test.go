@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWatchPrefix(t *testing.T) {
+	client := NewClient(hosts)
+	prefix := fmt.Sprintf("watch-%d/", time.Now().UnixNano())
+
+	client.Begin()
+	assert.Nil(t, client.Put(prefix+"a", "1"))
+	assert.Nil(t, client.Commit())
+
+	client.Begin()
+	_, from, err := client.GetVersion(prefix + "a")
+	assert.Nil(t, err)
+	assert.Nil(t, client.Commit())
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		writer := NewClient(hosts)
+		writer.Begin()
+		writer.Put(prefix+"b", "2")
+		writer.Put("not-"+prefix, "x")
+		writer.Commit()
+	}()
+
+	watcher := client.Watch(prefix, true, from)
+	events, err := watcher.Next(5 * time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(events))
+	assert.Equal(t, prefix+"b", events[0].Key)
+	assert.Equal(t, []byte("2"), events[0].Value)
+	assert.True(t, events[0].Version > from)
+
+	// Nothing else changed, so the next poll times out empty
+	events, err = watcher.Next(100 * time.Millisecond)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(events))
+}
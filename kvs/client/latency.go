@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rstutsman/cs6450-labs/kvs"
+)
+
+// Operations a Latencies times, in the order they are printed. A "tx" runs
+// from Begin until Commit succeeds; aborted attempts aren't counted.
+var latencyOps = []string{"tx", "get", "put", "scan", "commit", "abort"}
+
+// Latencies collects how long clients' transactions and operations take.
+// Many clients can share one.
+type Latencies struct {
+	sync.Mutex
+	histograms map[string]*kvs.Histogram
+}
+
+func NewLatencies() *Latencies {
+	l := &Latencies{histograms: make(map[string]*kvs.Histogram)}
+	for _, op := range latencyOps {
+		l.histograms[op] = &kvs.Histogram{}
+	}
+	return l
+}
+
+// Helper method to count an op that began at began and just finished. Does
+// nothing if l is nil.
+func (l *Latencies) record(op string, began time.Time) {
+	if l == nil {
+		return
+	}
+	l.Lock()
+	defer l.Unlock()
+	l.histograms[op].Record(time.Since(began))
+}
+
+// Snapshot copies the histogram of every op.
+func (l *Latencies) Snapshot() map[string]kvs.Histogram {
+	l.Lock()
+	defer l.Unlock()
+	histograms := make(map[string]kvs.Histogram, len(l.histograms))
+	for op, h := range l.histograms {
+		histograms[op] = *h
+	}
+	return histograms
+}
+
+// UseLatencies has the client time its transactions and operations in l.
+func (client *Client) UseLatencies(l *Latencies) {
+	client.latencies = l
+}
+
+// Helper function to print the percentiles of every op counted in now but
+// not in prev, an earlier snapshot, which may be nil
+func printLatencies(now, prev map[string]kvs.Histogram) {
+	for _, op := range latencyOps {
+		before := prev[op]
+		h := now[op]
+		interval := h.Sub(&before)
+		if interval.Count() > 0 {
+			fmt.Printf("%s latency %v\n", op, &interval)
+		}
+	}
+}
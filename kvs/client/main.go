@@ -1,11 +1,17 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"math/rand"
 	"net/rpc"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
@@ -16,11 +22,24 @@ import (
 type Client struct {
 	rpcClient         *rpc.Client
 	activeTransaction string            // current active transaction ID
-	writeSet          map[string]string // local write set
-	participants      []*rpc.Client     // list of participating servers
+	writeSet          map[string][]byte // local write set
+	participants      []string          // addresses of participating servers
 	clientID          string
-	hosts             []string               // list of all server hosts
+	hosts             []string               // one entry per shard; a shard's replicas are separated by "|"
+	replicas          [][]string             // replica addresses of each shard
+	primary           []int                  // index of the replica believed to be each shard's primary
+	partitioner       kvs.Partitioner        // decides which shard owns each key
+	shardMap          *kvs.ShardMap          // ranges of keys each shard owns, with range placement
+	configAddr        string                 // address of the config service the shard map comes from, if any
 	connCache         map[string]*rpc.Client // cache of RPC clients by host
+	maxKeySize        int
+	maxValueSize      int
+	coordinator       string      // address of the coordinator that runs commits; empty means the client does
+	began             time.Time   // when the active transaction began
+	latencies         *Latencies  // where to time transactions and operations, if anywhere
+	tracer            *kvs.Tracer // where to record spans of traced transactions, if anywhere
+	traceSample       float64     // share of transactions to trace
+	traceID           string      // trace of the active transaction; empty if it isn't traced
 }
 
 func Dial(addr string) *Client {
@@ -32,22 +51,63 @@ func Dial(addr string) *Client {
 	return &Client{
 		rpcClient:         rpcClient,
 		activeTransaction: "",
-		writeSet:          make(map[string]string),
+		writeSet:          make(map[string][]byte),
 		participants:      nil,
 		clientID:          "",
 		hosts:             nil,
+		connCache:         make(map[string]*rpc.Client),
+		maxKeySize:        kvs.DefaultMaxKeySize,
+		maxValueSize:      kvs.DefaultMaxValueSize,
 	}
 }
 
+// NewClient places keys on the shards in hosts by consistent hashing, with
+// equal weights. Shards are identified on the ring by their entry in hosts,
+// so a shard keeps its keys as long as its entry stays the same.
 func NewClient(hosts []string) *Client {
+	ring, err := kvs.NewRing(hosts, nil, kvs.DefaultVirtualNodes)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return NewPartitionedClient(hosts, ring)
+}
+
+// NewPartitionedClient places keys on the shards in hosts with partitioner,
+// which numbers shards by their position in hosts.
+func NewPartitionedClient(hosts []string, partitioner kvs.Partitioner) *Client {
 	// Connect to the first host initially
-	client := Dial(hosts[0])
-	client.hosts = hosts
+	client := Dial(strings.Split(hosts[0], "|")[0])
+	client.setHosts(hosts)
+	client.partitioner = partitioner
+	if ranges, ok := partitioner.(*kvs.RangePartitioner); ok {
+		owners := make([]string, len(hosts))
+		for i := range hosts {
+			owners[i] = client.replicas[i][0]
+		}
+		client.shardMap = ranges.ShardMap(owners)
+	}
 	client.clientID = fmt.Sprintf("%d", rand.Int63())
-	client.connCache = make(map[string]*rpc.Client)
 	return client
 }
 
+// Helper method to use the shards in hosts, starting with the first replica
+// of each as its primary
+func (client *Client) setHosts(hosts []string) {
+	client.hosts = hosts
+	client.replicas = make([][]string, len(hosts))
+	for i, host := range hosts {
+		client.replicas[i] = strings.Split(host, "|")
+	}
+	client.primary = make([]int, len(hosts))
+}
+
+// UseCoordinator hands every later commit to the coordinator at addr instead
+// of running 2PC in the client, so a crash during commit can't leave the
+// transaction in doubt.
+func (client *Client) UseCoordinator(addr string) {
+	client.coordinator = addr
+}
+
 func (client *Client) getConnection(addr string) (*rpc.Client, error) {
 	if conn, exists := client.connCache[addr]; exists {
 		return conn, nil
@@ -62,6 +122,120 @@ func (client *Client) getConnection(addr string) (*rpc.Client, error) {
 	return conn, nil
 }
 
+// Helper method to drop a broken connection so the next call redials
+func (client *Client) dropConnection(addr string) {
+	if conn, exists := client.connCache[addr]; exists {
+		conn.Close()
+		delete(client.connCache, addr)
+	}
+}
+
+// Helper method to move on to the next replica of the shard that addr
+// belongs to, after addr failed or turned out to be a backup. Returns the
+// address to use instead, which is addr itself if the shard has no other
+// replicas.
+func (client *Client) failover(addr string) string {
+	for shard, replicas := range client.replicas {
+		if replicas[client.primary[shard]] != addr {
+			continue
+		}
+		client.primary[shard] = (client.primary[shard] + 1) % len(replicas)
+		return replicas[client.primary[shard]]
+	}
+	return addr
+}
+
+// Helper method to follow a shard to its primary after addr said it isn't
+// one. Asks addr who the primary is, which a Raft follower knows, and
+// otherwise moves on to the next replica like failover. Returns the address
+// to use instead.
+func (client *Client) redirect(addr string) string {
+	shard := client.shardOf(addr)
+	if shard < 0 {
+		return addr
+	}
+
+	resp := kvs.PingResponse{}
+	if conn, err := client.getConnection(addr); err == nil && conn.Call("KVService.Ping", &kvs.PingRequest{}, &resp) == nil {
+		if i := slices.Index(client.replicas[shard], resp.Primary); i >= 0 && resp.Primary != addr {
+			client.primary[shard] = i
+			return resp.Primary
+		}
+	}
+	return client.failover(addr)
+}
+
+// Helper method to find the shard addr is a replica of, or -1
+func (client *Client) shardOf(addr string) int {
+	for shard, replicas := range client.replicas {
+		if slices.Contains(replicas, addr) {
+			return shard
+		}
+	}
+	return -1
+}
+
+// Helper method to list the address of every shard's primary
+func (client *Client) primaries() []string {
+	addrs := make([]string, len(client.replicas))
+	for shard, replicas := range client.replicas {
+		addrs[shard] = replicas[client.primary[shard]]
+	}
+	return addrs
+}
+
+const maxCallAttempts = 5
+
+// Helper method to call a server, redialing and trying again if the
+// connection fails. If the server has other replicas, later attempts go to
+// the next one. A lost reply means the request may have run already, so
+// this is only safe for idempotent requests like Commit and Abort.
+func (client *Client) callWithRetry(addr string, method string, args any, reply any) error {
+	var err error
+	for attempt := 0; attempt < maxCallAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(10<<attempt) * time.Millisecond)
+		}
+
+		var conn *rpc.Client
+		conn, err = client.getConnection(addr)
+		if err != nil {
+			addr = client.failover(addr)
+			continue
+		}
+
+		err = conn.Call(method, args, reply)
+		if _, isServerErr := err.(rpc.ServerError); err == nil || isServerErr {
+			return err
+		}
+		client.dropConnection(addr)
+		addr = client.failover(addr)
+	}
+	return err
+}
+
+const maxRedirects = 8
+
+// Helper method to make an idempotent call to the primary of addr's shard,
+// following redirects while status, which reads the reply, says the server
+// isn't the primary. Waits a little longer each time, since a new Raft
+// leader may not have been elected yet.
+func (client *Client) callPrimary(addr string, method string, args any, reply any, status func() kvs.Status) error {
+	for attempt := 0; ; attempt++ {
+		// Fields left at their zero value in a reply aren't decoded, so an
+		// earlier attempt's status would stick
+		reflect.ValueOf(reply).Elem().SetZero()
+		if err := client.callWithRetry(addr, method, args, reply); err != nil {
+			return err
+		}
+		if status() != kvs.StatusNotPrimary || attempt == maxRedirects {
+			return nil
+		}
+		time.Sleep(time.Duration(10<<min(attempt, 5)) * time.Millisecond)
+		addr = client.redirect(addr)
+	}
+}
+
 func (c *Client) Begin() error {
 	if c.activeTransaction != "" {
 		return fmt.Errorf("Cannot begin transaction: already in transaction")
@@ -70,10 +244,12 @@ func (c *Client) Begin() error {
 	// Generate unique transaction ID
 	txID := fmt.Sprintf("%s-%d", c.clientID, time.Now().UnixNano())
 	c.activeTransaction = txID
+	c.began = time.Now()
+	c.startTrace()
 
 	// Initialize transaction state
-	c.writeSet = make(map[string]string)
-	c.participants = make([]*rpc.Client, 0)
+	c.writeSet = make(map[string][]byte)
+	c.participants = make([]string, 0)
 	return nil
 }
 
@@ -81,30 +257,34 @@ func (c *Client) Commit() error {
 	if c.activeTransaction == "" {
 		panic("Cannot commit: no active transaction")
 	}
+	defer c.latencies.record("commit", time.Now())
 
-	// Phase 2 of 2PC: Send commit to all participants
-	success := true
-	for i, participant := range c.participants {
-		req := kvs.CommitRequest{
-			TransactionID: c.activeTransaction,
-			Lead:          i == 0, // First participant is the lead
-		}
-		resp := kvs.CommitResponse{}
-		err := participant.Call("KVService.Commit", &req, &resp)
-		if err != nil || !resp.Success {
-			success = false
-			break
-		}
+	var commitErr error
+	fanOut := time.Now()
+	if c.coordinator != "" {
+		commitErr = c.commitThroughCoordinator()
+	} else {
+		commitErr = c.commitParticipants()
 	}
+	outcome := "committed"
+	if commitErr != nil {
+		outcome = commitErr.Error()
+	}
+	c.span("commit fan-out", fanOut, "participants", strings.Join(c.participants, ","), "coordinator", c.coordinator)
+	c.span("transaction", c.began, "tx", c.activeTransaction, "outcome", outcome)
 
 	// Clear transaction state
 	c.activeTransaction = ""
 	c.writeSet = nil
 	c.participants = nil
 
-	if !success {
-		return fmt.Errorf("commit failed")
+	if errors.Is(commitErr, kvs.ErrOutcomeUnknown) {
+		return commitErr
+	}
+	if commitErr != nil {
+		return fmt.Errorf("commit failed: %w", commitErr)
 	}
+	c.latencies.record("tx", c.began)
 	return nil
 }
 
@@ -113,29 +293,222 @@ func (c *Client) Abort() error {
 		fmt.Println("Warning: Abort called with no active transaction")
 		return fmt.Errorf("Cannot abort: no active transaction")
 	}
+	defer c.latencies.record("abort", time.Now())
 
 	// Phase 2 of 2PC: Send abort to all participants
+	c.abortParticipants(c.participants)
+	c.span("transaction", c.began, "tx", c.activeTransaction, "outcome", "aborted")
+
+	// Clear transaction state
+	c.activeTransaction = ""
+	c.writeSet = make(map[string][]byte)
+	c.participants = make([]string, 0)
+
+	return nil
+}
+
+// Helper method to run both phases of 2PC from the client
+func (c *Client) commitParticipants() error {
+	// Phase 1 of 2PC: With more than one participant, every participant
+	// has to vote to commit first. Once prepared, participants that don't
+	// hear the decision ask each other for it, so a crash after this point
+	// can't leave their locks held.
+	commitErr := c.prepare()
+	if commitErr != nil {
+		c.abortParticipants(c.participants)
+		return commitErr
+	}
+
+	// Phase 2 of 2PC: Send commit to all participants. The decision is
+	// final, so keep going even if one of them can't be reached.
+	var undelivered []string
 	for i, participant := range c.participants {
+		err := c.sendCommit(participant, i == 0) // First participant is the lead
+		if err == nil {
+			continue
+		}
+		if len(c.participants) == 1 {
+			// With one participant the commit is the decision, so a reply
+			// is the outcome, but a lost one leaves it unknown
+			var statusErr *kvs.StatusError
+			if errors.As(err, &statusErr) {
+				return err
+			}
+			return fmt.Errorf("%w: %v", kvs.ErrOutcomeUnknown, err)
+		}
+		undelivered = append(undelivered, participant)
+	}
+	if len(undelivered) == 0 {
+		return nil
+	}
+
+	// The transaction has committed even though some participants haven't
+	// heard yet, so keep telling them. Once any participant commits, the rest
+	// also learn the outcome from it.
+	c.deliverCommit(undelivered)
+	if len(undelivered) == len(c.participants) {
+		return fmt.Errorf("%w: no participant has acknowledged the commit yet", kvs.ErrOutcomeUnknown)
+	}
+	return nil
+}
+
+// Helper method to send the commit decision for the active transaction to
+// one participant
+func (c *Client) sendCommit(participant string, lead bool) error {
+	req := kvs.CommitRequest{
+		TransactionID: c.activeTransaction,
+		Lead:          lead,
+		TraceID:       c.traceID,
+	}
+	resp := kvs.CommitResponse{}
+	began := time.Now()
+	err := c.callPrimary(participant, "KVService.Commit", &req, &resp, func() kvs.Status { return resp.Status })
+	c.span("Commit", began, "server", participant, "status", resp.Status.String())
+	if err != nil {
+		return err
+	}
+	return resp.Status.Err()
+}
+
+const maxCommitDelivery = 10 * time.Minute
+
+// Helper method to keep sending the commit decision for the active
+// transaction to participants that didn't acknowledge it, in the background
+// so the client can go on. It dials connections of its own, since the
+// client isn't safe to share.
+func (c *Client) deliverCommit(participants []string) {
+	type delivery struct {
+		replicas []string // the participant first, then the rest of its shard
+		req      kvs.CommitRequest
+	}
+	var pending []delivery
+	for _, participant := range participants {
+		replicas := []string{participant}
+		if shard := c.shardOf(participant); shard >= 0 {
+			for _, replica := range c.replicas[shard] {
+				if replica != participant {
+					replicas = append(replicas, replica)
+				}
+			}
+		}
+		req := kvs.CommitRequest{TransactionID: c.activeTransaction, Lead: participant == c.participants[0]}
+		pending = append(pending, delivery{replicas, req})
+	}
+
+	go func() {
+		began := time.Now()
+		for attempt := 0; len(pending) > 0; attempt++ {
+			if time.Since(began) > maxCommitDelivery {
+				log.Printf("giving up on delivering the commit of %s to %d participants", pending[0].req.TransactionID, len(pending))
+				return
+			}
+			time.Sleep(time.Duration(10<<min(attempt, 7)) * time.Millisecond)
+
+			remaining := pending[:0]
+			for _, d := range pending {
+				if !deliverTo(d.replicas, &d.req) {
+					remaining = append(remaining, d)
+				}
+			}
+			pending = remaining
+		}
+	}()
+}
+
+// Helper function to send a commit to whichever of a shard's replicas
+// accepts it. Reports whether one did.
+func deliverTo(replicas []string, req *kvs.CommitRequest) bool {
+	for _, addr := range replicas {
+		conn, err := rpc.DialHTTP("tcp", addr)
+		if err != nil {
+			continue
+		}
+		resp := kvs.CommitResponse{}
+		err = conn.Call("KVService.Commit", req, &resp)
+		conn.Close()
+		if err != nil || resp.Status == kvs.StatusNotPrimary || resp.Status == kvs.StatusUnknown || resp.Status == kvs.StatusOutcomeUnknown {
+			continue
+		}
+		if resp.Status != kvs.StatusOK {
+			log.Printf("commit of %s at %s: %v", req.TransactionID, addr, resp.Status)
+		}
+		return true
+	}
+	return false
+}
+
+// Helper method to have the coordinator run 2PC. If the coordinator can't be
+// reached, the outcome is unknown, so the participants are left for the
+// coordinator or the servers' timeouts to finish rather than aborted here.
+func (c *Client) commitThroughCoordinator() error {
+	req := kvs.CoordinatedCommitRequest{
+		TransactionID: c.activeTransaction,
+		Participants:  c.participants,
+		Shards:        make([]string, len(c.participants)),
+	}
+	for i, participant := range c.participants {
+		req.Shards[i] = participant
+		if shard := c.shardOf(participant); shard >= 0 {
+			req.Shards[i] = strings.Join(c.replicas[shard], "|")
+		}
+	}
+	resp := kvs.CoordinatedCommitResponse{}
+	if err := c.callWithRetry(c.coordinator, "Coordinator.Commit", &req, &resp); err != nil {
+		return fmt.Errorf("%w: %v", kvs.ErrOutcomeUnknown, err)
+	}
+	return resp.Status.Err()
+}
+
+// Helper method to collect votes from every participant. A single
+// participant decides on its own when it gets the commit, so it skips this.
+func (c *Client) prepare() error {
+	if len(c.participants) < 2 {
+		return nil
+	}
+
+	for _, participant := range c.participants {
+		req := kvs.PrepareRequest{
+			TransactionID: c.activeTransaction,
+			Participants:  c.participants,
+			TraceID:       c.traceID,
+		}
+		resp := kvs.PrepareResponse{}
+		began := time.Now()
+		err := c.callPrimary(participant, "KVService.Prepare", &req, &resp, func() kvs.Status { return resp.Status })
+		c.span("Prepare", began, "server", participant, "status", resp.Status.String())
+		if err == nil {
+			err = resp.Status.Err()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Helper method to send abort for the active transaction to some participants
+func (c *Client) abortParticipants(participants []string) {
+	for i, participant := range participants {
 		req := kvs.AbortRequest{
 			TransactionID: c.activeTransaction,
 			Lead:          i == 0, // First participant is the lead
 		}
 		resp := kvs.AbortResponse{}
-		participant.Call("KVService.Abort", &req, &resp)
+		c.callPrimary(participant, "KVService.Abort", &req, &resp, func() kvs.Status { return resp.Status })
 		// Don't check for errors on abort - just try to clean up
 	}
-
-	// Clear transaction state
-	c.activeTransaction = ""
-	c.writeSet = make(map[string]string)
-	c.participants = make([]*rpc.Client, 0)
-
-	return nil
 }
 
+// Get reads a text value. See GetBytes for arbitrary binary values.
 func (client *Client) Get(key string) (string, error) {
+	value, err := client.GetBytes(key)
+	return string(value), err
+}
+
+// GetBytes reads a value. Missing keys read as an empty value.
+func (client *Client) GetBytes(key string) ([]byte, error) {
 	if client.activeTransaction == "" {
-		return "", fmt.Errorf("Cannot get: no active transaction")
+		return nil, fmt.Errorf("Cannot get: no active transaction")
 	}
 
 	// Check write set first (read own writes)
@@ -143,70 +516,170 @@ func (client *Client) Get(key string) (string, error) {
 		return value, nil
 	}
 
+	response, err := client.get(key)
+	if err != nil {
+		return nil, err
+	}
+	return response.Value, nil
+}
+
+// GetVersion reads a key along with the version of its committed value. The
+// version is zero if the key doesn't exist. If the transaction has a pending
+// write for the key, the pending value is returned with the version it will
+// replace.
+func (client *Client) GetVersion(key string) ([]byte, uint64, error) {
+	if client.activeTransaction == "" {
+		return nil, 0, fmt.Errorf("Cannot get: no active transaction")
+	}
+
+	response, err := client.get(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	return response.Value, response.Version, nil
+}
+
+// Helper method to read a key from its server under a read lock
+func (client *Client) get(key string) (kvs.GetResponse, error) {
+	defer client.latencies.record("get", time.Now())
+	response := kvs.GetResponse{}
+	if len(key) > client.maxKeySize {
+		return response, fmt.Errorf("%w: key is %d bytes (limit %d)", kvs.ErrTooLarge, len(key), client.maxKeySize)
+	}
+
 	// Determine which server to contact based on key
 	serverAddr := client.getServerForKey(key)
 	rpcClient, err := client.getConnection(serverAddr)
 	if err != nil {
-		return "", err
+		client.failover(serverAddr)
+		return response, err
 	}
 
 	// Add to participants if not already there
-	client.addParticipant(rpcClient)
+	client.addParticipant(serverAddr)
 
 	request := kvs.GetRequest{
 		Key:           key,
 		TransactionID: client.activeTransaction,
+		Epoch:         client.epoch(),
+		TraceID:       client.traceID,
 	}
-	response := kvs.GetResponse{}
+	began := time.Now()
 	err = rpcClient.Call("KVService.Get", &request, &response)
+	client.span("Get", began, "server", serverAddr, "key", key, "status", response.Status.String())
 	if err != nil {
-		return "", err
+		client.dropConnection(serverAddr)
+		client.failover(serverAddr)
+		return response, err
 	}
 
-	if response.LockFail {
-		// Lock failed, abort transaction automatically
-		// client.Abort()
-		return "", fmt.Errorf("lock failed")
+	if err := response.Status.Err(); err != nil {
+		// The caller is expected to abort the transaction. If the server
+		// wasn't the primary, the next attempt goes to the one it names, or
+		// to another replica, as it does if the server is shutting down; if
+		// the key moved, to its new owner.
+		switch response.Status {
+		case kvs.StatusNotPrimary:
+			client.redirect(serverAddr)
+		case kvs.StatusDraining:
+			client.failover(serverAddr)
+		case kvs.StatusWrongShard, kvs.StatusStaleEpoch:
+			client.refreshShardMap()
+		}
+		return response, err
 	}
 
-	return response.Value, nil
+	return response, nil
 }
 
+// Put writes a text value. See PutBytes for arbitrary binary values.
 func (client *Client) Put(key string, value string) error {
+	return client.PutBytes(key, []byte(value))
+}
+
+// PutBytes writes a value. The client keeps a reference to value until the
+// transaction ends, so callers must not modify it in the meantime.
+func (client *Client) PutBytes(key string, value []byte) error {
+	return client.PutTTL(key, value, 0)
+}
+
+// PutTTL writes a value that expires ttl after the transaction commits. Once
+// expired, reads treat the key as missing. A zero ttl never expires.
+func (client *Client) PutTTL(key string, value []byte, ttl time.Duration) error {
+	if ttl < 0 {
+		return fmt.Errorf("Cannot put: negative TTL %v", ttl)
+	}
+	return client.put(kvs.PutRequest{Key: key, Value: value, TTL: ttl})
+}
+
+// PutIfVersion writes a value only if the key's committed version still
+// equals version, as returned by GetVersion. A zero version requires that the
+// key doesn't exist yet.
+func (client *Client) PutIfVersion(key string, value []byte, version uint64) error {
+	return client.put(kvs.PutRequest{
+		Key:             key,
+		Value:           value,
+		CheckVersion:    true,
+		ExpectedVersion: version,
+	})
+}
+
+// Helper method to take a write lock and buffer a write on the key's server
+func (client *Client) put(request kvs.PutRequest) error {
+	defer client.latencies.record("put", time.Now())
 	if client.activeTransaction == "" {
 		return fmt.Errorf("Cannot put: no active transaction")
 	}
-
-	// Add to local write set (read own writes)
-	client.writeSet[key] = value
+	if len(request.Key) > client.maxKeySize {
+		return fmt.Errorf("%w: key is %d bytes (limit %d)", kvs.ErrTooLarge, len(request.Key), client.maxKeySize)
+	}
+	if len(request.Value) > client.maxValueSize {
+		return fmt.Errorf("%w: value is %d bytes (limit %d)", kvs.ErrTooLarge, len(request.Value), client.maxValueSize)
+	}
 
 	// Determine which server to contact based on key
-	serverAddr := client.getServerForKey(key)
+	serverAddr := client.getServerForKey(request.Key)
 	rpcClient, err := client.getConnection(serverAddr)
 	if err != nil {
+		client.failover(serverAddr)
 		return err
 	}
 
 	// Add to participants if not already there
-	client.addParticipant(rpcClient)
+	client.addParticipant(serverAddr)
 
-	request := kvs.PutRequest{
-		Key:           key,
-		Value:         value,
-		TransactionID: client.activeTransaction,
-	}
+	request.TransactionID = client.activeTransaction
+	request.Epoch = client.epoch()
+	request.TraceID = client.traceID
 	response := kvs.PutResponse{}
+	began := time.Now()
 	err = rpcClient.Call("KVService.Put", &request, &response)
+	client.span("Put", began, "server", serverAddr, "key", request.Key, "status", response.Status.String())
 	if err != nil {
+		client.dropConnection(serverAddr)
+		client.failover(serverAddr)
 		return err
 	}
 
-	if response.LockFail {
-		// Lock failed, abort transaction automatically
-		// client.Abort()
-		return fmt.Errorf("lock failed")
+	if err := response.Status.Err(); err != nil {
+		// The caller is expected to abort the transaction. If the server
+		// wasn't the primary, the next attempt goes to the one it names, or
+		// to another replica, as it does if the server is shutting down; if
+		// the key moved, to its new owner.
+		switch response.Status {
+		case kvs.StatusNotPrimary:
+			client.redirect(serverAddr)
+		case kvs.StatusDraining:
+			client.failover(serverAddr)
+		case kvs.StatusWrongShard, kvs.StatusStaleEpoch:
+			client.refreshShardMap()
+		}
+		return err
 	}
 
+	// Add to local write set (read own writes)
+	client.writeSet[request.Key] = request.Value
+
 	return nil
 }
 
@@ -217,31 +690,31 @@ func (client *Client) getServerForKey(key string) string {
 		return "localhost:8080" // Default for single server tests
 	}
 
-	// Simple hash-based sharding
-	hash := 0
-	for _, c := range key {
-		hash = hash*31 + int(c)
-	}
-	if hash < 0 {
-		hash = -hash
-	}
-	return client.hosts[hash%len(client.hosts)]
+	shard := client.partitioner.Shard(key)
+	return client.replicas[shard][client.primary[shard]]
 }
 
-// Helper method to add a participant if not already present
-func (client *Client) addParticipant(rpcClient *rpc.Client) {
-	// Check if this client is already in participants
-	for _, p := range client.participants {
-		if p == rpcClient {
+// Helper method to add a participant if not already present. With Raft, a
+// transaction outlives a change of leader, so a new replica of a shard that
+// is already a participant replaces the old one.
+func (client *Client) addParticipant(addr string) {
+	// Check if this server is already in participants
+	shard := client.shardOf(addr)
+	for i, p := range client.participants {
+		if p == addr {
+			return
+		}
+		if shard >= 0 && client.shardOf(p) == shard {
+			client.participants[i] = addr
 			return
 		}
 	}
-	client.participants = append(client.participants, rpcClient)
+	client.participants = append(client.participants, addr)
 }
 
-func runClient(id int, hosts []string, done *atomic.Bool, workload *kvs.Workload, resultsCh chan<- uint64) {
-	client := NewClient(hosts)
-	value := strings.Repeat("x", 128)
+func runClient(id int, newClient func() *Client, done *atomic.Bool, workload *kvs.Workload, resultsCh chan<- uint64) {
+	client := newClient()
+	value := bytes.Repeat([]byte("x"), 128)
 	const batchSize = 1024
 	const maxRetries = 100
 	opsCompleted := uint64(0)
@@ -274,7 +747,7 @@ func runClient(id int, hosts []string, done *atomic.Bool, workload *kvs.Workload
 					key := fmt.Sprintf("%d", ops[k].Key)
 					if ops[k].IsRead {
 						fmt.Printf("Client %d: Attempting Get(%s)\n", id, key)
-						_, err := client.Get(key)
+						_, err = client.Get(key)
 						if err != nil {
 							fmt.Printf("Client %d: Get(%s) failed: %v\n", id, key, err)
 							// failedAt = k
@@ -284,7 +757,7 @@ func runClient(id int, hosts []string, done *atomic.Bool, workload *kvs.Workload
 						}
 					} else {
 						fmt.Printf("Client %d: Attempting Put(%s)\n", id, key)
-						err := client.Put(key, value)
+						err = client.PutBytes(key, value)
 						if err != nil {
 							fmt.Printf("Client %d: Put(%s) failed: %v\n", id, key, err)
 							// failedAt = k
@@ -308,6 +781,14 @@ func runClient(id int, hosts []string, done *atomic.Bool, workload *kvs.Workload
 					client.Abort()
 				}
 
+				// Running the transaction again can't fix errors like an
+				// oversized value
+				var statusErr *kvs.StatusError
+				if errors.As(err, &statusErr) && !kvs.IsRetryable(err) {
+					fmt.Printf("Client %d: Giving up on transaction: %v\n", id, err)
+					break
+				}
+
 				if retryCount >= maxRetries {
 					// Skip this transaction. Usually not expected to happen
 					// unless the system is overloaded or there's a bug.
@@ -333,17 +814,38 @@ func min(a, b int) int {
 	return b
 }
 
-func runPaymentClient(id int, hosts []string, done *atomic.Bool, resultsCh chan<- uint64) {
-	client := NewClient(hosts)
+// Balances are stored as decimal text. A missing account reads as the
+// initial balance of 1000.
+func parseBalance(value []byte) int {
+	bal, err := strconv.Atoi(string(value))
+	if err != nil {
+		return 1000
+	}
+	return bal
+}
+
+func formatBalance(bal int) []byte {
+	return strconv.AppendInt(nil, int64(bal), 10)
+}
+
+func runPaymentClient(id int, newClient func() *Client, tagged bool, done *atomic.Bool, resultsCh chan<- uint64) {
+	client := newClient()
+
+	// With tags, every key shares one hash tag and one shard
+	prefix := ""
+	if tagged {
+		prefix = kvs.PaymentTag
+	}
+	account := func(i int) string { return fmt.Sprintf("%saccount_%d", prefix, i) }
 
 	// Initialize accounts if this is client 0
 	if id == 0 {
 		err := client.Begin()
 		if err == nil {
 			for i := 0; i < 10; i++ {
-				client.Put(fmt.Sprintf("account_%d", i), "1000")
+				client.PutBytes(account(i), formatBalance(1000))
 			}
-			client.Put("initialized", "true")
+			client.Put(prefix+"initialized", "true")
 			client.Commit()
 		}
 	} else {
@@ -353,7 +855,7 @@ func runPaymentClient(id int, hosts []string, done *atomic.Bool, resultsCh chan<
 			if err != nil {
 				continue
 			}
-			initializedStr, err := client.Get("initialized")
+			initializedStr, err := client.Get(prefix + "initialized")
 			client.Commit()
 			if err == nil && initializedStr == "true" {
 				break
@@ -377,18 +879,14 @@ func runPaymentClient(id int, hosts []string, done *atomic.Bool, resultsCh chan<
 
 		fmt.Printf("Payment client %d: transferring $100 from account_%d to account_%d\n", id, src, dst)
 
-		srcBalStr, err := client.Get(fmt.Sprintf("account_%d", src))
+		srcBalBytes, err := client.GetBytes(account(src))
 		if err != nil {
 			client.Abort()
 			time.Sleep(10 * time.Millisecond)
 			continue
 		}
 
-		// Convert to int (simplified)
-		srcBal := 1000 // Default value for simplicity
-		if srcBalStr != "" {
-			fmt.Sscanf(srcBalStr, "%d", &srcBal)
-		}
+		srcBal := parseBalance(srcBalBytes)
 
 		if srcBal < 100 {
 			client.Abort()
@@ -397,26 +895,23 @@ func runPaymentClient(id int, hosts []string, done *atomic.Bool, resultsCh chan<
 		}
 
 		// Update source account balance
-		err = client.Put(fmt.Sprintf("account_%d", src), fmt.Sprintf("%d", srcBal-100))
+		err = client.PutBytes(account(src), formatBalance(srcBal-100))
 		if err != nil {
 			client.Abort()
 			time.Sleep(10 * time.Millisecond)
 			continue
 		}
 
-		dstBalStr, err := client.Get(fmt.Sprintf("account_%d", dst))
+		dstBalBytes, err := client.GetBytes(account(dst))
 		if err != nil {
 			client.Abort()
 			time.Sleep(10 * time.Millisecond)
 			continue
 		}
 
-		dstBal := 1000 // Default value for simplicity
-		if dstBalStr != "" {
-			fmt.Sscanf(dstBalStr, "%d", &dstBal)
-		}
+		dstBal := parseBalance(dstBalBytes)
 
-		err = client.Put(fmt.Sprintf("account_%d", dst), fmt.Sprintf("%d", dstBal+100))
+		err = client.PutBytes(account(dst), formatBalance(dstBal+100))
 		if err != nil {
 			client.Abort()
 			time.Sleep(10 * time.Millisecond)
@@ -424,6 +919,11 @@ func runPaymentClient(id int, hosts []string, done *atomic.Bool, resultsCh chan<
 		}
 
 		err = client.Commit()
+		if errors.Is(err, kvs.ErrOutcomeUnknown) {
+			// The transfer may have happened, so it isn't counted either
+			// way; the next one starts from the balances as they are
+			fmt.Printf("Payment client %d: transfer outcome unknown: %v\n", id, err)
+		}
 		if err != nil {
 			continue
 		}
@@ -440,16 +940,13 @@ func runPaymentClient(id int, hosts []string, done *atomic.Bool, resultsCh chan<
 
 		fetchBalanceSuccess := true
 		for i := 0; i < 10; i++ {
-			balStr, err := client.Get(fmt.Sprintf("account_%d", i))
+			balBytes, err := client.GetBytes(account(i))
 			if err != nil {
 				fetchBalanceSuccess = false
 				break
 			}
 
-			bal := 1000
-			if balStr != "" {
-				fmt.Sscanf(balStr, "%d", &bal)
-			}
+			bal := parseBalance(balBytes)
 			balances[i] = bal
 			total += bal
 		}
@@ -495,22 +992,97 @@ func (h *HostList) Set(value string) error {
 func main() {
 	hosts := HostList{}
 
-	flag.Var(&hosts, "hosts", "Comma-separated list of host:ports to connect to")
+	flag.Var(&hosts, "hosts", "Comma-separated list of shards to connect to, each a |-separated list of replica host:ports")
 	theta := flag.Float64("theta", 0.99, "Zipfian distribution skew parameter")
 	workload := flag.String("workload", "YCSB-B", "Workload type (YCSB-A, YCSB-B, YCSB-C)")
 	secs := flag.Int("secs", 30, "Duration in seconds for each client to run")
+	coordinator := flag.String("coordinator", "", "host:port of a coordinator to run commits (default: clients coordinate)")
+	partitionerName := flag.String("partitioner", kvs.PartitionRing, "How keys are placed on shards: modulo, ring, range, directory, or map to load the servers' shard map")
+	vnodes := flag.Int("vnodes", kvs.DefaultVirtualNodes, "Points on the consistent hash ring per unit of shard weight")
+	weights := flag.String("weights", "", "Comma-separated weight of each shard in -hosts, in order (default: equal weights)")
+	ranges := flag.String("ranges", "", "With -partitioner range, comma-separated first key of every shard but the first")
+	directory := flag.String("directory", "", "With -partitioner directory, file of \"key shard\" lines; other keys go on the ring")
+	configAddr := flag.String("config", "", "host:port of a config service to take the shards and shard map from, instead of -hosts and -partitioner")
+	tags := flag.Bool("tags", false, "With -workload xfer, put every account under one hash tag so transactions stay on one shard")
+	tracePath := flag.String("trace", "", "Write spans of a sample of transactions to this file, in the Chrome trace-event format (default: don't trace)")
+	traceSample := flag.Float64("trace-sample", 0.01, "With -trace, the share of transactions to trace")
 	flag.Parse()
 
 	if len(hosts) == 0 {
 		hosts = append(hosts, "localhost:8080")
 	}
 
+	shardWeights, err := kvs.ParseWeights(*weights)
+	if err != nil {
+		log.Fatal(err)
+	}
+	config := kvs.PartitionerConfig{
+		Shards:       hosts,
+		Weights:      shardWeights,
+		VirtualNodes: *vnodes,
+		Directory:    *directory,
+	}
+	if *ranges != "" {
+		config.Bounds = strings.Split(*ranges, ",")
+	}
+	newClient := func() *Client {
+		client := NewClient(hosts)
+		if err := client.LoadShardMap(); err != nil {
+			log.Fatal("shard map: ", err)
+		}
+		client.UseCoordinator(*coordinator)
+		return client
+	}
+	if *partitionerName != kvs.PartitionShardMap {
+		partitioner, err := kvs.NewPartitioner(*partitionerName, config)
+		if err != nil {
+			log.Fatal(err)
+		}
+		newClient = func() *Client {
+			client := NewPartitionedClient(hosts, partitioner)
+			client.UseCoordinator(*coordinator)
+			return client
+		}
+	}
+
+	if *configAddr != "" {
+		newClient = func() *Client {
+			client, err := NewConfiguredClient(*configAddr)
+			if err != nil {
+				log.Fatal("shard map: ", err)
+			}
+			client.UseCoordinator(*coordinator)
+			return client
+		}
+		*partitionerName = kvs.PartitionShardMap
+	}
+
+	// Every client times its work in one place; the totals so far are printed
+	// every second and at the end
+	latencies := NewLatencies()
+	var tracer *kvs.Tracer
+	if *tracePath != "" {
+		hostname, _ := os.Hostname()
+		tracer, err = kvs.NewTracer(*tracePath, fmt.Sprintf("kvsclient %s:%d", hostname, os.Getpid()))
+		if err != nil {
+			log.Fatal("trace: ", err)
+		}
+	}
+	withLatencies := newClient
+	newClient = func() *Client {
+		client := withLatencies()
+		client.UseLatencies(latencies)
+		client.UseTracer(tracer, *traceSample)
+		return client
+	}
+
 	fmt.Printf(
 		"hosts %v\n"+
 			"theta %.2f\n"+
 			"workload %s\n"+
+			"partitioner %s\n"+
 			"secs %d\n",
-		hosts, *theta, *workload, *secs,
+		hosts, *theta, *workload, *partitionerName, *secs,
 	)
 
 	start := time.Now()
@@ -520,17 +1092,28 @@ func main() {
 
 	if *workload == "xfer" {
 		for clientId := 0; clientId < 10; clientId++ {
-			go runPaymentClient(clientId, hosts, &done, resultsCh)
+			go runPaymentClient(clientId, newClient, *tags, &done, resultsCh)
 		}
 	} else {
 		clientId := 0
 		go func(clientId int) {
 			workload := kvs.NewWorkload(*workload, *theta)
-			runClient(clientId, hosts, &done, workload, resultsCh)
+			runClient(clientId, newClient, &done, workload, resultsCh)
 		}(clientId)
 	}
 
-	time.Sleep(time.Duration(*secs) * time.Second)
+	deadline := start.Add(time.Duration(*secs) * time.Second)
+	prev := latencies.Snapshot()
+	for time.Until(deadline) > 0 {
+		wait := time.Until(deadline)
+		if wait > time.Second {
+			wait = time.Second
+		}
+		time.Sleep(wait)
+		now := latencies.Snapshot()
+		printLatencies(now, prev)
+		prev = now
+	}
 	done.Store(true)
 
 	opsCompleted := <-resultsCh
@@ -539,4 +1122,8 @@ func main() {
 
 	opsPerSec := float64(opsCompleted) / elapsed.Seconds()
 	fmt.Printf("throughput %.2f ops/s\n", opsPerSec)
+	printLatencies(latencies.Snapshot(), nil)
+	if err := tracer.Close(); err != nil {
+		log.Print("trace: ", err)
+	}
 }
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"net/rpc"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/rstutsman/cs6450-labs/kvs"
+)
+
+// shardMapPartitioner places keys by a shard map, numbering shards by their
+// position in the client's host list.
+type shardMapPartitioner struct {
+	m      *kvs.ShardMap
+	shards map[string]int // shard of each range owner
+}
+
+func (p *shardMapPartitioner) Shard(key string) int {
+	return p.shards[p.m.Find(key).Owner]
+}
+
+// LoadShardMap asks every shard for the ranges it owns and places keys by
+// the resulting map from then on.
+func (client *Client) LoadShardMap() error {
+	var ranges []kvs.RangeInfo
+	for _, addr := range client.primaries() {
+		resp := kvs.RangesResponse{}
+		if err := client.callWithRetry(addr, "KVService.Ranges", &kvs.RangesRequest{}, &resp); err != nil {
+			return err
+		}
+		ranges = append(ranges, resp.Ranges...)
+	}
+	m, err := kvs.NewShardMap(ranges)
+	if err != nil {
+		return err
+	}
+	return client.UseShardMap(m)
+}
+
+// NewConfiguredClient places keys by the shard map of the config service at
+// configAddr, on the shards the map lists. The map is cached and fetched
+// again whenever a server rejects a request placed by it.
+func NewConfiguredClient(configAddr string) (*Client, error) {
+	conn, err := rpc.DialHTTP("tcp", configAddr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	resp := kvs.ShardMapResponse{}
+	if err := conn.Call("Config.Map", &kvs.ShardMapRequest{}, &resp); err != nil {
+		return nil, err
+	}
+
+	client := NewPartitionedClient(resp.Map.Shards, nil)
+	client.configAddr = configAddr
+	return client, client.UseShardMap(&resp.Map)
+}
+
+// Helper method to load the shard map again after a server said it doesn't
+// own a key or that the map is stale. Without a config service, the map is
+// rebuilt from the servers' own ranges, and the old map stays if they don't
+// fit together yet, as happens for a moment while a range is handed over.
+func (client *Client) refreshShardMap() {
+	if client.configAddr == "" {
+		if client.shardMap != nil {
+			client.LoadShardMap()
+		}
+		return
+	}
+
+	resp := kvs.ShardMapResponse{}
+	if err := client.callWithRetry(client.configAddr, "Config.Map", &kvs.ShardMapRequest{}, &resp); err != nil {
+		return
+	}
+	if resp.Map.Epoch <= client.epoch() {
+		return
+	}
+	if !slices.Equal(resp.Map.Shards, client.hosts) {
+		client.setHosts(resp.Map.Shards)
+	}
+	client.UseShardMap(&resp.Map)
+}
+
+// Helper method to get the epoch to stamp requests with, which is zero
+// unless the shard map came from the config service
+func (client *Client) epoch() uint64 {
+	if client.shardMap == nil {
+		return 0
+	}
+	return client.shardMap.Epoch
+}
+
+// UseShardMap places keys by m. Every owner in m must be one of the
+// client's shards, named by its host entry or by one of its replicas.
+func (client *Client) UseShardMap(m *kvs.ShardMap) error {
+	shards := make(map[string]int)
+	for _, r := range m.Ranges {
+		shard := client.ownerShard(r.Owner)
+		if shard < 0 {
+			return fmt.Errorf("range [%q, %q) is owned by %s, which is not in the host list", r.Start, r.End, r.Owner)
+		}
+		shards[r.Owner] = shard
+	}
+	client.shardMap = m
+	client.partitioner = &shardMapPartitioner{m: m, shards: shards}
+	return nil
+}
+
+// Helper method to find the shard a range owner names, by its host entry or
+// one of its replicas, or -1
+func (client *Client) ownerShard(owner string) int {
+	if shard := slices.Index(client.hosts, owner); shard >= 0 {
+		return shard
+	}
+	return client.shardOf(owner)
+}
+
+// Scan reads up to limit keys whose placement key is in [start, end), in
+// kvs.ScanLess order, as part of the active transaction; a zero limit means
+// no limit and an empty end no upper bound. Until the transaction ends, no
+// other transaction can change the keys read or insert new ones in the span
+// they cover. With range placement, only the shards that own part of the
+// span are asked; otherwise every shard is.
+func (client *Client) Scan(start, end string, limit int) ([]kvs.ScanEntry, error) {
+	if client.activeTransaction == "" {
+		return nil, fmt.Errorf("Cannot scan: no active transaction")
+	}
+	defer client.latencies.record("scan", time.Now())
+
+	if client.shardMap == nil {
+		var entries []kvs.ScanEntry
+		for _, addr := range client.primaries() {
+			scanned, err := client.scan(addr, start, end, limit)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, scanned...)
+		}
+		sort.Slice(entries, func(i, j int) bool { return kvs.ScanLess(entries[i].Key, entries[j].Key) })
+		if limit > 0 && len(entries) > limit {
+			entries = entries[:limit]
+		}
+		return entries, nil
+	}
+
+	// Ranges are visited in key order, so their entries come out in order
+	var entries []kvs.ScanEntry
+	for _, r := range client.shardMap.Overlapping(start, end) {
+		remaining := 0
+		if limit > 0 {
+			remaining = limit - len(entries)
+		}
+		shard := client.ownerShard(r.Owner)
+		scanned, err := client.scan(client.replicas[shard][client.primary[shard]], r.Start, r.End, remaining)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, scanned...)
+		if limit > 0 && len(entries) == limit {
+			break
+		}
+	}
+	return entries, nil
+}
+
+// Helper method to scan a span on one server
+func (client *Client) scan(addr string, start, end string, limit int) ([]kvs.ScanEntry, error) {
+	rpcClient, err := client.getConnection(addr)
+	if err != nil {
+		client.failover(addr)
+		return nil, err
+	}
+
+	client.addParticipant(addr)
+
+	request := kvs.ScanRequest{
+		TransactionID: client.activeTransaction,
+		Start:         start,
+		End:           end,
+		Limit:         limit,
+		Epoch:         client.epoch(),
+	}
+	response := kvs.ScanResponse{}
+	if err := rpcClient.Call("KVService.Scan", &request, &response); err != nil {
+		client.dropConnection(addr)
+		client.failover(addr)
+		return nil, err
+	}
+
+	if err := response.Status.Err(); err != nil {
+		// The caller is expected to abort the transaction
+		switch response.Status {
+		case kvs.StatusNotPrimary:
+			client.redirect(addr)
+		case kvs.StatusDraining:
+			client.failover(addr)
+		case kvs.StatusWrongShard, kvs.StatusStaleEpoch:
+			client.refreshShardMap()
+		}
+		return nil, err
+	}
+	return response.Entries, nil
+}
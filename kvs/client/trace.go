@@ -0,0 +1,31 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/rstutsman/cs6450-labs/kvs"
+)
+
+// UseTracer has the client trace a sample of its transactions in t, each
+// with probability sample. A traced transaction's requests carry its trace
+// ID, so servers that trace record their spans of it too.
+func (client *Client) UseTracer(t *kvs.Tracer, sample float64) {
+	client.tracer = t
+	client.traceSample = sample
+}
+
+// Helper method to decide whether to trace a new transaction, and give it a
+// trace ID if so
+func (client *Client) startTrace() {
+	client.traceID = ""
+	if client.tracer != nil && rand.Float64() < client.traceSample {
+		client.traceID = kvs.NewTraceID()
+	}
+}
+
+// Helper method to record a span of the active transaction that began at
+// began and just ended. Does nothing if the transaction isn't traced.
+func (client *Client) span(name string, began time.Time, args ...string) {
+	client.tracer.Span(client.traceID, name, began, args...)
+}
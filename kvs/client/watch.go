@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"net/rpc"
+	"time"
+
+	"github.com/rstutsman/cs6450-labs/kvs"
+)
+
+// Watcher follows committed changes to a key or a key prefix. Versions are
+// assigned per server, so the watcher keeps a resume point for every server
+// it polls. A key lives on one server; a prefix can span all of them.
+type Watcher struct {
+	client       *Client
+	key          string
+	prefix       bool
+	hosts        []string
+	from         map[string]uint64 // resume version per host, once known
+	incarnations map[string]uint64 // numbering each host's resume version belongs to, once a watch returns it
+}
+
+// Watch starts watching key (or every key starting with key, if prefix is
+// set) for changes committed after fromVersion on the server that owns key,
+// such as the version GetVersion returned. A version from one server says
+// nothing about another, so any other servers a prefix spans are watched
+// from the changes they commit next. Expired keys show up as deletes.
+// Watches don't need an active transaction and don't take any locks.
+func (client *Client) Watch(key string, prefix bool, fromVersion uint64) *Watcher {
+	owner := client.getServerForKey(key)
+	hosts := client.primaries()
+	if !prefix || len(hosts) == 0 {
+		hosts = []string{owner}
+	}
+
+	w := &Watcher{
+		client:       client,
+		key:          key,
+		prefix:       prefix,
+		hosts:        hosts,
+		from:         map[string]uint64{owner: fromVersion},
+		incarnations: make(map[string]uint64),
+	}
+	for _, host := range hosts {
+		if host != owner {
+			// If the host can't be reached now, Next tries again
+			if version, err := w.currentVersion(host); err == nil {
+				w.from[host] = version
+			}
+		}
+	}
+	return w
+}
+
+// Helper method to learn the version host is at, to watch it from there
+func (w *Watcher) currentVersion(host string) (uint64, error) {
+	conn, err := w.client.getConnection(host)
+	if err != nil {
+		return 0, err
+	}
+	resp := kvs.PingResponse{}
+	if err := conn.Call("KVService.Ping", &kvs.PingRequest{}, &resp); err != nil {
+		w.client.dropConnection(host)
+		return 0, err
+	}
+	return resp.Version, nil
+}
+
+// Next waits up to timeout for changes and returns them in commit order per
+// server. It returns no events and no error if nothing changed in time.
+func (w *Watcher) Next(timeout time.Duration) ([]kvs.WatchEvent, error) {
+	calls := make([]*rpc.Call, len(w.hosts))
+	for i, host := range w.hosts {
+		if _, known := w.from[host]; !known {
+			version, err := w.currentVersion(host)
+			if err != nil {
+				return nil, err
+			}
+			w.from[host] = version
+		}
+		conn, err := w.client.getConnection(host)
+		if err != nil {
+			return nil, err
+		}
+		req := &kvs.WatchRequest{
+			Key:         w.key,
+			Prefix:      w.prefix,
+			FromVersion: w.from[host],
+			Incarnation: w.incarnations[host],
+			Timeout:     timeout,
+		}
+		calls[i] = conn.Go("KVService.Watch", req, &kvs.WatchResponse{}, nil)
+	}
+
+	events := []kvs.WatchEvent{}
+	var err error
+	for i, call := range calls {
+		<-call.Done
+		if call.Error != nil {
+			err = call.Error
+			continue
+		}
+		resp := call.Reply.(*kvs.WatchResponse)
+		host := w.hosts[i]
+		if resp.Compacted {
+			// The resume point still moves ahead below, so the caller can
+			// resync its state and keep watching
+			err = fmt.Errorf("watch on %s: changes after version %d were compacted", host, w.from[host])
+		}
+		events = append(events, resp.Events...)
+		w.from[host] = resp.Version
+		w.incarnations[host] = resp.Incarnation
+	}
+	return events, err
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/rpc"
+	"sync"
+	"testing"
+
+	"github.com/rstutsman/cs6450-labs/kvs"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeServer stands in for a server. It records the ranges and epoch it is
+// assigned and the ranges it is asked to migrate.
+type fakeServer struct {
+	sync.Mutex
+	ranges   []kvs.RangeInfo
+	epoch    uint64
+	migrated []kvs.MigrateRequest
+	hot      []kvs.HotKey
+}
+
+func (f *fakeServer) Ranges(req *kvs.RangesRequest, resp *kvs.RangesResponse) error {
+	f.Lock()
+	defer f.Unlock()
+	resp.Ranges = f.ranges
+	resp.Epoch = f.epoch
+	return nil
+}
+
+func (f *fakeServer) AssignRanges(req *kvs.AssignRangesRequest, resp *kvs.AssignRangesResponse) error {
+	f.Lock()
+	defer f.Unlock()
+	f.ranges = req.Ranges
+	f.epoch = req.Epoch
+	resp.Status = kvs.StatusOK
+	return nil
+}
+
+func (f *fakeServer) MigrateRange(req *kvs.MigrateRequest, resp *kvs.MigrateResponse) error {
+	f.Lock()
+	defer f.Unlock()
+	f.migrated = append(f.migrated, *req)
+	resp.Keys = 7
+	resp.Status = kvs.StatusOK
+	return nil
+}
+
+func (f *fakeServer) HotKeys(req *kvs.HotKeysRequest, resp *kvs.HotKeysResponse) error {
+	f.Lock()
+	defer f.Unlock()
+	resp.Keys = f.hot
+	return nil
+}
+
+func (f *fakeServer) assigned() ([]kvs.RangeInfo, uint64) {
+	f.Lock()
+	defer f.Unlock()
+	return f.ranges, f.epoch
+}
+
+func startFakeServer(t *testing.T) (*fakeServer, string) {
+	fake := &fakeServer{}
+	server := rpc.NewServer()
+	server.RegisterName("KVService", fake)
+	l, err := net.Listen("tcp", "localhost:0")
+	assert.Nil(t, err)
+	go http.Serve(l, server)
+	t.Cleanup(func() { l.Close() })
+	return fake, l.Addr().String()
+}
+
+func startConfigService(t *testing.T, dir string, shards []string) *ConfigService {
+	partitioner, err := kvs.NewRangePartitioner([]string{"m"}, 2)
+	assert.Nil(t, err)
+	initial := partitioner.ShardMap(shards)
+	initial.Epoch = 1
+	initial.Shards = shards
+	c, err := NewConfigService(dir, initial)
+	assert.Nil(t, err)
+	return c
+}
+
+func TestSyncAssignsRanges(t *testing.T) {
+	a, addrA := startFakeServer(t)
+	b, addrB := startFakeServer(t)
+	c := startConfigService(t, t.TempDir(), []string{addrA, addrB})
+
+	c.syncServers()
+	ranges, epoch := a.assigned()
+	assert.Equal(t, uint64(1), epoch)
+	assert.Equal(t, []kvs.RangeInfo{{End: "m", Owner: addrA}}, ranges)
+	ranges, epoch = b.assigned()
+	assert.Equal(t, uint64(1), epoch)
+	assert.Equal(t, []kvs.RangeInfo{{Start: "m", Owner: addrB}}, ranges)
+}
+
+func TestMovePublishesNewEpoch(t *testing.T) {
+	a, addrA := startFakeServer(t)
+	b, addrB := startFakeServer(t)
+	dir := t.TempDir()
+	c := startConfigService(t, dir, []string{addrA, addrB})
+	c.syncServers()
+
+	resp := kvs.MoveRangeResponse{}
+	assert.Nil(t, c.Move(&kvs.MoveRangeRequest{Start: "g", End: "m", Target: addrB}, &resp))
+	assert.Equal(t, kvs.StatusOK, resp.Status)
+	assert.Equal(t, uint64(2), resp.Epoch)
+	assert.Equal(t, 7, resp.Keys)
+
+	// The owner was asked to migrate to the target's primary
+	assert.Equal(t, []kvs.MigrateRequest{{Start: "g", End: "m", Target: addrB}}, a.migrated)
+
+	// Both shards learned the new map
+	ranges, epoch := a.assigned()
+	assert.Equal(t, uint64(2), epoch)
+	assert.Equal(t, []kvs.RangeInfo{{End: "g", Owner: addrA}}, ranges)
+	ranges, epoch = b.assigned()
+	assert.Equal(t, uint64(2), epoch)
+	assert.Equal(t, []kvs.RangeInfo{{Start: "g", Owner: addrB}}, ranges)
+
+	// Spans owned by more than one shard, or already owned, can't move
+	assert.NotNil(t, c.Move(&kvs.MoveRangeRequest{Start: "a", End: "z", Target: addrA}, &resp))
+	assert.NotNil(t, c.Move(&kvs.MoveRangeRequest{Start: "x", End: "z", Target: addrB}, &resp))
+	assert.NotNil(t, c.Move(&kvs.MoveRangeRequest{Start: "a", End: "b", Target: "elsewhere:1"}, &resp))
+
+	// The map survives a restart
+	restarted := startConfigService(t, dir, []string{addrA, addrB})
+	mapResp := kvs.ShardMapResponse{}
+	assert.Nil(t, restarted.Map(&kvs.ShardMapRequest{}, &mapResp))
+	assert.Equal(t, uint64(2), mapResp.Map.Epoch)
+	assert.Equal(t, []string{addrA, addrB}, mapResp.Map.Shards)
+	assert.Equal(t, "g", mapResp.Map.Find("h").Start)
+	assert.Equal(t, addrB, mapResp.Map.Find("h").Owner)
+}
+
+func TestIsolateHotKeys(t *testing.T) {
+	a, addrA := startFakeServer(t)
+	_, addrB := startFakeServer(t)
+	hot, addrHot := startFakeServer(t)
+	c := startConfigService(t, t.TempDir(), []string{addrA, addrB})
+	c.m.Shards = append(c.m.Shards, addrHot)
+	c.hotShard = addrHot
+	c.syncServers()
+
+	a.hot = []kvs.HotKey{{Key: "{acct}:balance", Hot: true}, {Key: "cold"}}
+	c.isolateHotKeys()
+
+	// Only the hot key's tag moved, in a range of its own
+	assert.Equal(t, []kvs.MigrateRequest{{Start: "acct", End: "acct\x00", Target: addrHot}}, a.migrated)
+	assert.Equal(t, addrHot, c.m.Find("{acct}:balance").Owner)
+	assert.Equal(t, addrHot, c.m.Find("acct").Owner)
+	assert.Equal(t, addrA, c.m.Find("acct0").Owner)
+	assert.Equal(t, addrA, c.m.Find("cold").Owner)
+	ranges, epoch := hot.assigned()
+	assert.Equal(t, uint64(2), epoch)
+	assert.Equal(t, []kvs.RangeInfo{{Start: "acct", End: "acct\x00", Owner: addrHot}}, ranges)
+
+	// A key that already moved isn't moved again
+	c.isolateHotKeys()
+	assert.Equal(t, 1, len(a.migrated))
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rstutsman/cs6450-labs/kvs"
+)
+
+// ConfigService stores the cluster's shard map and hands it to clients. It
+// pushes every shard's ranges, stamped with the map's epoch, to the shard's
+// primary, so servers can reject requests placed by an older map. Every
+// change to the map goes through Move, which bumps the epoch.
+type ConfigService struct {
+	sync.Mutex
+	m        *kvs.ShardMap
+	path     string // where the map is saved
+	peers    *kvs.Peers
+	hotShard string // shard that hot keys are moved to; empty means they stay put
+
+	moving sync.Mutex // held while a range moves, so moves run one at a time
+}
+
+// NewConfigService loads the shard map saved in dir, or starts with initial
+// if there is none.
+func NewConfigService(dir string, initial *kvs.ShardMap) (*ConfigService, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	c := &ConfigService{m: initial, path: filepath.Join(dir, "shardmap.json"), peers: kvs.NewPeers()}
+
+	data, err := os.ReadFile(c.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, c.save()
+	}
+	if err != nil {
+		return nil, err
+	}
+	saved := &kvs.ShardMap{}
+	if err := json.Unmarshal(data, saved); err != nil {
+		return nil, fmt.Errorf("%s: %w", c.path, err)
+	}
+	if _, err := kvs.NewShardMap(saved.Ranges); err != nil {
+		return nil, fmt.Errorf("%s: %w", c.path, err)
+	}
+	c.m = saved
+	return c, nil
+}
+
+// Helper method to durably write the map to disk, replacing the saved one
+// only once the new one is complete. Must hold c's lock.
+func (c *ConfigService) save() error {
+	data, err := json.MarshalIndent(c.m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return kvs.WriteFileAtomic(c.path, data)
+}
+
+// Map returns the current shard map.
+func (c *ConfigService) Map(req *kvs.ShardMapRequest, resp *kvs.ShardMapResponse) error {
+	c.Lock()
+	defer c.Unlock()
+
+	resp.Map = *c.m
+	return nil
+}
+
+// Move has the shard that owns [Start, End) migrate it to the shard Target,
+// then publishes a map with the range moved.
+func (c *ConfigService) Move(req *kvs.MoveRangeRequest, resp *kvs.MoveRangeResponse) error {
+	c.moving.Lock()
+	defer c.moving.Unlock()
+
+	c.Lock()
+	m := c.m
+	c.Unlock()
+
+	if !slices.Contains(m.Shards, req.Target) {
+		return fmt.Errorf("%s is not a shard", req.Target)
+	}
+	if req.End != "" && req.End <= req.Start {
+		return fmt.Errorf("[%q, %q) is empty", req.Start, req.End)
+	}
+	overlapping := m.Overlapping(req.Start, req.End)
+	source := overlapping[0].Owner
+	for _, r := range overlapping {
+		if r.Owner != source {
+			return fmt.Errorf("[%q, %q) is owned by more than one shard", req.Start, req.End)
+		}
+	}
+	if source == req.Target {
+		return fmt.Errorf("[%q, %q) is already owned by %s", req.Start, req.End, req.Target)
+	}
+
+	from, err := c.primaryOf(source)
+	if err != nil {
+		return err
+	}
+	to, err := c.primaryOf(req.Target)
+	if err != nil {
+		return err
+	}
+	migrateReq := kvs.MigrateRequest{Start: req.Start, End: req.End, Target: to, FenceTimeout: req.FenceTimeout}
+	migrateResp := kvs.MigrateResponse{}
+	if err := c.peers.Call(from, "KVService.MigrateRange", &migrateReq, &migrateResp); err != nil {
+		return err
+	}
+	resp.Status = migrateResp.Status
+	resp.Keys = migrateResp.Keys
+	resp.CaughtUp = migrateResp.CaughtUp
+	if migrateResp.Status != kvs.StatusOK {
+		return nil
+	}
+
+	c.Lock()
+	c.m = m.Assign(req.Start, req.End, req.Target)
+	resp.Epoch = c.m.Epoch
+	err = c.save()
+	c.Unlock()
+	if err != nil {
+		return err
+	}
+
+	c.syncServers()
+	return nil
+}
+
+// Helper method to find the primary of the shard with host entry shard
+func (c *ConfigService) primaryOf(shard string) (string, error) {
+	replicas := strings.Split(shard, "|")
+	if len(replicas) == 1 {
+		return replicas[0], nil
+	}
+	for _, addr := range replicas {
+		resp := kvs.PingResponse{}
+		if err := c.peers.Call(addr, "KVService.Ping", &kvs.PingRequest{}, &resp); err != nil {
+			continue
+		}
+		if resp.Role == kvs.RolePrimary {
+			return addr, nil
+		}
+		if slices.Contains(replicas, resp.Primary) {
+			return resp.Primary, nil
+		}
+	}
+	return "", fmt.Errorf("no primary found for %s", shard)
+}
+
+// Helper method to assign every shard whose primary hasn't seen the current
+// epoch its ranges in the current map. Shards that can't be reached are
+// tried again on the next call.
+func (c *ConfigService) syncServers() {
+	c.Lock()
+	m := c.m
+	c.Unlock()
+
+	for _, shard := range m.Shards {
+		addr, err := c.primaryOf(shard)
+		if err != nil {
+			continue
+		}
+		rangesResp := kvs.RangesResponse{}
+		if err := c.peers.Call(addr, "KVService.Ranges", &kvs.RangesRequest{}, &rangesResp); err != nil {
+			continue
+		}
+		if rangesResp.Epoch >= m.Epoch {
+			continue
+		}
+		assignReq := kvs.AssignRangesRequest{Ranges: m.Owned(shard), Epoch: m.Epoch}
+		assignResp := kvs.AssignRangesResponse{}
+		if err := c.peers.Call(addr, "KVService.AssignRanges", &assignReq, &assignResp); err != nil {
+			log.Printf("assigning ranges to %s: %v", addr, err)
+		} else if err := assignResp.Status.Err(); err != nil {
+			log.Printf("assigning ranges to %s: %v", addr, err)
+		}
+	}
+}
+
+// Number of each shard's most accessed keys checked for hot ones
+const hotKeysChecked = 10
+
+// Helper method to move every key a shard reports as hot to the hot shard,
+// in a range of its own, so its traffic no longer competes with the shard's
+// other keys. Keys with a hash tag move along with the rest of their tag.
+func (c *ConfigService) isolateHotKeys() {
+	c.Lock()
+	m := c.m
+	c.Unlock()
+
+	for _, shard := range m.Shards {
+		if shard == c.hotShard {
+			continue
+		}
+		addr, err := c.primaryOf(shard)
+		if err != nil {
+			continue
+		}
+		resp := kvs.HotKeysResponse{}
+		if err := c.peers.Call(addr, "KVService.HotKeys", &kvs.HotKeysRequest{N: hotKeysChecked}, &resp); err != nil {
+			continue
+		}
+		for _, key := range resp.Keys {
+			// The shard may still count keys it no longer owns
+			start := kvs.HashTag(key.Key)
+			if !key.Hot || m.Find(start).Owner != shard {
+				continue
+			}
+			req := kvs.MoveRangeRequest{Start: start, End: start + "\x00", Target: c.hotShard}
+			moveResp := kvs.MoveRangeResponse{}
+			if err := c.Move(&req, &moveResp); err != nil {
+				log.Printf("moving hot key %q to %s: %v", start, c.hotShard, err)
+			} else if err := moveResp.Status.Err(); err != nil {
+				log.Printf("moving hot key %q to %s: %v", start, c.hotShard, err)
+			} else {
+				log.Printf("moved hot key %q to %s, shard map epoch %d", start, c.hotShard, moveResp.Epoch)
+			}
+
+			c.Lock()
+			m = c.m
+			c.Unlock()
+		}
+	}
+}
+
+func main() {
+	port := flag.String("port", "8060", "Port to run the config service on")
+	dataDir := flag.String("data-dir", "", "Directory for the shard map (default kvsdata-config-<port>)")
+	shards := flag.String("shards", "localhost:8080", "Comma-separated list of shards, each a host:port or replicas joined by | (used only when no map is saved yet)")
+	bounds := flag.String("ranges", "", "Comma-separated first key of every shard's range but the first's (used only when no map is saved yet)")
+	hotShard := flag.String("hot-shard", "", "Shard to move keys that servers report as hot to; it gets no ranges of its own in a new map (default: hot keys stay put)")
+	syncInterval := flag.Duration("sync-interval", time.Second, "How often to push the map to servers that haven't seen its epoch")
+	flag.Parse()
+
+	if *dataDir == "" {
+		*dataDir = fmt.Sprintf("kvsdata-config-%s", *port)
+	}
+
+	hosts := strings.Split(*shards, ",")
+	var rangeBounds []string
+	if *bounds != "" {
+		rangeBounds = strings.Split(*bounds, ",")
+	}
+	partitioner, err := kvs.NewRangePartitioner(rangeBounds, len(hosts))
+	if err != nil {
+		log.Fatal(err)
+	}
+	initial := partitioner.ShardMap(hosts)
+	initial.Epoch = 1
+	initial.Shards = hosts
+	if *hotShard != "" {
+		if slices.Contains(hosts, *hotShard) {
+			log.Fatalf("-hot-shard %s is also in -shards", *hotShard)
+		}
+		initial.Shards = append(initial.Shards, *hotShard)
+	}
+
+	config, err := NewConfigService(*dataDir, initial)
+	if err != nil {
+		log.Fatal("shard map: ", err)
+	}
+	config.hotShard = *hotShard
+	rpc.RegisterName("Config", config)
+	rpc.HandleHTTP()
+
+	l, e := net.Listen("tcp", fmt.Sprintf(":%v", *port))
+	if e != nil {
+		log.Fatal("listen error:", e)
+	}
+
+	fmt.Printf("Starting KVS config service on :%s\n", *port)
+
+	go func() {
+		for {
+			config.syncServers()
+			if config.hotShard != "" {
+				config.isolateHotKeys()
+			}
+			time.Sleep(*syncInterval)
+		}
+	}()
+
+	http.Serve(l, nil)
+}
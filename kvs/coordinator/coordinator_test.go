@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/rpc"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rstutsman/cs6450-labs/kvs"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeParticipant stands in for a server. It votes with vote and records
+// the decision it is sent for each transaction.
+type fakeParticipant struct {
+	sync.Mutex
+	vote      kvs.Status
+	decisions map[string]string
+	primary   string // once set, the participant has failed over to this replica
+}
+
+func (f *fakeParticipant) Prepare(req *kvs.PrepareRequest, resp *kvs.PrepareResponse) error {
+	f.Lock()
+	defer f.Unlock()
+	resp.Status = f.vote
+	if f.primary != "" {
+		resp.Status = kvs.StatusNotPrimary
+	}
+	return nil
+}
+
+func (f *fakeParticipant) Commit(req *kvs.CommitRequest, resp *kvs.CommitResponse) error {
+	f.Lock()
+	defer f.Unlock()
+	if f.primary != "" {
+		resp.Status = kvs.StatusNotPrimary
+		return nil
+	}
+	f.decisions[req.TransactionID] = kvs.TxCommitted
+	resp.Status = kvs.StatusOK
+	return nil
+}
+
+func (f *fakeParticipant) Abort(req *kvs.AbortRequest, resp *kvs.AbortResponse) error {
+	f.Lock()
+	defer f.Unlock()
+	if f.primary != "" {
+		resp.Status = kvs.StatusNotPrimary
+		return nil
+	}
+	f.decisions[req.TransactionID] = kvs.TxAborted
+	resp.Status = kvs.StatusOK
+	return nil
+}
+
+func (f *fakeParticipant) Ping(req *kvs.PingRequest, resp *kvs.PingResponse) error {
+	f.Lock()
+	defer f.Unlock()
+	resp.Role = kvs.RolePrimary
+	if f.primary != "" {
+		resp.Role = kvs.RoleBackup
+		resp.Primary = f.primary
+	}
+	return nil
+}
+
+func (f *fakeParticipant) failOver(primary string) {
+	f.Lock()
+	defer f.Unlock()
+	f.primary = primary
+}
+
+func (f *fakeParticipant) decision(txID string) string {
+	f.Lock()
+	defer f.Unlock()
+	return f.decisions[txID]
+}
+
+func startFakeParticipant(t *testing.T, vote kvs.Status) (*fakeParticipant, string) {
+	participant := &fakeParticipant{vote: vote, decisions: make(map[string]string)}
+	server := rpc.NewServer()
+	server.RegisterName("KVService", participant)
+	l, err := net.Listen("tcp", "localhost:0")
+	assert.Nil(t, err)
+	go http.Serve(l, server)
+	t.Cleanup(func() { l.Close() })
+	return participant, l.Addr().String()
+}
+
+func TestCommitWhenAllVoteYes(t *testing.T) {
+	a, addrA := startFakeParticipant(t, kvs.StatusOK)
+	b, addrB := startFakeParticipant(t, kvs.StatusOK)
+	c, err := NewCoordinator("localhost:0", t.TempDir(), false)
+	assert.Nil(t, err)
+
+	req := kvs.CoordinatedCommitRequest{TransactionID: "tx-yes", Participants: []string{addrA, addrB}}
+	resp := kvs.CoordinatedCommitResponse{}
+	assert.Nil(t, c.Commit(&req, &resp))
+	assert.Equal(t, kvs.StatusOK, resp.Status)
+	assert.Equal(t, kvs.TxCommitted, a.decision("tx-yes"))
+	assert.Equal(t, kvs.TxCommitted, b.decision("tx-yes"))
+
+	// A retried request gets the same answer
+	resp = kvs.CoordinatedCommitResponse{}
+	assert.Nil(t, c.Commit(&req, &resp))
+	assert.Equal(t, kvs.StatusOK, resp.Status)
+}
+
+func TestAbortWhenOneVotesNo(t *testing.T) {
+	a, addrA := startFakeParticipant(t, kvs.StatusOK)
+	b, addrB := startFakeParticipant(t, kvs.StatusTransactionExpired)
+	c, err := NewCoordinator("localhost:0", t.TempDir(), false)
+	assert.Nil(t, err)
+
+	req := kvs.CoordinatedCommitRequest{TransactionID: "tx-no", Participants: []string{addrA, addrB}}
+	resp := kvs.CoordinatedCommitResponse{}
+	assert.Nil(t, c.Commit(&req, &resp))
+	assert.Equal(t, kvs.StatusTransactionExpired, resp.Status)
+	assert.Equal(t, kvs.TxAborted, a.decision("tx-no"))
+	assert.Equal(t, kvs.TxAborted, b.decision("tx-no"))
+}
+
+func TestRecoveryFinishesDecisions(t *testing.T) {
+	a, addrA := startFakeParticipant(t, kvs.StatusOK)
+	dir := t.TempDir()
+
+	// Leave one transaction decided but unsent and another still voting, the
+	// way a crash would
+	decisions, err := kvs.OpenLog(dir+"/decisions.log", false)
+	assert.Nil(t, err)
+	decisions.Append(logRecord{TxID: "tx-decided", Type: recordStart, Participants: []string{addrA}})
+	decisions.Append(logRecord{TxID: "tx-decided", Type: recordDecision, Outcome: kvs.TxCommitted})
+	decisions.Append(logRecord{TxID: "tx-voting", Type: recordStart, Participants: []string{addrA}})
+	decisions.Close()
+
+	c, err := NewCoordinator("localhost:0", dir, false)
+	assert.Nil(t, err)
+	c.resendDecisions()
+	assert.Equal(t, kvs.TxCommitted, a.decision("tx-decided"))
+	assert.Equal(t, kvs.TxAborted, a.decision("tx-voting"))
+
+	// Both are marked as ended, so a second restart has nothing to resend
+	c, err = NewCoordinator("localhost:0", dir, false)
+	assert.Nil(t, err)
+	for _, id := range []string{"tx-decided", "tx-voting"} {
+		assert.True(t, c.transactions[id].ended, id)
+	}
+}
+
+func TestTxStatusPresumesAbort(t *testing.T) {
+	c, err := NewCoordinator("localhost:0", t.TempDir(), false)
+	assert.Nil(t, err)
+
+	resp := kvs.TxStatusResponse{}
+	assert.Nil(t, c.TxStatus(&kvs.TxStatusRequest{TransactionID: "tx-unknown"}, &resp))
+	assert.Equal(t, kvs.TxAborted, resp.State)
+
+	// A commit request arriving late can't override the decision
+	commitResp := kvs.CoordinatedCommitResponse{}
+	done := make(chan struct{})
+	go func() {
+		c.Commit(&kvs.CoordinatedCommitRequest{TransactionID: "tx-unknown"}, &commitResp)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("commit never returned")
+	}
+	assert.Equal(t, kvs.StatusTransactionAborted, commitResp.Status)
+}
+
+func TestForgetEnded(t *testing.T) {
+	dir := t.TempDir()
+	decisions, err := kvs.OpenLog(dir+"/decisions.log", false)
+	assert.Nil(t, err)
+	for i := 0; i < minCompaction; i++ {
+		txID := fmt.Sprintf("tx%d", i)
+		decisions.Append(logRecord{TxID: txID, Type: recordStart, Participants: []string{"localhost:1"}})
+		decisions.Append(logRecord{TxID: txID, Type: recordDecision, Outcome: kvs.TxCommitted})
+		decisions.Append(logRecord{TxID: txID, Type: recordEnd})
+	}
+	// Still waiting for its participant
+	decisions.Append(logRecord{TxID: "tx-pending", Type: recordStart, Participants: []string{"localhost:1"}})
+	decisions.Append(logRecord{TxID: "tx-pending", Type: recordDecision, Outcome: kvs.TxCommitted})
+	decisions.Close()
+
+	c, err := NewCoordinator("localhost:0", dir, false)
+	assert.Nil(t, err)
+	c.retention = time.Minute
+	for _, tx := range c.transactions {
+		tx.endedAt = time.Now().Add(-time.Hour)
+	}
+	c.transactions["tx0"].endedAt = time.Now()
+
+	c.forgetEnded()
+	assert.Equal(t, 2, len(c.transactions))
+	assert.Equal(t, 5, c.logged)
+
+	// Only what's kept comes back after a restart
+	c, err = NewCoordinator("localhost:0", dir, false)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(c.transactions))
+	assert.True(t, c.transactions["tx0"].ended)
+	assert.False(t, c.transactions["tx-pending"].ended)
+	assert.Equal(t, kvs.TxCommitted, c.transactions["tx-pending"].outcome)
+}
+
+func TestFollowsParticipantFailover(t *testing.T) {
+	a, addrA := startFakeParticipant(t, kvs.StatusOK)
+	a2, addrA2 := startFakeParticipant(t, kvs.StatusOK)
+	b2, addrB2 := startFakeParticipant(t, kvs.StatusOK)
+	a.failOver(addrA2)
+	dead, err := net.Listen("tcp", "localhost:0")
+	assert.Nil(t, err)
+	addrB := dead.Addr().String()
+	dead.Close()
+	c, err := NewCoordinator("localhost:0", t.TempDir(), false)
+	assert.Nil(t, err)
+
+	// One participant stepped down and names its successor, the other is
+	// down and its shard's other replica took over
+	req := kvs.CoordinatedCommitRequest{
+		TransactionID: "tx-failover",
+		Participants:  []string{addrA, addrB},
+		Shards:        []string{addrA + "|" + addrA2, addrB + "|" + addrB2},
+	}
+	resp := kvs.CoordinatedCommitResponse{}
+	assert.Nil(t, c.Commit(&req, &resp))
+	assert.Equal(t, kvs.StatusOK, resp.Status)
+	assert.Equal(t, kvs.TxCommitted, a2.decision("tx-failover"))
+	assert.Equal(t, kvs.TxCommitted, b2.decision("tx-failover"))
+	assert.True(t, c.transactions["tx-failover"].ended)
+}
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rstutsman/cs6450-labs/kvs"
+)
+
+// Types of records in the decision log.
+const (
+	recordStart    = "start"    // votes are being collected from Participants
+	recordDecision = "decision" // Outcome is final
+	recordEnd      = "end"      // every participant has applied Outcome
+)
+
+type logRecord struct {
+	TxID         string   `json:"txid"`
+	Type         string   `json:"type"`
+	Participants []string `json:"participants,omitempty"`
+	Shards       []string `json:"shards,omitempty"`
+	Outcome      string   `json:"outcome,omitempty"`
+}
+
+type transaction struct {
+	id           string
+	participants []string
+	shards       []string      // each participant's host entry, if the client sent them
+	outcome      string        // kvs.TxCommitted or kvs.TxAborted once decided
+	reason       kvs.Status    // why the transaction aborted
+	decided      chan struct{} // closed once outcome is set
+	decidedAt    time.Time
+	ended        bool      // every participant has applied the outcome
+	endedAt      time.Time // when it ended, or when the log was replayed
+}
+
+const (
+	defaultRetention = 10 * time.Minute
+	minCompaction    = 1000 // don't compact a log with fewer forgotten records than this
+)
+
+func newTransaction(id string, participants []string) *transaction {
+	return &transaction{id: id, participants: participants, decided: make(chan struct{})}
+}
+
+// Coordinator runs two-phase commit on behalf of clients. Clients still send
+// Get and Put straight to the servers and hand the coordinator the
+// participant list when they commit. The coordinator logs its decision before
+// telling anyone, and after a restart it finishes every transaction it had
+// decided and aborts every one it hadn't, so a client that crashes during
+// commit can't leave locks held.
+type Coordinator struct {
+	sync.Mutex
+	addr          string // this coordinator's address as servers know it
+	transactions  map[string]*transaction
+	log           *kvs.Log
+	logged        int // records in the log, including those of forgotten transactions
+	peers         *kvs.Peers
+	retryInterval time.Duration     // how long to wait before resending a decision
+	retention     time.Duration     // how long to remember an ended transaction; 0 means forever
+	primaries     map[string]string // the last known primary of each shard by host entry, once a participant has failed over
+}
+
+// NewCoordinator loads the decision log in dir and aborts every transaction
+// that was still collecting votes when the coordinator last stopped.
+func NewCoordinator(addr string, dir string, sync bool) (*Coordinator, error) {
+	c := &Coordinator{
+		addr:          addr,
+		transactions:  make(map[string]*transaction),
+		peers:         kvs.NewPeers(),
+		primaries:     make(map[string]string),
+		retryInterval: time.Second,
+		retention:     defaultRetention,
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, "decisions.log")
+
+	now := time.Now()
+	err := kvs.ReplayLog(path, func(line []byte) error {
+		var record logRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		c.logged++
+		tx, exists := c.transactions[record.TxID]
+		if !exists {
+			tx = newTransaction(record.TxID, nil)
+			c.transactions[record.TxID] = tx
+		}
+		switch record.Type {
+		case recordStart:
+			tx.participants = record.Participants
+			tx.shards = record.Shards
+		case recordDecision:
+			tx.outcome = record.Outcome
+			tx.reason = kvs.StatusTransactionAborted
+			close(tx.decided)
+		case recordEnd:
+			tx.ended = true
+			tx.endedAt = now
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	c.log, err = kvs.OpenLog(path, sync)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Lock()
+	for _, tx := range c.transactions {
+		if tx.outcome == "" {
+			c.decide(tx, kvs.TxAborted, kvs.StatusTransactionAborted)
+			tx.decidedAt = time.Time{} // nobody is sending it yet, so resend right away
+		}
+	}
+	c.Unlock()
+	c.syncDecisions()
+	return c, nil
+}
+
+// Commit runs 2PC for a transaction and returns once the outcome is decided.
+// Participants that can't be reached yet are told later.
+func (c *Coordinator) Commit(req *kvs.CoordinatedCommitRequest, resp *kvs.CoordinatedCommitResponse) error {
+	c.Lock()
+	tx, exists := c.transactions[req.TransactionID]
+	if !exists {
+		tx = newTransaction(req.TransactionID, req.Participants)
+		if len(req.Shards) == len(req.Participants) {
+			tx.shards = req.Shards
+		}
+		record := logRecord{TxID: tx.id, Type: recordStart, Participants: tx.participants, Shards: tx.shards}
+		if err := c.log.Write(record); err != nil {
+			c.Unlock()
+			return err
+		}
+		c.logged++
+		c.transactions[tx.id] = tx
+	}
+	c.Unlock()
+
+	// A repeated request waits for the first one to decide
+	if !exists {
+		c.syncDecisions()
+		reason := c.prepare(tx)
+		outcome := kvs.TxCommitted
+		if reason != kvs.StatusOK {
+			outcome = kvs.TxAborted
+		}
+
+		c.Lock()
+		c.decide(tx, outcome, reason)
+		c.Unlock()
+
+		c.syncDecisions()
+		c.finish(tx)
+	}
+
+	<-tx.decided
+	c.syncDecisions()
+	if tx.outcome == kvs.TxCommitted {
+		resp.Status = kvs.StatusOK
+	} else {
+		resp.Status = tx.reason
+	}
+	return nil
+}
+
+// TxStatus tells a prepared participant the outcome of a transaction. A
+// transaction the coordinator has never heard of can't have committed, so it
+// is aborted on the spot.
+func (c *Coordinator) TxStatus(req *kvs.TxStatusRequest, resp *kvs.TxStatusResponse) error {
+	defer c.syncDecisions()
+	c.Lock()
+	defer c.Unlock()
+
+	tx, exists := c.transactions[req.TransactionID]
+	if !exists {
+		tx = newTransaction(req.TransactionID, nil)
+		c.transactions[tx.id] = tx
+		c.decide(tx, kvs.TxAborted, kvs.StatusTransactionAborted)
+	}
+
+	if tx.outcome == "" {
+		resp.State = kvs.TxActive
+	} else {
+		resp.State = tx.outcome
+	}
+	return nil
+}
+
+// Helper method to collect a vote from every participant. Returns StatusOK
+// if they all voted to commit, otherwise the reason to abort.
+func (c *Coordinator) prepare(tx *transaction) kvs.Status {
+	for i, participant := range tx.participants {
+		req := kvs.PrepareRequest{
+			TransactionID: tx.id,
+			Participants:  tx.participants,
+			Coordinator:   c.addr,
+		}
+		resp := kvs.PrepareResponse{}
+		status := func() kvs.Status { return resp.Status }
+		if err := c.callParticipant(tx, i, "KVService.Prepare", &req, &resp, status); err != nil {
+			log.Printf("prepare %s at %s: %v", tx.id, participant, err)
+			return kvs.StatusTransactionAborted
+		}
+		if resp.Status != kvs.StatusOK {
+			return resp.Status
+		}
+	}
+	return kvs.StatusOK
+}
+
+// Helper method to record the outcome of a transaction before anyone is told
+// about it. The decision is written to the log, but only durable once the
+// caller has released c's lock and called syncDecisions. Must hold c's lock.
+func (c *Coordinator) decide(tx *transaction, outcome string, reason kvs.Status) {
+	if tx.outcome != "" {
+		return
+	}
+	if err := c.log.Write(logRecord{TxID: tx.id, Type: recordDecision, Outcome: outcome}); err != nil {
+		// Carrying on could tell participants an outcome a restart would
+		// forget, so stop here and let recovery abort the transaction
+		log.Fatalf("decision log: %v", err)
+	}
+	c.logged++
+	tx.outcome = outcome
+	tx.reason = reason
+	tx.decidedAt = time.Now()
+	close(tx.decided)
+}
+
+// syncDecisions waits until the records written so far are on disk. Callers
+// release c's lock before calling it and only then send or answer with what
+// they logged, so that commits arriving together share one sync instead of
+// each holding the lock through its own. Must not hold c's lock.
+func (c *Coordinator) syncDecisions() {
+	if err := c.log.WaitDurable(); err != nil {
+		// The decisions waiting here are already in memory, where later
+		// requests would take them as durable, so there is no carrying on
+		log.Fatalf("decision log: %v", err)
+	}
+}
+
+// Helper method to send a decided outcome to every participant. Once all of
+// them have applied it, the transaction is marked as ended in the log.
+func (c *Coordinator) finish(tx *transaction) {
+	acked := true
+	for i, participant := range tx.participants {
+		var err error
+		var status kvs.Status
+		if tx.outcome == kvs.TxCommitted {
+			resp := kvs.CommitResponse{}
+			err = c.callParticipant(tx, i, "KVService.Commit", &kvs.CommitRequest{TransactionID: tx.id, Lead: i == 0}, &resp, func() kvs.Status { return resp.Status })
+			status = resp.Status
+		} else {
+			resp := kvs.AbortResponse{}
+			err = c.callParticipant(tx, i, "KVService.Abort", &kvs.AbortRequest{TransactionID: tx.id, Lead: i == 0}, &resp, func() kvs.Status { return resp.Status })
+			status = resp.Status
+		}
+		if err != nil || status == kvs.StatusNotPrimary || status == kvs.StatusOutcomeUnknown {
+			acked = false
+			continue
+		}
+		if status != kvs.StatusOK {
+			log.Printf("%s %s at %s: %v", tx.outcome, tx.id, participant, status)
+		}
+	}
+	if !acked {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if tx.ended {
+		return
+	}
+	// Losing the end record in a crash only means resending the outcome, so
+	// nothing waits for it to be durable
+	if err := c.log.Write(logRecord{TxID: tx.id, Type: recordEnd}); err != nil {
+		log.Printf("decision log: %v", err)
+		return
+	}
+	c.logged++
+	tx.ended = true
+	tx.endedAt = time.Now()
+}
+
+// resendDecisions retries every decided transaction that some participant
+// hasn't acknowledged yet, including those recovered from the log.
+func (c *Coordinator) resendDecisions() {
+	var pending []*transaction
+
+	c.Lock()
+	now := time.Now()
+	for _, tx := range c.transactions {
+		if tx.outcome != "" && !tx.ended && now.Sub(tx.decidedAt) >= c.retryInterval {
+			pending = append(pending, tx)
+		}
+	}
+	c.Unlock()
+
+	// Outcomes decided by TxStatus may not have been synced yet
+	if len(pending) > 0 {
+		c.syncDecisions()
+	}
+	for _, tx := range pending {
+		c.finish(tx)
+	}
+}
+
+// forgetEnded drops transactions that ended more than c.retention ago, and
+// compacts the decision log once most of it is forgotten. Every participant
+// has applied their outcome, so none will ask about them again, and a client
+// retrying Commit has long since given up. A transaction asked about after
+// all is presumed aborted, which is what a participant that already knows the
+// outcome votes anyway.
+func (c *Coordinator) forgetEnded() {
+	c.Lock()
+	if c.retention == 0 {
+		c.Unlock()
+		return
+	}
+	cutoff := time.Now().Add(-c.retention)
+	for id, tx := range c.transactions {
+		if tx.ended && tx.endedAt.Before(cutoff) {
+			delete(c.transactions, id)
+		}
+	}
+
+	var records []any
+	for _, tx := range c.transactions {
+		if tx.participants != nil {
+			records = append(records, logRecord{TxID: tx.id, Type: recordStart, Participants: tx.participants, Shards: tx.shards})
+		}
+		if tx.outcome != "" {
+			records = append(records, logRecord{TxID: tx.id, Type: recordDecision, Outcome: tx.outcome})
+		}
+		if tx.ended {
+			records = append(records, logRecord{TxID: tx.id, Type: recordEnd})
+		}
+	}
+	if c.logged-len(records) < max(len(records), minCompaction) {
+		c.Unlock()
+		return
+	}
+	since := c.log.Size()
+	before := c.logged
+	c.logged = len(records)
+	c.Unlock()
+
+	// Records appended from here on are copied over after these
+	if err := c.log.Compact(records, since); err != nil {
+		log.Printf("decision log: compaction failed: %v", err)
+		c.Lock()
+		c.logged += before - len(records)
+		c.Unlock()
+		return
+	}
+	log.Printf("compacted decision log from %d records to %d", before, len(records))
+}
+
+const maxCallAttempts = 5
+
+// Helper method to call participant i of tx at its shard's primary. The
+// participant is the replica the client used, which may have failed over
+// since, so if it can't be reached or isn't primary any more, the call is
+// sent again to the primary its shard's replicas report. status reads the
+// reply's status. Only safe for idempotent requests like Prepare, Commit and
+// Abort.
+func (c *Coordinator) callParticipant(tx *transaction, i int, method string, args any, reply any, status func() kvs.Status) error {
+	addr := tx.participants[i]
+	shard := ""
+	if tx.shards != nil {
+		shard = tx.shards[i]
+		c.Lock()
+		if primary, known := c.primaries[shard]; known {
+			addr = primary
+		}
+		c.Unlock()
+	}
+
+	err := c.callWithRetry(addr, method, args, reply)
+	if (err == nil && status() != kvs.StatusNotPrimary) || shard == "" {
+		return err
+	}
+	primary, found := c.findPrimary(shard)
+	if !found || primary == addr {
+		return err
+	}
+	c.Lock()
+	c.primaries[shard] = primary
+	c.Unlock()
+
+	// Fields left at their zero value in a reply aren't decoded, so the
+	// first attempt's status would stick
+	reflect.ValueOf(reply).Elem().SetZero()
+	return c.callWithRetry(primary, method, args, reply)
+}
+
+// Helper method to find the primary of the shard with host entry shard, by
+// asking its replicas
+func (c *Coordinator) findPrimary(shard string) (string, bool) {
+	replicas := strings.Split(shard, "|")
+	for _, addr := range replicas {
+		resp := kvs.PingResponse{}
+		if err := c.peers.Call(addr, "KVService.Ping", &kvs.PingRequest{}, &resp); err != nil {
+			continue
+		}
+		if resp.Role == kvs.RolePrimary {
+			return addr, true
+		}
+		if slices.Contains(replicas, resp.Primary) {
+			return resp.Primary, true
+		}
+	}
+	return "", false
+}
+
+// Helper method to call a participant, trying again if the connection fails.
+// Only safe for idempotent requests like Prepare.
+func (c *Coordinator) callWithRetry(addr string, method string, args any, reply any) error {
+	var err error
+	for attempt := 0; attempt < maxCallAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(10<<attempt) * time.Millisecond)
+		}
+		err = c.peers.Call(addr, method, args, reply)
+		if _, isServerErr := err.(rpc.ServerError); err == nil || isServerErr {
+			return err
+		}
+	}
+	return err
+}
+
+func main() {
+	port := flag.String("port", "8070", "Port to run the coordinator on")
+	addr := flag.String("addr", "", "Address servers use to reach the coordinator (default localhost:<port>)")
+	dataDir := flag.String("data-dir", "", "Directory for the decision log (default kvsdata-coordinator-<port>)")
+	fsync := flag.Bool("fsync", true, "Sync the decision log to disk before acting on a decision")
+	retryInterval := flag.Duration("retry-interval", time.Second, "How often to resend decisions that participants haven't acknowledged")
+	retention := flag.Duration("retention", defaultRetention, "Forget transactions every participant acknowledged this long ago (0 keeps them forever)")
+	flag.Parse()
+
+	if *addr == "" {
+		*addr = fmt.Sprintf("localhost:%s", *port)
+	}
+	if *dataDir == "" {
+		*dataDir = fmt.Sprintf("kvsdata-coordinator-%s", *port)
+	}
+
+	coordinator, err := NewCoordinator(*addr, *dataDir, *fsync)
+	if err != nil {
+		log.Fatal("decision log: ", err)
+	}
+	coordinator.retryInterval = *retryInterval
+	coordinator.retention = *retention
+	rpc.Register(coordinator)
+	rpc.HandleHTTP()
+
+	l, e := net.Listen("tcp", fmt.Sprintf(":%v", *port))
+	if e != nil {
+		log.Fatal("listen error:", e)
+	}
+
+	fmt.Printf("Starting KVS coordinator on :%s\n", *port)
+
+	go func() {
+		for {
+			time.Sleep(*retryInterval)
+			coordinator.resendDecisions()
+			coordinator.forgetEnded()
+		}
+	}()
+
+	http.Serve(l, nil)
+}
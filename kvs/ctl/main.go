@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/rpc"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/rstutsman/cs6450-labs/kvs"
+)
+
+const usage = `usage: kvsctl [flags] command
+
+commands:
+  txs         list active and prepared transactions, oldest first
+  locks       dump the lock table
+  abort <id>  force abort an active transaction and release its locks
+  ready [host:port ...]
+              wait for each server (default -server) to be ready to serve
+              transactions, for up to -timeout
+  merge-traces <out> <trace>...
+              join the trace files of a run's clients and servers into one,
+              with only one trace's spans if -trace-id is set
+
+flags:
+`
+
+// kvsctl inspects a server's transactions and locks, aborts transactions
+// that wedge a run, waits for servers to come up and merges trace files.
+func main() {
+	addr := flag.String("server", "localhost:8080", "host:port of the server (its primary, to abort)")
+	asJSON := flag.Bool("json", false, "Print the server's response as JSON instead of a table")
+	timeout := flag.Duration("timeout", 30*time.Second, "How long ready waits for each server")
+	traceID := flag.String("trace-id", "", "With merge-traces, keep only this trace's spans")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if flag.Arg(0) == "ready" {
+		addrs := flag.Args()[1:]
+		if len(addrs) == 0 {
+			addrs = []string{*addr}
+		}
+		for _, addr := range addrs {
+			if err := kvs.WaitReady(addr, *timeout); err != nil {
+				log.Fatal(err)
+			}
+		}
+		return
+	}
+	if flag.Arg(0) == "merge-traces" && flag.NArg() >= 3 {
+		out, err := os.Create(flag.Arg(1))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := kvs.MergeTraces(out, *traceID, flag.Args()[2:]...); err != nil {
+			log.Fatal(err)
+		}
+		if err := out.Close(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	conn, err := rpc.DialHTTP("tcp", *addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+
+	switch command := flag.Arg(0); {
+	case command == "txs" && flag.NArg() == 1:
+		resp := kvs.ListTransactionsResponse{}
+		if err := conn.Call("KVService.ListTransactions", &kvs.ListTransactionsRequest{}, &resp); err != nil {
+			log.Fatal(err)
+		}
+		if *asJSON {
+			printJSON(resp)
+		} else {
+			printTransactions(resp.Transactions)
+		}
+	case command == "locks" && flag.NArg() == 1:
+		resp := kvs.LocksResponse{}
+		if err := conn.Call("KVService.Locks", &kvs.LocksRequest{}, &resp); err != nil {
+			log.Fatal(err)
+		}
+		if *asJSON {
+			printJSON(resp)
+		} else {
+			printLocks(resp.Locks)
+		}
+	case command == "abort" && flag.NArg() == 2:
+		req := kvs.ForceAbortRequest{TransactionID: flag.Arg(1)}
+		resp := kvs.ForceAbortResponse{}
+		if err := conn.Call("KVService.ForceAbort", &req, &resp); err != nil {
+			log.Fatal(err)
+		}
+		if err := resp.Status.Err(); err != nil {
+			log.Fatal(err)
+		}
+		if *asJSON {
+			printJSON(resp)
+		} else {
+			fmt.Printf("aborted %s\n", req.TransactionID)
+		}
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+// Helper function to print a table of transactions
+func printTransactions(txs []kvs.TransactionInfo) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "id\tstatus\tage\treads\twrites\tfailure\tcoordinator\tparticipants\t")
+	for _, tx := range txs {
+		failure := ""
+		if tx.Failure != kvs.StatusUnknown {
+			failure = tx.Failure.String()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%v\t%s\t%s\t%s\t%s\t%s\t\n",
+			tx.ID, tx.Status, tx.Age.Round(time.Millisecond),
+			strings.Join(tx.ReadSet, ","), strings.Join(tx.WriteSet, ","),
+			failure, tx.Coordinator, strings.Join(tx.Participants, ","))
+	}
+	tw.Flush()
+}
+
+// Helper function to print a table of the lock table's entries
+func printLocks(locks []kvs.LockEntry) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "key\twriter\treaders\t")
+	for _, lock := range locks {
+		fmt.Fprintf(tw, "%q\t%s\t%s\t\n", lock.Key, lock.Writer, strings.Join(lock.Readers, ","))
+	}
+	tw.Flush()
+}
+
+// Helper function to print v as indented JSON
+func printJSON(v any) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(string(data))
+}
@@ -0,0 +1,131 @@
+package kvs
+
+import (
+	"fmt"
+	"math/bits"
+	"time"
+)
+
+// Histograms split every power of two into 2^histogramSubBits buckets, so a
+// quantile is within 1/2^histogramSubBits (about 6%) of the true value.
+const (
+	histogramSubBits  = 4
+	histogramSubCount = 1 << histogramSubBits
+	histogramBuckets  = (64 - histogramSubBits + 1) * histogramSubCount
+)
+
+// Histogram counts durations in logarithmic buckets, in the style of an HDR
+// histogram: the relative error is bounded at any scale, from nanoseconds to
+// hours, in a fixed number of counters. It is a plain value; copying one
+// takes a snapshot. It isn't safe for concurrent use.
+type Histogram struct {
+	counts [histogramBuckets]uint64
+	count  uint64
+	sum    time.Duration
+	max    time.Duration
+}
+
+// Helper function to find the bucket of a duration of v nanoseconds. Values
+// below histogramSubCount get a bucket each; above that, the top
+// histogramSubBits+1 bits pick the bucket.
+func histogramBucket(v uint64) int {
+	if v < histogramSubCount {
+		return int(v)
+	}
+	exponent := bits.Len64(v) - 1
+	sub := (v >> (exponent - histogramSubBits)) & (histogramSubCount - 1)
+	return (exponent-histogramSubBits+1)*histogramSubCount + int(sub)
+}
+
+// Helper function to find the largest value in bucket i, in nanoseconds
+func histogramBucketMax(i int) uint64 {
+	if i < histogramSubCount {
+		return uint64(i)
+	}
+	exponent := i/histogramSubCount + histogramSubBits - 1
+	sub := uint64(i % histogramSubCount)
+	low := (histogramSubCount + sub) << (exponent - histogramSubBits)
+	return low + (1 << (exponent - histogramSubBits)) - 1
+}
+
+// Record counts one duration. Negative durations count as zero.
+func (h *Histogram) Record(d time.Duration) {
+	d = max(d, 0)
+	h.counts[histogramBucket(uint64(d))]++
+	h.count++
+	h.sum += d
+	h.max = max(h.max, d)
+}
+
+// Merge adds every duration counted in other.
+func (h *Histogram) Merge(other *Histogram) {
+	for i, n := range other.counts {
+		h.counts[i] += n
+	}
+	h.count += other.count
+	h.sum += other.sum
+	h.max = max(h.max, other.max)
+}
+
+// Sub returns the durations counted in h but not in prev, an earlier
+// snapshot of h. The maximum is h's, since prev's can't be taken back out.
+func (h *Histogram) Sub(prev *Histogram) Histogram {
+	r := Histogram{count: h.count - prev.count, sum: h.sum - prev.sum, max: h.max}
+	for i := range h.counts {
+		r.counts[i] = h.counts[i] - prev.counts[i]
+	}
+	return r
+}
+
+// Count returns the number of durations counted.
+func (h *Histogram) Count() uint64 {
+	return h.count
+}
+
+// Mean returns the average duration, or zero if none were counted.
+func (h *Histogram) Mean() time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	return h.sum / time.Duration(h.count)
+}
+
+// Quantile returns a duration that at least q of the counted durations are
+// no longer than, for q between 0 and 1, or zero if none were counted. It
+// overestimates by at most one bucket.
+func (h *Histogram) Quantile(q float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	rank := uint64(q*float64(h.count) + 0.5)
+	rank = min(max(rank, 1), h.count)
+	seen := uint64(0)
+	for i, n := range h.counts {
+		seen += n
+		if seen >= rank {
+			return min(time.Duration(histogramBucketMax(i)), h.max)
+		}
+	}
+	return h.max
+}
+
+// String summarizes h as its count and its 50th, 95th, 99th and 99.9th
+// percentiles.
+func (h *Histogram) String() string {
+	return fmt.Sprintf("n %d p50 %v p95 %v p99 %v p999 %v",
+		h.count,
+		roundDuration(h.Quantile(0.50)),
+		roundDuration(h.Quantile(0.95)),
+		roundDuration(h.Quantile(0.99)),
+		roundDuration(h.Quantile(0.999)))
+}
+
+// Helper function to keep three significant digits of a duration
+func roundDuration(d time.Duration) time.Duration {
+	for unit := time.Duration(1); unit < time.Hour; unit *= 10 {
+		if d < 1000*unit {
+			return d.Round(unit)
+		}
+	}
+	return d.Round(time.Second)
+}
@@ -0,0 +1,59 @@
+package kvs
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistogramBuckets(t *testing.T) {
+	// Buckets are contiguous and each value falls within its bucket's bounds
+	for _, v := range []uint64{0, 1, 15, 16, 17, 31, 32, 33, 1000, 123456789, 1 << 40, 1<<63 + 12345} {
+		i := histogramBucket(v)
+		assert.True(t, v <= histogramBucketMax(i), v)
+		if i > 0 {
+			assert.True(t, v > histogramBucketMax(i-1), v)
+		}
+	}
+	assert.Equal(t, histogramBuckets-1, histogramBucket(^uint64(0)))
+}
+
+func TestHistogramQuantiles(t *testing.T) {
+	h := Histogram{}
+	assert.Equal(t, time.Duration(0), h.Quantile(0.5))
+
+	for i := 1; i <= 1000; i++ {
+		h.Record(time.Duration(i) * time.Microsecond)
+	}
+	assert.Equal(t, uint64(1000), h.Count())
+	assert.Equal(t, 500500*time.Nanosecond, h.Mean())
+
+	// Within the bucket error of the exact value, and never below it
+	for _, q := range []float64{0.5, 0.95, 0.99, 0.999} {
+		exact := time.Duration(q*1000) * time.Microsecond
+		got := h.Quantile(q)
+		assert.True(t, got >= exact, q)
+		assert.True(t, float64(got) <= float64(exact)*(1+1.0/histogramSubCount), q)
+	}
+	assert.Equal(t, time.Millisecond, h.Quantile(1))
+}
+
+func TestHistogramSubAndMerge(t *testing.T) {
+	h := Histogram{}
+	h.Record(time.Millisecond)
+	prev := h
+	h.Record(time.Second)
+	h.Record(time.Second)
+
+	interval := h.Sub(&prev)
+	assert.Equal(t, uint64(2), interval.Count())
+	assert.True(t, interval.Quantile(0.5) >= 990*time.Millisecond)
+
+	merged := Histogram{}
+	merged.Merge(&prev)
+	merged.Merge(&interval)
+	assert.Equal(t, h.Count(), merged.Count())
+	assert.Equal(t, h.Quantile(0.3), merged.Quantile(0.3))
+	assert.Equal(t, "n 3 p50 1s p95 1s p99 1s p999 1s", merged.String())
+}
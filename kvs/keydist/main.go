@@ -0,0 +1,173 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/rpc"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/rstutsman/cs6450-labs/kvs"
+)
+
+// Shard is what one shard of the ring gets from the sampled workload.
+type Shard struct {
+	host    string
+	weight  int
+	keys    map[string]bool
+	ops     int
+	reads   int
+	hottest string
+	hotOps  int
+}
+
+// Helper function to generate the keys a client would touch. The payment
+// workload always touches the same eleven keys, all under one hash tag if
+// tagged; YCSB workloads draw keys the way runClient does.
+func sampleOps(workload string, theta float64, tagged bool, ops int, visit func(key string, isRead bool)) {
+	if workload == "xfer" {
+		prefix := ""
+		if tagged {
+			prefix = kvs.PaymentTag
+		}
+		keys := []string{prefix + "initialized"}
+		for i := 0; i < 10; i++ {
+			keys = append(keys, fmt.Sprintf("%saccount_%d", prefix, i))
+		}
+		for i := 0; i < ops; i++ {
+			visit(keys[i%len(keys)], i%2 == 0)
+		}
+		return
+	}
+
+	w := kvs.NewWorkload(workload, theta)
+	for i := 0; i < ops; i++ {
+		op := w.Next()
+		visit(fmt.Sprintf("%d", op.Key), op.IsRead)
+	}
+}
+
+func main() {
+	hosts := flag.String("hosts", "localhost:8080", "Comma-separated list of shards, as passed to kvsclient")
+	partitionerName := flag.String("partitioner", kvs.PartitionRing, "How keys are placed on shards: modulo, ring, range or directory")
+	ranges := flag.String("ranges", "", "With -partitioner range, comma-separated first key of every shard but the first")
+	directory := flag.String("directory", "", "With -partitioner directory, file of \"key shard\" lines; other keys go on the ring")
+	weights := flag.String("weights", "", "Comma-separated weight of each shard in -hosts, in order (default: equal weights)")
+	vnodes := flag.Int("vnodes", kvs.DefaultVirtualNodes, "Points on the consistent hash ring per unit of shard weight")
+	workload := flag.String("workload", "YCSB-B", "Workload to sample keys from (YCSB-A, YCSB-B, YCSB-C, or xfer)")
+	theta := flag.Float64("theta", 0.99, "Zipfian distribution skew parameter")
+	ops := flag.Int("ops", 1000000, "Number of operations to sample")
+	tags := flag.Bool("tags", false, "With -workload xfer, put every account under one hash tag, like kvsclient -tags")
+	live := flag.Bool("live", false, "Instead of sampling a workload, ask every server in -hosts for the keys it sees the most traffic on")
+	top := flag.Int("top", 10, "With -live, number of keys to list per server")
+	flag.Parse()
+
+	if *live {
+		printHotKeys(strings.Split(*hosts, ","), *top)
+		return
+	}
+
+	shardWeights, err := kvs.ParseWeights(*weights)
+	if err != nil {
+		log.Fatal(err)
+	}
+	hostList := strings.Split(*hosts, ",")
+	config := kvs.PartitionerConfig{
+		Shards:       hostList,
+		Weights:      shardWeights,
+		VirtualNodes: *vnodes,
+		Directory:    *directory,
+	}
+	if *ranges != "" {
+		config.Bounds = strings.Split(*ranges, ",")
+	}
+	partitioner, err := kvs.NewPartitioner(*partitionerName, config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	shards := make([]*Shard, len(hostList))
+	for i, host := range hostList {
+		shards[i] = &Shard{host: host, weight: 1, keys: make(map[string]bool)}
+		if shardWeights != nil {
+			shards[i].weight = shardWeights[i]
+		}
+	}
+
+	keyOps := make(map[string]int)
+	sampleOps(*workload, *theta, *tags, *ops, func(key string, isRead bool) {
+		shard := shards[partitioner.Shard(key)]
+		shard.keys[key] = true
+		shard.ops++
+		if isRead {
+			shard.reads++
+		}
+		keyOps[key]++
+		if keyOps[key] > shard.hotOps {
+			shard.hottest, shard.hotOps = key, keyOps[key]
+		}
+	})
+
+	fmt.Printf("workload %s, theta %.2f, %d ops over %d distinct keys, %s partitioner\n\n",
+		*workload, *theta, *ops, len(keyOps), *partitionerName)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "shard\tweight\tkeys\tkeys %\tops\tops %\treads %\thottest key\thottest ops %\t")
+	totalWeight := 0
+	for _, shard := range shards {
+		totalWeight += shard.weight
+	}
+	imbalance := 0.0
+	for _, shard := range shards {
+		if shard.weight > 0 {
+			share := float64(*ops) * float64(shard.weight) / float64(totalWeight)
+			imbalance = max(imbalance, float64(shard.ops)/share)
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%.1f\t%d\t%.1f\t%.1f\t%s\t%.2f\t\n",
+			shard.host, shard.weight,
+			len(shard.keys), percent(len(shard.keys), len(keyOps)),
+			shard.ops, percent(shard.ops, *ops),
+			percent(shard.reads, shard.ops),
+			shard.hottest, percent(shard.hotOps, *ops))
+	}
+	tw.Flush()
+
+	// 1.00 means every shard gets exactly its weighted share of the load
+	fmt.Printf("\nmost loaded shard gets %.2fx its weighted share of ops\n", imbalance)
+}
+
+// Helper function to list the hottest keys of every replica of every shard
+// in hosts, by the servers' own counts.
+func printHotKeys(hosts []string, top int) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "server	key	accesses	accesses %	conflicts	error	hot	lock mode	")
+	for _, host := range hosts {
+		for _, addr := range strings.Split(host, "|") {
+			conn, err := rpc.DialHTTP("tcp", addr)
+			if err != nil {
+				log.Fatal(err)
+			}
+			resp := kvs.HotKeysResponse{}
+			err = conn.Call("KVService.HotKeys", &kvs.HotKeysRequest{N: top}, &resp)
+			conn.Close()
+			if err != nil {
+				log.Fatal(err)
+			}
+			for _, key := range resp.Keys {
+				fmt.Fprintf(tw, "%s\t%q\t%d\t%.2f\t%d\t%d\t%v\t%s\t\n",
+					addr, key.Key, key.Accesses, percent(int(key.Accesses), int(resp.Total)),
+					key.Conflicts, key.Error, key.Hot, key.Mode)
+			}
+		}
+	}
+	tw.Flush()
+}
+
+func percent(n, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(n) / float64(total)
+}
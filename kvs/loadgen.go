@@ -144,3 +144,7 @@ func zeta(n uint64, theta float64) float64 {
 	}
 	return sum
 }
+
+// PaymentTag is the hash tag the payment workload can put on all of its keys,
+// so that every account lands on one shard and no transaction needs 2PC.
+const PaymentTag = "{bank}"
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/rpc"
+	"strings"
+	"time"
+
+	"github.com/rstutsman/cs6450-labs/kvs"
+)
+
+// kvsmigrate moves a range of keys from one server to another while the
+// cluster keeps serving transactions. With -config, the config service picks
+// the owner and publishes the new shard map once the range has moved.
+func main() {
+	configAddr := flag.String("config", "", "host:port of the config service; -from is then looked up in the shard map and -to is the target shard's host entry")
+	from := flag.String("from", "localhost:8080", "host:port of the server that owns the range (its primary, if replicated)")
+	to := flag.String("to", "localhost:8081", "host:port of the server taking over the range (its primary, if replicated)")
+	keyRange := flag.String("range", "", "Range of placement keys to move, as \"start,end\"; an empty end means no upper bound")
+	fenceTimeout := flag.Duration("fence-timeout", 0, "How long to wait for locks in the range to be released before giving up (0 means the server's default)")
+	flag.Parse()
+
+	start, end, found := strings.Cut(*keyRange, ",")
+	if !found {
+		log.Fatalf("-range %q is not \"start,end\"", *keyRange)
+	}
+
+	if *configAddr != "" {
+		conn, err := rpc.DialHTTP("tcp", *configAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		req := kvs.MoveRangeRequest{Start: start, End: end, Target: *to, FenceTimeout: *fenceTimeout}
+		resp := kvs.MoveRangeResponse{}
+		began := time.Now()
+		if err := conn.Call("Config.Move", &req, &resp); err != nil {
+			log.Fatal(err)
+		}
+		if err := resp.Status.Err(); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("moved [%q, %q) to %s in %v: %d keys copied, %d writes caught up, shard map epoch %d\n",
+			start, end, *to, time.Since(began).Round(time.Millisecond), resp.Keys, resp.CaughtUp, resp.Epoch)
+		return
+	}
+
+	conn, err := rpc.DialHTTP("tcp", *from)
+	if err != nil {
+		log.Fatal(err)
+	}
+	req := kvs.MigrateRequest{Start: start, End: end, Target: *to, FenceTimeout: *fenceTimeout}
+	resp := kvs.MigrateResponse{}
+	began := time.Now()
+	if err := conn.Call("KVService.MigrateRange", &req, &resp); err != nil {
+		log.Fatal(err)
+	}
+	if err := resp.Status.Err(); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("moved [%q, %q) from %s to %s in %v: %d keys copied, %d writes caught up\n",
+		start, end, *from, *to, time.Since(began).Round(time.Millisecond), resp.Keys, resp.CaughtUp)
+}
@@ -0,0 +1,194 @@
+package kvs
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Partitioner decides which shard owns each key. Shards are numbered by
+// their position in the client's host list, and every client of a cluster
+// must use the same partitioner. Every partitioner places a key with a hash
+// tag by its tag alone; see HashTag.
+type Partitioner interface {
+	Shard(key string) int
+}
+
+// HashTag returns the part of key that decides its placement. As in Redis
+// Cluster, if key has a non-empty "{...}" section, only what is between the
+// first "{" and the next "}" counts, so "{acct42}:balance" and
+// "{acct42}:history" always land on the same shard and a transaction over
+// both stays on one server. Otherwise the whole key counts.
+func HashTag(key string) string {
+	start := strings.IndexByte(key, '{')
+	if start < 0 {
+		return key
+	}
+	length := strings.IndexByte(key[start+1:], '}')
+	if length <= 0 {
+		return key
+	}
+	return key[start+1 : start+1+length]
+}
+
+// Names of the partitioners NewPartitioner knows.
+const (
+	PartitionModulo    = "modulo"
+	PartitionRing      = "ring"
+	PartitionRange     = "range"
+	PartitionDirectory = "directory"
+	PartitionShardMap  = "map" // loaded from the servers; see ShardMap
+)
+
+// PartitionerConfig holds what NewPartitioner needs; each partitioner uses
+// only some of it.
+type PartitionerConfig struct {
+	Shards       []string // every shard's host entry, in order
+	Weights      []int    // ring: relative share of each shard, nil for equal
+	VirtualNodes int      // ring: points per unit of weight
+	Bounds       []string // range: the first key of every shard but the first
+	Directory    string   // directory: path of the file listing keys and shards
+}
+
+// NewPartitioner builds the partitioner called kind.
+func NewPartitioner(kind string, config PartitionerConfig) (Partitioner, error) {
+	switch kind {
+	case PartitionModulo:
+		return NewModuloPartitioner(len(config.Shards)), nil
+	case PartitionRing:
+		return NewRing(config.Shards, config.Weights, config.VirtualNodes)
+	case PartitionRange:
+		return NewRangePartitioner(config.Bounds, len(config.Shards))
+	case PartitionShardMap:
+		return nil, fmt.Errorf("the %s partitioner is loaded from the servers", kind)
+	case PartitionDirectory:
+		// Keys the directory doesn't list are placed on the ring
+		ring, err := NewRing(config.Shards, config.Weights, config.VirtualNodes)
+		if err != nil {
+			return nil, err
+		}
+		return LoadDirectory(config.Directory, len(config.Shards), ring)
+	}
+	return nil, fmt.Errorf("unknown partitioner %q", kind)
+}
+
+// ModuloPartitioner hashes keys and takes the hash modulo the number of
+// shards. It spreads keys evenly, but changing the number of shards moves
+// almost every key.
+type ModuloPartitioner struct {
+	shards int
+}
+
+func NewModuloPartitioner(shards int) *ModuloPartitioner {
+	return &ModuloPartitioner{shards: shards}
+}
+
+func (p *ModuloPartitioner) Shard(key string) int {
+	key = HashTag(key)
+	hash := 0
+	for i := 0; i < len(key); i++ {
+		hash = hash*31 + int(key[i])
+	}
+	if hash < 0 {
+		hash = -hash
+	}
+	return hash % p.shards
+}
+
+// RangePartitioner gives each shard a contiguous range of keys in byte
+// order, so keys that sort together stay together.
+type RangePartitioner struct {
+	bounds []string // bounds[i] is the first key of shard i+1
+}
+
+// NewRangePartitioner splits the keys at bounds, which must be sorted and
+// have one entry fewer than there are shards. Shard 0 owns every key before
+// bounds[0], and the last shard every key from the last bound on.
+func NewRangePartitioner(bounds []string, shards int) (*RangePartitioner, error) {
+	if len(bounds) != shards-1 {
+		return nil, fmt.Errorf("%d range bounds for %d shards, need %d", len(bounds), shards, shards-1)
+	}
+	for i := 1; i < len(bounds); i++ {
+		if bounds[i-1] >= bounds[i] {
+			return nil, fmt.Errorf("range bounds out of order: %q before %q", bounds[i-1], bounds[i])
+		}
+	}
+	return &RangePartitioner{bounds: bounds}, nil
+}
+
+func (p *RangePartitioner) Shard(key string) int {
+	key = HashTag(key)
+	return sort.Search(len(p.bounds), func(i int) bool { return p.bounds[i] > key })
+}
+
+// ShardMap lists the partitioner's ranges, with owners[i] as the owner of
+// shard i's range.
+func (p *RangePartitioner) ShardMap(owners []string) *ShardMap {
+	m := &ShardMap{}
+	for i, owner := range owners {
+		r := RangeInfo{Owner: owner}
+		if i > 0 {
+			r.Start = p.bounds[i-1]
+		}
+		if i < len(p.bounds) {
+			r.End = p.bounds[i]
+		}
+		m.Ranges = append(m.Ranges, r)
+	}
+	return m
+}
+
+// DirectoryPartitioner places keys where an explicit directory says, and
+// every other key with a fallback partitioner.
+type DirectoryPartitioner struct {
+	entries  map[string]int
+	fallback Partitioner
+}
+
+func NewDirectoryPartitioner(entries map[string]int, fallback Partitioner) *DirectoryPartitioner {
+	return &DirectoryPartitioner{entries: entries, fallback: fallback}
+}
+
+// LoadDirectory reads a directory file with one "key shard" pair per line,
+// where shard is an index into the host list. Tagged keys are looked up by
+// their tag, so listing a tag places every key with it. Blank lines and
+// lines starting with # are skipped.
+func LoadDirectory(path string, shards int, fallback Partitioner) (*DirectoryPartitioner, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := make(map[string]int)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: want \"key shard\"", path, line)
+		}
+		shard, err := strconv.Atoi(fields[1])
+		if err != nil || shard < 0 || shard >= shards {
+			return nil, fmt.Errorf("%s:%d: bad shard %q for %d shards", path, line, fields[1], shards)
+		}
+		entries[fields[0]] = shard
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return NewDirectoryPartitioner(entries, fallback), nil
+}
+
+func (p *DirectoryPartitioner) Shard(key string) int {
+	if shard, found := p.entries[HashTag(key)]; found {
+		return shard
+	}
+	return p.fallback.Shard(key)
+}
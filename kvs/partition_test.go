@@ -0,0 +1,88 @@
+package kvs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModuloPartitioner(t *testing.T) {
+	p := NewModuloPartitioner(3)
+
+	// The same placement the client has always used
+	assert.Equal(t, int('a')%3, p.Shard("a"))
+	assert.Equal(t, (int('a')*31+int('b'))%3, p.Shard("ab"))
+}
+
+func TestRangePartitioner(t *testing.T) {
+	p, err := NewRangePartitioner([]string{"g", "n"}, 3)
+	assert.Nil(t, err)
+
+	assert.Equal(t, 0, p.Shard(""))
+	assert.Equal(t, 0, p.Shard("apple"))
+	assert.Equal(t, 1, p.Shard("g"))
+	assert.Equal(t, 1, p.Shard("mango"))
+	assert.Equal(t, 2, p.Shard("n"))
+	assert.Equal(t, 2, p.Shard("zebra"))
+
+	_, err = NewRangePartitioner([]string{"g"}, 3)
+	assert.NotNil(t, err)
+	_, err = NewRangePartitioner([]string{"n", "g"}, 3)
+	assert.NotNil(t, err)
+}
+
+func TestDirectoryPartitioner(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "directory")
+	assert.Nil(t, os.WriteFile(path, []byte("# hot keys get their own shard\nhot 2\n\nwarm 1\n"), 0644))
+
+	p, err := LoadDirectory(path, 3, NewModuloPartitioner(1))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, p.Shard("hot"))
+	assert.Equal(t, 1, p.Shard("warm"))
+	assert.Equal(t, 0, p.Shard("cold"))
+
+	assert.Nil(t, os.WriteFile(path, []byte("hot 3\n"), 0644))
+	_, err = LoadDirectory(path, 3, NewModuloPartitioner(1))
+	assert.NotNil(t, err)
+}
+
+func TestNewPartitioner(t *testing.T) {
+	config := PartitionerConfig{Shards: []string{"a:1", "b:1"}, VirtualNodes: DefaultVirtualNodes, Bounds: []string{"m"}}
+	for _, kind := range []string{PartitionModulo, PartitionRing, PartitionRange} {
+		p, err := NewPartitioner(kind, config)
+		assert.Nil(t, err, kind)
+		shard := p.Shard("key")
+		assert.True(t, shard == 0 || shard == 1, kind)
+	}
+
+	_, err := NewPartitioner("random", config)
+	assert.NotNil(t, err)
+}
+
+func TestHashTag(t *testing.T) {
+	assert.Equal(t, "acct42", HashTag("{acct42}:balance"))
+	assert.Equal(t, "acct42", HashTag("user:{acct42}"))
+	assert.Equal(t, "a", HashTag("{a}{b}"))
+	assert.Equal(t, "plain", HashTag("plain"))
+	assert.Equal(t, "{}:empty", HashTag("{}:empty"))
+	assert.Equal(t, "open{", HashTag("open{"))
+	assert.Equal(t, "}x{", HashTag("}x{"))
+}
+
+func TestPartitionersHonorHashTags(t *testing.T) {
+	ring, err := NewRing([]string{"a:1", "b:1", "c:1", "d:1"}, nil, DefaultVirtualNodes)
+	assert.Nil(t, err)
+	ranges, err := NewRangePartitioner([]string{"g", "n", "t"}, 4)
+	assert.Nil(t, err)
+
+	for _, p := range []Partitioner{ring, NewModuloPartitioner(4), ranges} {
+		for i := 0; i < 100; i++ {
+			tag := fmt.Sprintf("{acct%d}", i)
+			assert.Equal(t, p.Shard(tag+":balance"), p.Shard(tag+":history"))
+			assert.Equal(t, p.Shard(tag[1:len(tag)-1]), p.Shard(tag+":balance"))
+		}
+	}
+}
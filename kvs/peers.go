@@ -0,0 +1,52 @@
+package kvs
+
+import (
+	"net/rpc"
+	"sync"
+)
+
+// Peers is a cache of RPC connections that servers and tools use to reach
+// other servers. It is safe for concurrent use.
+type Peers struct {
+	sync.Mutex
+	conns map[string]*rpc.Client
+}
+
+func NewPeers() *Peers {
+	return &Peers{conns: make(map[string]*rpc.Client)}
+}
+
+// Call invokes method on the server at addr, dropping the connection if it
+// breaks so the next call redials.
+func (p *Peers) Call(addr string, method string, args any, reply any) error {
+	p.Lock()
+	conn, exists := p.conns[addr]
+	p.Unlock()
+
+	if !exists {
+		var err error
+		conn, err = rpc.DialHTTP("tcp", addr)
+		if err != nil {
+			return err
+		}
+		p.Lock()
+		if existing, raced := p.conns[addr]; raced {
+			conn.Close()
+			conn = existing
+		} else {
+			p.conns[addr] = conn
+		}
+		p.Unlock()
+	}
+
+	err := conn.Call(method, args, reply)
+	if _, isServerErr := err.(rpc.ServerError); err != nil && !isServerErr {
+		p.Lock()
+		if p.conns[addr] == conn {
+			delete(p.conns, addr)
+		}
+		p.Unlock()
+		conn.Close()
+	}
+	return err
+}
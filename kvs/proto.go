@@ -1,41 +1,425 @@
 package kvs
 
+import "time"
+
+// Keys are Go strings and values are byte slices. Both may hold arbitrary
+// bytes; nothing in the protocol assumes they are text.
+
+const (
+	DefaultMaxKeySize   = 1 << 10 // 1 KiB
+	DefaultMaxValueSize = 1 << 20 // 1 MiB
+)
+
 type PutRequest struct {
-	Key   string
-	Value string
+	Key           string
+	Value         []byte
 	TransactionID string
+	Epoch         uint64        // epoch of the shard map the client placed the key by; zero if it has none
+	TTL           time.Duration // expire the value this long after commit; zero means never
+	TraceID       string        // trace to record the request's spans in; empty if it isn't traced
+
+	// When CheckVersion is set, the put only succeeds if the key's committed
+	// version equals ExpectedVersion (zero means the key must not exist).
+	CheckVersion    bool
+	ExpectedVersion uint64
 }
 
 type PutResponse struct {
-	Success  bool
-    LockFail bool
+	Status Status
 }
 
 type GetRequest struct {
-	Key string
+	Key           string
 	TransactionID string
+	Epoch         uint64 // epoch of the shard map the client placed the key by; zero if it has none
+	TraceID       string // trace to record the request's spans in; empty if it isn't traced
 }
 
 type GetResponse struct {
-	Value string
-	Success  bool
-	LockFail bool
+	Value   []byte
+	Version uint64 // version of the committed value; zero if the key is missing
+	Status  Status
 }
 
 type AbortRequest struct {
-    TransactionID string
-	Lead		  bool    // the first participant is the lead
+	TransactionID string
+	Lead          bool // the first participant is the lead
 }
 
 type CommitRequest struct {
-    TransactionID string
-    Lead          bool    // the first participant is the lead
+	TransactionID string
+	Lead          bool   // the first participant is the lead
+	TraceID       string // trace to record the request's spans in; empty if it isn't traced
+}
+
+// PrepareRequest asks a participant to vote on committing. After voting yes
+// the participant must wait for the decision; if it doesn't arrive, the
+// participant asks the others in Participants to learn or decide it.
+type PrepareRequest struct {
+	TransactionID string
+	Participants  []string // addresses of every participant, including this one
+	Coordinator   string   // address of the coordinator that decides; empty if the client decides
+	TraceID       string   // trace to record the request's spans in; empty if it isn't traced
+}
+
+type PrepareResponse struct {
+	Status Status
+}
+
+// Transaction states reported by TxStatus.
+const (
+	TxActive    = "active"
+	TxPrepared  = "prepared"
+	TxCommitted = "committed"
+	TxAborted   = "aborted"
+)
+
+// TxStatusRequest is sent between servers to resolve a transaction that is
+// in doubt. A server that hasn't prepared the transaction aborts it before
+// answering, so it can never vote yes later.
+type TxStatusRequest struct {
+	TransactionID string
+	Forwarded     bool // passed on by a Raft replica to its leader, which must not pass it on again
+}
+
+type TxStatusResponse struct {
+	State string // TxPrepared, TxCommitted or TxAborted; a coordinator still collecting votes, or a backup, answers TxActive
+}
+
+// CoordinatedCommitRequest hands a transaction to a coordinator, which runs
+// both phases of 2PC against Participants. Sending it again for the same
+// transaction returns the same result.
+type CoordinatedCommitRequest struct {
+	TransactionID string
+	Participants  []string
+	Shards        []string // each participant's host entry, with its shard's replicas separated by "|", so the coordinator can follow a failover; optional
+}
+
+type CoordinatedCommitResponse struct {
+	Status Status // StatusOK once commit is decided, otherwise why the transaction aborted
+}
+
+// Replica roles. Only a shard's primary serves clients; backups apply what
+// the primary replicates to them and take over if it fails.
+const (
+	RolePrimary = "primary"
+	RoleBackup  = "backup"
+)
+
+// Types of replicated records.
+const (
+	ReplicatePrepare = "prepare"
+	ReplicateCommit  = "commit"
+	ReplicateAbort   = "abort"
+	ReplicateRanges  = "ranges"
+	ReplicateForget  = "forget"
+)
+
+// ReplicateRequest carries one step of a transaction from a shard's primary
+// to a backup. Term increases with every promotion, so a backup can reject a
+// primary that has been replaced.
+type ReplicateRequest struct {
+	Term          uint64
+	Primary       string // address of the sending primary
+	Type          string // ReplicatePrepare, ReplicateCommit, ReplicateAbort, ReplicateRanges or ReplicateForget
+	TransactionID string
+	ReadSet       []string         // keys read-locked by a prepared transaction
+	Writes        []CommittedWrite // the transaction's write set, sorted by key
+	Participants  []string         // for prepare records
+	Coordinator   string           // for prepare records
+	Version       uint64           // for commit records with writes
+	CommitTime    time.Time        // for commit records; TTLs count from here
+	Ranges        []RangeInfo      // for ranges records: every range the shard owns
+	Epoch         uint64           // for ranges records: the shard map epoch, if it changed
+	Forget        []string         // for forget records: transactions whose outcomes are no longer needed
+	Seq           uint64           // how many records the primary has built this term, counting this one
+}
+
+type ReplicateResponse struct {
+	Status Status // StatusNotPrimary if the backup knows of a newer primary
+}
+
+// ForgetRequest drops the outcomes of finished transactions from a replica.
+// Only the primary or leader sends it, once nobody can ask for them again.
+type ForgetRequest struct {
+	TransactionIDs []string
+}
+
+type ForgetResponse struct {
+	Status Status
+}
+
+type SnapshotEntry struct {
+	Key       string
+	Value     []byte
+	Version   uint64
+	ExpiresAt time.Time
+}
+
+// SnapshotRequest brings a backup that missed records up to date with the
+// primary's committed data, prepared transactions and outcomes.
+type SnapshotRequest struct {
+	Term        uint64
+	Primary     string
+	Seq         uint64 // how many records the primary had built this term when it took the snapshot
+	Version     uint64
+	Incarnation uint64 // the primary's version numbering, which the backup takes on
+	Entries     []SnapshotEntry
+	Prepared    []ReplicateRequest // a prepare record for each prepared transaction
+	Outcomes    map[string]string
+	Ranges      []RangeInfo
+	Epoch       uint64
+}
+
+type SnapshotResponse struct {
+	Status Status
+}
+
+type PingRequest struct{}
+
+type PingResponse struct {
+	Role    string
+	Term    uint64
+	Primary string // the primary as far as this replica knows
+	Version uint64 // version of the last change this replica applied
+	Stale   bool   // the replica may have missed records and waits for a snapshot, so it can't take over
+
+	// A backup's place in the primary's records. The live backup furthest
+	// along takes over.
+	AppliedTerm uint64 // term of the primary whose records it last applied
+	Applied     uint64 // how many of that primary's records it has
+}
+
+// PromoteRequest makes a backup its shard's primary. A backup that may have
+// missed records refuses with StatusStaleReplica.
+type PromoteRequest struct{}
+
+type PromoteResponse struct {
+	Status Status
 }
 
 type CommitResponse struct {
-    Success bool
+	Status Status
 }
 
 type AbortResponse struct {
-    Success bool
-}
\ No newline at end of file
+	Status Status
+}
+
+type WatchRequest struct {
+	Key         string
+	Prefix      bool          // match every key that starts with Key
+	FromVersion uint64        // only return changes newer than this version
+	Incarnation uint64        // the Incarnation FromVersion was returned with, or zero if unknown
+	Timeout     time.Duration // how long to wait for a matching change
+}
+
+type WatchEvent struct {
+	Key     string
+	Value   []byte
+	Version uint64
+	Deleted bool // the key's TTL ran out; Value is empty
+}
+
+type WatchResponse struct {
+	Events      []WatchEvent // matching changes in commit order
+	Version     uint64       // resume point to pass as the next FromVersion
+	Incarnation uint64       // numbering Version belongs to, to pass as the next Incarnation
+	Compacted   bool         // changes after FromVersion are no longer retained, or the server restarted since
+}
+
+type ChangeLogRequest struct {
+	FromVersion uint64        // only return records newer than this version
+	MaxRecords  int           // upper bound on records returned; zero means no limit
+	Incarnation uint64        // the Incarnation FromVersion was returned with, or zero if unknown
+	Timeout     time.Duration // how long to wait when there are no new records
+}
+
+type CommittedWrite struct {
+	Key     string
+	Value   []byte
+	TTL     time.Duration
+	Deleted bool // the key's TTL ran out; only in the change log
+}
+
+type CommitRecord struct {
+	Version       uint64
+	TransactionID string
+	Writes        []CommittedWrite // sorted by key
+}
+
+type ChangeLogResponse struct {
+	Records     []CommitRecord // committed transactions in commit order
+	Version     uint64         // resume point to pass as the next FromVersion
+	Incarnation uint64         // numbering Version belongs to, to pass as the next Incarnation
+	Compacted   bool           // records after FromVersion are no longer retained, or the server restarted since; Records start at the oldest retained one
+}
+
+// ScanRequest reads every key whose placement key is in [Start, End), in
+// ScanLess order, under read locks. Keys that other transactions insert in
+// the scanned span conflict with the scan until the transaction ends.
+type ScanRequest struct {
+	TransactionID string
+	Start         string
+	End           string // empty means no upper bound
+	Limit         int    // most entries to return; zero means no limit
+	Epoch         uint64 // epoch of the shard map the client placed the span by; zero if it has none
+}
+
+type ScanEntry struct {
+	Key     string
+	Value   []byte
+	Version uint64 // version of the committed value; zero for a pending insert
+}
+
+type ScanResponse struct {
+	Entries []ScanEntry
+	Status  Status
+}
+
+type RangesRequest struct{}
+
+// RangesResponse lists the ranges a server owns, in key order.
+type RangesResponse struct {
+	Ranges []RangeInfo
+	Epoch  uint64 // epoch of the shard map the ranges were last assigned from
+}
+
+// AssignRangesRequest sets the ranges a server owns, replacing the ones it
+// owned before. The server drops the committed keys it no longer owns.
+type AssignRangesRequest struct {
+	Ranges []RangeInfo
+	Epoch  uint64 // epoch of the shard map the ranges come from; zero keeps the server's epoch
+}
+
+type AssignRangesResponse struct {
+	Status Status
+}
+
+// MigrateRequest asks the owner of [Start, End) to move it to Target while
+// transactions keep running. The span must lie within one range the server
+// owns.
+type MigrateRequest struct {
+	Start        string
+	End          string        // empty means no upper bound
+	Target       string        // address of the server taking over the span
+	FenceTimeout time.Duration // how long to wait for locks in the span to be released; zero means a default
+}
+
+type MigrateResponse struct {
+	Status   Status
+	Keys     int // keys copied
+	CaughtUp int // writes committed during the copy and sent after it
+}
+
+// InstallRangeRequest copies committed entries of a span that is moving to
+// the receiving server. The receiver doesn't serve them until it is assigned
+// the span.
+type InstallRangeRequest struct {
+	TransactionID string // the entries are installed by committing this transaction
+	Start         string
+	End           string
+	Entries       []SnapshotEntry
+	Version       uint64 // the sender's version; the receiver's versions move past it
+}
+
+type InstallRangeResponse struct {
+	Status Status
+}
+
+type ShardMapRequest struct{}
+
+type ShardMapResponse struct {
+	Map ShardMap
+}
+
+// MoveRangeRequest asks the config service to move [Start, End) to the shard
+// whose host entry is Target, and to publish the new shard map.
+type MoveRangeRequest struct {
+	Start        string
+	End          string // empty means no upper bound
+	Target       string
+	FenceTimeout time.Duration // passed on to the owner; zero means its default
+}
+
+type MoveRangeResponse struct {
+	Status   Status
+	Epoch    uint64 // epoch of the new shard map
+	Keys     int    // keys copied
+	CaughtUp int    // writes committed during the copy and sent after it
+}
+
+// Lock modes a server can use for a key. Under LockNoWait a request that
+// conflicts with another transaction's lock fails at once, and the client
+// retries the transaction; under LockWait it first waits a little for the
+// lock to be released, which suits hot keys that every transaction touches,
+// unless waiting would deadlock.
+const (
+	LockNoWait = "no-wait"
+	LockWait   = "wait"
+)
+
+// HotKeysRequest asks a server for the N keys it has seen the most requests
+// for lately.
+type HotKeysRequest struct {
+	N int
+}
+
+// HotKey is a server's estimate of the recent traffic on one key. Counts
+// decay over time and may be overestimated by up to Error.
+type HotKey struct {
+	Key       string
+	Accesses  uint64 // gets and puts
+	Conflicts uint64 // gets and puts that found the key locked
+	Error     uint64
+	Hot       bool   // above the server's hot key threshold
+	Mode      string // lock mode the server uses for the key
+}
+
+type HotKeysResponse struct {
+	Keys  []HotKey // most accessed first
+	Total uint64   // accesses to every key, decayed like the keys' counts
+}
+
+// TransactionInfo describes a transaction a server is running, for admins.
+type TransactionInfo struct {
+	ID           string
+	Status       string        // TxActive or TxPrepared
+	Age          time.Duration // since the server first saw the transaction
+	ReadSet      []string
+	WriteSet     []string
+	Participants []string // known once prepared
+	Coordinator  string
+	Failure      Status // why the first of its requests that failed on this server did; StatusUnknown if none has
+}
+
+type ListTransactionsRequest struct{}
+
+type ListTransactionsResponse struct {
+	Transactions []TransactionInfo // oldest first
+}
+
+// LockEntry lists the transactions holding locks on one key.
+type LockEntry struct {
+	Key     string
+	Readers []string
+	Writer  string // empty if nobody holds the write lock
+}
+
+type LocksRequest struct{}
+
+type LocksResponse struct {
+	Locks []LockEntry // in key order
+}
+
+// ForceAbortRequest has a server abort an active transaction and release
+// its locks, for an admin unwedging a run. Prepared transactions are left
+// to two-phase commit, since aborting one could undo half of a commit; one
+// that prepares before the abort takes effect gets StatusTransactionPrepared.
+type ForceAbortRequest struct {
+	TransactionID string
+}
+
+type ForceAbortResponse struct {
+	Status Status
+}
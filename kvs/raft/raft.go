@@ -0,0 +1,693 @@
+// Package raft is a small implementation of the Raft consensus protocol. A
+// group of nodes agrees on a log of opaque commands, and every node hands the
+// committed commands to its state machine in the same order. Storage and
+// transport are pluggable, so a group can run across processes over net/rpc
+// or inside one process for tests.
+//
+// The state machine compacts the log by handing the node a snapshot of its
+// state as of an applied entry: the entries up to it are dropped, a
+// restarted node starts from the snapshot, and a follower too far behind for
+// the leader's log gets the snapshot instead of the entries.
+package raft
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Entry is one slot in the log. Entry i lives at index i; index 0 is a
+// sentinel that is never applied.
+type Entry struct {
+	Index   int
+	Term    uint64
+	Command []byte // nil for the no-op a new leader appends
+}
+
+// ApplyMsg delivers a committed entry to the state machine, or a snapshot
+// that replaces its state with the state as of entry Index.
+type ApplyMsg struct {
+	Index    int
+	Term     uint64
+	Command  []byte // nil for no-ops, which the state machine skips
+	Snapshot []byte // set instead of Command for a snapshot
+}
+
+// Snapshot is the state machine's state as of the entry at Index, which
+// stands in for every entry up to it.
+type Snapshot struct {
+	Index int
+	Term  uint64
+	Data  []byte
+}
+
+type RequestVoteArgs struct {
+	Term         uint64
+	CandidateID  int
+	LastLogIndex int
+	LastLogTerm  uint64
+}
+
+type RequestVoteReply struct {
+	Term        uint64
+	VoteGranted bool
+}
+
+type AppendEntriesArgs struct {
+	Term         uint64
+	LeaderID     int
+	PrevLogIndex int
+	PrevLogTerm  uint64
+	Entries      []Entry
+	LeaderCommit int
+}
+
+type AppendEntriesReply struct {
+	Term    uint64
+	Success bool
+
+	// On failure, the index the leader should back up to: the first entry of
+	// the conflicting term, or just past the end of a short log
+	ConflictIndex int
+}
+
+type InstallSnapshotArgs struct {
+	Term     uint64
+	LeaderID int
+	Snapshot Snapshot
+}
+
+type InstallSnapshotReply struct {
+	Term uint64
+}
+
+type Config struct {
+	ElectionTimeout   time.Duration // followers wait between this and twice this before standing
+	HeartbeatInterval time.Duration
+}
+
+var DefaultConfig = Config{
+	ElectionTimeout:   300 * time.Millisecond,
+	HeartbeatInterval: 50 * time.Millisecond,
+}
+
+// ErrStopped is returned by RPCs to a node that has been stopped.
+var ErrStopped = errors.New("raft node stopped")
+
+type role int
+
+const (
+	follower role = iota
+	candidate
+	leader
+)
+
+type Raft struct {
+	sync.Mutex
+	id        int
+	peers     int // size of the group, including this node
+	transport Transport
+	storage   Storage
+	config    Config
+	applyCh   chan<- ApplyMsg
+
+	// Persistent state
+	currentTerm uint64
+	votedFor    int     // -1 if no vote in currentTerm
+	log         []Entry // starts with the last entry the snapshot stands in for, as a sentinel
+	snapshot    Snapshot
+
+	commitIndex      int
+	lastApplied      int
+	recovered        int // last entry loaded from storage at start, until it is applied or truncated
+	role             role
+	leader           int // last known leader, or -1
+	electionDeadline time.Time
+	nextHeartbeat    time.Time
+	nextIndex        []int // on the leader: next entry to send to each peer
+	matchIndex       []int // on the leader: highest entry known replicated on each peer
+
+	applyCond *sync.Cond
+	stopped   chan struct{}
+	dead      bool
+}
+
+// New starts node id of a group of peers nodes, restoring whatever storage
+// holds. Committed entries are sent on applyCh in log order, and applyCh is
+// closed once the node stops.
+func New(id int, peers int, transport Transport, storage Storage, applyCh chan<- ApplyMsg, config Config) (*Raft, error) {
+	term, votedFor, snapshot, entries, err := storage.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	rf := &Raft{
+		id:          id,
+		peers:       peers,
+		transport:   transport,
+		storage:     storage,
+		config:      config,
+		applyCh:     applyCh,
+		currentTerm: term,
+		votedFor:    votedFor,
+		log:         append([]Entry{{Index: snapshot.Index, Term: snapshot.Term}}, entries...),
+		snapshot:    snapshot,
+		commitIndex: snapshot.Index,
+		recovered:   snapshot.Index + len(entries),
+		leader:      -1,
+		nextIndex:   make([]int, peers),
+		matchIndex:  make([]int, peers),
+		stopped:     make(chan struct{}),
+	}
+	rf.applyCond = sync.NewCond(&rf.Mutex)
+	rf.resetElectionDeadline()
+
+	go rf.ticker()
+	go rf.applier()
+	return rf, nil
+}
+
+// Start proposes a command. It returns the index the command will have if it
+// commits and the current term, or isLeader false if this node can't accept
+// proposals. There is no guarantee the command ever commits.
+func (rf *Raft) Start(command []byte) (index int, term uint64, isLeader bool) {
+	rf.Lock()
+	defer rf.Unlock()
+
+	if rf.dead || rf.role != leader {
+		return 0, rf.currentTerm, false
+	}
+	index = rf.appendLocal(command)
+	if rf.role != leader {
+		return 0, rf.currentTerm, false
+	}
+	rf.broadcastAppend()
+	return index, rf.currentTerm, true
+}
+
+// State returns the current term and whether this node is the leader.
+func (rf *Raft) State() (term uint64, isLeader bool) {
+	rf.Lock()
+	defer rf.Unlock()
+	return rf.currentTerm, !rf.dead && rf.role == leader
+}
+
+// Leader returns the last known leader, or -1 if there isn't one.
+func (rf *Raft) Leader() int {
+	rf.Lock()
+	defer rf.Unlock()
+	if rf.dead {
+		return -1
+	}
+	return rf.leader
+}
+
+// Recovering reports whether the node has yet to apply every entry it
+// loaded from storage when it started. Entries are only applied once a
+// leader says they are committed, so a restarted node stays recovering
+// until it hears from one.
+func (rf *Raft) Recovering() bool {
+	rf.Lock()
+	defer rf.Unlock()
+	return rf.lastApplied < rf.recovered
+}
+
+// Snapshot compacts the log with data, the state machine's state as of the
+// applied entry at index: the entries up to it are dropped. A snapshot that
+// is older than the current one is ignored.
+func (rf *Raft) Snapshot(index int, data []byte) error {
+	rf.Lock()
+	defer rf.Unlock()
+
+	if rf.dead || index <= rf.log[0].Index || index > rf.commitIndex {
+		return nil
+	}
+	snapshot := Snapshot{Index: index, Term: rf.entry(index).Term, Data: data}
+	return rf.compact(snapshot, rf.log[index-rf.log[0].Index+1:])
+}
+
+// Stop shuts the node down. Its storage can be reused to restart it.
+func (rf *Raft) Stop() {
+	rf.Lock()
+	defer rf.Unlock()
+	if rf.dead {
+		return
+	}
+	rf.dead = true
+	close(rf.stopped)
+	rf.applyCond.Broadcast()
+}
+
+// RequestVote is the RPC a candidate sends to collect votes.
+func (rf *Raft) RequestVote(args *RequestVoteArgs, reply *RequestVoteReply) error {
+	rf.Lock()
+	defer rf.Unlock()
+
+	if rf.dead {
+		return ErrStopped
+	}
+	if args.Term > rf.currentTerm {
+		rf.becomeFollower(args.Term)
+	}
+	reply.Term = rf.currentTerm
+	if args.Term < rf.currentTerm {
+		return nil
+	}
+
+	// Only vote for candidates whose log has everything this one has
+	last := rf.lastEntry()
+	upToDate := args.LastLogTerm > last.Term ||
+		(args.LastLogTerm == last.Term && args.LastLogIndex >= last.Index)
+	if (rf.votedFor == -1 || rf.votedFor == args.CandidateID) && upToDate {
+		if rf.votedFor != args.CandidateID {
+			rf.votedFor = args.CandidateID
+			if err := rf.storage.SaveState(rf.currentTerm, rf.votedFor); err != nil {
+				return err
+			}
+		}
+		rf.resetElectionDeadline()
+		reply.VoteGranted = true
+	}
+	return nil
+}
+
+// AppendEntries is the RPC the leader sends to replicate entries, and with no
+// entries as a heartbeat.
+func (rf *Raft) AppendEntries(args *AppendEntriesArgs, reply *AppendEntriesReply) error {
+	rf.Lock()
+	defer rf.Unlock()
+
+	if rf.dead {
+		return ErrStopped
+	}
+	if args.Term > rf.currentTerm || (args.Term == rf.currentTerm && rf.role != follower) {
+		rf.becomeFollower(args.Term)
+	}
+	reply.Term = rf.currentTerm
+	if args.Term < rf.currentTerm {
+		return nil
+	}
+	rf.leader = args.LeaderID
+	rf.resetElectionDeadline()
+
+	// Entries up to the snapshot are committed, so they match the leader's
+	lastVouched := args.PrevLogIndex + len(args.Entries)
+	entries := args.Entries
+	if base := rf.log[0].Index; args.PrevLogIndex < base {
+		entries = entries[min(base-args.PrevLogIndex, len(entries)):]
+	}
+
+	lastIndex := rf.lastEntry().Index
+	if args.PrevLogIndex > lastIndex {
+		reply.ConflictIndex = lastIndex + 1
+		return nil
+	}
+	if args.PrevLogIndex >= rf.log[0].Index {
+		if conflictTerm := rf.entry(args.PrevLogIndex).Term; conflictTerm != args.PrevLogTerm {
+			i := args.PrevLogIndex
+			for i > rf.log[0].Index+1 && rf.entry(i-1).Term == conflictTerm {
+				i--
+			}
+			reply.ConflictIndex = i
+			return nil
+		}
+	}
+
+	// Skip entries already in the log; a stale, reordered request must not
+	// truncate entries that a newer one appended
+	for i, entry := range entries {
+		if entry.Index <= rf.lastEntry().Index {
+			if rf.entry(entry.Index).Term == entry.Term {
+				continue
+			}
+			if err := rf.storage.Truncate(entry.Index); err != nil {
+				return err
+			}
+			rf.log = rf.log[:entry.Index-rf.log[0].Index]
+			rf.recovered = min(rf.recovered, entry.Index-1)
+		}
+		newEntries := append([]Entry(nil), entries[i:]...)
+		if err := rf.storage.Append(newEntries); err != nil {
+			return err
+		}
+		rf.log = append(rf.log, newEntries...)
+		break
+	}
+
+	// Only entries this request vouches for are known to match the leader
+	if commit := min(args.LeaderCommit, lastVouched); commit > rf.commitIndex {
+		rf.commitIndex = commit
+		rf.applyCond.Broadcast()
+	}
+	reply.Success = true
+	return nil
+}
+
+// InstallSnapshot is the RPC the leader sends a follower that needs entries
+// the leader has compacted away.
+func (rf *Raft) InstallSnapshot(args *InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	rf.Lock()
+	defer rf.Unlock()
+
+	if rf.dead {
+		return ErrStopped
+	}
+	if args.Term > rf.currentTerm || (args.Term == rf.currentTerm && rf.role != follower) {
+		rf.becomeFollower(args.Term)
+	}
+	reply.Term = rf.currentTerm
+	if args.Term < rf.currentTerm {
+		return nil
+	}
+	rf.leader = args.LeaderID
+	rf.resetElectionDeadline()
+
+	snapshot := args.Snapshot
+	if snapshot.Index <= rf.commitIndex {
+		return nil
+	}
+
+	// Keep the entries after the snapshot if the log agrees with it there
+	var kept []Entry
+	if snapshot.Index <= rf.lastEntry().Index && rf.entry(snapshot.Index).Term == snapshot.Term {
+		kept = rf.log[snapshot.Index-rf.log[0].Index+1:]
+	} else {
+		rf.recovered = min(rf.recovered, snapshot.Index)
+	}
+	if err := rf.compact(snapshot, kept); err != nil {
+		return err
+	}
+	rf.commitIndex = snapshot.Index
+	rf.applyCond.Broadcast()
+	return nil
+}
+
+// ticker starts elections and sends heartbeats.
+func (rf *Raft) ticker() {
+	ticker := time.NewTicker(rf.config.HeartbeatInterval / 5)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-rf.stopped:
+			return
+		case <-ticker.C:
+		}
+
+		rf.Lock()
+		now := time.Now()
+		switch {
+		case rf.role == leader && !now.Before(rf.nextHeartbeat):
+			rf.broadcastAppend()
+		case rf.role != leader && now.After(rf.electionDeadline):
+			rf.startElection()
+		}
+		rf.Unlock()
+	}
+}
+
+// applier hands committed entries to the state machine.
+func (rf *Raft) applier() {
+	defer close(rf.applyCh)
+
+	for {
+		rf.Lock()
+		for rf.lastApplied >= rf.commitIndex && !rf.dead {
+			rf.applyCond.Wait()
+		}
+		if rf.dead {
+			rf.Unlock()
+			return
+		}
+
+		// Entries the snapshot stands in for are applied by applying it
+		if rf.lastApplied < rf.log[0].Index {
+			snapshot := rf.snapshot
+			rf.Unlock()
+			select {
+			case rf.applyCh <- ApplyMsg{Index: snapshot.Index, Term: snapshot.Term, Snapshot: snapshot.Data}:
+			case <-rf.stopped:
+				return
+			}
+			rf.Lock()
+			rf.lastApplied = max(rf.lastApplied, snapshot.Index)
+			rf.Unlock()
+			continue
+		}
+		base := rf.log[0].Index
+		entries := append([]Entry(nil), rf.log[rf.lastApplied+1-base:rf.commitIndex+1-base]...)
+		rf.Unlock()
+
+		for _, entry := range entries {
+			select {
+			case rf.applyCh <- ApplyMsg{Index: entry.Index, Term: entry.Term, Command: entry.Command}:
+			case <-rf.stopped:
+				return
+			}
+			rf.Lock()
+			rf.lastApplied = entry.Index
+			rf.Unlock()
+		}
+	}
+}
+
+// Helper method to stand for election in a new term. Must hold rf's lock.
+func (rf *Raft) startElection() {
+	rf.currentTerm++
+	rf.votedFor = rf.id
+	rf.role = candidate
+	rf.leader = -1
+	rf.resetElectionDeadline()
+	if err := rf.storage.SaveState(rf.currentTerm, rf.votedFor); err != nil {
+		// Without a durable vote this node could vote twice in the term
+		rf.votedFor = -1
+		rf.role = follower
+		return
+	}
+
+	term := rf.currentTerm
+	last := rf.lastEntry()
+	args := RequestVoteArgs{Term: term, CandidateID: rf.id, LastLogIndex: last.Index, LastLogTerm: last.Term}
+	votes := 1
+	if votes > rf.peers/2 {
+		rf.becomeLeader()
+		return
+	}
+
+	for peer := 0; peer < rf.peers; peer++ {
+		if peer == rf.id {
+			continue
+		}
+		go func(peer int) {
+			reply := RequestVoteReply{}
+			if err := rf.transport.RequestVote(peer, &args, &reply); err != nil {
+				return
+			}
+
+			rf.Lock()
+			defer rf.Unlock()
+			if reply.Term > rf.currentTerm {
+				rf.becomeFollower(reply.Term)
+				return
+			}
+			if rf.currentTerm != term || rf.role != candidate || !reply.VoteGranted {
+				return
+			}
+			votes++
+			if votes > rf.peers/2 {
+				rf.becomeLeader()
+			}
+		}(peer)
+	}
+}
+
+// Helper method to take over as leader. The no-op entry lets entries from
+// earlier terms commit without waiting for a new proposal. Must hold rf's
+// lock.
+func (rf *Raft) becomeLeader() {
+	rf.role = leader
+	rf.leader = rf.id
+	for peer := range rf.nextIndex {
+		rf.nextIndex[peer] = rf.lastEntry().Index + 1
+		rf.matchIndex[peer] = 0
+	}
+	rf.appendLocal(nil)
+	rf.broadcastAppend()
+}
+
+// Helper method to follow whoever has term, which is at least the current
+// one. Must hold rf's lock.
+func (rf *Raft) becomeFollower(term uint64) {
+	if term > rf.currentTerm {
+		rf.currentTerm = term
+		rf.votedFor = -1
+		rf.leader = -1
+		rf.storage.SaveState(rf.currentTerm, rf.votedFor)
+	}
+	rf.role = follower
+}
+
+// Helper method to append a command to the leader's log. Must hold rf's
+// lock.
+func (rf *Raft) appendLocal(command []byte) int {
+	entry := Entry{Index: rf.lastEntry().Index + 1, Term: rf.currentTerm, Command: command}
+	if err := rf.storage.Append([]Entry{entry}); err != nil {
+		// The entry isn't durable, so it can't count toward a majority here.
+		// Step down and let a node with working storage lead.
+		rf.role = follower
+		return entry.Index
+	}
+	rf.log = append(rf.log, entry)
+	rf.matchIndex[rf.id] = entry.Index
+	rf.advanceCommit()
+	return entry.Index
+}
+
+// Helper method to send every peer the entries it is missing, or a heartbeat
+// if it has them all. Must hold rf's lock.
+func (rf *Raft) broadcastAppend() {
+	rf.nextHeartbeat = time.Now().Add(rf.config.HeartbeatInterval)
+	for peer := 0; peer < rf.peers; peer++ {
+		if peer != rf.id {
+			go rf.sendAppend(peer)
+		}
+	}
+}
+
+func (rf *Raft) sendAppend(peer int) {
+	rf.Lock()
+	if rf.role != leader || rf.dead {
+		rf.Unlock()
+		return
+	}
+	prev := rf.nextIndex[peer] - 1
+	if prev < rf.log[0].Index {
+		rf.Unlock()
+		rf.sendSnapshot(peer)
+		return
+	}
+	args := AppendEntriesArgs{
+		Term:         rf.currentTerm,
+		LeaderID:     rf.id,
+		PrevLogIndex: prev,
+		PrevLogTerm:  rf.entry(prev).Term,
+		Entries:      append([]Entry(nil), rf.log[prev+1-rf.log[0].Index:]...),
+		LeaderCommit: rf.commitIndex,
+	}
+	rf.Unlock()
+
+	reply := AppendEntriesReply{}
+	if err := rf.transport.AppendEntries(peer, &args, &reply); err != nil {
+		return
+	}
+
+	rf.Lock()
+	defer rf.Unlock()
+	if reply.Term > rf.currentTerm {
+		rf.becomeFollower(reply.Term)
+		return
+	}
+	if rf.role != leader || rf.currentTerm != args.Term {
+		return
+	}
+	if reply.Success {
+		match := args.PrevLogIndex + len(args.Entries)
+		if match > rf.matchIndex[peer] {
+			rf.matchIndex[peer] = match
+			rf.nextIndex[peer] = match + 1
+		}
+		rf.advanceCommit()
+		return
+	}
+	if rf.nextIndex[peer] != args.PrevLogIndex+1 {
+		// A newer reply already moved nextIndex
+		return
+	}
+	if reply.ConflictIndex >= 1 && reply.ConflictIndex < rf.nextIndex[peer] {
+		rf.nextIndex[peer] = reply.ConflictIndex
+	} else if rf.nextIndex[peer] > 1 {
+		rf.nextIndex[peer]--
+	}
+	go rf.sendAppend(peer)
+}
+
+// sendSnapshot sends peer the snapshot in place of the entries it needs.
+func (rf *Raft) sendSnapshot(peer int) {
+	rf.Lock()
+	if rf.role != leader || rf.dead {
+		rf.Unlock()
+		return
+	}
+	args := InstallSnapshotArgs{Term: rf.currentTerm, LeaderID: rf.id, Snapshot: rf.snapshot}
+	rf.Unlock()
+
+	reply := InstallSnapshotReply{}
+	if err := rf.transport.InstallSnapshot(peer, &args, &reply); err != nil {
+		return
+	}
+
+	rf.Lock()
+	defer rf.Unlock()
+	if reply.Term > rf.currentTerm {
+		rf.becomeFollower(reply.Term)
+		return
+	}
+	if rf.role != leader || rf.currentTerm != args.Term {
+		return
+	}
+	if match := args.Snapshot.Index; match > rf.matchIndex[peer] {
+		rf.matchIndex[peer] = match
+		rf.nextIndex[peer] = match + 1
+	}
+	rf.advanceCommit()
+	go rf.sendAppend(peer)
+}
+
+// Helper method to replace the log up to snapshot's entry with snapshot,
+// keeping the entries that follow it. Must hold rf's lock.
+func (rf *Raft) compact(snapshot Snapshot, kept []Entry) error {
+	kept = append([]Entry(nil), kept...)
+	if err := rf.storage.SaveSnapshot(snapshot, kept); err != nil {
+		return err
+	}
+	rf.snapshot = snapshot
+	rf.log = append([]Entry{{Index: snapshot.Index, Term: snapshot.Term}}, kept...)
+	return nil
+}
+
+// Helper method to get the entry at index, which must be in the log or be
+// the snapshot's last entry. Must hold rf's lock.
+func (rf *Raft) entry(index int) Entry {
+	return rf.log[index-rf.log[0].Index]
+}
+
+// Helper method to get the last entry in the log, or the snapshot's last
+// entry if the log is empty past it. Must hold rf's lock.
+func (rf *Raft) lastEntry() Entry {
+	return rf.log[len(rf.log)-1]
+}
+
+// Helper method to commit the newest entry from the current term that a
+// majority has. Earlier entries commit along with it. Must hold rf's lock.
+func (rf *Raft) advanceCommit() {
+	for n := rf.lastEntry().Index; n > rf.commitIndex && rf.entry(n).Term == rf.currentTerm; n-- {
+		count := 0
+		for peer := range rf.matchIndex {
+			if rf.matchIndex[peer] >= n {
+				count++
+			}
+		}
+		if count > rf.peers/2 {
+			rf.commitIndex = n
+			rf.applyCond.Broadcast()
+			return
+		}
+	}
+}
+
+// Helper method to pick a new random election timeout. Must hold rf's lock.
+func (rf *Raft) resetElectionDeadline() {
+	timeout := rf.config.ElectionTimeout + time.Duration(rand.Int63n(int64(rf.config.ElectionTimeout)))
+	rf.electionDeadline = time.Now().Add(timeout)
+}
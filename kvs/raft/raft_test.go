@@ -0,0 +1,364 @@
+package raft
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testConfig = Config{
+	ElectionTimeout:   50 * time.Millisecond,
+	HeartbeatInterval: 10 * time.Millisecond,
+}
+
+// cluster runs a group in one process and records what each node applies.
+// With snapshotEvery set, each node's state machine, the commands it
+// applied, snapshots itself every that many entries.
+type cluster struct {
+	t             *testing.T
+	network       *LocalNetwork
+	nodes         []*Raft
+	storage       []*MemoryStorage
+	snapshotEvery int
+	mu            sync.Mutex
+	applied       [][]string
+	appliers      sync.WaitGroup
+}
+
+func newCluster(t *testing.T, n int) *cluster {
+	c := &cluster{
+		t:       t,
+		network: NewLocalNetwork(),
+		nodes:   make([]*Raft, n),
+		storage: make([]*MemoryStorage, n),
+		applied: make([][]string, n),
+	}
+	for i := range c.nodes {
+		c.storage[i] = NewMemoryStorage()
+		c.start(i)
+	}
+	t.Cleanup(func() {
+		for _, node := range c.nodes {
+			node.Stop()
+		}
+		c.appliers.Wait()
+	})
+	return c
+}
+
+// Starts node i on its storage, replaying its log from the beginning.
+func (c *cluster) start(i int) {
+	applyCh := make(chan ApplyMsg)
+	node, err := New(i, len(c.nodes), c.network.Transport(i), c.storage[i], applyCh, testConfig)
+	assert.Nil(c.t, err)
+
+	c.mu.Lock()
+	c.applied[i] = nil
+	c.mu.Unlock()
+	c.nodes[i] = node
+	c.network.Add(i, node)
+
+	c.appliers.Add(1)
+	go func() {
+		defer c.appliers.Done()
+		for msg := range applyCh {
+			c.mu.Lock()
+			if msg.Snapshot != nil {
+				c.applied[i] = nil
+				assert.Nil(c.t, json.Unmarshal(msg.Snapshot, &c.applied[i]))
+			} else if msg.Command != nil {
+				c.applied[i] = append(c.applied[i], string(msg.Command))
+			}
+			var data []byte
+			if c.snapshotEvery > 0 && msg.Index%c.snapshotEvery == 0 {
+				data, _ = json.Marshal(c.applied[i])
+			}
+			c.mu.Unlock()
+			if data != nil {
+				assert.Nil(c.t, node.Snapshot(msg.Index, data))
+			}
+		}
+	}()
+}
+
+func (c *cluster) crash(i int) {
+	c.network.Disconnect(i)
+	c.nodes[i].Stop()
+}
+
+func (c *cluster) restart(i int) {
+	c.start(i)
+}
+
+// Waits for exactly one connected leader and returns it.
+func (c *cluster) leader() int {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		leaders := map[uint64][]int{}
+		var newest uint64
+		for i, node := range c.nodes {
+			if _, err := c.network.route(i, i); err != nil {
+				continue
+			}
+			if term, isLeader := node.State(); isLeader {
+				leaders[term] = append(leaders[term], i)
+				newest = max(newest, term)
+			}
+		}
+		if len(leaders[newest]) == 1 {
+			return leaders[newest][0]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.t.Fatal("no leader elected")
+	return -1
+}
+
+// Proposes command at the leader until it commits on the given nodes.
+func (c *cluster) commit(command string, nodes ...int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		leader := c.leader()
+		if _, _, isLeader := c.nodes[leader].Start([]byte(command)); isLeader {
+			for wait := time.Now().Add(time.Second); time.Now().Before(wait); {
+				if c.appliedEverywhere(command, nodes) {
+					return
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+	}
+	c.t.Fatalf("%s did not commit", command)
+}
+
+func (c *cluster) appliedEverywhere(command string, nodes []int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, i := range nodes {
+		found := false
+		for _, applied := range c.applied[i] {
+			found = found || applied == command
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// Checks that no two nodes applied different commands at the same position.
+func (c *cluster) checkLogs() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := range c.applied {
+		for j := range c.applied[i] {
+			for k := range c.applied {
+				if j < len(c.applied[k]) {
+					assert.Equal(c.t, c.applied[i][j], c.applied[k][j], "node %d and %d disagree at %d", i, k, j)
+				}
+			}
+		}
+	}
+}
+
+func TestElectsOneLeader(t *testing.T) {
+	c := newCluster(t, 3)
+	leader := c.leader()
+
+	// With no failures, the leader keeps its term
+	term, _ := c.nodes[leader].State()
+	time.Sleep(5 * testConfig.ElectionTimeout)
+	newTerm, isLeader := c.nodes[leader].State()
+	assert.True(t, isLeader)
+	assert.Equal(t, term, newTerm)
+	for _, node := range c.nodes {
+		assert.Equal(t, leader, node.Leader())
+	}
+}
+
+func TestFollowersRejectProposals(t *testing.T) {
+	c := newCluster(t, 3)
+	leader := c.leader()
+	follower := (leader + 1) % 3
+
+	_, _, isLeader := c.nodes[follower].Start([]byte("x"))
+	assert.False(t, isLeader)
+}
+
+func TestReplicatesInOrder(t *testing.T) {
+	c := newCluster(t, 3)
+	for i := 0; i < 10; i++ {
+		c.commit(fmt.Sprintf("cmd-%d", i), 0, 1, 2)
+	}
+	c.checkLogs()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := range c.applied {
+		assert.Equal(t, 10, len(c.applied[i]))
+	}
+}
+
+func TestLeaderFailover(t *testing.T) {
+	c := newCluster(t, 3)
+	c.commit("before", 0, 1, 2)
+
+	old := c.leader()
+	c.network.Disconnect(old)
+	others := []int{(old + 1) % 3, (old + 2) % 3}
+	c.commit("during", others...)
+
+	// The old leader can't commit on its own, and takes the new log once
+	// it is back
+	c.nodes[old].Start([]byte("lost"))
+	time.Sleep(2 * testConfig.ElectionTimeout)
+	c.network.Connect(old)
+	c.commit("after", 0, 1, 2)
+
+	c.checkLogs()
+	assert.False(t, c.appliedEverywhere("lost", []int{old}))
+}
+
+func TestNoProgressWithoutMajority(t *testing.T) {
+	c := newCluster(t, 3)
+	c.commit("before", 0, 1, 2)
+
+	leader := c.leader()
+	c.network.Disconnect((leader + 1) % 3)
+	c.network.Disconnect((leader + 2) % 3)
+	_, _, isLeader := c.nodes[leader].Start([]byte("stuck"))
+	assert.True(t, isLeader)
+
+	time.Sleep(5 * testConfig.ElectionTimeout)
+	assert.False(t, c.appliedEverywhere("stuck", []int{leader}))
+}
+
+func TestRestartReplaysLog(t *testing.T) {
+	c := newCluster(t, 3)
+	c.commit("a", 0, 1, 2)
+	c.commit("b", 0, 1, 2)
+
+	for i := range c.nodes {
+		c.crash(i)
+	}
+	for i := range c.nodes {
+		c.restart(i)
+		assert.True(t, c.nodes[i].Recovering())
+	}
+	c.commit("c", 0, 1, 2)
+	for i := range c.nodes {
+		assert.False(t, c.nodes[i].Recovering())
+	}
+
+	c.checkLogs()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := range c.applied {
+		assert.Equal(t, []string{"a", "b", "c"}, c.applied[i])
+	}
+}
+
+func TestFileStorage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "raft.log")
+	storage, err := OpenFileStorage(path, false)
+	assert.Nil(t, err)
+
+	assert.Nil(t, storage.SaveState(3, 1))
+	assert.Nil(t, storage.Append([]Entry{{Index: 1, Term: 1, Command: []byte("a")}, {Index: 2, Term: 2, Command: []byte("b")}}))
+	assert.Nil(t, storage.Truncate(2))
+	assert.Nil(t, storage.Append([]Entry{{Index: 2, Term: 3}}))
+	assert.Nil(t, storage.SaveState(4, -1))
+	assert.Nil(t, storage.Close())
+
+	storage, err = OpenFileStorage(path, false)
+	assert.Nil(t, err)
+	defer storage.Close()
+	term, votedFor, snapshot, entries, err := storage.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(4), term)
+	assert.Equal(t, -1, votedFor)
+	assert.Equal(t, Snapshot{}, snapshot)
+	assert.Equal(t, []Entry{{Index: 1, Term: 1, Command: []byte("a")}, {Index: 2, Term: 3}}, entries)
+}
+
+func TestFileStorageSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "raft.log")
+	storage, err := OpenFileStorage(path, false)
+	assert.Nil(t, err)
+
+	assert.Nil(t, storage.SaveState(2, 0))
+	assert.Nil(t, storage.Append([]Entry{{Index: 1, Term: 1}, {Index: 2, Term: 2}, {Index: 3, Term: 2}}))
+	snapshot := Snapshot{Index: 2, Term: 2, Data: []byte("state")}
+	assert.Nil(t, storage.SaveSnapshot(snapshot, []Entry{{Index: 3, Term: 2}}))
+	assert.Nil(t, storage.Append([]Entry{{Index: 4, Term: 2}}))
+	assert.Nil(t, storage.Truncate(4))
+	assert.Nil(t, storage.Close())
+
+	storage, err = OpenFileStorage(path, false)
+	assert.Nil(t, err)
+	defer storage.Close()
+	term, votedFor, loaded, entries, err := storage.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(2), term)
+	assert.Equal(t, 0, votedFor)
+	assert.Equal(t, snapshot, loaded)
+	assert.Equal(t, []Entry{{Index: 3, Term: 2}}, entries)
+
+	// A crash between saving the snapshot and rewriting the log leaves the
+	// old log, whose first entries the snapshot stands in for
+	assert.Nil(t, storage.SaveSnapshot(Snapshot{Index: 3, Term: 2}, nil))
+	assert.Nil(t, os.WriteFile(path, nil, 0644))
+	assert.Nil(t, storage.Append([]Entry{{Index: 1, Term: 1}, {Index: 2, Term: 2}, {Index: 3, Term: 2}, {Index: 4, Term: 2}}))
+	_, _, loaded, entries, err = storage.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, 3, loaded.Index)
+	assert.Equal(t, []Entry{{Index: 4, Term: 2}}, entries)
+}
+
+func TestSnapshotCompactsLog(t *testing.T) {
+	c := newCluster(t, 3)
+	c.snapshotEvery = 5
+	for i := 0; i < 20; i++ {
+		c.commit(fmt.Sprintf("cmd-%d", i), 0, 1, 2)
+	}
+	for i := range c.storage {
+		assert.True(t, c.storage[i].LogSize() < 10, "node %d kept %d entries", i, c.storage[i].LogSize())
+	}
+
+	// A restarted node starts from its snapshot
+	c.crash(0)
+	c.restart(0)
+	c.commit("after", 0, 1, 2)
+	c.checkLogs()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := range c.applied {
+		assert.Equal(t, 21, len(c.applied[i]))
+	}
+}
+
+func TestLaggingFollowerGetsSnapshot(t *testing.T) {
+	c := newCluster(t, 3)
+	c.snapshotEvery = 5
+	c.commit("before", 0, 1, 2)
+
+	// The leader compacts away the entries a disconnected follower misses
+	lagging := (c.leader() + 1) % 3
+	c.network.Disconnect(lagging)
+	others := []int{(lagging + 1) % 3, (lagging + 2) % 3}
+	for i := 0; i < 20; i++ {
+		c.commit(fmt.Sprintf("cmd-%d", i), others...)
+	}
+
+	c.network.Connect(lagging)
+	c.commit("after", 0, 1, 2)
+	c.checkLogs()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	assert.Equal(t, c.applied[others[0]], c.applied[lagging])
+}
@@ -0,0 +1,222 @@
+package raft
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/rstutsman/cs6450-labs/kvs"
+)
+
+// Storage keeps a node's term, vote, snapshot and log across restarts.
+// Every method must be durable before it returns.
+type Storage interface {
+	// Load returns what was saved, or term 0, no vote (-1), an empty
+	// snapshot and an empty log for a new node. The entries follow the
+	// snapshot's last one.
+	Load() (term uint64, votedFor int, snapshot Snapshot, entries []Entry, err error)
+	SaveState(term uint64, votedFor int) error
+	// Append adds entries that directly follow the last saved one.
+	Append(entries []Entry) error
+	// Truncate drops every entry from index on.
+	Truncate(index int) error
+	// SaveSnapshot replaces the snapshot and the entries saved so far with
+	// snapshot and the entries that follow it.
+	SaveSnapshot(snapshot Snapshot, entries []Entry) error
+}
+
+// MemoryStorage keeps state in memory. Reusing it for a new node simulates a
+// restart that kept its disk.
+type MemoryStorage struct {
+	sync.Mutex
+	term     uint64
+	votedFor int
+	snapshot Snapshot
+	entries  []Entry
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{votedFor: -1}
+}
+
+func (s *MemoryStorage) Load() (uint64, int, Snapshot, []Entry, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.term, s.votedFor, s.snapshot, append([]Entry(nil), s.entries...), nil
+}
+
+func (s *MemoryStorage) SaveState(term uint64, votedFor int) error {
+	s.Lock()
+	defer s.Unlock()
+	s.term, s.votedFor = term, votedFor
+	return nil
+}
+
+func (s *MemoryStorage) Append(entries []Entry) error {
+	s.Lock()
+	defer s.Unlock()
+	s.entries = append(s.entries, entries...)
+	return nil
+}
+
+func (s *MemoryStorage) Truncate(index int) error {
+	s.Lock()
+	defer s.Unlock()
+	if n := index - 1 - s.snapshot.Index; n < len(s.entries) {
+		s.entries = s.entries[:max(n, 0)]
+	}
+	return nil
+}
+
+func (s *MemoryStorage) SaveSnapshot(snapshot Snapshot, entries []Entry) error {
+	s.Lock()
+	defer s.Unlock()
+	s.snapshot = snapshot
+	s.entries = append([]Entry(nil), entries...)
+	return nil
+}
+
+// LogSize returns how many entries are saved after the snapshot.
+func (s *MemoryStorage) LogSize() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.entries)
+}
+
+// Types of records in a FileStorage log.
+const (
+	recordState    = "state"
+	recordEntry    = "entry"
+	recordTruncate = "truncate"
+)
+
+type fileRecord struct {
+	Type     string `json:"type"`
+	Term     uint64 `json:"term,omitempty"`
+	VotedFor int    `json:"voted_for,omitempty"`
+	Index    int    `json:"index,omitempty"`
+	Command  []byte `json:"command,omitempty"`
+}
+
+// FileStorage keeps state in an append-only log file, and the snapshot in a
+// file next to it. Replaying the log applies every state change, append and
+// truncation in order. Saving a snapshot rewrites the log with only the
+// entries that follow it, starting with the current term and vote.
+type FileStorage struct {
+	path     string
+	log      *kvs.Log
+	term     uint64 // the last term and vote saved, to start a rewritten log with
+	votedFor int
+}
+
+// OpenFileStorage opens the log at path, creating it if needed. Unless sync
+// is set, writes may be lost in a crash, which can break Raft's guarantees.
+func OpenFileStorage(path string, sync bool) (*FileStorage, error) {
+	log, err := kvs.OpenLog(path, sync)
+	if err != nil {
+		return nil, err
+	}
+	return &FileStorage{path: path, log: log, votedFor: -1}, nil
+}
+
+func (s *FileStorage) Load() (uint64, int, Snapshot, []Entry, error) {
+	var term uint64
+	votedFor := -1
+	var snapshot Snapshot
+	var entries []Entry
+
+	data, err := os.ReadFile(s.snapshotPath())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return 0, -1, Snapshot{}, nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &snapshot); err != nil {
+			return 0, -1, Snapshot{}, nil, fmt.Errorf("%s: %w", s.snapshotPath(), err)
+		}
+	}
+
+	// A crash while saving a snapshot can leave the log from before it, so
+	// the log may start with entries the snapshot stands in for
+	first := snapshot.Index + 1
+	err = kvs.ReplayLog(s.path, func(line []byte) error {
+		var record fileRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return fmt.Errorf("%s: %w", s.path, err)
+		}
+		switch record.Type {
+		case recordState:
+			term, votedFor = record.Term, record.VotedFor
+		case recordEntry:
+			if len(entries) == 0 && record.Index <= snapshot.Index+1 {
+				first = record.Index
+			}
+			if record.Index != first+len(entries) {
+				return fmt.Errorf("%s: entry %d follows entry %d", s.path, record.Index, first+len(entries)-1)
+			}
+			entries = append(entries, Entry{Index: record.Index, Term: record.Term, Command: record.Command})
+		case recordTruncate:
+			if n := record.Index - first; n < len(entries) {
+				entries = entries[:max(n, 0)]
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, -1, Snapshot{}, nil, err
+	}
+	for len(entries) > 0 && entries[0].Index <= snapshot.Index {
+		entries = entries[1:]
+	}
+	s.term, s.votedFor = term, votedFor
+	return term, votedFor, snapshot, entries, nil
+}
+
+func (s *FileStorage) SaveState(term uint64, votedFor int) error {
+	if err := s.log.Append(fileRecord{Type: recordState, Term: term, VotedFor: votedFor}); err != nil {
+		return err
+	}
+	s.term, s.votedFor = term, votedFor
+	return nil
+}
+
+func (s *FileStorage) Append(entries []Entry) error {
+	for _, entry := range entries {
+		record := fileRecord{Type: recordEntry, Term: entry.Term, Index: entry.Index, Command: entry.Command}
+		if err := s.log.Append(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *FileStorage) Truncate(index int) error {
+	return s.log.Append(fileRecord{Type: recordTruncate, Index: index})
+}
+
+// SaveSnapshot writes the snapshot before rewriting the log, so a crash in
+// between leaves a log whose first entries the snapshot stands in for.
+func (s *FileStorage) SaveSnapshot(snapshot Snapshot, entries []Entry) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	if err := kvs.WriteFileAtomic(s.snapshotPath(), data); err != nil {
+		return err
+	}
+
+	records := []any{fileRecord{Type: recordState, Term: s.term, VotedFor: s.votedFor}}
+	for _, entry := range entries {
+		records = append(records, fileRecord{Type: recordEntry, Term: entry.Term, Index: entry.Index, Command: entry.Command})
+	}
+	return s.log.Compact(records, s.log.Size())
+}
+
+func (s *FileStorage) snapshotPath() string {
+	return s.path + ".snapshot"
+}
+
+func (s *FileStorage) Close() error {
+	return s.log.Close()
+}
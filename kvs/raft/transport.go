@@ -0,0 +1,121 @@
+package raft
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/rstutsman/cs6450-labs/kvs"
+)
+
+// Transport carries RPCs from one node to the others in its group. Peers are
+// identified by their position in the group.
+type Transport interface {
+	RequestVote(peer int, args *RequestVoteArgs, reply *RequestVoteReply) error
+	AppendEntries(peer int, args *AppendEntriesArgs, reply *AppendEntriesReply) error
+	InstallSnapshot(peer int, args *InstallSnapshotArgs, reply *InstallSnapshotReply) error
+}
+
+// RPCTransport reaches peers over net/rpc. Each peer must register its node
+// under the name "Raft".
+type RPCTransport struct {
+	addrs []string
+	peers *kvs.Peers
+}
+
+func NewRPCTransport(addrs []string) *RPCTransport {
+	return &RPCTransport{addrs: addrs, peers: kvs.NewPeers()}
+}
+
+func (t *RPCTransport) RequestVote(peer int, args *RequestVoteArgs, reply *RequestVoteReply) error {
+	return t.peers.Call(t.addrs[peer], "Raft.RequestVote", args, reply)
+}
+
+func (t *RPCTransport) AppendEntries(peer int, args *AppendEntriesArgs, reply *AppendEntriesReply) error {
+	return t.peers.Call(t.addrs[peer], "Raft.AppendEntries", args, reply)
+}
+
+func (t *RPCTransport) InstallSnapshot(peer int, args *InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	return t.peers.Call(t.addrs[peer], "Raft.InstallSnapshot", args, reply)
+}
+
+// ErrDisconnected is returned for calls to or from a node that is
+// disconnected from a LocalNetwork.
+var ErrDisconnected = errors.New("disconnected")
+
+// LocalNetwork connects the nodes of a group inside one process, for tests.
+// Disconnecting a node cuts it off in both directions, like a crash or a
+// partition.
+type LocalNetwork struct {
+	sync.Mutex
+	nodes     map[int]*Raft
+	connected map[int]bool
+}
+
+func NewLocalNetwork() *LocalNetwork {
+	return &LocalNetwork{nodes: make(map[int]*Raft), connected: make(map[int]bool)}
+}
+
+// Transport returns the transport for node id to use.
+func (n *LocalNetwork) Transport(id int) Transport {
+	return &localTransport{network: n, from: id}
+}
+
+// Add connects node as id, replacing any node that had the id before.
+func (n *LocalNetwork) Add(id int, node *Raft) {
+	n.Lock()
+	defer n.Unlock()
+	n.nodes[id] = node
+	n.connected[id] = true
+}
+
+func (n *LocalNetwork) Connect(id int) {
+	n.Lock()
+	defer n.Unlock()
+	n.connected[id] = true
+}
+
+func (n *LocalNetwork) Disconnect(id int) {
+	n.Lock()
+	defer n.Unlock()
+	n.connected[id] = false
+}
+
+// Helper method to find the node a call from one node to another reaches
+func (n *LocalNetwork) route(from, to int) (*Raft, error) {
+	n.Lock()
+	defer n.Unlock()
+	node, exists := n.nodes[to]
+	if !exists || !n.connected[from] || !n.connected[to] {
+		return nil, ErrDisconnected
+	}
+	return node, nil
+}
+
+type localTransport struct {
+	network *LocalNetwork
+	from    int
+}
+
+func (t *localTransport) RequestVote(peer int, args *RequestVoteArgs, reply *RequestVoteReply) error {
+	node, err := t.network.route(t.from, peer)
+	if err != nil {
+		return err
+	}
+	return node.RequestVote(args, reply)
+}
+
+func (t *localTransport) AppendEntries(peer int, args *AppendEntriesArgs, reply *AppendEntriesReply) error {
+	node, err := t.network.route(t.from, peer)
+	if err != nil {
+		return err
+	}
+	return node.AppendEntries(args, reply)
+}
+
+func (t *localTransport) InstallSnapshot(peer int, args *InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	node, err := t.network.route(t.from, peer)
+	if err != nil {
+		return err
+	}
+	return node.InstallSnapshot(args, reply)
+}
@@ -0,0 +1,43 @@
+package kvs
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// How often WaitReady asks a server whether it is ready
+const readyPollInterval = 100 * time.Millisecond
+
+// Ready asks the server at addr whether it is ready to serve transactions.
+// It returns nil if it is, and otherwise an error with the server's reason or
+// why it couldn't be reached.
+func Ready(addr string) error {
+	client := http.Client{Timeout: time.Second}
+	resp, err := client.Get("http://" + addr + "/readyz")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s not ready: %s", addr, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// WaitReady waits up to timeout for the server at addr to be ready, for
+// scripts that start servers and then clients. It returns the last reason
+// the server wasn't ready if it never is.
+func WaitReady(addr string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		err := Ready(addr)
+		if err == nil || time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(readyPollInterval)
+	}
+}
@@ -0,0 +1,40 @@
+package kvs
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWaitReady(t *testing.T) {
+	var polls atomic.Int32
+	var draining atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/readyz", r.URL.Path)
+		if draining.Load() {
+			http.Error(w, "draining", http.StatusServiceUnavailable)
+			return
+		}
+		if polls.Add(1) < 3 {
+			http.Error(w, "replaying the raft log", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ready\n"))
+	}))
+	defer server.Close()
+	addr := strings.TrimPrefix(server.URL, "http://")
+
+	err := Ready(addr)
+	assert.ErrorContains(t, err, "not ready: replaying the raft log")
+	assert.Nil(t, WaitReady(addr, 5*time.Second))
+	assert.Equal(t, int32(3), polls.Load())
+
+	// A server that never gets ready reports why
+	draining.Store(true)
+	assert.ErrorContains(t, WaitReady(addr, 200*time.Millisecond), "draining")
+}
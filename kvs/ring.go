@@ -0,0 +1,112 @@
+package kvs
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultVirtualNodes is how many points a node of weight 1 gets on a Ring.
+const DefaultVirtualNodes = 128
+
+// Ring places keys on nodes by consistent hashing. Each node owns a number of
+// points on a 64-bit hash ring in proportion to its weight, and a key
+// belongs to the node owning the first point at or after the key's hash.
+// Adding or removing a node only moves the keys next to its points, about
+// 1/n of them, where modulo hashing moves almost every key.
+type Ring struct {
+	nodes  []string
+	points []ringPoint // sorted by hash
+}
+
+type ringPoint struct {
+	hash uint64
+	node int // index into nodes
+}
+
+// NewRing builds a ring over nodes. weights gives each node's share of the
+// keys relative to the others, or nil for equal shares; a node of weight 0
+// gets no keys. vnodes is the number of points per unit of weight; more
+// points spread keys more evenly at the cost of a bigger ring.
+func NewRing(nodes []string, weights []int, vnodes int) (*Ring, error) {
+	if weights != nil && len(weights) != len(nodes) {
+		return nil, fmt.Errorf("%d weights for %d nodes", len(weights), len(nodes))
+	}
+	if vnodes <= 0 {
+		return nil, fmt.Errorf("virtual nodes must be positive, got %d", vnodes)
+	}
+
+	r := &Ring{nodes: nodes}
+	for i, node := range nodes {
+		weight := 1
+		if weights != nil {
+			weight = weights[i]
+		}
+		if weight < 0 {
+			return nil, fmt.Errorf("negative weight %d for %s", weight, node)
+		}
+		for v := 0; v < weight*vnodes; v++ {
+			r.points = append(r.points, ringPoint{hash: HashKey(fmt.Sprintf("%s#%d", node, v)), node: i})
+		}
+	}
+	if len(r.points) == 0 {
+		return nil, fmt.Errorf("every node has weight 0")
+	}
+
+	// Ties are broken by node so every client builds the same ring
+	sort.Slice(r.points, func(i, j int) bool {
+		if r.points[i].hash != r.points[j].hash {
+			return r.points[i].hash < r.points[j].hash
+		}
+		return r.points[i].node < r.points[j].node
+	})
+	return r, nil
+}
+
+// Shard returns the index in nodes of the node that owns key.
+func (r *Ring) Shard(key string) int {
+	hash := HashKey(HashTag(key))
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= hash })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].node
+}
+
+// Nodes returns the nodes the ring was built over.
+func (r *Ring) Nodes() []string {
+	return r.nodes
+}
+
+// HashKey hashes a key for placement: 64-bit FNV-1a, followed by a finalizer
+// that spreads similar keys, like "host#1" and "host#2", across the ring.
+func HashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// ParseWeights parses a comma-separated list of weights, as taken by the
+// -weights flags. An empty string means equal weights and returns nil.
+func ParseWeights(s string) ([]int, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var weights []int
+	for _, field := range strings.Split(s, ",") {
+		weight, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil {
+			return nil, fmt.Errorf("bad weight %q", field)
+		}
+		weights = append(weights, weight)
+	}
+	return weights, nil
+}
@@ -0,0 +1,65 @@
+package kvs
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const ringTestKeys = 100000
+
+// Counts how many of the test keys each node of the ring owns.
+func ringShares(r *Ring) []int {
+	counts := make([]int, len(r.Nodes()))
+	for i := 0; i < ringTestKeys; i++ {
+		counts[r.Shard(fmt.Sprintf("%d", i))]++
+	}
+	return counts
+}
+
+func TestRingSpreadsKeysEvenly(t *testing.T) {
+	r, err := NewRing([]string{"a:1", "b:1", "c:1", "d:1"}, nil, DefaultVirtualNodes)
+	assert.Nil(t, err)
+
+	for _, count := range ringShares(r) {
+		assert.InDelta(t, ringTestKeys/4, count, ringTestKeys/4*0.15)
+	}
+}
+
+func TestRingFollowsWeights(t *testing.T) {
+	r, err := NewRing([]string{"a:1", "b:1", "c:1"}, []int{1, 3, 0}, DefaultVirtualNodes)
+	assert.Nil(t, err)
+
+	counts := ringShares(r)
+	assert.InDelta(t, ringTestKeys/4, counts[0], ringTestKeys/4*0.15)
+	assert.InDelta(t, ringTestKeys*3/4, counts[1], ringTestKeys*3/4*0.15)
+	assert.Equal(t, 0, counts[2])
+}
+
+func TestRingMovesFewKeysWhenANodeIsAdded(t *testing.T) {
+	before, err := NewRing([]string{"a:1", "b:1", "c:1"}, nil, DefaultVirtualNodes)
+	assert.Nil(t, err)
+	after, err := NewRing([]string{"a:1", "b:1", "c:1", "d:1"}, nil, DefaultVirtualNodes)
+	assert.Nil(t, err)
+
+	// Only keys taken over by the new node move, about a quarter of them
+	moved := 0
+	for i := 0; i < ringTestKeys; i++ {
+		key := fmt.Sprintf("%d", i)
+		if old, now := before.Shard(key), after.Shard(key); old != now {
+			assert.Equal(t, 3, now)
+			moved++
+		}
+	}
+	assert.InDelta(t, ringTestKeys/4, moved, ringTestKeys/4*0.2)
+}
+
+func TestRingRejectsBadConfig(t *testing.T) {
+	_, err := NewRing([]string{"a:1", "b:1"}, []int{1}, DefaultVirtualNodes)
+	assert.NotNil(t, err)
+	_, err = NewRing([]string{"a:1"}, []int{0}, DefaultVirtualNodes)
+	assert.NotNil(t, err)
+	_, err = NewRing([]string{"a:1"}, nil, 0)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/rstutsman/cs6450-labs/kvs"
+)
+
+// ListTransactions lists the transactions this server is running, with what
+// they have read and written so far. Backups only know about prepared ones.
+func (kv *KVService) ListTransactions(req *kvs.ListTransactionsRequest, resp *kvs.ListTransactionsResponse) error {
+	kv.Lock()
+	defer kv.Unlock()
+
+	now := kv.clock()
+	for _, tx := range kv.transactions {
+		info := kvs.TransactionInfo{
+			ID:           tx.ID,
+			Status:       tx.Status,
+			Age:          now.Sub(tx.StartTime),
+			ReadSet:      sortedKeys(tx.ReadSet),
+			WriteSet:     sortedKeys(tx.WriteSet),
+			Participants: tx.Participants,
+			Coordinator:  tx.Coordinator,
+			Failure:      tx.Failure,
+		}
+		resp.Transactions = append(resp.Transactions, info)
+	}
+	sort.Slice(resp.Transactions, func(i, j int) bool {
+		if resp.Transactions[i].Age != resp.Transactions[j].Age {
+			return resp.Transactions[i].Age > resp.Transactions[j].Age
+		}
+		return resp.Transactions[i].ID < resp.Transactions[j].ID
+	})
+	return nil
+}
+
+// Locks dumps the lock table: every key with a lock held on it, and who
+// holds it.
+func (kv *KVService) Locks(req *kvs.LocksRequest, resp *kvs.LocksResponse) error {
+	kv.Lock()
+	defer kv.Unlock()
+
+	for _, key := range sortedKeys(kv.locks) {
+		lock := kv.locks[key]
+		resp.Locks = append(resp.Locks, kvs.LockEntry{
+			Key:     key,
+			Readers: sortedKeys(lock.Readers),
+			Writer:  lock.Writer,
+		})
+	}
+	return nil
+}
+
+// ForceAbort aborts an active transaction and releases its locks, as if its
+// client had asked to. The client finds out on its next request. Aborting a
+// prepared transaction could undo half of a commit the other participants
+// have already applied, so those are refused.
+func (kv *KVService) ForceAbort(req *kvs.ForceAbortRequest, resp *kvs.ForceAbortResponse) error {
+	defer kv.syncOutcomes()
+	kv.Lock()
+	if kv.raft == nil && kv.role != kvs.RolePrimary {
+		kv.Unlock()
+		resp.Status = kvs.StatusNotPrimary
+		return nil
+	}
+	if err := kv.checkForceAbort(req.TransactionID); err != nil {
+		kv.Unlock()
+		return err
+	}
+
+	if kv.raft != nil {
+		// The abort goes through the log like a client's. The transaction
+		// may prepare before it is applied, so it is checked again then.
+		kv.Unlock()
+		return propose(kv, opForceAbort, req, resp, func() { resp.Status = kvs.StatusNotPrimary })
+	}
+	defer kv.Unlock()
+	return kv.forceAbort(req, resp)
+}
+
+// Helper method to abort a transaction for ForceAbort, unless it has
+// prepared since ForceAbort checked it, in which case it is left to two-phase
+// commit. Must hold kv's lock.
+func (kv *KVService) forceAbort(req *kvs.ForceAbortRequest, resp *kvs.ForceAbortResponse) error {
+	if tx, exists := kv.transactions[req.TransactionID]; exists && tx.Status == "prepared" {
+		resp.Status = kvs.StatusTransactionPrepared
+		return nil
+	}
+	abortResp := kvs.AbortResponse{}
+	err := kv.abort(&kvs.AbortRequest{TransactionID: req.TransactionID}, &abortResp)
+	resp.Status = abortResp.Status
+	return err
+}
+
+// Helper method to check that the transaction txID can be force aborted.
+// Must hold kv's lock.
+func (kv *KVService) checkForceAbort(txID string) error {
+	tx, exists := kv.transactions[txID]
+	if !exists {
+		if outcome, finished := kv.outcomes[txID]; finished {
+			return fmt.Errorf("transaction %s already %s", txID, outcome)
+		}
+		return fmt.Errorf("transaction %s: %w", txID, kvs.ErrUnknownTransaction)
+	}
+	if tx.Status == "prepared" {
+		return fmt.Errorf("transaction %s is prepared; its coordinator decides the outcome", txID)
+	}
+	return nil
+}
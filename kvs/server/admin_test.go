@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/rstutsman/cs6450-labs/kvs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListTransactionsAndLocks(t *testing.T) {
+	kv := NewKVService()
+	get(kv, "tx1", "a")
+	put(kv, "tx1", "b", "1")
+	get(kv, "tx2", "a")
+	put(kv, "tx2", "b", "2")
+
+	txs := kvs.ListTransactionsResponse{}
+	assert.Nil(t, kv.ListTransactions(&kvs.ListTransactionsRequest{}, &txs))
+	assert.Equal(t, 2, len(txs.Transactions))
+	assert.Equal(t, "tx1", txs.Transactions[0].ID)
+	assert.Equal(t, kvs.TxActive, txs.Transactions[0].Status)
+	assert.Equal(t, []string{"a"}, txs.Transactions[0].ReadSet)
+	assert.Equal(t, []string{"b"}, txs.Transactions[0].WriteSet)
+	assert.Equal(t, kvs.StatusWriteLockConflict, txs.Transactions[1].Failure)
+
+	locks := kvs.LocksResponse{}
+	assert.Nil(t, kv.Locks(&kvs.LocksRequest{}, &locks))
+	assert.Equal(t, []kvs.LockEntry{
+		{Key: "a", Readers: []string{"tx1", "tx2"}},
+		{Key: "b", Readers: []string{}, Writer: "tx1"},
+	}, locks.Locks)
+}
+
+func TestForceAbort(t *testing.T) {
+	kv := NewKVService()
+	put(kv, "stuck", "k", "1")
+	put(kv, "prepared", "p", "1")
+	prepareResp := kvs.PrepareResponse{}
+	kv.Prepare(&kvs.PrepareRequest{TransactionID: "prepared", Participants: []string{kv.addr}}, &prepareResp)
+	assert.Equal(t, kvs.StatusOK, prepareResp.Status)
+
+	resp := kvs.ForceAbortResponse{}
+	assert.Nil(t, kv.ForceAbort(&kvs.ForceAbortRequest{TransactionID: "stuck"}, &resp))
+	assert.Equal(t, kvs.StatusOK, resp.Status)
+
+	// Its locks are free, and its client finds out on its next request
+	assert.Equal(t, kvs.StatusOK, put(kv, "next", "k", "2"))
+	assert.Equal(t, kvs.StatusTransactionAborted, put(kv, "stuck", "k", "3"))
+
+	assert.NotNil(t, kv.ForceAbort(&kvs.ForceAbortRequest{TransactionID: "stuck"}, &resp))
+	assert.NotNil(t, kv.ForceAbort(&kvs.ForceAbortRequest{TransactionID: "prepared"}, &resp))
+	assert.NotNil(t, kv.ForceAbort(&kvs.ForceAbortRequest{TransactionID: "unknown"}, &resp))
+	assert.Equal(t, kvs.StatusOK, commit(kv, "prepared"))
+}
+
+// Applies a request as if it had come out of the Raft log.
+func applyLogged(t *testing.T, kv *KVService, opType string, req any) any {
+	request, err := json.Marshal(req)
+	assert.Nil(t, err)
+	command, err := json.Marshal(raftOp{Type: opType, Time: time.Now(), Request: request})
+	assert.Nil(t, err)
+	kv.Lock()
+	defer kv.Unlock()
+	return kv.applyOp(command)
+}
+
+func TestForceAbortRechecksWhenApplied(t *testing.T) {
+	kv := NewKVService()
+	applyLogged(t, kv, opPut, &kvs.PutRequest{TransactionID: "tx1", Key: "k", Value: []byte("1")})
+
+	// ForceAbort finds the transaction active and proposes the abort, but
+	// the transaction's prepare is ahead of it in the log
+	kv.Lock()
+	assert.Nil(t, kv.checkForceAbort("tx1"))
+	kv.Unlock()
+	applyLogged(t, kv, opPrepare, &kvs.PrepareRequest{TransactionID: "tx1", Participants: []string{kv.addr}})
+
+	result := applyLogged(t, kv, opForceAbort, &kvs.ForceAbortRequest{TransactionID: "tx1"})
+	assert.Equal(t, kvs.StatusTransactionPrepared, result.(*kvs.ForceAbortResponse).Status)
+	assert.Equal(t, kvs.StatusOK, commit(kv, "tx1"))
+	assert.Equal(t, "1", committedValue(kv, "k"))
+}
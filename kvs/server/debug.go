@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rstutsman/cs6450-labs/kvs"
+)
+
+const (
+	debugListed      = 20  // rows in each list on /debug/kvs, unless ?n= says otherwise
+	recentAbortsKept = 100 // aborts remembered for /debug/kvs
+)
+
+// abortRecord remembers one aborted transaction for /debug/kvs.
+type abortRecord struct {
+	ID     string
+	Reason string // as in kvs_aborts_total
+	At     time.Time
+	Age    time.Duration // how long the transaction ran here
+	Reads  int
+	Writes int
+}
+
+// Helper method to remember that tx aborted for reason, keeping only the
+// most recent aborts. Must hold kv's lock.
+func (kv *KVService) recordAbort(tx *Transaction, reason string) {
+	now := kv.clock()
+	kv.recentAborts = append(kv.recentAborts, abortRecord{
+		ID:     tx.ID,
+		Reason: reason,
+		At:     now,
+		Age:    now.Sub(tx.StartTime),
+		Reads:  len(tx.ReadSet),
+		Writes: len(tx.WriteSet),
+	})
+	if len(kv.recentAborts) > recentAbortsKept {
+		kv.recentAborts = kv.recentAborts[len(kv.recentAborts)-recentAbortsKept:]
+	}
+}
+
+type debugCount struct {
+	Name  string
+	Count uint64
+}
+
+type debugTransaction struct {
+	ID      string
+	Status  string
+	Age     time.Duration
+	Reads   string
+	Writes  string
+	Failure string
+}
+
+type debugLock struct {
+	Key       string
+	Conflicts uint64
+	Accesses  uint64
+	Mode      string
+	Writer    string
+	Readers   string
+}
+
+type debugLatency struct {
+	Method string
+	Count  uint64
+	Mean   time.Duration
+	P50    time.Duration
+	P99    time.Duration
+	P999   time.Duration
+}
+
+// debugPage is everything /debug/kvs shows, copied out under kv's lock.
+type debugPage struct {
+	Now          time.Time
+	Uptime       time.Duration
+	Addr         string
+	Role         string
+	Epoch        uint64
+	Ranges       []string
+	Counts       []debugCount
+	AbortReasons []debugCount
+	Latencies    []debugLatency
+	Transactions []debugTransaction
+	Locks        []debugLock
+	Aborts       []abortRecord
+}
+
+var debugTemplate = template.Must(template.New("debug").Parse(`<!DOCTYPE html>
+<html>
+<head><title>kvs {{.Addr}}</title></head>
+<body>
+<h1>kvs {{.Addr}}</h1>
+<p>{{.Role}}, shard map epoch {{.Epoch}}, up {{.Uptime}}, as of {{.Now.Format "15:04:05.000"}}.
+Ranges: {{range .Ranges}}<code>{{.}}</code> {{else}}none{{end}}</p>
+<p>See also <a href="/metrics">/metrics</a>, <a href="/debug/pprof/">/debug/pprof</a> and <a href="/debug/rpc">/debug/rpc</a>.</p>
+
+<h2>Stats</h2>
+<table border="1">
+{{range .Counts}}<tr><td>{{.Name}}</td><td align="right">{{.Count}}</td></tr>
+{{end}}</table>
+
+<h3>Aborts by reason</h3>
+<table border="1">
+{{range .AbortReasons}}<tr><td>{{.Name}}</td><td align="right">{{.Count}}</td></tr>
+{{else}}<tr><td>none</td></tr>
+{{end}}</table>
+
+<h3>RPC latency</h3>
+<table border="1">
+<tr><th>method</th><th>count</th><th>mean</th><th>p50</th><th>p99</th><th>p999</th></tr>
+{{range .Latencies}}<tr><td>{{.Method}}</td><td align="right">{{.Count}}</td><td align="right">{{.Mean}}</td><td align="right">{{.P50}}</td><td align="right">{{.P99}}</td><td align="right">{{.P999}}</td></tr>
+{{end}}</table>
+
+<h2>Longest-running transactions</h2>
+<table border="1">
+<tr><th>id</th><th>status</th><th>age</th><th>reads</th><th>writes</th><th>failure</th></tr>
+{{range .Transactions}}<tr><td>{{.ID}}</td><td>{{.Status}}</td><td align="right">{{.Age}}</td><td>{{.Reads}}</td><td>{{.Writes}}</td><td>{{.Failure}}</td></tr>
+{{else}}<tr><td colspan="6">none</td></tr>
+{{end}}</table>
+
+<h2>Most contended locks</h2>
+<p>Conflicts on the keys the hot key sketch tracks, lately.</p>
+<table border="1">
+<tr><th>key</th><th>conflicts</th><th>accesses</th><th>lock mode</th><th>writer</th><th>readers</th></tr>
+{{range .Locks}}<tr><td><code>{{printf "%q" .Key}}</code></td><td align="right">{{.Conflicts}}</td><td align="right">{{.Accesses}}</td><td>{{.Mode}}</td><td>{{.Writer}}</td><td>{{.Readers}}</td></tr>
+{{else}}<tr><td colspan="6">none</td></tr>
+{{end}}</table>
+
+<h2>Recent aborts</h2>
+<table border="1">
+<tr><th>at</th><th>id</th><th>reason</th><th>ran for</th><th>reads</th><th>writes</th></tr>
+{{range .Aborts}}<tr><td>{{.At.Format "15:04:05.000"}}</td><td>{{.ID}}</td><td>{{.Reason}}</td><td align="right">{{.Age}}</td><td align="right">{{.Reads}}</td><td align="right">{{.Writes}}</td></tr>
+{{else}}<tr><td colspan="6">none</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// serveDebug writes a page for people about the server's state: its stats,
+// its longest-running transactions, its most contended locks and its most
+// recent aborts. ?n= sets how many rows each list gets.
+func (kv *KVService) serveDebug(w http.ResponseWriter, r *http.Request) {
+	n := debugListed
+	if v, err := strconv.Atoi(r.URL.Query().Get("n")); err == nil && v > 0 {
+		n = v
+	}
+
+	latency := kv.rpcMetrics.snapshot()
+	kv.Lock()
+	page := kv.debugPage(n)
+	kv.Unlock()
+
+	for _, method := range sortedKeys(latency) {
+		h := latency[method]
+		page.Latencies = append(page.Latencies, debugLatency{
+			Method: method,
+			Count:  h.Count(),
+			Mean:   h.Mean(),
+			P50:    h.Quantile(0.50),
+			P99:    h.Quantile(0.99),
+			P999:   h.Quantile(0.999),
+		})
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := debugTemplate.Execute(w, page); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Helper method to copy what /debug/kvs shows, with n rows in each list.
+// Must hold kv's lock.
+func (kv *KVService) debugPage(n int) *debugPage {
+	now := kv.clock()
+	page := &debugPage{
+		Now:    now,
+		Uptime: time.Since(kv.started).Round(time.Second),
+		Addr:   kv.addr,
+		Role:   kv.role,
+		Epoch:  kv.epoch,
+	}
+	for _, r := range kv.ranges {
+		page.Ranges = append(page.Ranges, fmt.Sprintf("[%q, %q)", r.start, r.end))
+	}
+	page.Counts = []debugCount{
+		{"gets", kv.stats.gets},
+		{"puts", kv.stats.puts},
+		{"scans", kv.stats.scans},
+		{"commits (lead participant)", kv.stats.commits},
+		{"aborts (lead participant)", kv.stats.aborts},
+		{"commits (any participant)", kv.committed},
+		{"active transactions", uint64(kv.active)},
+		{"locked keys", uint64(len(kv.locks))},
+		{"keys", uint64(len(kv.mp))},
+	}
+	for _, reason := range sortedKeys(kv.abortReasons) {
+		page.AbortReasons = append(page.AbortReasons, debugCount{reason, kv.abortReasons[reason]})
+	}
+
+	txs := make([]*Transaction, 0, len(kv.transactions))
+	for _, tx := range kv.transactions {
+		txs = append(txs, tx)
+	}
+	sort.Slice(txs, func(i, j int) bool { return txs[i].StartTime.Before(txs[j].StartTime) })
+	for _, tx := range txs[:min(n, len(txs))] {
+		failure := ""
+		if tx.Failure != kvs.StatusUnknown {
+			failure = tx.Failure.String()
+		}
+		page.Transactions = append(page.Transactions, debugTransaction{
+			ID:      tx.ID,
+			Status:  tx.Status,
+			Age:     now.Sub(tx.StartTime),
+			Reads:   strings.Join(sortedKeys(tx.ReadSet), " "),
+			Writes:  strings.Join(sortedKeys(tx.WriteSet), " "),
+			Failure: failure,
+		})
+	}
+
+	counters := make([]*hotKeyCounter, 0, len(kv.hotKeys.heap))
+	for _, c := range kv.hotKeys.heap {
+		if c.conflicts > 0 {
+			counters = append(counters, c)
+		}
+	}
+	sort.Slice(counters, func(i, j int) bool {
+		if counters[i].conflicts != counters[j].conflicts {
+			return counters[i].conflicts > counters[j].conflicts
+		}
+		return counters[i].key < counters[j].key
+	})
+	for _, c := range counters[:min(n, len(counters))] {
+		lock := debugLock{Key: c.key, Conflicts: c.conflicts, Accesses: c.accesses, Mode: kv.lockMode(c.key)}
+		if held, exists := kv.locks[c.key]; exists {
+			lock.Writer = held.Writer
+			lock.Readers = strings.Join(sortedKeys(held.Readers), " ")
+		}
+		page.Locks = append(page.Locks, lock)
+	}
+
+	// Newest first
+	for i := len(kv.recentAborts) - 1; i >= 0 && len(page.Aborts) < n; i-- {
+		page.Aborts = append(page.Aborts, kv.recentAborts[i])
+	}
+	return page
+}
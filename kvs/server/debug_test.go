@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rstutsman/cs6450-labs/kvs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDebugPage(t *testing.T) {
+	kv := NewKVService()
+	_, status := get(kv, "holder", "hot")
+	assert.Equal(t, kvs.StatusOK, status)
+	assert.Equal(t, kvs.StatusWriteLockConflict, put(kv, "writer", "hot", "x"))
+	kv.Abort(&kvs.AbortRequest{TransactionID: "writer"}, &kvs.AbortResponse{})
+
+	page := kv.debugPage(debugListed)
+	assert.Equal(t, "holder", page.Transactions[0].ID)
+	assert.Equal(t, "hot", page.Transactions[0].Reads)
+	assert.Equal(t, "hot", page.Locks[0].Key)
+	assert.Equal(t, uint64(1), page.Locks[0].Conflicts)
+	assert.Equal(t, "holder", page.Locks[0].Readers)
+	assert.Equal(t, "writer", page.Aborts[0].ID)
+	assert.Equal(t, "write_lock_conflict", page.Aborts[0].Reason)
+
+	recorder := httptest.NewRecorder()
+	kv.serveDebug(recorder, httptest.NewRequest("GET", "/debug/kvs", nil))
+	assert.Equal(t, 200, recorder.Code)
+	assert.Contains(t, recorder.Body.String(), "<td>write_lock_conflict</td>")
+
+	// Only the most recent aborts are kept, newest first
+	for i := 0; i < recentAbortsKept+10; i++ {
+		txID := fmt.Sprint("tx", i)
+		put(kv, txID, "k", "v")
+		kv.Abort(&kvs.AbortRequest{TransactionID: txID}, &kvs.AbortResponse{})
+	}
+	assert.Equal(t, recentAbortsKept, len(kv.recentAborts))
+	page = kv.debugPage(5)
+	assert.Equal(t, 5, len(page.Aborts))
+	assert.Equal(t, fmt.Sprint("tx", recentAbortsKept+9), page.Aborts[0].ID)
+}
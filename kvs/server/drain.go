@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/rstutsman/cs6450-labs/kvs"
+)
+
+// Helper method to refuse the first request of a new transaction while the
+// server drains. Transactions that are already running carry on. The check
+// is made before a request is proposed with Raft, so every replica applies
+// the same requests. Must not hold kv's lock.
+func (kv *KVService) admit(txID string) kvs.Status {
+	if !kv.draining.Load() {
+		return kvs.StatusOK
+	}
+	kv.Lock()
+	defer kv.Unlock()
+	if _, exists := kv.transactions[txID]; exists {
+		return kvs.StatusOK
+	}
+	if _, finished := kv.outcomes[txID]; finished {
+		// Let the request report the outcome
+		return kvs.StatusOK
+	}
+	return kvs.StatusDraining
+}
+
+// drain stops the server taking new transactions and waits up to timeout
+// for the ones running to commit or abort. Then it aborts those that are
+// still active. Prepared transactions are left for two-phase commit to
+// decide; their backups, if any, know about them. Returns how many
+// transactions were aborted and how many are still prepared.
+func (kv *KVService) drain(timeout time.Duration) (aborted, prepared int) {
+	kv.draining.Store(true)
+	deadline := time.Now().Add(timeout)
+
+	kv.Lock()
+	for kv.active > 0 {
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			break
+		}
+		released := kv.released
+		timer := time.NewTimer(wait)
+		kv.Unlock()
+		select {
+		case <-released:
+		case <-timer.C:
+		}
+		timer.Stop()
+		kv.Lock()
+	}
+	var active []string
+	for txID, tx := range kv.transactions {
+		if tx.Status == "active" {
+			tx.fail(kvs.StatusDraining)
+			active = append(active, txID)
+		}
+	}
+	kv.Unlock()
+
+	for _, txID := range active {
+		resp := kvs.ForceAbortResponse{}
+		if err := kv.ForceAbort(&kvs.ForceAbortRequest{TransactionID: txID}, &resp); err == nil && resp.Status == kvs.StatusOK {
+			aborted++
+		}
+	}
+
+	kv.Lock()
+	defer kv.Unlock()
+	return aborted, kv.active
+}
+
+// shutdown drains the server for up to timeout, flushes the outcome log,
+// ends the trace file and prints the server's totals for its whole run.
+func (kv *KVService) shutdown(timeout time.Duration) {
+	aborted, prepared := kv.drain(timeout)
+	log.Printf("drained: aborted %d active transactions, %d still prepared", aborted, prepared)
+
+	kv.Lock()
+	if kv.outcomeLog != nil {
+		if err := kv.outcomeLog.Sync(); err != nil {
+			log.Printf("outcome log: %v", err)
+		}
+	}
+	if err := kv.tracer.Close(); err != nil {
+		log.Printf("trace: %v", err)
+	}
+	stats := kv.stats
+	committed := kv.committed
+	reasons := make(map[string]uint64, len(kv.abortReasons))
+	for reason, n := range kv.abortReasons {
+		reasons[reason] = n
+	}
+	kv.Unlock()
+
+	elapsed := time.Since(kv.started)
+	fmt.Printf("final stats over %v\n", elapsed.Round(time.Second))
+	fmt.Printf("gets %d\nputs %d\nscans %d\ncommits %d\naborts %d\ncommitted here %d\n",
+		stats.gets, stats.puts, stats.scans, stats.commits, stats.aborts, committed)
+	for _, reason := range sortedKeys(reasons) {
+		fmt.Printf("aborts %s %d\n", reason, reasons[reason])
+	}
+	latency := kv.rpcMetrics.snapshot()
+	for _, method := range sortedKeys(latency) {
+		h := latency[method]
+		fmt.Printf("%s latency %v\n", method, &h)
+	}
+}
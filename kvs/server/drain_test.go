@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/rstutsman/cs6450-labs/kvs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDrainLetsActiveTransactionsFinish(t *testing.T) {
+	kv := NewKVService()
+	assert.Equal(t, kvs.StatusOK, put(kv, "tx1", "a", "1"))
+
+	done := make(chan int)
+	go func() {
+		aborted, prepared := kv.drain(5 * time.Second)
+		done <- aborted + prepared
+	}()
+	assert.Eventually(t, kv.draining.Load, time.Second, time.Millisecond)
+
+	// New transactions are turned away, but tx1 can finish
+	assert.Equal(t, kvs.StatusDraining, put(kv, "tx2", "b", "2"))
+	_, status := get(kv, "tx3", "a")
+	assert.Equal(t, kvs.StatusDraining, status)
+	assert.Equal(t, kvs.StatusOK, put(kv, "tx1", "b", "1"))
+	assert.Equal(t, kvs.StatusOK, commit(kv, "tx1"))
+
+	select {
+	case left := <-done:
+		assert.Equal(t, 0, left)
+	case <-time.After(time.Second):
+		t.Fatal("drain didn't return once no transactions were left")
+	}
+	assert.Equal(t, "1", committedValue(kv, "b"))
+}
+
+func TestDrainAbortsActiveTransactionsAtDeadline(t *testing.T) {
+	kv := NewKVService()
+	assert.Equal(t, kvs.StatusOK, put(kv, "active", "a", "1"))
+	assert.Equal(t, kvs.StatusOK, put(kv, "prepared", "b", "1"))
+	prepareResp := kvs.PrepareResponse{}
+	kv.Prepare(&kvs.PrepareRequest{TransactionID: "prepared", Participants: []string{kv.addr}}, &prepareResp)
+	assert.Equal(t, kvs.StatusOK, prepareResp.Status)
+
+	aborted, prepared := kv.drain(10 * time.Millisecond)
+	assert.Equal(t, 1, aborted)
+	assert.Equal(t, 1, prepared)
+	assert.Equal(t, uint64(1), kv.abortReasons["server_draining"])
+	assert.Equal(t, kvs.StatusTransactionAborted, put(kv, "active", "a", "2"))
+
+	// The prepared transaction is still decided by its coordinator
+	assert.Equal(t, kvs.StatusOK, commit(kv, "prepared"))
+	assert.Equal(t, "1", committedValue(kv, "b"))
+}
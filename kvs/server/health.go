@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// serveHealthz reports that the server is up and answering HTTP.
+func (kv *KVService) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// serveReadyz reports whether the server is ready to serve transactions,
+// with 503 and the reason if it isn't.
+func (kv *KVService) serveReadyz(w http.ResponseWriter, r *http.Request) {
+	kv.Lock()
+	reason := kv.notReady()
+	kv.Unlock()
+
+	if reason != "" {
+		http.Error(w, reason, http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ready")
+}
+
+// Helper method to explain why the server isn't ready to serve
+// transactions, or return an empty string if it is. Must hold kv's lock.
+func (kv *KVService) notReady() string {
+	switch {
+	case kv.draining.Load():
+		return "draining"
+	case kv.raft != nil && kv.raft.Recovering():
+		return "replaying the raft log"
+	case kv.raft != nil && kv.leaderAddr() == "":
+		return "no raft leader"
+	case kv.needsSnapshot:
+		return "waiting for a snapshot from the primary"
+	case len(kv.ranges) == 0:
+		return "owns no key range"
+	}
+	return ""
+}
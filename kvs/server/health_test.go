@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rstutsman/cs6450-labs/kvs"
+	"github.com/stretchr/testify/assert"
+)
+
+func readyz(kv *KVService) (int, string) {
+	recorder := httptest.NewRecorder()
+	kv.serveReadyz(recorder, httptest.NewRequest("GET", "/readyz", nil))
+	return recorder.Code, recorder.Body.String()
+}
+
+func TestReadyz(t *testing.T) {
+	kv := NewKVService()
+	code, body := readyz(kv)
+	assert.Equal(t, 200, code)
+	assert.Equal(t, "ready\n", body)
+
+	// A backup isn't ready until the primary has sent it the store
+	kv.role = kvs.RoleBackup
+	kv.needsSnapshot = true
+	code, body = readyz(kv)
+	assert.Equal(t, 503, code)
+	assert.Equal(t, "waiting for a snapshot from the primary\n", body)
+	kv.InstallSnapshot(&kvs.SnapshotRequest{Term: 1, Primary: "primary", Ranges: []kvs.RangeInfo{{}}}, &kvs.SnapshotResponse{})
+	code, _ = readyz(kv)
+	assert.Equal(t, 200, code)
+
+	// Nor is a server that owns nothing
+	kv.setRanges(nil, 2)
+	_, body = readyz(kv)
+	assert.Equal(t, "owns no key range\n", body)
+	kv.setRanges([]kvs.RangeInfo{{Start: "a", End: "m"}}, 3)
+	code, _ = readyz(kv)
+	assert.Equal(t, 200, code)
+
+	kv.draining.Store(true)
+	code, body = readyz(kv)
+	assert.Equal(t, 503, code)
+	assert.Equal(t, "draining\n", body)
+}
+
+func TestReadyzWithRaft(t *testing.T) {
+	g := startRaftGroup(t, "shard", 3)
+	g.leader()
+
+	// Followers are ready once they know the leader
+	for i := range g.addrs {
+		kv := g.replica(i)
+		assert.Eventually(t, func() bool {
+			code, _ := readyz(kv)
+			return code == 200
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+}
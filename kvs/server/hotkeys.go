@@ -0,0 +1,257 @@
+package main
+
+import (
+	"container/heap"
+	"sort"
+	"time"
+
+	"github.com/rstutsman/cs6450-labs/kvs"
+)
+
+const (
+	defaultHotKeyCapacity = 1024
+	defaultHotKeyShare    = 0.02
+	defaultLockWait       = 5 * time.Millisecond
+	hotKeyDecayInterval   = 10 * time.Second
+	minHotAccesses        = 1000 // don't call any key hot before the server has seen this many accesses
+)
+
+// hotKeyCounter is the sketch's estimate for one key.
+type hotKeyCounter struct {
+	key       string
+	accesses  uint64
+	conflicts uint64
+	error     uint64 // accesses inherited from the key this counter replaced
+	index     int    // position in the sketch's heap
+}
+
+// hotKeyHeap orders counters least accessed first.
+type hotKeyHeap []*hotKeyCounter
+
+func (h hotKeyHeap) Len() int           { return len(h) }
+func (h hotKeyHeap) Less(i, j int) bool { return h[i].accesses < h[j].accesses }
+func (h hotKeyHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *hotKeyHeap) Push(x any) {
+	c := x.(*hotKeyCounter)
+	c.index = len(*h)
+	*h = append(*h, c)
+}
+
+func (h *hotKeyHeap) Pop() any {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
+
+// hotKeySketch estimates the most accessed keys in bounded space with the
+// Space-Saving algorithm. It counts at most capacity keys; an untracked key
+// takes over the counter of the least accessed one, keeping its count as an
+// overestimate. Any key that gets more than total/capacity of the accesses is
+// always tracked. Counts halve every hotKeyDecayInterval, so the sketch
+// follows the keys that are hot now.
+type hotKeySketch struct {
+	capacity int
+	counters map[string]*hotKeyCounter
+	heap     hotKeyHeap
+	total    uint64
+}
+
+func newHotKeySketch(capacity int) *hotKeySketch {
+	return &hotKeySketch{capacity: capacity, counters: make(map[string]*hotKeyCounter)}
+}
+
+// access counts a get or put of key.
+func (s *hotKeySketch) access(key string) {
+	if s.capacity <= 0 {
+		return
+	}
+	s.total++
+
+	c, tracked := s.counters[key]
+	if !tracked && len(s.heap) < s.capacity {
+		c = &hotKeyCounter{key: key}
+		s.counters[key] = c
+		heap.Push(&s.heap, c)
+	} else if !tracked {
+		c = s.heap[0]
+		delete(s.counters, c.key)
+		c.key = key
+		c.error = c.accesses
+		c.conflicts = 0
+		s.counters[key] = c
+	}
+	c.accesses++
+	heap.Fix(&s.heap, c.index)
+}
+
+// conflict counts a get or put of key that found it locked.
+func (s *hotKeySketch) conflict(key string) {
+	if c, tracked := s.counters[key]; tracked {
+		c.conflicts++
+	}
+}
+
+// decay halves every count. Halving keeps the heap in order.
+func (s *hotKeySketch) decay() {
+	s.total /= 2
+	for _, c := range s.heap {
+		c.accesses /= 2
+		c.conflicts /= 2
+		c.error /= 2
+	}
+}
+
+// isHot reports whether key surely got at least share of the accesses.
+func (s *hotKeySketch) isHot(key string, share float64) bool {
+	c, tracked := s.counters[key]
+	if !tracked || share <= 0 || s.total < minHotAccesses {
+		return false
+	}
+	return float64(c.accesses-c.error) >= share*float64(s.total)
+}
+
+// top returns the n most accessed keys, most accessed first.
+func (s *hotKeySketch) top(n int) []*hotKeyCounter {
+	// Sort a copy, leaving the heap intact
+	counters := append([]*hotKeyCounter(nil), s.heap...)
+	sort.Slice(counters, func(i, j int) bool {
+		if counters[i].accesses != counters[j].accesses {
+			return counters[i].accesses > counters[j].accesses
+		}
+		return counters[i].key < counters[j].key
+	})
+	return counters[:min(n, len(counters))]
+}
+
+// HotKeys lists the keys this server has seen the most gets and puts for
+// lately. Every replica keeps its own counts.
+func (kv *KVService) HotKeys(req *kvs.HotKeysRequest, resp *kvs.HotKeysResponse) error {
+	kv.Lock()
+	defer kv.Unlock()
+
+	n := req.N
+	if n <= 0 {
+		n = 10
+	}
+	for _, c := range kv.hotKeys.top(n) {
+		resp.Keys = append(resp.Keys, kvs.HotKey{
+			Key:       c.key,
+			Accesses:  c.accesses,
+			Conflicts: c.conflicts,
+			Error:     c.error,
+			Hot:       kv.hotKeys.isHot(c.key, kv.hotShare),
+			Mode:      kv.lockMode(c.key),
+		})
+	}
+	resp.Total = kv.hotKeys.total
+	return nil
+}
+
+// decayHotKeys halves the hot key counts, so keys that cool off drop out.
+func (kv *KVService) decayHotKeys() {
+	kv.Lock()
+	defer kv.Unlock()
+	kv.hotKeys.decay()
+}
+
+// Helper method to pick the lock mode for key: hot keys use kv.hotMode, the
+// rest never wait. Must hold kv's lock.
+func (kv *KVService) lockMode(key string) string {
+	if kv.hotMode == kvs.LockWait && kv.hotKeys.isHot(key, kv.hotShare) {
+		return kvs.LockWait
+	}
+	return kvs.LockNoWait
+}
+
+// Helper method to take a lock on key for tx with acquire, which reports a
+// conflict if another transaction holds it. Under kvs.LockWait, a conflict
+// waits up to kv.lockWait for locks to be released and tries again, unless
+// a holder is itself waiting, directly or not, for a lock tx holds: then
+// tx is the deadlock victim and fails at once. Waiting drops kv's lock, so
+// tx may be aborted or the key's range fenced in the meantime. With Raft,
+// requests are applied from the log and never wait. Must hold kv's lock.
+func (kv *KVService) acquireLock(key string, tx *Transaction, acquire func() kvs.Status) kvs.Status {
+	status := acquire()
+	if status == kvs.StatusOK {
+		return status
+	}
+	kv.hotKeys.conflict(key)
+	if kv.raft != nil || kv.lockMode(key) != kvs.LockWait {
+		return status
+	}
+
+	defer kv.tracer.Span(tx.TraceID, "lock wait", time.Now(), "key", key)
+	deadline := time.Now().Add(kv.lockWait)
+	defer delete(kv.waiting, tx.ID)
+	for status != kvs.StatusOK {
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return status
+		}
+		if kv.waitsForItself(key, tx.ID) {
+			return kvs.StatusDeadlockVictim
+		}
+		kv.waiting[tx.ID] = key
+		released := kv.released
+		timer := time.NewTimer(wait)
+		kv.Unlock()
+		select {
+		case <-released:
+		case <-timer.C:
+		}
+		timer.Stop()
+		kv.Lock()
+
+		if kv.transactions[tx.ID] != tx {
+			return kvs.StatusTransactionAborted
+		}
+		if status := kv.placement(key, 0); status != kvs.StatusOK {
+			return status
+		}
+		status = acquire()
+	}
+	return status
+}
+
+// Helper method to report whether txID waiting for the lock on key would
+// complete a cycle: following the holders of each lock to the lock they are
+// waiting for leads back to a lock txID holds. Conflicts with scans have no
+// holder to follow and are left to the lock wait. Must hold kv's lock.
+func (kv *KVService) waitsForItself(key, txID string) bool {
+	seen := make(map[string]bool)
+	keys := []string{key}
+	for first := true; len(keys) > 0; first = false {
+		lock := kv.locks[keys[len(keys)-1]]
+		keys = keys[:len(keys)-1]
+		if lock == nil {
+			continue
+		}
+		holders := make([]string, 0, len(lock.Readers)+1)
+		if lock.Writer != "" {
+			holders = append(holders, lock.Writer)
+		}
+		for reader := range lock.Readers {
+			holders = append(holders, reader)
+		}
+		for _, holder := range holders {
+			// txID may already hold a read lock on the key it waits to upgrade
+			if holder == txID {
+				if first {
+					continue
+				}
+				return true
+			}
+			if waitingFor, ok := kv.waiting[holder]; ok && !seen[waitingFor] {
+				seen[waitingFor] = true
+				keys = append(keys, waitingFor)
+			}
+		}
+	}
+	return false
+}
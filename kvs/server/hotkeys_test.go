@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/rstutsman/cs6450-labs/kvs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHotKeySketchFindsHeavyHitters(t *testing.T) {
+	s := newHotKeySketch(64)
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 100000; i++ {
+		switch {
+		case i%10 == 0:
+			s.access("hot1")
+		case i%20 == 1:
+			s.access("hot2")
+		default:
+			s.access(fmt.Sprintf("cold%d", r.Intn(10000)))
+		}
+	}
+
+	// The sketch stays bounded and still ranks the heavy hitters first
+	assert.Equal(t, 64, len(s.counters))
+	top := s.top(2)
+	assert.Equal(t, "hot1", top[0].key)
+	assert.Equal(t, "hot2", top[1].key)
+	assert.True(t, top[0].accesses >= 10000)
+	assert.True(t, s.isHot("hot1", 0.05))
+	assert.True(t, s.isHot("hot2", 0.04))
+	assert.False(t, s.isHot("hot2", 0.2))
+
+	// Counts decay, and a key that is no longer accessed stops being hot
+	for i := 0; i < 10; i++ {
+		s.decay()
+		for j := 0; j < 10000; j++ {
+			s.access("hot2")
+		}
+	}
+	assert.Equal(t, "hot2", s.top(1)[0].key)
+	assert.False(t, s.isHot("hot1", 0.05))
+}
+
+func TestHotKeysRPC(t *testing.T) {
+	kv := NewKVService()
+	kv.hotShare = 0.3
+	for i := 0; i < 2000; i++ {
+		txID := fmt.Sprint("tx", i)
+		key := "warm"
+		if i%2 == 0 {
+			key = "hot"
+		} else if i%4 == 1 {
+			key = fmt.Sprint("cold", i)
+		}
+		get(kv, txID, key)
+		commit(kv, txID)
+	}
+	get(kv, "holder", "hot")
+	put(kv, "writer", "hot", "x")
+
+	resp := kvs.HotKeysResponse{}
+	assert.Nil(t, kv.HotKeys(&kvs.HotKeysRequest{N: 2}, &resp))
+	assert.Equal(t, uint64(2002), resp.Total)
+	assert.Equal(t, 2, len(resp.Keys))
+	assert.Equal(t, "hot", resp.Keys[0].Key)
+	assert.Equal(t, uint64(1), resp.Keys[0].Conflicts)
+	assert.True(t, resp.Keys[0].Hot)
+	assert.Equal(t, kvs.LockNoWait, resp.Keys[0].Mode)
+	assert.Equal(t, "warm", resp.Keys[1].Key)
+	assert.False(t, resp.Keys[1].Hot)
+}
+
+func TestHotKeysWaitForLocks(t *testing.T) {
+	kv := NewKVService()
+	kv.hotMode = kvs.LockWait
+	kv.lockWait = time.Second
+	for i := 0; i < minHotAccesses; i++ {
+		get(kv, "warmup", "hot")
+	}
+	commit(kv, "warmup")
+
+	// A cold key still conflicts at once
+	assert.Equal(t, kvs.StatusOK, put(kv, "holder", "cold", "1"))
+	assert.Equal(t, kvs.StatusWriteLockConflict, put(kv, "writer", "cold", "2"))
+
+	// A hot key waits for the holder to commit
+	assert.Equal(t, kvs.StatusOK, put(kv, "holder", "hot", "1"))
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		kv.Commit(&kvs.CommitRequest{TransactionID: "holder", Lead: true}, &kvs.CommitResponse{})
+	}()
+	began := time.Now()
+	assert.Equal(t, kvs.StatusOK, put(kv, "writer", "hot", "2"))
+	assert.True(t, time.Since(began) < time.Second)
+	assert.Equal(t, kvs.StatusOK, commit(kv, "writer"))
+	assert.Equal(t, "2", committedValue(kv, "hot"))
+
+	// But not past the lock wait
+	kv.lockWait = 10 * time.Millisecond
+	assert.Equal(t, kvs.StatusOK, put(kv, "holder2", "hot", "3"))
+	assert.Equal(t, kvs.StatusWriteLockConflict, put(kv, "writer2", "hot", "4"))
+}
+
+func TestLockWaitDeadlockPicksVictim(t *testing.T) {
+	kv := NewKVService()
+	kv.hotMode = kvs.LockWait
+	kv.lockWait = 5 * time.Second
+	for i := 0; i < minHotAccesses; i++ {
+		get(kv, "warmup", "a")
+		get(kv, "warmup", "b")
+	}
+	commit(kv, "warmup")
+
+	// tx1 waits for tx2's lock on b
+	assert.Equal(t, kvs.StatusOK, put(kv, "tx1", "a", "1"))
+	assert.Equal(t, kvs.StatusOK, put(kv, "tx2", "b", "2"))
+	done := make(chan kvs.Status)
+	go func() { done <- put(kv, "tx1", "b", "1") }()
+	assert.Eventually(t, func() bool {
+		kv.Lock()
+		defer kv.Unlock()
+		return kv.waiting["tx1"] == "b"
+	}, time.Second, time.Millisecond)
+
+	// So tx2 waiting for tx1's lock on a would never end; it fails at once
+	began := time.Now()
+	assert.Equal(t, kvs.StatusDeadlockVictim, put(kv, "tx2", "a", "2"))
+	assert.True(t, time.Since(began) < time.Second)
+
+	// And once it aborts, tx1 gets the lock
+	kv.Abort(&kvs.AbortRequest{TransactionID: "tx2"}, &kvs.AbortResponse{})
+	assert.Equal(t, kvs.StatusOK, <-done)
+	assert.Equal(t, kvs.StatusOK, commit(kv, "tx1"))
+}
@@ -6,16 +6,28 @@ import (
 	"log"
 	"net"
 	"net/http"
+	_ "net/http/pprof"
 	"net/rpc"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/rstutsman/cs6450-labs/kvs"
+	"github.com/rstutsman/cs6450-labs/kvs/raft"
 )
 
 type Stats struct {
 	puts    uint64
 	gets    uint64
+	scans   uint64
 	commits uint64
 	aborts  uint64
 }
@@ -24,16 +36,42 @@ func (s *Stats) Sub(prev *Stats) Stats {
 	r := Stats{}
 	r.puts = s.puts - prev.puts
 	r.gets = s.gets - prev.gets
+	r.scans = s.scans - prev.scans
 	r.commits = s.commits - prev.commits
 	r.aborts = s.aborts - prev.aborts
 	return r
 }
 
 type Transaction struct {
-	ID       string
-	ReadSet  map[string]bool
-	WriteSet map[string]string
-	Status   string // "active", "committed", "aborted"
+	ID           string
+	ReadSet      map[string]bool
+	WriteSet     map[string]Write
+	Status       string    // "active" or "prepared"; finished transactions only keep an outcome
+	StartTime    time.Time // when this server first saw the transaction
+	PreparedAt   time.Time
+	Participants []string        // every participant's address, known once prepared
+	Coordinator  string          // address of the coordinator, if one decides the outcome
+	Scans        []keySpan       // spans read by scans, which other transactions can't insert into
+	Expired      map[string]bool // keys it found expired but still locked, which it keeps seeing as absent
+	Failure      kvs.Status      // why the first of its requests that failed here did; StatusUnknown if none has
+	TraceID      string          // trace its requests are recorded in, if any
+}
+
+// Write is a pending write buffered in a transaction until commit.
+type Write struct {
+	Value []byte
+	TTL   time.Duration // zero means the value never expires
+}
+
+// Entry is a committed value in the store.
+type Entry struct {
+	Value     []byte
+	Version   uint64    // commit version of the transaction that wrote it
+	ExpiresAt time.Time // zero means the entry never expires
+}
+
+func (e *Entry) expired(now time.Time) bool {
+	return !e.ExpiresAt.IsZero() && !now.Before(e.ExpiresAt)
 }
 
 type LockInfo struct {
@@ -43,94 +81,298 @@ type LockInfo struct {
 
 type KVService struct {
 	sync.Mutex
-	mp           map[string]string
+	mp           map[string]*Entry
+	expiring     map[string]bool // keys in mp that have an expiry time
+	version      uint64          // version assigned to the last committed write set
+	incarnation  uint64          // which numbering version belongs to; new when the store starts empty, and taken from the primary with a snapshot
+	history      []*Change       // recent committed write sets, oldest first
+	maxHistory   int
+	changed      chan struct{} // closed and replaced whenever a write set commits
+	maxKeySize   int
+	maxValueSize int
 	stats        Stats
 	prevStats    Stats
+	prevLatency  map[string]kvs.Histogram // RPC latencies as of the last printStats
 	lastPrint    time.Time
 	transactions map[string]*Transaction
 	locks        map[string]*LockInfo
+	active       int               // transactions that are neither committed nor aborted
+	maxActive    int               // reject new transactions beyond this many; zero means no limit
+	outcomes     map[string]string // outcome of every finished transaction by ID, until it is forgotten
+	outcomeLog   *kvs.Log
+	finished     []finishedTx  // transactions whose outcomes are kept, oldest first
+	retention    time.Duration // forget outcomes this old; zero means never
+	logged       int           // records in the outcome log, forgotten or not
+
+	addr               string // this server's address as clients and peers know it
+	peers              *kvs.Peers
+	txTimeout          time.Duration // expire transactions active this long; zero means never
+	terminationTimeout time.Duration // resolve transactions prepared this long
+
+	role             string                 // kvs.RolePrimary or kvs.RoleBackup
+	term             uint64                 // increases each time a replica of this shard is promoted
+	replicas         []string               // every replica of this shard in promotion order, including this one
+	primary          string                 // the shard's primary as far as this replica knows
+	backups          map[string]*backupSync // on the primary: the backups that successful responses wait for
+	backlog          []kvs.ReplicateRequest // on the primary: records some in-sync backup hasn't been sent, ending with record seq
+	seq              uint64                 // on the primary: records built this term
+	replicating      sync.Mutex             // on the primary: held while sending records or snapshots, so they go out in order; taken before kv's lock
+	replicated       chan struct{}          // closed and replaced whenever backups catch up or the primary steps down
+	replicateTimeout time.Duration          // give up waiting for backups after this long and report the outcome unknown
+	backupTimeout    time.Duration          // stop waiting for a backup that has been out of sync this long
+	lastHeard        time.Time              // on a backup: when the primary was last heard from
+	failoverTimeout  time.Duration          // on a backup: take over after this long without the primary; zero means never
+	needsSnapshot    bool                   // on a backup: may have missed records, so it can't take over until the primary sends it a snapshot
+	appliedTerm      uint64                 // on a backup: term of the primary whose records it last applied
+	applied          uint64                 // on a backup: the last of those records it applied
+
+	raft           *raft.Raft         // the shard's Raft node, if replicated with Raft
+	pending        map[int]*pendingOp // proposals by log index, waiting to be applied
+	applyTime      time.Time          // leader's time for the entry being applied
+	proposeTimeout time.Duration      // give up on a proposal that hasn't applied after this long
+	snapshotEvery  int                // snapshot the state and compact the Raft log every this many entries; zero means never
+	snapshotIndex  int                // the entry the last snapshot was taken or installed at
+
+	ranges      []*keyRange // ranges of placement keys this server owns, in key order
+	epoch       uint64      // epoch of the shard map the ranges were last assigned from
+	splitKeys   int         // split a range holding more keys than this; zero means never
+	splitLoad   float64     // split a range serving more operations a second than this; zero means never
+	lastBalance time.Time
+
+	hotKeys  *hotKeySketch
+	hotShare float64           // a key is hot once it gets this share of accesses; zero means none is
+	hotMode  string            // lock mode for hot keys
+	lockWait time.Duration     // how long a request on a key in kvs.LockWait mode waits for the lock
+	released chan struct{}     // closed and replaced whenever a transaction releases its locks
+	waiting  map[string]string // transactions waiting for a lock, by ID, and the key each waits for
+
+	committed    uint64            // transactions committed here, as lead participant or not
+	abortReasons map[string]uint64 // transactions aborted here, by reason
+	rpcMetrics   *rpcMetrics
+	recentAborts []abortRecord // the last recentAbortsKept aborts, oldest first
+	started      time.Time
+	draining     atomic.Bool // set on shutdown; new transactions are refused
+	tracer       *kvs.Tracer // where traced requests' spans go, if anywhere
 }
 
 func NewKVService() *KVService {
-	kvs := &KVService{}
-	kvs.mp = make(map[string]string)
-	kvs.lastPrint = time.Now()
-	kvs.transactions = make(map[string]*Transaction)
-	kvs.locks = make(map[string]*LockInfo)
-	return kvs
+	kv := &KVService{}
+	kv.mp = make(map[string]*Entry)
+	kv.expiring = make(map[string]bool)
+	kv.incarnation = newIncarnation()
+	kv.maxHistory = defaultMaxHistory
+	kv.changed = make(chan struct{})
+	kv.maxKeySize = kvs.DefaultMaxKeySize
+	kv.maxValueSize = kvs.DefaultMaxValueSize
+	kv.lastPrint = time.Now()
+	kv.transactions = make(map[string]*Transaction)
+	kv.locks = make(map[string]*LockInfo)
+	kv.outcomes = make(map[string]string)
+	kv.retention = defaultOutcomeRetention
+	kv.peers = kvs.NewPeers()
+	kv.txTimeout = 30 * time.Second
+	kv.terminationTimeout = 5 * time.Second
+	kv.role = kvs.RolePrimary
+	kv.proposeTimeout = 2 * time.Second
+	kv.snapshotEvery = defaultSnapshotEntries
+	kv.replicated = make(chan struct{})
+	kv.replicateTimeout = 2 * time.Second
+	kv.backupTimeout = time.Second
+	kv.ranges = []*keyRange{{}}
+	kv.splitKeys = defaultSplitKeys
+	kv.lastBalance = time.Now()
+	kv.hotKeys = newHotKeySketch(defaultHotKeyCapacity)
+	kv.hotShare = defaultHotKeyShare
+	kv.hotMode = kvs.LockNoWait
+	kv.lockWait = defaultLockWait
+	kv.released = make(chan struct{})
+	kv.abortReasons = make(map[string]uint64)
+	kv.waiting = make(map[string]string)
+	kv.rpcMetrics = newRPCMetrics()
+	kv.started = time.Now()
+	return kv
 }
 
 func (kv *KVService) Get(request *kvs.GetRequest, response *kvs.GetResponse) error {
+	defer kv.rpcMetrics.observe("Get", time.Now())
+	defer kv.traceRPC(request.TraceID, "Get", time.Now(), &response.Status)
+	if status := kv.admit(request.TransactionID); status != kvs.StatusOK {
+		response.Status = status
+		return nil
+	}
+	if kv.raft != nil {
+		return propose(kv, opGet, request, response, func() { response.Status = kvs.StatusNotPrimary })
+	}
+
 	kv.Lock()
 	defer kv.Unlock()
 
+	if kv.role != kvs.RolePrimary {
+		response.Status = kvs.StatusNotPrimary
+		return nil
+	}
+	return kv.get(request, response)
+}
+
+// Helper method to read a key under a read lock. Must hold kv's lock.
+func (kv *KVService) get(request *kvs.GetRequest, response *kvs.GetResponse) error {
 	kv.stats.gets++
+	kv.countOp(request.Key)
+	kv.hotKeys.access(request.Key)
+
+	if len(request.Key) > kv.maxKeySize {
+		response.Status = kvs.StatusTooLarge
+		return nil
+	}
+	if status := kv.placement(request.Key, request.Epoch); status != kvs.StatusOK {
+		response.Status = status
+		return nil
+	}
 
 	// Get or create transaction
-	tx, exists := kv.transactions[request.TransactionID]
-	if !exists {
-		tx = &Transaction{
-			ID:       request.TransactionID,
-			ReadSet:  make(map[string]bool),
-			WriteSet: make(map[string]string),
-			Status:   "active",
-		}
-		kv.transactions[request.TransactionID] = tx
+	tx, status := kv.getOrCreateTransaction(request.TransactionID)
+	if status != kvs.StatusOK {
+		response.Status = status
+		return nil
+	}
+	if request.TraceID != "" {
+		tx.TraceID = request.TraceID
 	}
 
+	kv.reclaimIfExpired(request.Key, kv.clock())
+
 	// Try to acquire read lock
-	if !kv.acquireReadLock(request.Key, request.TransactionID) {
-		response.LockFail = true
+	acquire := func() kvs.Status { return kv.acquireReadLock(request.Key, request.TransactionID) }
+	if status := kv.acquireLock(request.Key, tx, acquire); status != kvs.StatusOK {
+		response.Status = tx.fail(status)
 		return nil
 	}
 
-	// Add to read set
+	// Check if we have a pending write for this key. The version is always
+	// that of the committed value, since pending writes don't have one yet.
+	entry, found := kv.visible(request.Key, tx, kv.clock())
 	tx.ReadSet[request.Key] = true
-
-	// Check if we have a pending write for this key
-	if value, exists := tx.WriteSet[request.Key]; exists {
-		response.Value = value
-	} else if value, found := kv.mp[request.Key]; found {
-		response.Value = value
+	if found {
+		response.Version = entry.Version
+	}
+	if write, exists := tx.WriteSet[request.Key]; exists {
+		response.Value = write.Value
+	} else if found {
+		response.Value = entry.Value
 	}
 
-	response.Success = true
+	response.Status = kvs.StatusOK
 	return nil
 }
 
 func (kv *KVService) Put(request *kvs.PutRequest, response *kvs.PutResponse) error {
+	defer kv.rpcMetrics.observe("Put", time.Now())
+	defer kv.traceRPC(request.TraceID, "Put", time.Now(), &response.Status)
+	if status := kv.admit(request.TransactionID); status != kvs.StatusOK {
+		response.Status = status
+		return nil
+	}
+	if kv.raft != nil {
+		return propose(kv, opPut, request, response, func() { response.Status = kvs.StatusNotPrimary })
+	}
+
 	kv.Lock()
 	defer kv.Unlock()
 
+	if kv.role != kvs.RolePrimary {
+		response.Status = kvs.StatusNotPrimary
+		return nil
+	}
+	return kv.put(request, response)
+}
+
+// Helper method to buffer a write under a write lock. Must hold kv's lock.
+func (kv *KVService) put(request *kvs.PutRequest, response *kvs.PutResponse) error {
 	kv.stats.puts++
+	kv.countOp(request.Key)
+	kv.hotKeys.access(request.Key)
+
+	if len(request.Key) > kv.maxKeySize || len(request.Value) > kv.maxValueSize {
+		response.Status = kvs.StatusTooLarge
+		return nil
+	}
+	if status := kv.placement(request.Key, request.Epoch); status != kvs.StatusOK {
+		response.Status = status
+		return nil
+	}
 
 	// Get or create transaction
-	tx, exists := kv.transactions[request.TransactionID]
-	if !exists {
-		tx = &Transaction{
-			ID:       request.TransactionID,
-			ReadSet:  make(map[string]bool),
-			WriteSet: make(map[string]string),
-			Status:   "active",
+	tx, status := kv.getOrCreateTransaction(request.TransactionID)
+	if status != kvs.StatusOK {
+		response.Status = status
+		return nil
+	}
+	if request.TraceID != "" {
+		tx.TraceID = request.TraceID
+	}
+
+	kv.reclaimIfExpired(request.Key, kv.clock())
+
+	// Try to acquire write lock. A scan by another transaction holds the
+	// whole span it read, not just the keys that were there.
+	acquire := func() kvs.Status {
+		if kv.scannedByOther(request.Key, request.TransactionID) {
+			return kvs.StatusWriteLockConflict
 		}
-		kv.transactions[request.TransactionID] = tx
+		return kv.acquireWriteLock(request.Key, request.TransactionID)
+	}
+	if status := kv.acquireLock(request.Key, tx, acquire); status != kvs.StatusOK {
+		response.Status = tx.fail(status)
+		return nil
 	}
 
-	// Try to acquire write lock
-	if !kv.acquireWriteLock(request.Key, request.TransactionID) {
-		response.LockFail = true
+	// Check the precondition while holding the write lock, so the version
+	// can't change before commit
+	if request.CheckVersion && kv.committedVersion(request.Key, tx) != request.ExpectedVersion {
+		response.Status = tx.fail(kvs.StatusPreconditionFailed)
 		return nil
 	}
 
 	// Add to write set
-	tx.WriteSet[request.Key] = request.Value
+	tx.WriteSet[request.Key] = Write{Value: request.Value, TTL: request.TTL}
 
-	response.Success = true
+	response.Status = kvs.StatusOK
 	return nil
 }
 
+// Helper method to find a transaction, registering it on its first request
+func (kv *KVService) getOrCreateTransaction(txID string) (*Transaction, kvs.Status) {
+	if tx, exists := kv.transactions[txID]; exists {
+		return tx, kvs.StatusOK
+	}
+
+	switch kv.outcomes[txID] {
+	case outcomeCommitted:
+		return nil, kvs.StatusTransactionCommitted
+	case outcomeAborted:
+		return nil, kvs.StatusTransactionAborted
+	case outcomeExpired:
+		return nil, kvs.StatusTransactionExpired
+	}
+
+	if kv.maxActive > 0 && kv.active >= kv.maxActive {
+		return nil, kvs.StatusOverloaded
+	}
+
+	tx := &Transaction{
+		ID:        txID,
+		ReadSet:   make(map[string]bool),
+		WriteSet:  make(map[string]Write),
+		Status:    "active",
+		StartTime: kv.clock(),
+	}
+	kv.transactions[txID] = tx
+	kv.active++
+	return tx, kvs.StatusOK
+}
+
 // Helper method to acquire read lock
-func (kv *KVService) acquireReadLock(key, txID string) bool {
+func (kv *KVService) acquireReadLock(key, txID string) kvs.Status {
 	lock, exists := kv.locks[key]
 	if !exists {
 		lock = &LockInfo{
@@ -142,25 +384,25 @@ func (kv *KVService) acquireReadLock(key, txID string) bool {
 
 	// Already have read lock
 	if lock.Readers[txID] {
-		return true
+		return kvs.StatusOK
 	}
 
 	// If we have write lock, keep it (don't downgrade)
 	if lock.Writer == txID {
-		return true // Read is allowed when holding write lock
+		return kvs.StatusOK // Read is allowed when holding write lock
 	}
 
 	// Can acquire read lock if no writer or if we already have read lock
 	if lock.Writer == "" || lock.Readers[txID] {
 		lock.Readers[txID] = true
-		return true
+		return kvs.StatusOK
 	}
 
-	return false
+	return kvs.StatusReadLockConflict
 }
 
 // Helper method to acquire write lock
-func (kv *KVService) acquireWriteLock(key, txID string) bool {
+func (kv *KVService) acquireWriteLock(key, txID string) kvs.Status {
 	lock, exists := kv.locks[key]
 	if !exists {
 		lock = &LockInfo{
@@ -173,12 +415,12 @@ func (kv *KVService) acquireWriteLock(key, txID string) bool {
 	// Can acquire write lock if no other readers and no writer
 	if len(lock.Readers) == 0 && lock.Writer == "" {
 		lock.Writer = txID
-		return true
+		return kvs.StatusOK
 	}
 
 	// Can upgrade if we already have write lock
 	if lock.Writer == txID {
-		return true
+		return kvs.StatusOK
 	}
 
 	// Try to upgrade from read lock to write lock
@@ -187,13 +429,89 @@ func (kv *KVService) acquireWriteLock(key, txID string) bool {
 		if len(lock.Readers) == 1 {
 			delete(lock.Readers, txID)
 			lock.Writer = txID
-			return true
+			return kvs.StatusOK
 		}
 		// Cannot upgrade with other readers present
+		return kvs.StatusUpgradeConflict
+	}
+
+	return kvs.StatusWriteLockConflict
+}
+
+// Helper method to look up the committed version of a key as tx sees it
+func (kv *KVService) committedVersion(key string, tx *Transaction) uint64 {
+	if entry, found := kv.visible(key, tx, kv.clock()); found {
+		return entry.Version
+	}
+	return 0
+}
+
+// Helper method to look up the committed entry tx sees for a key. An expired
+// entry is only dropped once nobody holds a lock on it, so until then it is
+// still visible to transactions that read it before it expired, and absent to
+// everyone else. Must hold kv's lock.
+func (kv *KVService) visible(key string, tx *Transaction, now time.Time) (*Entry, bool) {
+	entry, found := kv.mp[key]
+	if !found || !entry.expired(now) {
+		return entry, found
+	}
+	if tx.ReadSet[key] && !tx.Expired[key] {
+		return entry, true
+	}
+	if tx.Expired == nil {
+		tx.Expired = make(map[string]bool)
+	}
+	tx.Expired[key] = true
+	return nil, false
+}
+
+// Helper method to drop an expired entry and record its expiry as a change.
+// Expiration only happens while no transaction holds a lock on the key, so a
+// transaction that has already read or written it keeps seeing a consistent
+// value until it commits or aborts. Reads check expiry through visible rather
+// than relying on this having run.
+func (kv *KVService) reclaimIfExpired(key string, now time.Time) bool {
+	if _, locked := kv.locks[key]; locked {
 		return false
 	}
+	entry, found := kv.mp[key]
+	if !found || !entry.expired(now) {
+		return false
+	}
+	kv.deleteEntry(key)
+	kv.recordExpiry(key)
+	return true
+}
+
+// sweepExpired reclaims expired entries that nobody holds a lock on. With
+// Raft, the leader has every replica do it through the log instead. Backups
+// leave it to their primary, since an expiry takes a version and theirs
+// follow the primary's.
+func (kv *KVService) sweepExpired() int {
+	if kv.raft != nil {
+		if _, isLeader := kv.raft.State(); isLeader {
+			kv.submit(opSweep, struct{}{})
+		}
+		return 0
+	}
 
-	return false
+	kv.Lock()
+	defer kv.Unlock()
+	if kv.role != kvs.RolePrimary {
+		return 0
+	}
+	return kv.sweep(time.Now())
+}
+
+// Helper method to reclaim expired entries as of now. Must hold kv's lock.
+func (kv *KVService) sweep(now time.Time) int {
+	reclaimed := 0
+	for key := range kv.expiring {
+		if kv.reclaimIfExpired(key, now) {
+			reclaimed++
+		}
+	}
+	return reclaimed
 }
 
 // Helper method to release all locks for a transaction
@@ -212,61 +530,187 @@ func (kv *KVService) releaseLocks(txID string) {
 			delete(kv.locks, key)
 		}
 	}
+
+	// Wake requests waiting for a lock
+	close(kv.released)
+	kv.released = make(chan struct{})
 }
 
+// Commit applies a transaction's writes and releases its locks. It is
+// idempotent: committing again reports success without reapplying anything.
 func (kv *KVService) Commit(req *kvs.CommitRequest, resp *kvs.CommitResponse) error {
+	defer kv.rpcMetrics.observe("Commit", time.Now())
+	defer kv.traceRPC(req.TraceID, "Commit", time.Now(), &resp.Status)
+	if kv.raft != nil {
+		return propose(kv, opCommit, req, resp, func() { resp.Status = kvs.StatusNotPrimary })
+	}
+
+	defer kv.syncOutcomes()
+	defer kv.awaitBackups(&resp.Status)
 	kv.Lock()
 	defer kv.Unlock()
 
-	tx, exists := kv.transactions[req.TransactionID]
-	if !exists {
-		resp.Success = false
+	if kv.role != kvs.RolePrimary {
+		resp.Status = kvs.StatusNotPrimary
 		return nil
 	}
+	return kv.commit(req, resp)
+}
 
-	// Apply all pending writes
-	for key, value := range tx.WriteSet {
-		kv.mp[key] = value
+// Helper method to commit a transaction. Must hold kv's lock.
+func (kv *KVService) commit(req *kvs.CommitRequest, resp *kvs.CommitResponse) error {
+	switch kv.outcomes[req.TransactionID] {
+	case outcomeCommitted:
+		resp.Status = kvs.StatusOK
+		return nil
+	case outcomeAborted:
+		resp.Status = kvs.StatusTransactionAborted
+		return nil
+	case outcomeExpired:
+		resp.Status = kvs.StatusTransactionExpired
+		return nil
 	}
 
-	// Release all locks
-	kv.releaseLocks(req.TransactionID)
+	tx, exists := kv.transactions[req.TransactionID]
+	if !exists {
+		resp.Status = kvs.StatusUnknownTransaction
+		return nil
+	}
 
-	// Update transaction status
-	tx.Status = "committed"
+	if err := kv.commitTransaction(tx); err != nil {
+		return err
+	}
 
 	// Update stats (only count if this is the lead participant)
 	if req.Lead {
 		kv.stats.commits++
 	}
 
-	resp.Success = true
+	resp.Status = kvs.StatusOK
 	return nil
 }
 
+// Helper method to durably commit a transaction, apply its writes and
+// release its locks. A primary builds the commit's record for its backups
+// first. Must hold kv's lock.
+func (kv *KVService) commitTransaction(tx *Transaction) error {
+	now := kv.clock()
+	record := kvs.ReplicateRequest{
+		Type:          kvs.ReplicateCommit,
+		TransactionID: tx.ID,
+		Writes:        committedWrites(tx.WriteSet),
+		CommitTime:    now,
+	}
+	if len(tx.WriteSet) > 0 {
+		record.Version = kv.version + 1
+	}
+	kv.replicate(record)
+	return kv.applyCommit(tx, now)
+}
+
+// Helper method to commit a transaction locally, with TTLs counting from
+// now. Must hold kv's lock.
+func (kv *KVService) applyCommit(tx *Transaction, now time.Time) error {
+	if tx.TraceID != "" {
+		defer kv.tracer.Span(tx.TraceID, "apply", time.Now(), "writes", strconv.Itoa(len(tx.WriteSet)))
+	}
+	if err := kv.recordOutcome(tx.ID, outcomeCommitted); err != nil {
+		return err
+	}
+
+	// Apply all pending writes, all stamped with the same new version
+	if len(tx.WriteSet) > 0 {
+		kv.version++
+	}
+	for key, write := range tx.WriteSet {
+		entry := &Entry{Value: write.Value, Version: kv.version}
+		if write.TTL > 0 {
+			entry.ExpiresAt = now.Add(write.TTL)
+			kv.expiring[key] = true
+		} else {
+			delete(kv.expiring, key)
+		}
+		kv.storeEntry(key, entry)
+	}
+	if len(tx.WriteSet) > 0 {
+		kv.recordChange(tx.ID, tx.WriteSet)
+	}
+
+	// Release all locks and forget the transaction; its outcome is enough
+	kv.committed++
+	kv.releaseLocks(tx.ID)
+	delete(kv.transactions, tx.ID)
+	kv.active--
+	return nil
+}
+
+// Abort discards a transaction's writes and releases its locks. It is
+// idempotent, and aborting a transaction this server has never seen records
+// the abort so that it can't start here later.
 func (kv *KVService) Abort(req *kvs.AbortRequest, resp *kvs.AbortResponse) error {
+	defer kv.rpcMetrics.observe("Abort", time.Now())
+	if kv.raft != nil {
+		return propose(kv, opAbort, req, resp, func() { resp.Status = kvs.StatusNotPrimary })
+	}
+
+	defer kv.syncOutcomes()
+	defer kv.awaitBackups(&resp.Status)
 	kv.Lock()
 	defer kv.Unlock()
 
-	tx, exists := kv.transactions[req.TransactionID]
-	if !exists {
-		resp.Success = false
+	if kv.role != kvs.RolePrimary {
+		resp.Status = kvs.StatusNotPrimary
 		return nil
 	}
+	return kv.abort(req, resp)
+}
 
-	// Discard all pending writes (they're already in write set, not applied)
-	// Just release locks
-	kv.releaseLocks(req.TransactionID)
+// Helper method to abort a transaction. Must hold kv's lock.
+func (kv *KVService) abort(req *kvs.AbortRequest, resp *kvs.AbortResponse) error {
+	switch kv.outcomes[req.TransactionID] {
+	case outcomeCommitted:
+		resp.Status = kvs.StatusTransactionCommitted
+		return nil
+	case outcomeAborted, outcomeExpired:
+		resp.Status = kvs.StatusOK
+		return nil
+	}
 
-	// Update transaction status
-	tx.Status = "aborted"
+	_, exists := kv.transactions[req.TransactionID]
+	if err := kv.abortTransaction(req.TransactionID, outcomeAborted); err != nil {
+		return err
+	}
 
 	// Update stats (only count if this is the lead participant)
-	if req.Lead {
+	if exists && req.Lead {
 		kv.stats.aborts++
 	}
 
-	resp.Success = true
+	resp.Status = kvs.StatusOK
+	return nil
+}
+
+// Helper method to durably abort a transaction and release its locks. The
+// outcome is outcomeAborted, or outcomeExpired if the server gave up on it.
+// Backups only know about prepared transactions, so only their aborts are
+// replicated. Must hold kv's lock.
+func (kv *KVService) abortTransaction(txID string, outcome string) error {
+	if tx, exists := kv.transactions[txID]; exists && tx.Status == "prepared" {
+		kv.replicate(kvs.ReplicateRequest{Type: kvs.ReplicateAbort, TransactionID: txID})
+	}
+	if err := kv.recordOutcome(txID, outcome); err != nil {
+		return err
+	}
+
+	if tx, exists := kv.transactions[txID]; exists {
+		kv.countAbort(tx, outcome)
+
+		// Discard all pending writes (they're already in write set, not applied)
+		// Just release locks
+		kv.releaseLocks(txID)
+		delete(kv.transactions, txID)
+		kv.active--
+	}
 	return nil
 }
 
@@ -278,6 +722,9 @@ func (kv *KVService) printStats() {
 	now := time.Now()
 	lastPrint := kv.lastPrint
 	kv.lastPrint = now
+	prevLatency := kv.prevLatency
+	latency := kv.rpcMetrics.snapshot()
+	kv.prevLatency = latency
 	kv.Unlock()
 
 	diff := stats.Sub(&prevStats)
@@ -289,15 +736,144 @@ func (kv *KVService) printStats() {
 		float64(diff.gets+diff.puts)/deltaS,
 		float64(diff.commits)/deltaS,
 		float64(diff.aborts)/deltaS)
+
+	// Latency percentiles of the RPCs served since the last print
+	printed := false
+	for _, method := range sortedKeys(latency) {
+		prev := prevLatency[method]
+		h := latency[method]
+		interval := h.Sub(&prev)
+		if interval.Count() > 0 {
+			fmt.Printf("%s latency %v\n", method, &interval)
+			printed = true
+		}
+	}
+	if printed {
+		fmt.Println()
+	}
 }
 
 func main() {
 	port := flag.String("port", "8080", "Port to run the server on")
+	sweepInterval := flag.Duration("sweep-interval", time.Second, "How often to reclaim expired keys")
+	history := flag.Int("history", defaultMaxHistory, "Number of committed write sets kept for watchers and the change log")
+	maxKeySize := flag.Int("max-key-size", kvs.DefaultMaxKeySize, "Largest key accepted, in bytes")
+	maxValueSize := flag.Int("max-value-size", kvs.DefaultMaxValueSize, "Largest value accepted, in bytes")
+	maxActive := flag.Int("max-active-tx", 0, "Reject new transactions while this many are active (0 means no limit)")
+	dataDir := flag.String("data-dir", "", "Directory for durable state (default kvsdata-<port>)")
+	fsync := flag.Bool("fsync", true, "Sync the outcome log to disk before acknowledging commits and aborts")
+	retention := flag.Duration("outcome-retention", defaultOutcomeRetention, "Forget the outcomes of transactions that finished this long ago (0 keeps them forever)")
+	addr := flag.String("addr", "", "Address clients and other servers use to reach this one; required with -replicas, and with more than one shard (default localhost:<port>)")
+	txTimeout := flag.Duration("tx-timeout", 30*time.Second, "Abort transactions that stay active this long without preparing (0 disables)")
+	terminationTimeout := flag.Duration("termination-timeout", 5*time.Second, "Ask other participants about transactions prepared this long without a decision")
+	replicas := flag.String("replicas", "", "Comma-separated host:ports of every replica of this server's shard, including this one, in promotion order")
+	role := flag.String("role", kvs.RolePrimary, "Role to start in when -replicas is set: primary or backup")
+	failoverTimeout := flag.Duration("failover-timeout", 0, "Promote a backup after the primary is unreachable this long (0 means only promote with the Promote RPC)")
+	useRaft := flag.Bool("raft", false, "Replicate the shard across -replicas with Raft instead of primary-backup")
+	ownedRange := flag.String("key-range", ",", "Range of placement keys this server owns, as \"start,end\"; either side may be empty for no bound, and an empty value owns nothing until ranges are moved here")
+	splitKeys := flag.Int("split-keys", defaultSplitKeys, "Split a range holding more keys than this (0 disables)")
+	splitLoad := flag.Float64("split-load", 0, "Split a range serving more operations a second than this (0 disables)")
+	hotKeys := flag.Int("hot-keys", defaultHotKeyCapacity, "Number of keys to keep access counts for when finding hot keys (0 disables)")
+	hotShare := flag.Float64("hot-key-share", defaultHotKeyShare, "Call a key hot once it gets this share of the server's gets and puts")
+	hotMode := flag.String("hot-key-mode", kvs.LockNoWait, "Lock mode for hot keys: no-wait aborts on a conflict at once, wait waits up to -lock-wait for the lock first")
+	lockWait := flag.Duration("lock-wait", defaultLockWait, "With -hot-key-mode wait, how long a request on a hot key waits for a lock")
+	electionTimeout := flag.Duration("election-timeout", raft.DefaultConfig.ElectionTimeout, "With -raft, how long followers wait for the leader before holding an election")
+	snapshotEntries := flag.Int("raft-snapshot-entries", defaultSnapshotEntries, "With -raft, snapshot the store and compact the log every this many entries (0 never compacts)")
+	drainTimeout := flag.Duration("drain-timeout", 10*time.Second, "On SIGTERM or interrupt, how long to let active transactions finish before aborting them")
+	tracePath := flag.String("trace", "", "Write the spans of traced requests to this file, in the Chrome trace-event format (default: don't trace)")
+	mutexProfile := flag.Int("mutex-profile-fraction", 0, "Sample 1 in this many lock contention events for /debug/pprof/mutex (0 disables)")
 	flag.Parse()
 
-	kvs := NewKVService()
-	rpc.Register(kvs)
+	runtime.SetMutexProfileFraction(*mutexProfile)
+
+	if *dataDir == "" {
+		*dataDir = fmt.Sprintf("kvsdata-%s", *port)
+	}
+
+	kv := NewKVService()
+	kv.maxHistory = *history
+	kv.maxKeySize = *maxKeySize
+	kv.maxValueSize = *maxValueSize
+	kv.maxActive = *maxActive
+	kv.addr = *addr
+	if kv.addr == "" {
+		kv.addr = fmt.Sprintf("localhost:%s", *port)
+	}
+	kv.txTimeout = *txTimeout
+	kv.retention = *retention
+	owned, err := parseKeyRange(*ownedRange)
+	if err != nil {
+		log.Fatal(err)
+	}
+	kv.ranges = owned
+	kv.splitKeys = *splitKeys
+	kv.splitLoad = *splitLoad
+	kv.terminationTimeout = *terminationTimeout
+	kv.hotKeys = newHotKeySketch(*hotKeys)
+	kv.hotShare = *hotShare
+	if *hotMode != kvs.LockNoWait && *hotMode != kvs.LockWait {
+		log.Fatalf("unknown lock mode %q", *hotMode)
+	}
+	kv.hotMode = *hotMode
+	kv.lockWait = *lockWait
+	if *tracePath != "" {
+		kv.tracer, err = kvs.NewTracer(*tracePath, "kvsserver "+kv.addr)
+		if err != nil {
+			log.Fatal("trace: ", err)
+		}
+	}
+	if *replicas != "" {
+		if *addr == "" {
+			log.Fatal("-replicas needs -addr, so the replicas know which of them this is")
+		}
+		kv.replicas = strings.Split(*replicas, ",")
+		if !slices.Contains(kv.replicas, kv.addr) {
+			log.Fatalf("-replicas must include this server's address %s", kv.addr)
+		}
+		switch {
+		case *useRaft:
+			// The replicas elect a leader among themselves
+		case *role == kvs.RolePrimary:
+			if err := kv.startPrimary(); err != nil {
+				log.Fatal(err)
+			}
+		case *role == kvs.RoleBackup:
+			kv.startBackup(0, "")
+		default:
+			log.Fatalf("unknown role %q", *role)
+		}
+		kv.failoverTimeout = *failoverTimeout
+	}
+	if *useRaft {
+		// The Raft log holds everything, so there is no outcome log to replay
+		if kv.replicas == nil {
+			kv.replicas = []string{kv.addr}
+		}
+		if err := os.MkdirAll(*dataDir, 0755); err != nil {
+			log.Fatal("raft log: ", err)
+		}
+		storage, err := raft.OpenFileStorage(filepath.Join(*dataDir, "raft.log"), *fsync)
+		if err != nil {
+			log.Fatal("raft log: ", err)
+		}
+		config := raft.DefaultConfig
+		config.ElectionTimeout = *electionTimeout
+		kv.snapshotEvery = *snapshotEntries
+		id := slices.Index(kv.replicas, kv.addr)
+		node, err := kv.startRaft(id, raft.NewRPCTransport(kv.replicas), storage, config)
+		if err != nil {
+			log.Fatal("raft log: ", err)
+		}
+		rpc.RegisterName("Raft", node)
+	} else if err := kv.openOutcomeLog(*dataDir, *fsync); err != nil {
+		log.Fatal("outcome log: ", err)
+	}
+	rpc.Register(kv)
 	rpc.HandleHTTP()
+	http.HandleFunc("/metrics", kv.serveMetrics)
+	http.HandleFunc("/debug/kvs", kv.serveDebug)
+	http.HandleFunc("/healthz", kv.serveHealthz)
+	http.HandleFunc("/readyz", kv.serveReadyz)
 
 	l, e := net.Listen("tcp", fmt.Sprintf(":%v", *port))
 	if e != nil {
@@ -308,10 +884,73 @@ func main() {
 
 	go func() {
 		for {
-			kvs.printStats()
+			kv.printStats()
 			time.Sleep(1 * time.Second)
 		}
 	}()
 
+	go func() {
+		for {
+			time.Sleep(*sweepInterval)
+			kv.sweepExpired()
+		}
+	}()
+
+	go func() {
+		for {
+			time.Sleep(time.Second)
+			kv.terminate()
+		}
+	}()
+
+	go func() {
+		for {
+			time.Sleep(outcomeGCInterval)
+			kv.forgetOutcomes()
+		}
+	}()
+
+	go func() {
+		for {
+			time.Sleep(time.Second)
+			kv.balanceRanges()
+		}
+	}()
+
+	go func() {
+		for {
+			time.Sleep(hotKeyDecayInterval)
+			kv.decayHotKeys()
+		}
+	}()
+
+	if len(kv.replicas) > 1 && !*useRaft {
+		go func() {
+			for {
+				time.Sleep(time.Second)
+				kv.syncBackups()
+			}
+		}()
+	}
+
+	if *failoverTimeout > 0 && !*useRaft {
+		go func() {
+			for {
+				time.Sleep(*failoverTimeout / 4)
+				kv.monitorPrimary()
+			}
+		}()
+	}
+
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+		sig := <-signals
+		log.Printf("%v: draining for up to %v", sig, *drainTimeout)
+		kv.shutdown(*drainTimeout)
+		l.Close()
+		os.Exit(0)
+	}()
+
 	http.Serve(l, nil)
 }
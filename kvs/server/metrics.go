@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rstutsman/cs6450-labs/kvs"
+)
+
+// Upper bounds of the RPC latency histogram buckets, in seconds
+var latencyBuckets = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+// Reasons a transaction aborted on this server besides a failed request
+const (
+	abortRequested = "requested" // the client gave up, for its own reasons or another participant's
+	abortExpired   = "expired"   // the server gave up on it
+)
+
+type latencyHistogram struct {
+	counts []uint64 // observations in each bucket, plus one past the last bound
+	sum    float64
+	count  uint64
+}
+
+// rpcMetrics times RPCs, in fixed buckets for /metrics and in log buckets
+// for percentiles. It has its own lock, so handlers can record their latency
+// after releasing kv's.
+type rpcMetrics struct {
+	sync.Mutex
+	latency    map[string]*latencyHistogram
+	histograms map[string]*kvs.Histogram
+}
+
+func newRPCMetrics() *rpcMetrics {
+	return &rpcMetrics{latency: make(map[string]*latencyHistogram), histograms: make(map[string]*kvs.Histogram)}
+}
+
+// observe records how long a call to method that began at began took.
+func (m *rpcMetrics) observe(method string, began time.Time) {
+	seconds := time.Since(began).Seconds()
+	bucket := sort.SearchFloat64s(latencyBuckets, seconds)
+
+	m.Lock()
+	defer m.Unlock()
+	h, exists := m.latency[method]
+	if !exists {
+		h = &latencyHistogram{counts: make([]uint64, len(latencyBuckets)+1)}
+		m.latency[method] = h
+	}
+	h.counts[bucket]++
+	h.sum += seconds
+	h.count++
+
+	if _, exists := m.histograms[method]; !exists {
+		m.histograms[method] = &kvs.Histogram{}
+	}
+	m.histograms[method].Record(time.Since(began))
+}
+
+// snapshot copies the log-bucketed histogram of every method.
+func (m *rpcMetrics) snapshot() map[string]kvs.Histogram {
+	m.Lock()
+	defer m.Unlock()
+	histograms := make(map[string]kvs.Histogram, len(m.histograms))
+	for method, h := range m.histograms {
+		histograms[method] = *h
+	}
+	return histograms
+}
+
+// Helper method to remember why the first of tx's requests that failed on
+// this server did, which is most likely why tx will abort. Returns status.
+func (tx *Transaction) fail(status kvs.Status) kvs.Status {
+	if tx.Failure == kvs.StatusUnknown {
+		tx.Failure = status
+	}
+	return status
+}
+
+// Helper method to count a transaction aborting with outcome, and remember
+// it for /debug/kvs. Must hold kv's lock.
+func (kv *KVService) countAbort(tx *Transaction, outcome string) {
+	reason := abortRequested
+	switch {
+	case outcome == outcomeExpired:
+		reason = abortExpired
+	case tx.Failure != kvs.StatusUnknown:
+		reason = strings.ReplaceAll(tx.Failure.String(), " ", "_")
+	}
+	kv.abortReasons[reason]++
+	kv.recordAbort(tx, reason)
+}
+
+// Helper method to record the span of an RPC that began at began and ended
+// with status, if the request is traced
+func (kv *KVService) traceRPC(traceID, method string, began time.Time, status *kvs.Status) {
+	if kv.tracer == nil || traceID == "" {
+		return
+	}
+	kv.tracer.Span(traceID, method, began, "status", status.String())
+}
+
+// serveMetrics writes the server's metrics in the Prometheus text
+// exposition format.
+func (kv *KVService) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	kv.Lock()
+	stats := kv.stats
+	committed := kv.committed
+	reasons := make(map[string]uint64, len(kv.abortReasons))
+	for reason, n := range kv.abortReasons {
+		reasons[reason] = n
+	}
+	locks, active, keys := len(kv.locks), kv.active, len(kv.mp)
+	kv.Unlock()
+
+	writeHeader(w, "kvs_ops_total", "counter", "Gets, puts and scans served.")
+	fmt.Fprintf(w, "kvs_ops_total{op=\"get\"} %d\n", stats.gets)
+	fmt.Fprintf(w, "kvs_ops_total{op=\"put\"} %d\n", stats.puts)
+	fmt.Fprintf(w, "kvs_ops_total{op=\"scan\"} %d\n", stats.scans)
+
+	writeHeader(w, "kvs_commits_total", "counter", "Transactions committed on this server; a transaction over several shards counts on each.")
+	fmt.Fprintf(w, "kvs_commits_total %d\n", committed)
+
+	writeHeader(w, "kvs_aborts_total", "counter", "Transactions aborted on this server, by the first request of theirs that failed here, or requested or expired.")
+	for _, reason := range sortedKeys(reasons) {
+		fmt.Fprintf(w, "kvs_aborts_total{reason=%q} %d\n", reason, reasons[reason])
+	}
+
+	writeHeader(w, "kvs_locks", "gauge", "Keys with a lock held on them.")
+	fmt.Fprintf(w, "kvs_locks %d\n", locks)
+	writeHeader(w, "kvs_active_transactions", "gauge", "Transactions that are neither committed nor aborted.")
+	fmt.Fprintf(w, "kvs_active_transactions %d\n", active)
+	writeHeader(w, "kvs_keys", "gauge", "Committed keys stored.")
+	fmt.Fprintf(w, "kvs_keys %d\n", keys)
+
+	kv.rpcMetrics.Lock()
+	defer kv.rpcMetrics.Unlock()
+	writeHeader(w, "kvs_rpc_duration_seconds", "histogram", "Time to serve each RPC, including replication.")
+	for _, method := range sortedKeys(kv.rpcMetrics.latency) {
+		h := kv.rpcMetrics.latency[method]
+		cumulative := uint64(0)
+		for i, bound := range latencyBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "kvs_rpc_duration_seconds_bucket{method=%q,le=\"%g\"} %d\n", method, bound, cumulative)
+		}
+		fmt.Fprintf(w, "kvs_rpc_duration_seconds_bucket{method=%q,le=\"+Inf\"} %d\n", method, h.count)
+		fmt.Fprintf(w, "kvs_rpc_duration_seconds_sum{method=%q} %g\n", method, h.sum)
+		fmt.Fprintf(w, "kvs_rpc_duration_seconds_count{method=%q} %d\n", method, h.count)
+	}
+}
+
+// Helper function to write the HELP and TYPE lines of a metric
+func writeHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// Helper function to list a map's keys in order, so the output is stable
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rstutsman/cs6450-labs/kvs"
+	"github.com/stretchr/testify/assert"
+)
+
+func scrape(kv *KVService) string {
+	recorder := httptest.NewRecorder()
+	kv.serveMetrics(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	return recorder.Body.String()
+}
+
+func TestMetrics(t *testing.T) {
+	kv := NewKVService()
+	assert.Equal(t, kvs.StatusOK, put(kv, "tx1", "a", "1"))
+	assert.Equal(t, kvs.StatusOK, commit(kv, "tx1"))
+
+	// One transaction aborts after a conflict, one for no reason the server
+	// knows of, and one holds a lock
+	_, status := get(kv, "holder", "a")
+	assert.Equal(t, kvs.StatusOK, status)
+	assert.Equal(t, kvs.StatusWriteLockConflict, put(kv, "tx2", "a", "2"))
+	kv.Abort(&kvs.AbortRequest{TransactionID: "tx2"}, &kvs.AbortResponse{})
+	put(kv, "tx3", "b", "3")
+	kv.Abort(&kvs.AbortRequest{TransactionID: "tx3"}, &kvs.AbortResponse{})
+
+	metrics := scrape(kv)
+	assert.Contains(t, metrics, "# TYPE kvs_ops_total counter\n")
+	assert.Contains(t, metrics, "kvs_ops_total{op=\"get\"} 1\n")
+	assert.Contains(t, metrics, "kvs_ops_total{op=\"put\"} 3\n")
+	assert.Contains(t, metrics, "kvs_commits_total 1\n")
+	assert.Contains(t, metrics, "kvs_aborts_total{reason=\"requested\"} 1\n")
+	assert.Contains(t, metrics, "kvs_aborts_total{reason=\"write_lock_conflict\"} 1\n")
+	assert.Contains(t, metrics, "kvs_locks 1\n")
+	assert.Contains(t, metrics, "kvs_active_transactions 1\n")
+
+	// Histogram buckets are cumulative and end with every call
+	assert.Contains(t, metrics, "# TYPE kvs_rpc_duration_seconds histogram\n")
+	assert.Contains(t, metrics, "kvs_rpc_duration_seconds_bucket{method=\"Put\",le=\"+Inf\"} 3\n")
+	assert.Contains(t, metrics, "kvs_rpc_duration_seconds_bucket{method=\"Put\",le=\"2.5\"} 3\n")
+	assert.Contains(t, metrics, "kvs_rpc_duration_seconds_count{method=\"Abort\"} 2\n")
+}
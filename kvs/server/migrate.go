@@ -0,0 +1,377 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/rstutsman/cs6450-labs/kvs"
+)
+
+// A range moves to another server while transactions keep running. The
+// owner copies the committed entries in the range to the new server, then
+// keeps sending the writes committed since, until few are left. It then
+// fences the range, refusing new locks in it, and waits for the transactions
+// that hold locks there to finish. After that nothing in the range can
+// change, so the owner sends the last writes, the new server is assigned the
+// range, and the old owner gives it up and drops its copy. Clients that
+// still send requests for the range to the old owner get StatusWrongShard.
+
+const (
+	defaultFenceTimeout = 2 * time.Second
+	maxCatchUpRounds    = 5
+	catchUpDone         = 100  // fence once a round of catching up sends fewer writes than this
+	installBatch        = 1000 // entries per InstallRange request
+)
+
+// MigrateRange moves the keys in [Start, End) to Target. It returns an error
+// and keeps the range if any step fails; the entries already copied stay on
+// Target, unserved, and are overwritten if the range is moved there again.
+func (kv *KVService) MigrateRange(req *kvs.MigrateRequest, resp *kvs.MigrateResponse) error {
+	kv.Lock()
+	if !kv.leading() {
+		kv.Unlock()
+		resp.Status = kvs.StatusNotPrimary
+		return nil
+	}
+	r, err := kv.carve(req.Start, req.End)
+	kv.Unlock()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		kv.Lock()
+		r.moving = false
+		kv.Unlock()
+	}()
+
+	// Copy the range, then catch up while transactions keep committing
+	start := time.Now()
+	sent, keys, err := kv.copyRange(req)
+	if err != nil {
+		return err
+	}
+	resp.Keys = keys
+	for round := 0; round < maxCatchUpRounds; round++ {
+		n, err := kv.catchUp(req, &sent)
+		if err != nil {
+			return err
+		}
+		resp.CaughtUp += n
+		if n < catchUpDone {
+			break
+		}
+	}
+
+	// Fence the range and wait for the locks in it to be released
+	if status := kv.fenceRange(r, true); status != kvs.StatusOK {
+		resp.Status = status
+		return nil
+	}
+	timeout := req.FenceTimeout
+	if timeout == 0 {
+		timeout = defaultFenceTimeout
+	}
+	fenced := time.Now()
+	if !kv.waitIdle(req.Start, req.End, timeout) {
+		kv.fenceRange(r, false)
+		return fmt.Errorf("locks in [%q, %q) still held after %v", req.Start, req.End, timeout)
+	}
+	n, err := kv.catchUp(req, &sent)
+	if err == nil {
+		err = kv.handOver(req)
+	}
+	if err != nil {
+		kv.fenceRange(r, false)
+		return err
+	}
+	resp.CaughtUp += n
+
+	// Give up the range, which drops its keys
+	kv.Lock()
+	var infos []kvs.RangeInfo
+	for _, info := range kv.rangeInfos() {
+		if info.Start != r.start || info.End != r.end {
+			infos = append(infos, info)
+		}
+	}
+	kv.Unlock()
+	if status := kv.assign(infos); status != kvs.StatusOK {
+		resp.Status = status
+		return nil
+	}
+
+	log.Printf("moved [%q, %q) to %s in %v, fenced for %v: %d keys, %d writes caught up",
+		req.Start, req.End, req.Target, time.Since(start), time.Since(fenced), resp.Keys, resp.CaughtUp)
+	resp.Status = kvs.StatusOK
+	return nil
+}
+
+// Helper method to cut [start, end) out of the owned ranges that hold it,
+// which may have been split, so it can move as one range, and mark it
+// moving. Must hold kv's lock.
+func (kv *KVService) carve(start, end string) (*keyRange, error) {
+	if end != "" && end <= start {
+		return nil, fmt.Errorf("[%q, %q) is empty", start, end)
+	}
+
+	// The owned ranges that overlap the span must cover it without gaps
+	first, last := -1, -1
+	for i, r := range kv.ranges {
+		if !overlaps(r.start, r.end, start, end) {
+			continue
+		}
+		if r.moving || r.fenced {
+			return nil, fmt.Errorf("range [%q, %q) is already moving", r.start, r.end)
+		}
+		if first < 0 {
+			first = i
+		} else if kv.ranges[last].end != r.start {
+			return nil, fmt.Errorf("%s doesn't own all of [%q, %q)", kv.addr, start, end)
+		}
+		last = i
+	}
+	if first < 0 || kv.ranges[first].start > start || (kv.ranges[last].end != "" && (end == "" || kv.ranges[last].end < end)) {
+		return nil, fmt.Errorf("%s doesn't own all of [%q, %q)", kv.addr, start, end)
+	}
+
+	var pieces []*keyRange
+	if r := kv.ranges[first]; r.start < start {
+		pieces = append(pieces, &keyRange{start: r.start, end: start})
+	}
+	moving := &keyRange{start: start, end: end, moving: true}
+	pieces = append(pieces, moving)
+	if r := kv.ranges[last]; end != "" && end != r.end {
+		pieces = append(pieces, &keyRange{start: end, end: r.end})
+	}
+	kv.ranges = append(kv.ranges[:first], append(pieces, kv.ranges[last+1:]...)...)
+	kv.countKeys(pieces)
+	return moving, nil
+}
+
+// Helper method to copy every committed entry in the range to the target.
+// Returns the version the copy is as of and the number of keys copied.
+func (kv *KVService) copyRange(req *kvs.MigrateRequest) (uint64, int, error) {
+	kv.Lock()
+	now := kv.clock()
+	version := kv.version
+	var entries []kvs.SnapshotEntry
+	for key, entry := range kv.mp {
+		if kvs.InRange(key, req.Start, req.End) && !entry.expired(now) {
+			entries = append(entries, snapshotEntry(key, entry))
+		}
+	}
+	kv.Unlock()
+
+	return version, len(entries), kv.install(req, entries, version)
+}
+
+// Helper method to send the target the keys in the range written since
+// version *sent, and move *sent up to what has been sent. If those writes
+// have been compacted away, the whole range is copied again. Returns the
+// number of keys sent.
+func (kv *KVService) catchUp(req *kvs.MigrateRequest, sent *uint64) (int, error) {
+	kv.Lock()
+	changes, compacted := kv.changesSince(*sent, 0)
+	if compacted {
+		kv.Unlock()
+		version, keys, err := kv.copyRange(req)
+		*sent = version
+		return keys, err
+	}
+
+	now := kv.clock()
+	written := make(map[string]bool)
+	var entries []kvs.SnapshotEntry
+	for _, change := range changes {
+		for key := range change.Writes {
+			if written[key] || !kvs.InRange(key, req.Start, req.End) {
+				continue
+			}
+			written[key] = true
+			if entry, found := kv.mp[key]; found && !entry.expired(now) {
+				entries = append(entries, snapshotEntry(key, entry))
+			}
+		}
+	}
+	version := kv.version
+	kv.Unlock()
+
+	if err := kv.install(req, entries, version); err != nil {
+		return 0, err
+	}
+	*sent = version
+	return len(entries), nil
+}
+
+// Helper method to send entries of the range to the target in batches
+func (kv *KVService) install(req *kvs.MigrateRequest, entries []kvs.SnapshotEntry, version uint64) error {
+	for len(entries) > 0 {
+		batch := entries[:min(len(entries), installBatch)]
+		entries = entries[len(batch):]
+
+		installReq := kvs.InstallRangeRequest{
+			TransactionID: fmt.Sprintf("migrate-%s-%d", kv.addr, time.Now().UnixNano()),
+			Start:         req.Start,
+			End:           req.End,
+			Entries:       batch,
+			Version:       version,
+		}
+		installResp := kvs.InstallRangeResponse{}
+		if err := kv.peers.Call(req.Target, "KVService.InstallRange", &installReq, &installResp); err != nil {
+			return err
+		}
+		if err := installResp.Status.Err(); err != nil {
+			return fmt.Errorf("installing on %s: %w", req.Target, err)
+		}
+	}
+	return nil
+}
+
+// Helper method to fence or unfence r, on this server and its replicas
+func (kv *KVService) fenceRange(r *keyRange, fenced bool) kvs.Status {
+	kv.Lock()
+	infos := kv.rangeInfos()
+	for i := range infos {
+		if infos[i].Start == r.start && infos[i].End == r.end {
+			infos[i].Fenced = fenced
+		}
+	}
+	kv.Unlock()
+	return kv.assign(infos)
+}
+
+// Helper method to replace the ranges this server owns, on it and its
+// replicas
+func (kv *KVService) assign(infos []kvs.RangeInfo) kvs.Status {
+	resp := kvs.AssignRangesResponse{}
+	if err := kv.AssignRanges(&kvs.AssignRangesRequest{Ranges: infos}, &resp); err != nil {
+		log.Printf("assigning ranges: %v", err)
+		return kvs.StatusNotPrimary
+	}
+	return resp.Status
+}
+
+// Helper method to wait until no transaction holds a lock on a key in
+// [start, end) or has scanned part of it. Returns false if that takes longer
+// than timeout.
+func (kv *KVService) waitIdle(start, end string, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		kv.Lock()
+		idle := kv.spanIdle(start, end)
+		kv.Unlock()
+		if idle {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Helper method to check that no transaction holds a lock in [start, end).
+// Must hold kv's lock.
+func (kv *KVService) spanIdle(start, end string) bool {
+	for key := range kv.locks {
+		if kvs.InRange(key, start, end) {
+			return false
+		}
+	}
+	for _, tx := range kv.transactions {
+		for _, span := range tx.Scans {
+			if overlaps(span.start, span.end, start, end) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Helper method to assign the range to the target, next to the ranges it
+// already owns
+func (kv *KVService) handOver(req *kvs.MigrateRequest) error {
+	rangesResp := kvs.RangesResponse{}
+	if err := kv.peers.Call(req.Target, "KVService.Ranges", &kvs.RangesRequest{}, &rangesResp); err != nil {
+		return err
+	}
+	assignReq := kvs.AssignRangesRequest{
+		Ranges: append(rangesResp.Ranges, kvs.RangeInfo{Start: req.Start, End: req.End, Owner: req.Target}),
+	}
+	assignResp := kvs.AssignRangesResponse{}
+	if err := kv.peers.Call(req.Target, "KVService.AssignRanges", &assignReq, &assignResp); err != nil {
+		return err
+	}
+	if err := assignResp.Status.Err(); err != nil {
+		return fmt.Errorf("assigning to %s: %w", req.Target, err)
+	}
+	return nil
+}
+
+// InstallRange stores entries of a range that is moving to this server. The
+// entries are committed as a transaction, so they reach this server's
+// replicas, but aren't served until the range is assigned here.
+func (kv *KVService) InstallRange(req *kvs.InstallRangeRequest, resp *kvs.InstallRangeResponse) error {
+	if kv.raft != nil {
+		return propose(kv, opInstall, req, resp, func() { resp.Status = kvs.StatusNotPrimary })
+	}
+
+	defer kv.syncOutcomes()
+	defer kv.awaitBackups(&resp.Status)
+	kv.Lock()
+	defer kv.Unlock()
+
+	if kv.role != kvs.RolePrimary {
+		resp.Status = kvs.StatusNotPrimary
+		return nil
+	}
+	return kv.installRange(req, resp)
+}
+
+// Helper method to commit the entries of a moving range. Their versions
+// are replaced by this server's, which first moves past the sender's so a
+// version read before the move can't match a different value after it.
+// Must hold kv's lock.
+func (kv *KVService) installRange(req *kvs.InstallRangeRequest, resp *kvs.InstallRangeResponse) error {
+	for _, r := range kv.ranges {
+		if overlaps(r.start, r.end, req.Start, req.End) {
+			return fmt.Errorf("%s already owns [%q, %q), which overlaps [%q, %q)", kv.addr, r.start, r.end, req.Start, req.End)
+		}
+	}
+	if kv.outcomes[req.TransactionID] == outcomeCommitted {
+		resp.Status = kvs.StatusOK
+		return nil
+	}
+
+	now := kv.clock()
+	tx := &Transaction{
+		ID:        req.TransactionID,
+		ReadSet:   make(map[string]bool),
+		WriteSet:  make(map[string]Write),
+		Status:    "active",
+		StartTime: now,
+	}
+	for _, e := range req.Entries {
+		write := Write{Value: e.Value}
+		if !e.ExpiresAt.IsZero() {
+			if write.TTL = e.ExpiresAt.Sub(now); write.TTL <= 0 {
+				continue
+			}
+		}
+		tx.WriteSet[e.Key] = write
+	}
+	kv.version = max(kv.version, req.Version)
+	kv.transactions[tx.ID] = tx
+	kv.active++
+
+	if err := kv.commitTransaction(tx); err != nil {
+		return err
+	}
+	resp.Status = kvs.StatusOK
+	return nil
+}
+
+func snapshotEntry(key string, entry *Entry) kvs.SnapshotEntry {
+	return kvs.SnapshotEntry{Key: key, Value: entry.Value, Version: entry.Version, ExpiresAt: entry.ExpiresAt}
+}
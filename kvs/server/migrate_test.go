@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rstutsman/cs6450-labs/kvs"
+	"github.com/stretchr/testify/assert"
+)
+
+func spans(kv *KVService) [][2]string {
+	var result [][2]string
+	for _, r := range ranges(kv) {
+		result = append(result, [2]string{r.Start, r.End})
+	}
+	return result
+}
+
+func TestMigrateRangeUnderLoad(t *testing.T) {
+	source := startShard(t, 2)
+	target := startTestServer(t, "localhost:0")
+	target.kv.ranges = nil
+
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, kvs.StatusOK, put(source[0].kv, "fill", fmt.Sprintf("k%03d", i), "0"))
+	}
+	assert.Equal(t, kvs.StatusOK, commit(source[0].kv, "fill"))
+
+	// Keep writing a key in the moving range, following it to its new owner
+	var stop atomic.Bool
+	var wg sync.WaitGroup
+	var lastCommitted atomic.Int64
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		owner := source[0].kv
+		for i := 1; !stop.Load(); i++ {
+			txID := fmt.Sprintf("writer-%d", i)
+			status := put(owner, txID, "k050", fmt.Sprint(i))
+			if status == kvs.StatusOK {
+				status = commit(owner, txID)
+			} else {
+				owner.Abort(&kvs.AbortRequest{TransactionID: txID}, &kvs.AbortResponse{})
+			}
+			switch status {
+			case kvs.StatusOK:
+				lastCommitted.Store(int64(i))
+			case kvs.StatusWrongShard:
+				// Like a client refreshing its shard map
+				owner = target.kv
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	resp := kvs.MigrateResponse{}
+	err := source[0].kv.MigrateRange(&kvs.MigrateRequest{Start: "k040", End: "k060", Target: target.kv.addr}, &resp)
+	assert.Nil(t, err)
+	assert.Equal(t, kvs.StatusOK, resp.Status)
+	assert.Equal(t, 20, resp.Keys)
+	time.Sleep(20 * time.Millisecond)
+	stop.Store(true)
+	wg.Wait()
+
+	// The range moved, along with every write to it
+	assert.Equal(t, [][2]string{{"", "k040"}, {"k060", ""}}, spans(source[0].kv))
+	assert.Equal(t, [][2]string{{"", "k040"}, {"k060", ""}}, spans(source[1].kv))
+	assert.Equal(t, [][2]string{{"k040", "k060"}}, spans(target.kv))
+	assert.Equal(t, fmt.Sprint(lastCommitted.Load()), committedValue(target.kv, "k050"))
+	assert.Equal(t, "0", committedValue(target.kv, "k041"))
+	assert.Equal(t, "", committedValue(target.kv, "k060"))
+
+	// The old owner and its backup dropped the keys and redirect clients
+	assert.Equal(t, "", committedValue(source[0].kv, "k050"))
+	assert.Equal(t, "", committedValue(source[1].kv, "k050"))
+	_, status := get(source[0].kv, "reader", "k045")
+	assert.Equal(t, kvs.StatusWrongShard, status)
+	_, status = get(source[0].kv, "reader", "k065")
+	assert.Equal(t, kvs.StatusOK, status)
+}
+
+func TestMigrateRangeGivesUpOnHeldLocks(t *testing.T) {
+	source := startTestServer(t, "localhost:0")
+	target := startTestServer(t, "localhost:0")
+	target.kv.ranges = nil
+	assert.Equal(t, kvs.StatusOK, put(source.kv, "fill", "b", "1"))
+	assert.Equal(t, kvs.StatusOK, commit(source.kv, "fill"))
+
+	_, status := get(source.kv, "holder", "b")
+	assert.Equal(t, kvs.StatusOK, status)
+
+	req := kvs.MigrateRequest{Start: "a", End: "c", Target: target.kv.addr, FenceTimeout: 50 * time.Millisecond}
+	assert.NotNil(t, source.kv.MigrateRange(&req, &kvs.MigrateResponse{}))
+
+	// The source keeps the range and serves it again
+	assert.Equal(t, kvs.StatusOK, put(source.kv, "holder", "b", "2"))
+	assert.Equal(t, kvs.StatusOK, commit(source.kv, "holder"))
+	assert.Equal(t, "2", committedValue(source.kv, "b"))
+	assert.Equal(t, 0, len(spans(target.kv)))
+
+	// And can move it once the lock is gone
+	resp := kvs.MigrateResponse{}
+	assert.Nil(t, source.kv.MigrateRange(&req, &resp))
+	assert.Equal(t, kvs.StatusOK, resp.Status)
+	assert.Equal(t, "2", committedValue(target.kv, "b"))
+}
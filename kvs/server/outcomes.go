@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/rstutsman/cs6450-labs/kvs"
+)
+
+const (
+	outcomeCommitted = "committed"
+	outcomeAborted   = "aborted"
+	outcomeExpired   = "expired" // aborted by the server after a timeout
+)
+
+const (
+	defaultOutcomeRetention = 10 * time.Minute
+	outcomeGCInterval       = 10 * time.Second
+	minOutcomeCompaction    = 1000 // don't compact a log with fewer forgotten records than this
+)
+
+// outcomeRecord is a line in the durable outcome log. Once a transaction's
+// outcome is logged, repeated Commit or Abort requests get the same answer,
+// even across restarts. A prepared transaction's vote is logged before it is
+// given, with what it needs to commit, and an outcome for it follows later.
+type outcomeRecord struct {
+	TxID         string                `json:"txid"`
+	Outcome      string                `json:"outcome,omitempty"`
+	At           time.Time             `json:"at,omitempty"`
+	Participants []string              `json:"participants,omitempty"` // other participants that must confirm a prepared commit
+	Prepare      *kvs.ReplicateRequest `json:"prepare,omitempty"`      // the prepared transaction, for a vote
+}
+
+// finishedTx is a finished transaction whose outcome is still kept.
+type finishedTx struct {
+	id           string
+	at           time.Time
+	participants []string // other participants that must confirm the outcome before it is forgotten
+}
+
+// Helper method to load the outcome log from dir and keep appending to it.
+func (kv *KVService) openOutcomeLog(dir string, sync bool) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, "outcomes.log")
+
+	now := time.Now()
+	prepared := make(map[string]*kvs.ReplicateRequest)
+	var order []string
+	err := kvs.ReplayLog(path, func(line []byte) error {
+		var record outcomeRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		kv.logged++
+		if record.Prepare != nil {
+			prepared[record.TxID] = record.Prepare
+			order = append(order, record.TxID)
+			return nil
+		}
+		delete(prepared, record.TxID)
+		if record.At.IsZero() {
+			record.At = now
+		}
+		kv.outcomes[record.TxID] = record.Outcome
+		kv.finished = append(kv.finished, finishedTx{id: record.TxID, at: record.At, participants: record.Participants})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Transactions that voted yes without learning the outcome hold their
+	// locks again, and termination decides them
+	for _, txID := range order {
+		if req, inDoubt := prepared[txID]; inDoubt {
+			kv.applyPrepare(req)
+			log.Printf("restored prepared transaction %s", txID)
+		}
+	}
+
+	kv.outcomeLog, err = kvs.OpenLog(path, sync)
+	return err
+}
+
+// Helper method to record a transaction's outcome before anyone is told
+// about it. The outcome is written to the log, but only durable once the
+// handler has released kv's lock and called syncOutcomes. Transactions that
+// didn't write anything and never prepared aren't logged: forgetting them in
+// a crash is the same as aborting them. Must hold kv's lock.
+func (kv *KVService) recordOutcome(txID, outcome string) error {
+	now := kv.clock()
+	var participants []string
+	tx, exists := kv.transactions[txID]
+	if exists && tx.Status == "prepared" && outcome == outcomeCommitted {
+		participants = otherParticipants(tx.Participants, kv.addr)
+	}
+
+	if kv.outcomeLog != nil && (!exists || tx.Status == "prepared" || len(tx.WriteSet) > 0) {
+		record := outcomeRecord{TxID: txID, Outcome: outcome, At: now, Participants: participants}
+		if err := kv.outcomeLog.Write(record); err != nil {
+			return err
+		}
+		kv.logged++
+	}
+	kv.outcomes[txID] = outcome
+	kv.finished = append(kv.finished, finishedTx{id: txID, at: now, participants: participants})
+	return nil
+}
+
+// Helper method to log a transaction's yes vote along with everything it
+// needs to commit, so a restart can't lose it. The vote is only durable once
+// the handler has released kv's lock and called syncOutcomes. Must hold kv's
+// lock.
+func (kv *KVService) recordPrepare(req kvs.ReplicateRequest) error {
+	if kv.outcomeLog == nil {
+		return nil
+	}
+	if err := kv.outcomeLog.Write(outcomeRecord{TxID: req.TransactionID, At: kv.clock(), Prepare: &req}); err != nil {
+		return err
+	}
+	kv.logged++
+	return nil
+}
+
+// syncOutcomes waits until the outcomes recorded so far are on disk. RPC
+// handlers call it after releasing kv's lock and before answering, so that
+// commits arriving together share one sync instead of each holding the lock
+// through its own. Must not hold kv's lock.
+func (kv *KVService) syncOutcomes() {
+	if kv.outcomeLog == nil {
+		return
+	}
+	if err := kv.outcomeLog.WaitDurable(); err != nil {
+		// Other transactions may already have seen the writes of the
+		// transactions waiting here, so there is no taking them back
+		log.Fatalf("outcome log: %v", err)
+	}
+}
+
+// forgetOutcomes drops the outcomes of transactions that finished more than
+// kv.retention ago, and compacts the outcome log once most of it is
+// forgotten. By then any retried Commit or Abort, late request or
+// termination of the transaction has long asked for it. The exception is a
+// commit this server prepared for: a participant that asked about it later
+// would be told it aborted, so it is kept until every other participant says
+// it knows the outcome too. The primary or leader decides, and its replicas
+// forget the same outcomes.
+func (kv *KVService) forgetOutcomes() {
+	kv.Lock()
+	if kv.retention == 0 || !kv.leading() {
+		kv.Unlock()
+		return
+	}
+	cutoff := time.Now().Add(-kv.retention)
+	var expired []finishedTx
+	for _, f := range kv.finished {
+		if !f.at.Before(cutoff) {
+			break
+		}
+		if _, kept := kv.outcomes[f.id]; kept {
+			expired = append(expired, f)
+		}
+	}
+	kv.Unlock()
+
+	req := kvs.ForgetRequest{}
+	for _, f := range expired {
+		if kv.confirmed(f) {
+			req.TransactionIDs = append(req.TransactionIDs, f.id)
+		}
+	}
+	if len(req.TransactionIDs) == 0 {
+		return
+	}
+
+	if kv.raft != nil {
+		kv.submit(opForget, &req)
+		return
+	}
+	kv.Lock()
+	if kv.role == kvs.RolePrimary {
+		kv.forget(&req, &kvs.ForgetResponse{})
+		record := kvs.ReplicateRequest{Type: kvs.ReplicateForget, Forget: req.TransactionIDs}
+		kv.replicate(record)
+	}
+	kv.Unlock()
+	kv.compactOutcomes()
+}
+
+// Helper method to check that every other participant of f knows its
+// outcome, so nobody will ask this server for it again.
+func (kv *KVService) confirmed(f finishedTx) bool {
+	for _, addr := range f.participants {
+		resp := kvs.TxStatusResponse{}
+		if err := kv.peers.Call(addr, "KVService.TxStatus", &kvs.TxStatusRequest{TransactionID: f.id}, &resp); err != nil {
+			return false
+		}
+		if resp.State != kvs.TxCommitted && resp.State != kvs.TxAborted {
+			return false
+		}
+	}
+	return true
+}
+
+// Helper method to drop outcomes the primary or leader has decided nobody
+// needs anymore. Must hold kv's lock.
+func (kv *KVService) forget(req *kvs.ForgetRequest, resp *kvs.ForgetResponse) error {
+	for _, txID := range req.TransactionIDs {
+		delete(kv.outcomes, txID)
+	}
+	// Outcomes are forgotten roughly oldest first, so the ones at the front
+	// of the queue are usually gone
+	drop := 0
+	for drop < len(kv.finished) {
+		if _, kept := kv.outcomes[kv.finished[drop].id]; kept {
+			break
+		}
+		drop++
+	}
+	kv.finished = kv.finished[drop:]
+	resp.Status = kvs.StatusOK
+	return nil
+}
+
+// Helper method to rewrite the outcome log with only the outcomes still
+// kept and the votes of transactions still prepared, once it holds more
+// forgotten records than kept ones. Must not hold kv's lock.
+func (kv *KVService) compactOutcomes() {
+	kv.Lock()
+	if kv.outcomeLog == nil || kv.logged-len(kv.outcomes) < max(len(kv.outcomes), minOutcomeCompaction) {
+		kv.Unlock()
+		return
+	}
+	var records []any
+	for _, tx := range kv.transactions {
+		if tx.Status == "prepared" {
+			prepare := kv.prepareRecord(tx)
+			records = append(records, outcomeRecord{TxID: tx.ID, At: tx.PreparedAt, Prepare: &prepare})
+		}
+	}
+	seen := make(map[string]bool, len(kv.outcomes))
+	for _, f := range kv.finished {
+		outcome, kept := kv.outcomes[f.id]
+		if !kept || seen[f.id] {
+			continue
+		}
+		seen[f.id] = true
+		records = append(records, outcomeRecord{TxID: f.id, Outcome: outcome, At: f.at, Participants: f.participants})
+	}
+	since := kv.outcomeLog.Size()
+	before := kv.logged
+	kv.logged = len(records)
+	kv.Unlock()
+
+	if err := kv.outcomeLog.Compact(records, since); err != nil {
+		log.Printf("outcome log: compaction failed: %v", err)
+		kv.Lock()
+		kv.logged += before - len(records)
+		kv.Unlock()
+		return
+	}
+	log.Printf("compacted outcome log from %d records to %d", before, len(records))
+}
+
+// Helper function to list the other participants of a transaction
+func otherParticipants(participants []string, self string) []string {
+	return slices.DeleteFunc(slices.Clone(participants), func(addr string) bool { return addr == self })
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/rstutsman/cs6450-labs/kvs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadOnlyOutcomesAreNotLogged(t *testing.T) {
+	dir := t.TempDir()
+	kv := NewKVService()
+	assert.Nil(t, kv.openOutcomeLog(dir, true))
+
+	assert.Equal(t, kvs.StatusOK, put(kv, "writer", "key", "value"))
+	assert.Equal(t, kvs.StatusOK, commit(kv, "writer"))
+	_, status := get(kv, "reader", "key")
+	assert.Equal(t, kvs.StatusOK, status)
+	assert.Equal(t, kvs.StatusOK, commit(kv, "reader"))
+	assert.Equal(t, outcomeCommitted, kv.outcomes["reader"])
+
+	restarted := NewKVService()
+	assert.Nil(t, restarted.openOutcomeLog(dir, true))
+	assert.Equal(t, outcomeCommitted, restarted.outcomes["writer"])
+	_, known := restarted.outcomes["reader"]
+	assert.False(t, known)
+}
+
+func TestForgetOutcomes(t *testing.T) {
+	dir := t.TempDir()
+	kv := NewKVService()
+	assert.Nil(t, kv.openOutcomeLog(dir, false))
+	kv.retention = time.Minute
+
+	n := minOutcomeCompaction + 10
+	for i := 0; i < n; i++ {
+		txID := fmt.Sprintf("old%d", i)
+		assert.Equal(t, kvs.StatusOK, put(kv, txID, "key", "value"))
+		assert.Equal(t, kvs.StatusOK, commit(kv, txID))
+	}
+	for i := range kv.finished {
+		kv.finished[i].at = time.Now().Add(-time.Hour)
+	}
+	assert.Equal(t, kvs.StatusOK, put(kv, "new", "key", "value"))
+	assert.Equal(t, kvs.StatusOK, commit(kv, "new"))
+
+	// A commit that was prepared with another participant is kept until it
+	// confirms the outcome
+	assert.Equal(t, kvs.StatusOK, put(kv, "prepared", "other", "value"))
+	prepareResp := kvs.PrepareResponse{}
+	kv.Prepare(&kvs.PrepareRequest{TransactionID: "prepared", Participants: []string{kv.addr, "localhost:1"}}, &prepareResp)
+	assert.Equal(t, kvs.StatusOK, prepareResp.Status)
+	assert.Equal(t, kvs.StatusOK, commit(kv, "prepared"))
+	kv.finished[len(kv.finished)-1].at = time.Now().Add(-time.Hour)
+
+	kv.forgetOutcomes()
+	assert.Equal(t, 2, len(kv.outcomes))
+	assert.Equal(t, outcomeCommitted, kv.outcomes["new"])
+	assert.Equal(t, outcomeCommitted, kv.outcomes["prepared"])
+
+	// The log was compacted down to what's kept
+	assert.Equal(t, 2, kv.logged)
+	restarted := NewKVService()
+	assert.Nil(t, restarted.openOutcomeLog(dir, false))
+	assert.Equal(t, kv.outcomes, restarted.outcomes)
+	assert.Equal(t, []string{"localhost:1"}, restarted.finished[1].participants)
+}
+
+func TestPreparedSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	kv := NewKVService()
+	kv.addr = "localhost:1"
+	assert.Nil(t, kv.openOutcomeLog(dir, true))
+
+	assert.Equal(t, kvs.StatusOK, put(kv, "prepared", "key", "value"))
+	prepareResp := kvs.PrepareResponse{}
+	assert.Nil(t, kv.Prepare(&kvs.PrepareRequest{TransactionID: "prepared", Participants: []string{"localhost:1", "localhost:2"}}, &prepareResp))
+	assert.Equal(t, kvs.StatusOK, prepareResp.Status)
+
+	// The vote and the write set come back with the locks, so the
+	// transaction can still commit
+	restarted := NewKVService()
+	assert.Nil(t, restarted.openOutcomeLog(dir, true))
+	tx := restarted.transactions["prepared"]
+	assert.NotNil(t, tx)
+	assert.Equal(t, "prepared", tx.Status)
+	assert.Equal(t, []string{"localhost:1", "localhost:2"}, tx.Participants)
+	assert.Equal(t, kvs.StatusWriteLockConflict, put(restarted, "other", "key", "other"))
+	assert.Equal(t, kvs.StatusOK, commit(restarted, "prepared"))
+	assert.Equal(t, "value", committedValue(restarted, "key"))
+
+	// Once decided, it stays decided
+	again := NewKVService()
+	assert.Nil(t, again.openOutcomeLog(dir, true))
+	assert.Nil(t, again.transactions["prepared"])
+	assert.Equal(t, outcomeCommitted, again.outcomes["prepared"])
+}
+
+func TestPrepareNeedsOwnAddress(t *testing.T) {
+	kv := NewKVService()
+	kv.addr = "localhost:1"
+	assert.Equal(t, kvs.StatusOK, put(kv, "tx", "key", "value"))
+
+	// Participants list this server under another name, so termination
+	// would never find its vote
+	resp := kvs.PrepareResponse{}
+	assert.NotNil(t, kv.Prepare(&kvs.PrepareRequest{TransactionID: "tx", Participants: []string{"localhost:8080", "localhost:2"}}, &resp))
+	assert.Equal(t, "active", kv.transactions["tx"].Status)
+}
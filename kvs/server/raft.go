@@ -0,0 +1,382 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/rstutsman/cs6450-labs/kvs"
+	"github.com/rstutsman/cs6450-labs/kvs/raft"
+)
+
+// In Raft mode every replica of a shard is a node in a Raft group. Each
+// request that changes state, including taking a read lock, is proposed to
+// the group's log by the leader, and every replica applies the log in the
+// same order, so any of them can take over with the same lock table,
+// prepared transactions and outcomes. Applying must be deterministic, so the
+// leader stamps each entry with the time it was proposed and the store uses
+// that time instead of its own clock.
+//
+// Every kv.snapshotEvery entries, each replica snapshots everything applying
+// the log has built, and the log up to that entry is dropped. A restarted
+// replica starts from its snapshot, and one too far behind gets the
+// leader's.
+
+const defaultSnapshotEntries = 10000
+
+// Types of operations in the Raft log.
+const (
+	opGet        = "get"
+	opPut        = "put"
+	opPrepare    = "prepare"
+	opCommit     = "commit"
+	opAbort      = "abort"
+	opTxStatus   = "txstatus"
+	opExpire     = "expire" // abort a transaction that stayed active too long
+	opSweep      = "sweep"  // reclaim expired entries
+	opScan       = "scan"
+	opRanges     = "ranges"     // assign the ranges the shard owns
+	opInstall    = "install"    // install entries of a range moving here
+	opForget     = "forget"     // drop outcomes nobody needs anymore
+	opForceAbort = "forceabort" // abort a transaction for an admin, unless it has prepared
+	opBalance    = "balance"    // split or merge ranges, unless they changed since
+)
+
+// raftOp is the command in a Raft log entry.
+type raftOp struct {
+	Type    string          `json:"type"`
+	Time    time.Time       `json:"time"`
+	Request json.RawMessage `json:"request"`
+}
+
+// pendingOp is a proposal waiting to be applied. done receives the response,
+// an error, or nil if another leader's entry took the index.
+type pendingOp struct {
+	term uint64
+	done chan any
+}
+
+// Helper method to join the Raft group of this shard as node id, the index
+// of this replica in kv.replicas. Committed entries are applied as they
+// arrive.
+func (kv *KVService) startRaft(id int, transport raft.Transport, storage raft.Storage, config raft.Config) (*raft.Raft, error) {
+	applyCh := make(chan raft.ApplyMsg)
+	node, err := raft.New(id, len(kv.replicas), transport, storage, applyCh, config)
+	if err != nil {
+		return nil, err
+	}
+
+	kv.Lock()
+	kv.raft = node
+	kv.pending = make(map[int]*pendingOp)
+	kv.incarnation = raftIncarnation(kv.replicas)
+	kv.Unlock()
+
+	go kv.applyEntries(applyCh)
+	return node, nil
+}
+
+// Helper function to run a request through the Raft log and wait for the
+// response it gets when applied. If this replica isn't the leader, or loses
+// leadership before the entry commits, notLeader fills in the response
+// instead.
+func propose[Req, Resp any](kv *KVService, opType string, req *Req, resp *Resp, notLeader func()) error {
+	request, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	command, err := json.Marshal(raftOp{Type: opType, Time: time.Now(), Request: request})
+	if err != nil {
+		return err
+	}
+
+	// Register the proposal before the applier can get to its index
+	kv.Lock()
+	index, term, isLeader := kv.raft.Start(command)
+	if !isLeader {
+		kv.Unlock()
+		notLeader()
+		return nil
+	}
+	op := &pendingOp{term: term, done: make(chan any, 1)}
+	kv.pending[index] = op
+	kv.Unlock()
+
+	timer := time.NewTimer(kv.proposeTimeout)
+	defer timer.Stop()
+	select {
+	case result := <-op.done:
+		switch result := result.(type) {
+		case *Resp:
+			*resp = *result
+		case error:
+			return result
+		default:
+			notLeader()
+		}
+	case <-timer.C:
+		// The entry may still commit, but every request is safe to repeat
+		kv.Lock()
+		delete(kv.pending, index)
+		kv.Unlock()
+		notLeader()
+	}
+	return nil
+}
+
+// Helper method to propose an operation nobody waits for. Only the leader's
+// proposals get anywhere.
+func (kv *KVService) submit(opType string, req any) {
+	request, err := json.Marshal(req)
+	if err != nil {
+		log.Printf("%s: %v", opType, err)
+		return
+	}
+	command, err := json.Marshal(raftOp{Type: opType, Time: time.Now(), Request: request})
+	if err != nil {
+		log.Printf("%s: %v", opType, err)
+		return
+	}
+	kv.raft.Start(command)
+}
+
+// raftSnapshot is everything applying the Raft log builds, as of an entry.
+type raftSnapshot struct {
+	Version      uint64
+	Entries      []kvs.SnapshotEntry
+	History      []*Change
+	Transactions []*Transaction
+	Locks        map[string]*LockInfo
+	Outcomes     map[string]string
+	Finished     []snapshotFinished
+	Ranges       []kvs.RangeInfo
+	Epoch        uint64
+}
+
+type snapshotFinished struct {
+	ID           string
+	At           time.Time
+	Participants []string
+}
+
+// applyEntries applies committed entries in log order and hands each result
+// to the proposal waiting for it, if any. It returns once the node stops.
+func (kv *KVService) applyEntries(applyCh <-chan raft.ApplyMsg) {
+	for msg := range applyCh {
+		kv.Lock()
+		if msg.Snapshot != nil {
+			if err := kv.restoreSnapshot(msg.Snapshot); err != nil {
+				log.Fatalf("raft snapshot: %v", err)
+			}
+			kv.snapshotIndex = msg.Index
+
+			// Entries the snapshot stands in for don't get results of
+			// their own, so their proposals are answered as if leadership
+			// was lost
+			for index, op := range kv.pending {
+				if index <= msg.Index {
+					delete(kv.pending, index)
+					op.done <- nil
+				}
+			}
+			kv.Unlock()
+			continue
+		}
+
+		var result any
+		if msg.Command != nil {
+			result = kv.applyOp(msg.Command)
+		}
+		if op, exists := kv.pending[msg.Index]; exists {
+			delete(kv.pending, msg.Index)
+			if op.term == msg.Term {
+				op.done <- result
+			} else {
+				op.done <- nil
+			}
+		}
+		var snapshot []byte
+		if kv.snapshotEvery > 0 && msg.Index-kv.snapshotIndex >= kv.snapshotEvery {
+			var err error
+			if snapshot, err = json.Marshal(kv.takeSnapshot()); err != nil {
+				log.Printf("raft snapshot: %v", err)
+			}
+			kv.snapshotIndex = msg.Index
+		}
+		kv.Unlock()
+
+		// Nothing else is applied meanwhile, so the state is still as of
+		// this entry
+		if snapshot != nil {
+			if err := kv.raft.Snapshot(msg.Index, snapshot); err != nil {
+				log.Printf("raft snapshot: %v", err)
+			}
+		}
+	}
+}
+
+// Helper method to capture everything applying the Raft log has built. Must
+// hold kv's lock.
+func (kv *KVService) takeSnapshot() *raftSnapshot {
+	snapshot := &raftSnapshot{
+		Version:  kv.version,
+		Entries:  make([]kvs.SnapshotEntry, 0, len(kv.mp)),
+		History:  kv.history,
+		Locks:    kv.locks,
+		Outcomes: kv.outcomes,
+		Ranges:   kv.rangeInfos(),
+		Epoch:    kv.epoch,
+	}
+	for key, entry := range kv.mp {
+		snapshot.Entries = append(snapshot.Entries, kvs.SnapshotEntry{
+			Key:       key,
+			Value:     entry.Value,
+			Version:   entry.Version,
+			ExpiresAt: entry.ExpiresAt,
+		})
+	}
+	for _, tx := range kv.transactions {
+		snapshot.Transactions = append(snapshot.Transactions, tx)
+	}
+	for _, f := range kv.finished {
+		snapshot.Finished = append(snapshot.Finished, snapshotFinished{ID: f.id, At: f.at, Participants: f.participants})
+	}
+	return snapshot
+}
+
+// Helper method to replace everything applying the Raft log has built with
+// a snapshot of it. Must hold kv's lock.
+func (kv *KVService) restoreSnapshot(data []byte) error {
+	var snapshot raftSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return err
+	}
+
+	kv.mp = make(map[string]*Entry, len(snapshot.Entries))
+	kv.expiring = make(map[string]bool)
+	for _, e := range snapshot.Entries {
+		kv.mp[e.Key] = &Entry{Value: e.Value, Version: e.Version, ExpiresAt: e.ExpiresAt}
+		if !e.ExpiresAt.IsZero() {
+			kv.expiring[e.Key] = true
+		}
+	}
+	kv.version = snapshot.Version
+	kv.history = snapshot.History
+	close(kv.changed)
+	kv.changed = make(chan struct{})
+	kv.ranges = newRanges(snapshot.Ranges)
+	kv.countKeys(kv.ranges)
+	kv.epoch = snapshot.Epoch
+
+	kv.transactions = make(map[string]*Transaction, len(snapshot.Transactions))
+	kv.active = 0
+	for _, tx := range snapshot.Transactions {
+		kv.transactions[tx.ID] = tx
+		if tx.Status == "active" {
+			kv.active++
+		}
+	}
+	kv.locks = snapshot.Locks
+	if kv.locks == nil {
+		kv.locks = make(map[string]*LockInfo)
+	}
+	kv.outcomes = snapshot.Outcomes
+	if kv.outcomes == nil {
+		kv.outcomes = make(map[string]string)
+	}
+	kv.finished = nil
+	for _, f := range snapshot.Finished {
+		kv.finished = append(kv.finished, finishedTx{id: f.ID, at: f.At, participants: f.Participants})
+	}
+
+	log.Printf("raft: installed snapshot at version %d", kv.version)
+	return nil
+}
+
+// Helper method to apply one command from the log. Must hold kv's lock.
+func (kv *KVService) applyOp(command []byte) any {
+	var op raftOp
+	if err := json.Unmarshal(command, &op); err != nil {
+		log.Printf("raft: %v", err)
+		return err
+	}
+	kv.applyTime = op.Time
+	defer func() { kv.applyTime = time.Time{} }()
+
+	switch op.Type {
+	case opGet:
+		return applyRequest(op, kv.get)
+	case opPut:
+		return applyRequest(op, kv.put)
+	case opPrepare:
+		return applyRequest(op, kv.prepare)
+	case opCommit:
+		return applyRequest(op, kv.commit)
+	case opAbort:
+		return applyRequest(op, kv.abort)
+	case opTxStatus:
+		return applyRequest(op, kv.txStatus)
+	case opExpire:
+		return applyRequest(op, kv.expire)
+	case opForceAbort:
+		return applyRequest(op, kv.forceAbort)
+	case opScan:
+		return applyRequest(op, kv.scan)
+	case opRanges:
+		return applyRequest(op, kv.assignRanges)
+	case opBalance:
+		return applyRequest(op, kv.balance)
+	case opInstall:
+		return applyRequest(op, kv.installRange)
+	case opForget:
+		return applyRequest(op, kv.forget)
+	case opSweep:
+		return kv.sweep(op.Time)
+	}
+	log.Printf("raft: unknown operation %q", op.Type)
+	return fmt.Errorf("unknown operation %q", op.Type)
+}
+
+// Helper function to decode an operation's request and run it through a
+// handler. Returns the response, or the handler's error.
+func applyRequest[Req, Resp any](op raftOp, handle func(*Req, *Resp) error) any {
+	req := new(Req)
+	if err := json.Unmarshal(op.Request, req); err != nil {
+		return err
+	}
+	resp := new(Resp)
+	if err := handle(req, resp); err != nil {
+		return err
+	}
+	return resp
+}
+
+// Helper method to find the address of the Raft leader, or an empty string
+// if it isn't known.
+func (kv *KVService) leaderAddr() string {
+	if leader := kv.raft.Leader(); leader >= 0 && leader < len(kv.replicas) {
+		return kv.replicas[leader]
+	}
+	return ""
+}
+
+// Helper method to check whether this replica acts for its shard: the Raft
+// leader, or the primary without Raft.
+func (kv *KVService) leading() bool {
+	if kv.raft != nil {
+		_, isLeader := kv.raft.State()
+		return isLeader
+	}
+	return kv.role == kvs.RolePrimary
+}
+
+// Helper method to get the current time as far as the store is concerned:
+// the leader's time for the entry being applied, or the local clock outside
+// of Raft.
+func (kv *KVService) clock() time.Time {
+	if !kv.applyTime.IsZero() {
+		return kv.applyTime
+	}
+	return time.Now()
+}
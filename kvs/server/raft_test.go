@@ -0,0 +1,378 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rstutsman/cs6450-labs/kvs"
+	"github.com/rstutsman/cs6450-labs/kvs/raft"
+	"github.com/stretchr/testify/assert"
+)
+
+var testRaftConfig = raft.Config{
+	ElectionTimeout:   100 * time.Millisecond,
+	HeartbeatInterval: 20 * time.Millisecond,
+}
+
+// raftGroup runs the replicas of one shard in process. Killing a replica
+// stops it and throws away its state except for its Raft storage, like a
+// crash that keeps the disk.
+type raftGroup struct {
+	t        *testing.T
+	mu       sync.Mutex
+	network  *raft.LocalNetwork
+	replicas []*KVService
+	storage  []*raft.MemoryStorage
+	addrs    []string
+}
+
+func startRaftGroup(t *testing.T, name string, n int) *raftGroup {
+	g := &raftGroup{
+		t:        t,
+		network:  raft.NewLocalNetwork(),
+		replicas: make([]*KVService, n),
+		storage:  make([]*raft.MemoryStorage, n),
+	}
+	for i := range g.replicas {
+		g.addrs = append(g.addrs, fmt.Sprintf("%s-%d", name, i))
+		g.storage[i] = raft.NewMemoryStorage()
+	}
+	for i := range g.replicas {
+		g.start(i)
+	}
+	t.Cleanup(func() {
+		for i := range g.replicas {
+			g.kill(i)
+		}
+	})
+	return g
+}
+
+func (g *raftGroup) start(i int) {
+	kv := NewKVService()
+	kv.addr = g.addrs[i]
+	kv.replicas = g.addrs
+	kv.proposeTimeout = 500 * time.Millisecond
+	kv.snapshotEvery = 20 // so tests go through snapshots and compacted logs
+	node, err := kv.startRaft(i, g.network.Transport(i), g.storage[i], testRaftConfig)
+	assert.Nil(g.t, err)
+	g.network.Add(i, node)
+
+	g.mu.Lock()
+	g.replicas[i] = kv
+	g.mu.Unlock()
+}
+
+func (g *raftGroup) kill(i int) {
+	g.network.Disconnect(i)
+	g.replica(i).raft.Stop()
+}
+
+func (g *raftGroup) replica(i int) *KVService {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.replicas[i]
+}
+
+// Returns the replica that is leader, waiting for an election if needed, or
+// -1 if none turns up.
+func (g *raftGroup) leader() int {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		for i := range g.replicas {
+			resp := kvs.PingResponse{}
+			g.replica(i).Ping(&kvs.PingRequest{}, &resp)
+			if resp.Role == kvs.RolePrimary {
+				return i
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return -1
+}
+
+// Sends a request to the leader, following it to a new leader until the
+// request gets an answer from one.
+func (g *raftGroup) call(request func(kv *KVService) kvs.Status) kvs.Status {
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); {
+		leader := g.leader()
+		if leader < 0 {
+			break
+		}
+		if status := request(g.replica(leader)); status != kvs.StatusNotPrimary {
+			return status
+		}
+	}
+	g.t.Error("no leader answered")
+	return kvs.StatusNotPrimary
+}
+
+func (g *raftGroup) get(txID, key string) (string, kvs.Status) {
+	var value string
+	status := g.call(func(kv *KVService) kvs.Status {
+		var status kvs.Status
+		value, status = get(kv, txID, key)
+		return status
+	})
+	return value, status
+}
+
+func (g *raftGroup) put(txID, key, value string) kvs.Status {
+	return g.call(func(kv *KVService) kvs.Status { return put(kv, txID, key, value) })
+}
+
+func (g *raftGroup) prepare(txID string) kvs.Status {
+	return g.call(func(kv *KVService) kvs.Status {
+		resp := kvs.PrepareResponse{}
+		kv.Prepare(&kvs.PrepareRequest{TransactionID: txID, Participants: []string{kv.addr}}, &resp)
+		return resp.Status
+	})
+}
+
+func (g *raftGroup) commit(txID string) kvs.Status {
+	return g.call(func(kv *KVService) kvs.Status { return commit(kv, txID) })
+}
+
+func (g *raftGroup) abort(txID string) kvs.Status {
+	return g.call(func(kv *KVService) kvs.Status {
+		resp := kvs.AbortResponse{}
+		kv.Abort(&kvs.AbortRequest{TransactionID: txID}, &resp)
+		return resp.Status
+	})
+}
+
+func TestRaftFollowersRedirect(t *testing.T) {
+	g := startRaftGroup(t, "shard", 3)
+	leader := g.leader()
+	follower := g.replica((leader + 1) % 3)
+
+	_, status := get(follower, "tx1", "key")
+	assert.Equal(t, kvs.StatusNotPrimary, status)
+
+	resp := kvs.PingResponse{}
+	follower.Ping(&kvs.PingRequest{}, &resp)
+	assert.Equal(t, kvs.RoleBackup, resp.Role)
+	assert.Equal(t, g.addrs[leader], resp.Primary)
+}
+
+func TestRaftCommitReachesEveryReplica(t *testing.T) {
+	g := startRaftGroup(t, "shard", 3)
+
+	assert.Equal(t, kvs.StatusOK, g.put("tx1", "key", "value"))
+	assert.Equal(t, kvs.StatusOK, g.commit("tx1"))
+
+	for i := range g.replicas {
+		assert.Eventually(t, func() bool { return committedValue(g.replica(i), "key") == "value" }, time.Second, 10*time.Millisecond)
+	}
+}
+
+func TestRaftLeaderFailoverKeepsLocks(t *testing.T) {
+	g := startRaftGroup(t, "shard", 3)
+
+	// An active transaction's locks are in the log, so it carries on at the
+	// new leader
+	assert.Equal(t, kvs.StatusOK, g.put("tx1", "key", "value"))
+	g.kill(g.leader())
+
+	assert.Equal(t, kvs.StatusWriteLockConflict, g.put("tx2", "key", "other"))
+	assert.Equal(t, kvs.StatusOK, g.prepare("tx1"))
+	assert.Equal(t, kvs.StatusOK, g.commit("tx1"))
+
+	value, status := g.get("tx3", "key")
+	assert.Equal(t, kvs.StatusOK, status)
+	assert.Equal(t, "value", value)
+}
+
+func TestRaftRestartReplaysLog(t *testing.T) {
+	g := startRaftGroup(t, "shard", 3)
+	assert.Equal(t, kvs.StatusOK, g.put("tx1", "key", "value"))
+	assert.Equal(t, kvs.StatusOK, g.commit("tx1"))
+
+	for i := range g.replicas {
+		g.kill(i)
+	}
+	for i := range g.replicas {
+		g.start(i)
+	}
+
+	value, status := g.get("tx2", "key")
+	assert.Equal(t, kvs.StatusOK, status)
+	assert.Equal(t, "value", value)
+	assert.Equal(t, kvs.StatusTransactionCommitted, g.put("tx1", "key", "again"))
+}
+
+func TestRaftSnapshotsCompactLog(t *testing.T) {
+	g := startRaftGroup(t, "shard", 3)
+	lagging := (g.leader() + 1) % 3
+	g.kill(lagging)
+	for i := 0; i < 30; i++ {
+		txID := fmt.Sprintf("tx%d", i)
+		assert.Equal(t, kvs.StatusOK, g.put(txID, fmt.Sprintf("key%d", i), "value"))
+		assert.Equal(t, kvs.StatusOK, g.commit(txID))
+	}
+	assert.Equal(t, kvs.StatusOK, g.put("active", "locked", "value"))
+	for i := range g.replicas {
+		if i != lagging {
+			assert.Eventually(t, func() bool { return g.storage[i].LogSize() <= g.replica(i).snapshotEvery }, time.Second, 10*time.Millisecond)
+		}
+	}
+
+	// The leader no longer has the entries the replica missed, so it gets
+	// a snapshot, active transaction and all
+	g.start(lagging)
+	assert.Eventually(t, func() bool { return committedValue(g.replica(lagging), "key29") == "value" }, 5*time.Second, 10*time.Millisecond)
+
+	// And replicas restarting together start from their snapshots
+	for i := range g.replicas {
+		g.kill(i)
+	}
+	for i := range g.replicas {
+		g.start(i)
+	}
+	value, status := g.get("reader", "key0")
+	assert.Equal(t, kvs.StatusOK, status)
+	assert.Equal(t, "value", value)
+	assert.Equal(t, kvs.StatusWriteLockConflict, g.put("writer", "locked", "other"))
+	assert.Equal(t, kvs.StatusOK, g.commit("active"))
+	value, _ = g.get("reader2", "locked")
+	assert.Equal(t, "value", value)
+}
+
+// Runs the payment workload across two Raft groups while their leaders are
+// killed and restarted, and checks that no money is created or lost.
+func TestRaftPaymentsSurviveLeaderCrashes(t *testing.T) {
+	const accounts = 6
+	const initialBalance = 1000
+
+	groups := []*raftGroup{startRaftGroup(t, "a", 3), startRaftGroup(t, "b", 3)}
+	groupOf := func(account int) *raftGroup { return groups[account%len(groups)] }
+	key := func(account int) string { return fmt.Sprintf("account-%d", account) }
+
+	for account := 0; account < accounts; account++ {
+		txID := fmt.Sprintf("init-%d", account)
+		assert.Equal(t, kvs.StatusOK, groupOf(account).put(txID, key(account), strconv.Itoa(initialBalance)))
+		assert.Equal(t, kvs.StatusOK, groupOf(account).commit(txID))
+	}
+
+	var done atomic.Bool
+	var transfers, checks atomic.Int64
+	var workers sync.WaitGroup
+
+	// Ends a transaction on every group it touched: commit if every group
+	// prepared, abort otherwise. A decision has to reach every group, however
+	// many leaders go down on the way.
+	finish := func(txID string, touched []*raftGroup) bool {
+		for _, g := range touched {
+			if len(touched) > 1 && g.prepare(txID) != kvs.StatusOK {
+				for _, g := range touched {
+					g.abort(txID)
+				}
+				return false
+			}
+		}
+		for _, g := range touched {
+			assert.Equal(t, kvs.StatusOK, g.commit(txID), txID)
+		}
+		return true
+	}
+
+	transfer := func(id int) {
+		defer workers.Done()
+		for n := 0; !done.Load(); n++ {
+			txID := fmt.Sprintf("transfer-%d-%d", id, n)
+			from, to := rand.Intn(accounts), rand.Intn(accounts)
+			if from == to {
+				continue
+			}
+			touched := []*raftGroup{groupOf(from)}
+			if groupOf(to) != groupOf(from) {
+				touched = append(touched, groupOf(to))
+			}
+
+			fromBalance, status := groupOf(from).get(txID, key(from))
+			if status == kvs.StatusOK {
+				var toBalance string
+				toBalance, status = groupOf(to).get(txID, key(to))
+				if status == kvs.StatusOK {
+					a, _ := strconv.Atoi(fromBalance)
+					b, _ := strconv.Atoi(toBalance)
+					status = groupOf(from).put(txID, key(from), strconv.Itoa(a-1))
+					if status == kvs.StatusOK {
+						status = groupOf(to).put(txID, key(to), strconv.Itoa(b+1))
+					}
+				}
+			}
+			if status != kvs.StatusOK {
+				for _, g := range touched {
+					g.abort(txID)
+				}
+				continue
+			}
+			if finish(txID, touched) {
+				transfers.Add(1)
+			}
+		}
+	}
+
+	// Reads every account in one transaction; the total never changes
+	check := func(id int) bool {
+		txID := fmt.Sprintf("check-%d-%d", id, rand.Int63())
+		total := 0
+		for account := 0; account < accounts; account++ {
+			balance, status := groupOf(account).get(txID, key(account))
+			if status != kvs.StatusOK {
+				for _, g := range groups {
+					g.abort(txID)
+				}
+				return false
+			}
+			b, _ := strconv.Atoi(balance)
+			total += b
+		}
+		if finish(txID, groups) {
+			assert.Equal(t, accounts*initialBalance, total, txID)
+			return true
+		}
+		return false
+	}
+
+	for id := 0; id < 4; id++ {
+		workers.Add(1)
+		go transfer(id)
+	}
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		for !done.Load() {
+			if check(0) {
+				checks.Add(1)
+			}
+		}
+	}()
+
+	// Kill a leader, give the group time to elect another, then bring the
+	// old one back
+	for round := 0; round < 6; round++ {
+		time.Sleep(200 * time.Millisecond)
+		g := groups[round%len(groups)]
+		leader := g.leader()
+		if leader < 0 {
+			continue
+		}
+		g.kill(leader)
+		time.Sleep(300 * time.Millisecond)
+		g.start(leader)
+	}
+	time.Sleep(200 * time.Millisecond)
+	done.Store(true)
+	workers.Wait()
+
+	assert.Greater(t, transfers.Load(), int64(0))
+	assert.Greater(t, checks.Load(), int64(0))
+	t.Logf("%d transfers, %d balance checks", transfers.Load(), checks.Load())
+	assert.Eventually(t, func() bool { return check(1) }, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,506 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rstutsman/cs6450-labs/kvs"
+)
+
+// A server owns one or more contiguous ranges of placement keys (see
+// kvs.HashTag), all of them by default. It keeps count of the keys and the
+// load in each range, splits a range that gets too big or too busy, and
+// merges neighbouring ranges that have gone cold. Splits and merges don't
+// move any data; they only change the ranges the server reports in its part
+// of the shard map, which is the unit a range can later be moved in. The
+// primary or Raft leader decides them and replicates them like any other
+// change of ranges, so every replica of a shard owns the same ones.
+
+const defaultSplitKeys = 100000
+
+// keyRange is a range of placement keys [start, end) this server owns; an
+// empty end means no upper bound.
+type keyRange struct {
+	start string
+	end   string
+	keys  int     // keys stored in the range
+	load  float64 // operations per second over the last balance interval
+	ops   uint64  // operations since the last balance
+
+	fenced bool // moving to another server; new locks in it are refused
+	moving bool // being migrated by this server, so it must not split or merge
+}
+
+func (r *keyRange) info(owner string) kvs.RangeInfo {
+	return kvs.RangeInfo{Start: r.start, End: r.end, Owner: owner, Keys: r.keys, Load: r.load, Fenced: r.fenced}
+}
+
+// Helper function to check whether [start1, end1) and [start2, end2)
+// overlap, where an empty end means no upper bound.
+func overlaps(start1, end1, start2, end2 string) bool {
+	return (end1 == "" || start2 < end1) && (end2 == "" || start1 < end2)
+}
+
+// keySpan is a span of placement keys a transaction has scanned. Until the
+// transaction ends, other transactions can't write keys in it.
+type keySpan struct {
+	start string
+	end   string
+}
+
+// A span goes into Raft snapshots as [start, end].
+func (s keySpan) MarshalJSON() ([]byte, error) {
+	return json.Marshal([2]string{s.start, s.end})
+}
+
+func (s *keySpan) UnmarshalJSON(data []byte) error {
+	var bounds [2]string
+	if err := json.Unmarshal(data, &bounds); err != nil {
+		return err
+	}
+	s.start, s.end = bounds[0], bounds[1]
+	return nil
+}
+
+// parseKeyRange parses the -key-range flag, "start,end" with either side
+// empty for no bound, or an empty string for no range at all.
+func parseKeyRange(s string) ([]*keyRange, error) {
+	if s == "" {
+		return nil, nil
+	}
+	start, end, found := strings.Cut(s, ",")
+	if !found {
+		return nil, fmt.Errorf("key range %q is not \"start,end\"", s)
+	}
+	if end != "" && end <= start {
+		return nil, fmt.Errorf("key range %q is empty", s)
+	}
+	return []*keyRange{{start: start, end: end}}, nil
+}
+
+// Helper method to find the range that owns key, or nil if this server
+// owns none. Must hold kv's lock.
+func (kv *KVService) rangeFor(key string) *keyRange {
+	return findRange(kv.ranges, key)
+}
+
+// Helper function to find the range in ranges, sorted by start, that holds
+// key, or nil
+func findRange(ranges []*keyRange, key string) *keyRange {
+	key = kvs.HashTag(key)
+	i := sort.Search(len(ranges), func(i int) bool { return ranges[i].start > key })
+	if i == 0 || !kvs.InRange(key, ranges[i-1].start, ranges[i-1].end) {
+		return nil
+	}
+	return ranges[i-1]
+}
+
+// Helper method to check that a request for key was placed by a current
+// shard map, and that this server may take new locks on key: it owns the
+// key's range and the range isn't fenced. Requests without an epoch skip the
+// first check. Must hold kv's lock.
+func (kv *KVService) placement(key string, epoch uint64) kvs.Status {
+	if epoch != 0 && epoch < kv.epoch {
+		return kvs.StatusStaleEpoch
+	}
+	if r := kv.rangeFor(key); r == nil || r.fenced {
+		return kvs.StatusWrongShard
+	}
+	return kvs.StatusOK
+}
+
+// Helper method to check whether this server may take new locks on every
+// key in [start, end). Must hold kv's lock.
+func (kv *KVService) ownsSpan(start, end string) bool {
+	at := start
+	for _, r := range kv.ranges {
+		if r.fenced || !kvs.InRange(at, r.start, r.end) {
+			continue
+		}
+		if r.end == "" || (end != "" && r.end >= end) {
+			return true
+		}
+		at = r.end
+	}
+	return false
+}
+
+// Helper method to count an operation on key against its range's load.
+// Must hold kv's lock.
+func (kv *KVService) countOp(key string) {
+	if r := kv.rangeFor(key); r != nil {
+		r.ops++
+	}
+}
+
+// Helper method to set key's committed entry, counting the key in its range
+// if it is new. Must hold kv's lock.
+func (kv *KVService) storeEntry(key string, entry *Entry) {
+	if _, exists := kv.mp[key]; !exists {
+		if r := kv.rangeFor(key); r != nil {
+			r.keys++
+		}
+	}
+	kv.mp[key] = entry
+}
+
+// Helper method to delete key's committed entry, uncounting it from its
+// range. Must hold kv's lock.
+func (kv *KVService) deleteEntry(key string) {
+	if _, exists := kv.mp[key]; exists {
+		if r := kv.rangeFor(key); r != nil {
+			r.keys--
+		}
+		delete(kv.mp, key)
+	}
+	delete(kv.expiring, key)
+}
+
+// Helper method to count the keys in ranges from scratch, for ranges that
+// were just created. Must hold kv's lock.
+func (kv *KVService) countKeys(ranges []*keyRange) {
+	for _, r := range ranges {
+		r.keys = 0
+	}
+	for key := range kv.mp {
+		if r := findRange(ranges, key); r != nil {
+			r.keys++
+		}
+	}
+}
+
+// balanceRequest is a split or merge of ranges. It only applies if the
+// ranges it was worked out from are still the ones owned, since by the time
+// a Raft proposal applies, a migration may have fenced or moved one of them.
+type balanceRequest struct {
+	From []kvs.RangeInfo
+	To   []kvs.RangeInfo
+}
+
+type balanceResponse struct {
+	Applied bool
+}
+
+// balanceRanges works out the load of every range since the last balance,
+// then splits the ranges over a threshold and merges cold neighbours. Only
+// the primary or Raft leader splits and merges, and the new ranges are
+// replicated or proposed like any other change of ranges.
+func (kv *KVService) balanceRanges() {
+	kv.Lock()
+	now := time.Now()
+	elapsed := now.Sub(kv.lastBalance).Seconds()
+	kv.lastBalance = now
+	for _, r := range kv.ranges {
+		r.load = float64(r.ops) / elapsed
+		r.ops = 0
+	}
+	if !kv.leading() {
+		kv.Unlock()
+		return
+	}
+
+	var ranges []*keyRange
+	for _, r := range kv.ranges {
+		ranges = append(ranges, kv.split(r)...)
+	}
+	ranges = kv.merge(ranges)
+	if slices.Equal(ranges, kv.ranges) {
+		kv.Unlock()
+		return
+	}
+	req := &balanceRequest{From: kv.rangeInfos()}
+	for _, r := range ranges {
+		req.To = append(req.To, r.info(kv.addr))
+	}
+
+	if kv.raft != nil {
+		kv.Unlock()
+		propose(kv, opBalance, req, &balanceResponse{}, func() {})
+		return
+	}
+	kv.balance(req, &balanceResponse{})
+	kv.Unlock()
+	status := kvs.StatusOK
+	kv.awaitBackups(&status)
+}
+
+// Helper method to replicate and apply a split or merge of ranges, unless
+// the owned ranges changed since it was worked out. Must hold kv's lock.
+func (kv *KVService) balance(req *balanceRequest, resp *balanceResponse) error {
+	if !slices.EqualFunc(kv.ranges, req.From, func(r *keyRange, info kvs.RangeInfo) bool {
+		return r.start == info.Start && r.end == info.End && r.fenced == info.Fenced
+	}) {
+		return nil
+	}
+	kv.replicate(kvs.ReplicateRequest{Type: kvs.ReplicateRanges, Ranges: req.To})
+	kv.setRanges(req.To, 0)
+	resp.Applied = true
+	return nil
+}
+
+// Helper method to split r in two at its median key if it holds more than
+// kv.splitKeys keys or serves more than kv.splitLoad operations a second.
+// The load is assumed to split evenly. Finding the median reads every key,
+// but only for a range that needs splitting. Must hold kv's lock.
+func (kv *KVService) split(r *keyRange) []*keyRange {
+	if r.moving || r.fenced {
+		return []*keyRange{r}
+	}
+	tooBig := kv.splitKeys > 0 && r.keys > kv.splitKeys
+	tooBusy := kv.splitLoad > 0 && r.load > kv.splitLoad
+	if !tooBig && !tooBusy {
+		return []*keyRange{r}
+	}
+
+	// Keys with the same tag must stay together, so split between tags
+	var tags []string
+	seen := make(map[string]bool)
+	for key := range kv.mp {
+		if tag := kvs.HashTag(key); !seen[tag] && kvs.InRange(tag, r.start, r.end) {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) < 2 {
+		return []*keyRange{r}
+	}
+	sort.Strings(tags)
+	at := tags[len(tags)/2]
+
+	left := &keyRange{start: r.start, end: at, load: r.load / 2}
+	right := &keyRange{start: at, end: r.end, load: r.load / 2}
+	kv.countKeys([]*keyRange{left, right})
+	log.Printf("split range [%q, %q) at %q: %d keys, %.0f ops/s", r.start, r.end, at, r.keys, r.load)
+	return []*keyRange{left, right}
+}
+
+// Helper method to merge neighbouring ranges that together hold at most
+// half of kv.splitKeys keys and serve at most half of kv.splitLoad, so the
+// merged range doesn't split again right away. Must hold kv's lock.
+func (kv *KVService) merge(ranges []*keyRange) []*keyRange {
+	if len(ranges) == 0 {
+		return ranges
+	}
+	merged := ranges[:1]
+	for _, r := range ranges[1:] {
+		last := merged[len(merged)-1]
+		keys, load := last.keys+r.keys, last.load+r.load
+		cold := (kv.splitKeys <= 0 || keys <= kv.splitKeys/2) && (kv.splitLoad <= 0 || load <= kv.splitLoad/2)
+		if last.end != r.start || !cold || last.moving || r.moving || last.fenced || r.fenced {
+			merged = append(merged, r)
+			continue
+		}
+		log.Printf("merged ranges [%q, %q) and [%q, %q): %d keys, %.0f ops/s", last.start, last.end, r.start, r.end, keys, load)
+		merged[len(merged)-1] = &keyRange{start: last.start, end: r.end, keys: keys, load: load}
+	}
+	return merged
+}
+
+// Ranges reports the ranges this server owns, for building the shard map.
+func (kv *KVService) Ranges(req *kvs.RangesRequest, resp *kvs.RangesResponse) error {
+	kv.Lock()
+	defer kv.Unlock()
+
+	resp.Ranges = kv.rangeInfos()
+	resp.Epoch = kv.epoch
+	return nil
+}
+
+// AssignRanges sets the ranges this server owns. Migrations use it to fence
+// and hand over ranges, and it is replicated like a transaction so that a
+// new primary owns the same ranges.
+func (kv *KVService) AssignRanges(req *kvs.AssignRangesRequest, resp *kvs.AssignRangesResponse) error {
+	if kv.raft != nil {
+		return propose(kv, opRanges, req, resp, func() { resp.Status = kvs.StatusNotPrimary })
+	}
+
+	defer kv.awaitBackups(&resp.Status)
+	kv.Lock()
+	defer kv.Unlock()
+
+	if kv.role != kvs.RolePrimary {
+		resp.Status = kvs.StatusNotPrimary
+		return nil
+	}
+	return kv.assignRanges(req, resp)
+}
+
+// Helper method to replicate and apply a new set of owned ranges. Must hold
+// kv's lock.
+func (kv *KVService) assignRanges(req *kvs.AssignRangesRequest, resp *kvs.AssignRangesResponse) error {
+	kv.replicate(kvs.ReplicateRequest{Type: kvs.ReplicateRanges, Ranges: req.Ranges, Epoch: req.Epoch})
+	kv.setRanges(req.Ranges, req.Epoch)
+	resp.Status = kvs.StatusOK
+	return nil
+}
+
+// Helper method to own the ranges in infos instead of the ones owned so
+// far, as of the shard map epoch, if it isn't zero. Committed keys that were
+// owned before and aren't anymore have moved to another server, so they are
+// dropped. Must hold kv's lock.
+func (kv *KVService) setRanges(infos []kvs.RangeInfo, epoch uint64) {
+	kv.epoch = max(kv.epoch, epoch)
+
+	var dropped []string
+	ranges := newRanges(infos)
+	for key := range kv.mp {
+		if kv.rangeFor(key) != nil && findRange(ranges, key) == nil {
+			dropped = append(dropped, key)
+		}
+	}
+
+	// Ranges that stay the same keep their counts; new ones are counted,
+	// including keys installed before the range was assigned here
+	var created []*keyRange
+	for i, r := range ranges {
+		if old := kv.rangeFor(r.start); old != nil && old.start == r.start && old.end == r.end {
+			old.fenced = r.fenced
+			ranges[i] = old
+		} else {
+			created = append(created, r)
+		}
+	}
+	kv.ranges = ranges
+	if len(created) > 0 {
+		kv.countKeys(created)
+	}
+
+	for _, key := range dropped {
+		delete(kv.mp, key)
+		delete(kv.expiring, key)
+	}
+	if len(dropped) > 0 {
+		log.Printf("dropped %d keys this server no longer owns", len(dropped))
+	}
+}
+
+// Helper function to build a sorted range list from infos
+func newRanges(infos []kvs.RangeInfo) []*keyRange {
+	ranges := make([]*keyRange, 0, len(infos))
+	for _, info := range infos {
+		ranges = append(ranges, &keyRange{start: info.Start, end: info.End, load: info.Load, fenced: info.Fenced})
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].start < ranges[j].start })
+	return ranges
+}
+
+// Helper method to list the ranges this server owns. Must hold kv's lock.
+func (kv *KVService) rangeInfos() []kvs.RangeInfo {
+	infos := make([]kvs.RangeInfo, 0, len(kv.ranges))
+	for _, r := range kv.ranges {
+		infos = append(infos, r.info(kv.addr))
+	}
+	return infos
+}
+
+func (kv *KVService) Scan(req *kvs.ScanRequest, resp *kvs.ScanResponse) error {
+	defer kv.rpcMetrics.observe("Scan", time.Now())
+	if status := kv.admit(req.TransactionID); status != kvs.StatusOK {
+		resp.Status = status
+		return nil
+	}
+	if kv.raft != nil {
+		return propose(kv, opScan, req, resp, func() { resp.Status = kvs.StatusNotPrimary })
+	}
+
+	kv.Lock()
+	defer kv.Unlock()
+
+	if kv.role != kvs.RolePrimary {
+		resp.Status = kvs.StatusNotPrimary
+		return nil
+	}
+	return kv.scan(req, resp)
+}
+
+// Helper method to read a span of keys in order under read locks. The span
+// is remembered, up to the last key read if the limit cut it short, so that
+// no other transaction can insert a key into it before this one ends. Must
+// hold kv's lock.
+func (kv *KVService) scan(req *kvs.ScanRequest, resp *kvs.ScanResponse) error {
+	kv.stats.scans++
+	if req.Epoch != 0 && req.Epoch < kv.epoch {
+		resp.Status = kvs.StatusStaleEpoch
+		return nil
+	}
+	if !kv.ownsSpan(req.Start, req.End) {
+		resp.Status = kvs.StatusWrongShard
+		return nil
+	}
+
+	tx, status := kv.getOrCreateTransaction(req.TransactionID)
+	if status != kvs.StatusOK {
+		resp.Status = status
+		return nil
+	}
+
+	// Committed keys and keys being inserted, including this transaction's
+	// own pending writes
+	var keys []string
+	for key := range kv.mp {
+		if kvs.InRange(key, req.Start, req.End) {
+			keys = append(keys, key)
+		}
+	}
+	for key, lock := range kv.locks {
+		if _, found := kv.mp[key]; !found && lock.Writer != "" && kvs.InRange(key, req.Start, req.End) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return kvs.ScanLess(keys[i], keys[j]) })
+
+	now := kv.clock()
+	span := keySpan{start: req.Start, end: req.End}
+	for _, key := range keys {
+		if req.Limit > 0 && len(resp.Entries) == req.Limit {
+			span.end = kvs.HashTag(resp.Entries[len(resp.Entries)-1].Key) + "\x00"
+			break
+		}
+
+		kv.reclaimIfExpired(key, now)
+		if status := kv.acquireReadLock(key, req.TransactionID); status != kvs.StatusOK {
+			resp.Entries = nil
+			resp.Status = tx.fail(status)
+			return nil
+		}
+		entry, found := kv.visible(key, tx, now)
+		tx.ReadSet[key] = true
+		kv.countOp(key)
+
+		if write, exists := tx.WriteSet[key]; exists {
+			scanned := kvs.ScanEntry{Key: key, Value: write.Value}
+			if found {
+				scanned.Version = entry.Version
+			}
+			resp.Entries = append(resp.Entries, scanned)
+		} else if found {
+			resp.Entries = append(resp.Entries, kvs.ScanEntry{Key: key, Value: entry.Value, Version: entry.Version})
+		}
+	}
+	tx.Scans = append(tx.Scans, span)
+
+	resp.Status = kvs.StatusOK
+	return nil
+}
+
+// Helper method to check whether a transaction other than txID has scanned
+// a span that key falls in, so writing key could change what it read. Must
+// hold kv's lock.
+func (kv *KVService) scannedByOther(key, txID string) bool {
+	for id, tx := range kv.transactions {
+		if id == txID {
+			continue
+		}
+		for _, span := range tx.Scans {
+			if kvs.InRange(key, span.start, span.end) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/rstutsman/cs6450-labs/kvs"
+	"github.com/stretchr/testify/assert"
+)
+
+func scan(kv *KVService, txID, start, end string, limit int) ([]string, kvs.Status) {
+	resp := kvs.ScanResponse{}
+	kv.Scan(&kvs.ScanRequest{TransactionID: txID, Start: start, End: end, Limit: limit}, &resp)
+	var keys []string
+	for _, entry := range resp.Entries {
+		keys = append(keys, entry.Key)
+	}
+	return keys, resp.Status
+}
+
+func ranges(kv *KVService) []kvs.RangeInfo {
+	resp := kvs.RangesResponse{}
+	kv.Ranges(&kvs.RangesRequest{}, &resp)
+	return resp.Ranges
+}
+
+func TestRangesSplitAndMerge(t *testing.T) {
+	kv := NewKVService()
+	kv.splitKeys = 10
+	for i := 0; i < 40; i++ {
+		assert.Equal(t, kvs.StatusOK, put(kv, "fill", fmt.Sprintf("key%02d", i), "x"))
+	}
+	assert.Equal(t, kvs.StatusOK, commit(kv, "fill"))
+
+	// Each balance splits every range that is too big in two
+	for i := 0; i < 4; i++ {
+		kv.balanceRanges()
+	}
+	owned := ranges(kv)
+	assert.True(t, len(owned) >= 4)
+	keys := 0
+	for i, r := range owned {
+		assert.True(t, r.Keys <= 10, r)
+		if i > 0 {
+			assert.Equal(t, owned[i-1].End, r.Start)
+		}
+		keys += r.Keys
+	}
+	assert.Equal(t, 40, keys)
+	assert.Equal(t, "", owned[0].Start)
+	assert.Equal(t, "", owned[len(owned)-1].End)
+
+	// Once the keys are gone the ranges merge back into one
+	kv.Lock()
+	for i := 0; i < 40; i++ {
+		kv.deleteEntry(fmt.Sprintf("key%02d", i))
+	}
+	kv.Unlock()
+	kv.balanceRanges()
+	assert.Equal(t, []kvs.RangeInfo{{Owner: kv.addr}}, ranges(kv))
+}
+
+func TestRangesSplitWhenBusy(t *testing.T) {
+	kv := NewKVService()
+	kv.splitKeys = 0
+	kv.splitLoad = 1
+	assert.Equal(t, kvs.StatusOK, put(kv, "fill", "a", "x"))
+	assert.Equal(t, kvs.StatusOK, put(kv, "fill", "b", "x"))
+	assert.Equal(t, kvs.StatusOK, commit(kv, "fill"))
+	for i := 0; i < 100; i++ {
+		get(kv, fmt.Sprintf("reader%d", i), "a")
+	}
+
+	kv.balanceRanges()
+	assert.Equal(t, 2, len(ranges(kv)))
+}
+
+func TestBackupGetsPrimarysSplits(t *testing.T) {
+	shard := startShard(t, 2)
+	primary, backup := shard[0].kv, shard[1].kv
+	primary.splitKeys = 10
+	backup.splitKeys = 10
+	for i := 0; i < 40; i++ {
+		assert.Equal(t, kvs.StatusOK, put(primary, "fill", fmt.Sprintf("key%02d", i), "x"))
+	}
+	assert.Equal(t, kvs.StatusOK, commit(primary, "fill"))
+
+	// A backup doesn't split on its own, it gets the primary's ranges
+	backup.balanceRanges()
+	assert.Equal(t, 1, len(ranges(backup)))
+	primary.balanceRanges()
+	owned := ranges(primary)
+	assert.Equal(t, 2, len(owned))
+	backupOwned := ranges(backup)
+	assert.Equal(t, len(owned), len(backupOwned))
+	for i := range owned {
+		assert.Equal(t, owned[i].Start, backupOwned[i].Start)
+		assert.Equal(t, owned[i].End, backupOwned[i].End)
+		assert.Equal(t, owned[i].Keys, backupOwned[i].Keys)
+	}
+}
+
+func TestStaleBalanceIsntApplied(t *testing.T) {
+	kv := NewKVService()
+	from := ranges(kv)
+	to := []kvs.RangeInfo{{Start: "", End: "m"}, {Start: "m", End: ""}}
+
+	// A migration fences the range before the split proposal applies
+	fenced := []kvs.RangeInfo{{Fenced: true}}
+	applyLogged(t, kv, opRanges, &kvs.AssignRangesRequest{Ranges: fenced})
+	result := applyLogged(t, kv, opBalance, &balanceRequest{From: from, To: to})
+	assert.False(t, result.(*balanceResponse).Applied)
+	assert.Equal(t, 1, len(ranges(kv)))
+}
+
+func TestScanIsOrderedAndLimited(t *testing.T) {
+	kv := NewKVService()
+	for _, key := range []string{"c", "a", "{b}:2", "b", "{b}:1", "d"} {
+		assert.Equal(t, kvs.StatusOK, put(kv, "fill", key, "x"))
+	}
+	assert.Equal(t, kvs.StatusOK, commit(kv, "fill"))
+
+	keys, status := scan(kv, "tx1", "", "", 0)
+	assert.Equal(t, kvs.StatusOK, status)
+	assert.Equal(t, []string{"a", "b", "{b}:1", "{b}:2", "c", "d"}, keys)
+
+	keys, status = scan(kv, "tx2", "b", "d", 2)
+	assert.Equal(t, kvs.StatusOK, status)
+	assert.Equal(t, []string{"b", "{b}:1"}, keys)
+
+	assert.Equal(t, kvs.StatusOK, commit(kv, "tx1"))
+	assert.Equal(t, kvs.StatusOK, commit(kv, "tx2"))
+
+	// A scan sees its own transaction's inserts
+	assert.Equal(t, kvs.StatusOK, put(kv, "tx3", "e", "x"))
+	keys, _ = scan(kv, "tx3", "d", "", 0)
+	assert.Equal(t, []string{"d", "e"}, keys)
+}
+
+func TestScanBlocksInserts(t *testing.T) {
+	kv := NewKVService()
+	assert.Equal(t, kvs.StatusOK, put(kv, "fill", "a", "x"))
+	assert.Equal(t, kvs.StatusOK, commit(kv, "fill"))
+
+	_, status := scan(kv, "scanner", "a", "m", 0)
+	assert.Equal(t, kvs.StatusOK, status)
+
+	// Inserting into the scanned span conflicts, outside it doesn't
+	assert.Equal(t, kvs.StatusWriteLockConflict, put(kv, "writer", "b", "x"))
+	assert.Equal(t, kvs.StatusWriteLockConflict, put(kv, "writer", "a", "x"))
+	assert.Equal(t, kvs.StatusOK, put(kv, "writer", "n", "x"))
+
+	// Until the scanning transaction ends
+	assert.Equal(t, kvs.StatusOK, commit(kv, "scanner"))
+	assert.Equal(t, kvs.StatusOK, put(kv, "writer", "b", "x"))
+
+	// And a pending insert makes a scan over it conflict
+	_, status = scan(kv, "scanner2", "", "", 0)
+	assert.Equal(t, kvs.StatusReadLockConflict, status)
+}
+
+func TestRejectsStaleEpoch(t *testing.T) {
+	kv := NewKVService()
+	assign := func(epoch uint64, infos ...kvs.RangeInfo) {
+		resp := kvs.AssignRangesResponse{}
+		kv.AssignRanges(&kvs.AssignRangesRequest{Ranges: infos, Epoch: epoch}, &resp)
+		assert.Equal(t, kvs.StatusOK, resp.Status)
+	}
+	assign(3, kvs.RangeInfo{Start: "", End: "m"})
+
+	// Requests placed by an older map are rejected, unstamped ones aren't
+	stamped := func(epoch uint64, key string) kvs.Status {
+		resp := kvs.PutResponse{}
+		kv.Put(&kvs.PutRequest{TransactionID: fmt.Sprint("tx", epoch), Key: key, Value: []byte("x"), Epoch: epoch}, &resp)
+		return resp.Status
+	}
+	assert.Equal(t, kvs.StatusStaleEpoch, stamped(2, "a"))
+	assert.Equal(t, kvs.StatusOK, stamped(3, "a"))
+	assert.Equal(t, kvs.StatusOK, stamped(0, "b"))
+	assert.Equal(t, kvs.StatusWrongShard, stamped(4, "x"))
+
+	resp := kvs.ScanResponse{}
+	kv.Scan(&kvs.ScanRequest{TransactionID: "scanner", End: "m", Epoch: 1}, &resp)
+	assert.Equal(t, kvs.StatusStaleEpoch, resp.Status)
+
+	// Assignments without an epoch keep the current one
+	assign(0, kvs.RangeInfo{Start: "", End: ""})
+	rangesResp := kvs.RangesResponse{}
+	kv.Ranges(&kvs.RangesRequest{}, &rangesResp)
+	assert.Equal(t, uint64(3), rangesResp.Epoch)
+}
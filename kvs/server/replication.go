@@ -0,0 +1,732 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/rstutsman/cs6450-labs/kvs"
+)
+
+// Replication keeps backups of a shard in step with its primary. The primary
+// builds a record of every prepare, commit and abort of a prepared
+// transaction as it takes effect locally, and sends the records to its
+// backups in order once it has released its lock. A request only reports
+// success once every in-sync backup has every record built so far, so
+// anything a client has been told survives the primary. A backup that can't
+// be reached falls out of sync until a snapshot catches it up; successful
+// responses wait for it for backupTimeout, and then carry on without it.
+// Active transactions aren't replicated; their clients see the failover and
+// abort them.
+//
+// Only the live replica with the most records can take over, so one that
+// fell out of sync can't take over from one that didn't. A new primary
+// doesn't wait for the one it replaced, so a replica that stepped down or
+// restarted may have missed records, and can't take over until the primary
+// sends it a snapshot.
+
+// backupSync is what the primary knows about one of its backups.
+type backupSync struct {
+	inSync    bool      // it is sent every record as it is built
+	seq       uint64    // the last record it is known to have
+	outOfSync time.Time // when it fell out of sync
+}
+
+// Replicate applies a record from the primary. Records from a primary that
+// has been replaced are rejected, which tells it to step down.
+func (kv *KVService) Replicate(req *kvs.ReplicateRequest, resp *kvs.ReplicateResponse) error {
+	defer kv.syncOutcomes()
+	kv.Lock()
+	defer kv.Unlock()
+
+	if !kv.acceptPrimary(req.Term, req.Primary) {
+		resp.Status = kvs.StatusNotPrimary
+		return nil
+	}
+	if kv.needsSnapshot {
+		// Failing puts this replica out of sync, so the primary sends one
+		return fmt.Errorf("%s needs a snapshot before it can apply records", kv.addr)
+	}
+
+	switch req.Type {
+	case kvs.ReplicatePrepare:
+		if _, exists := kv.transactions[req.TransactionID]; exists {
+			break
+		}
+		kv.applyPrepare(req)
+		if err := kv.recordPrepare(*req); err != nil {
+			return err
+		}
+	case kvs.ReplicateCommit:
+		if kv.outcomes[req.TransactionID] == outcomeCommitted {
+			break
+		}
+		tx, exists := kv.transactions[req.TransactionID]
+		if !exists {
+			// Transactions with one participant commit without preparing
+			tx = &Transaction{ID: req.TransactionID, ReadSet: make(map[string]bool)}
+			kv.transactions[tx.ID] = tx
+			kv.active++
+		}
+		tx.WriteSet = writeSet(req.Writes)
+		if len(tx.WriteSet) > 0 {
+			// Normally a no-op, since backups stay in step with the primary
+			kv.version = req.Version - 1
+		}
+		if err := kv.applyCommit(tx, req.CommitTime); err != nil {
+			return err
+		}
+	case kvs.ReplicateAbort:
+		if err := kv.abortTransaction(req.TransactionID, outcomeAborted); err != nil {
+			return err
+		}
+	case kvs.ReplicateRanges:
+		kv.setRanges(req.Ranges, req.Epoch)
+	case kvs.ReplicateForget:
+		kv.forget(&kvs.ForgetRequest{TransactionIDs: req.Forget}, &kvs.ForgetResponse{})
+	}
+
+	kv.appliedTerm, kv.applied = req.Term, req.Seq
+	resp.Status = kvs.StatusOK
+	return nil
+}
+
+// InstallSnapshot replaces this backup's state with the primary's. The
+// primary sends one when a backup has missed records.
+func (kv *KVService) InstallSnapshot(req *kvs.SnapshotRequest, resp *kvs.SnapshotResponse) error {
+	defer kv.syncOutcomes()
+	kv.Lock()
+	defer kv.Unlock()
+
+	if !kv.acceptPrimary(req.Term, req.Primary) {
+		resp.Status = kvs.StatusNotPrimary
+		return nil
+	}
+
+	kv.mp = make(map[string]*Entry)
+	kv.expiring = make(map[string]bool)
+	for _, e := range req.Entries {
+		kv.mp[e.Key] = &Entry{Value: e.Value, Version: e.Version, ExpiresAt: e.ExpiresAt}
+		if !e.ExpiresAt.IsZero() {
+			kv.expiring[e.Key] = true
+		}
+	}
+	kv.version = req.Version
+	kv.incarnation = req.Incarnation
+	kv.ranges = newRanges(req.Ranges)
+	kv.countKeys(kv.ranges)
+	kv.epoch = req.Epoch
+
+	// Watchers resuming from before the snapshot see the history as compacted
+	kv.history = nil
+	close(kv.changed)
+	kv.changed = make(chan struct{})
+
+	kv.transactions = make(map[string]*Transaction)
+	kv.locks = make(map[string]*LockInfo)
+	kv.active = 0
+	for i := range req.Prepared {
+		kv.applyPrepare(&req.Prepared[i])
+		if err := kv.recordPrepare(req.Prepared[i]); err != nil {
+			return err
+		}
+	}
+
+	for txID, outcome := range req.Outcomes {
+		if _, known := kv.outcomes[txID]; known {
+			continue
+		}
+		if err := kv.recordOutcome(txID, outcome); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("installed snapshot from %s at version %d", req.Primary, req.Version)
+	kv.needsSnapshot = false
+	kv.appliedTerm, kv.applied = req.Term, req.Seq
+	resp.Status = kvs.StatusOK
+	return nil
+}
+
+// Ping reports this replica's role and what it knows about the primary. With
+// Raft, the leader reports itself as primary and the rest as backups.
+func (kv *KVService) Ping(req *kvs.PingRequest, resp *kvs.PingResponse) error {
+	kv.Lock()
+	defer kv.Unlock()
+
+	if kv.raft != nil {
+		term, isLeader := kv.raft.State()
+		resp.Role = kvs.RoleBackup
+		if isLeader {
+			resp.Role = kvs.RolePrimary
+		}
+		resp.Term = term
+		resp.Primary = kv.leaderAddr()
+		resp.Version = kv.version
+		return nil
+	}
+
+	resp.Role = kv.role
+	resp.Term = kv.term
+	resp.Primary = kv.primary
+	resp.Version = kv.version
+	resp.Stale = kv.needsSnapshot
+	resp.AppliedTerm = kv.appliedTerm
+	resp.Applied = kv.applied
+	return nil
+}
+
+// Promote makes this replica the primary of its shard. Only promote a backup
+// once the old primary is down; if it is still running, it steps down the
+// next time it replicates. A backup that may have missed records refuses.
+func (kv *KVService) Promote(req *kvs.PromoteRequest, resp *kvs.PromoteResponse) error {
+	kv.Lock()
+	defer kv.Unlock()
+
+	if kv.role != kvs.RolePrimary {
+		if kv.needsSnapshot {
+			resp.Status = kvs.StatusStaleReplica
+			return nil
+		}
+		kv.promote()
+	}
+	resp.Status = kvs.StatusOK
+	return nil
+}
+
+// startPrimary makes this replica its shard's primary when it is started as
+// one. The store isn't kept across restarts, so a restarted primary must not
+// push its empty one onto backups that have the data. If another replica is
+// already primary, this one becomes its backup. Otherwise the live backup
+// with the most records is promoted in its place, and this one waits for a
+// snapshot; only if no backup has any records does this one take over. Call
+// it before serving requests.
+func (kv *KVService) startPrimary() error {
+	successor, bestTerm, best := "", uint64(0), uint64(0)
+	for _, addr := range kv.replicas {
+		if addr == kv.addr {
+			continue
+		}
+		resp := kvs.PingResponse{}
+		if err := kv.peers.Call(addr, "KVService.Ping", &kvs.PingRequest{}, &resp); err != nil {
+			continue
+		}
+		if resp.Role == kvs.RolePrimary {
+			kv.startBackup(resp.Term, addr)
+			log.Printf("%s is already primary for term %d", addr, resp.Term)
+			return nil
+		}
+		if !resp.Stale && resp.AppliedTerm > 0 && (successor == "" || resp.AppliedTerm > bestTerm || (resp.AppliedTerm == bestTerm && resp.Applied > best)) {
+			successor, bestTerm, best = addr, resp.AppliedTerm, resp.Applied
+		}
+	}
+
+	if successor != "" {
+		resp := kvs.PromoteResponse{}
+		if err := kv.peers.Call(successor, "KVService.Promote", &kvs.PromoteRequest{}, &resp); err != nil {
+			return fmt.Errorf("promoting backup %s, which has the shard's data: %w", successor, err)
+		}
+		if resp.Status != kvs.StatusOK {
+			return fmt.Errorf("promoting backup %s, which has the shard's data: %w", successor, resp.Status.Err())
+		}
+		kv.startBackup(0, successor)
+		log.Printf("promoted backup %s, which has the shard's data", successor)
+		return nil
+	}
+
+	kv.Lock()
+	defer kv.Unlock()
+	kv.promote()
+	return nil
+}
+
+// Helper method to start as a backup of primary that needs a snapshot
+func (kv *KVService) startBackup(term uint64, primary string) {
+	kv.Lock()
+	defer kv.Unlock()
+	kv.role = kvs.RoleBackup
+	kv.term = term
+	kv.primary = primary
+	kv.lastHeard = time.Now()
+	kv.needsSnapshot = true
+}
+
+// Helper method to check that a record comes from the current primary,
+// adopting it if its term is newer. Must hold kv's lock.
+func (kv *KVService) acceptPrimary(term uint64, primary string) bool {
+	if term < kv.term || (term == kv.term && kv.primary != "" && primary != kv.primary) {
+		return false
+	}
+	if kv.role == kvs.RolePrimary {
+		kv.stepDown()
+	}
+	kv.term = term
+	kv.primary = primary
+	kv.lastHeard = time.Now()
+	return true
+}
+
+// Helper method to build a record of a change before it takes effect here.
+// The record is sent to the backups once the handler has released kv's lock,
+// and the handler waits for them with awaitBackups before it reports
+// success. Must hold kv's lock.
+func (kv *KVService) replicate(req kvs.ReplicateRequest) {
+	if kv.role != kvs.RolePrimary || kv.backups == nil {
+		return
+	}
+	kv.seq++
+	req.Term = kv.term
+	req.Primary = kv.addr
+	req.Seq = kv.seq
+	kv.backlog = append(kv.backlog, req)
+}
+
+// awaitBackups waits until every backup it waits for has the records built
+// so far, if status is StatusOK. Handlers defer it before taking kv's lock, so it runs
+// once they have released it, and sends the records itself unless another
+// handler already is. If this replica steps down first, status becomes
+// StatusNotPrimary; if the backups don't catch up within replicateTimeout,
+// StatusOutcomeUnknown, since the change took effect here and survives if
+// they catch up later. Must not hold kv's lock.
+func (kv *KVService) awaitBackups(status *kvs.Status) {
+	if *status != kvs.StatusOK {
+		return
+	}
+	kv.Lock()
+	term, target, replicated := kv.term, kv.seq, kv.backups != nil
+	kv.Unlock()
+	if !replicated {
+		return
+	}
+
+	timer := time.NewTimer(kv.replicateTimeout)
+	defer timer.Stop()
+	for {
+		if kv.replicating.TryLock() {
+			kv.sendRecords()
+			kv.replicating.Unlock()
+		}
+
+		kv.Lock()
+		if kv.term != term || kv.role != kvs.RolePrimary {
+			kv.Unlock()
+			*status = kvs.StatusNotPrimary
+			return
+		}
+		acked, excludeIn := kv.acked(time.Now())
+		if acked >= target {
+			kv.Unlock()
+			return
+		}
+		replicated := kv.replicated
+		kv.Unlock()
+
+		var excluded <-chan time.Time
+		if excludeIn > 0 {
+			excluded = time.After(excludeIn)
+		}
+		select {
+		case <-replicated:
+		case <-excluded:
+		case <-timer.C:
+			*status = kvs.StatusOutcomeUnknown
+			return
+		}
+	}
+}
+
+// Helper method to find the last record every backup that responses wait
+// for has. They wait for in-sync backups, and for out-of-sync ones until
+// they have been out of sync for backupTimeout. Also returns how long until
+// the next out-of-sync backup stops being waited for, or zero if none is.
+// Must hold kv's lock.
+func (kv *KVService) acked(now time.Time) (uint64, time.Duration) {
+	acked, excludeIn := kv.seq, time.Duration(0)
+	for _, b := range kv.backups {
+		if b.inSync {
+			acked = min(acked, b.seq)
+			continue
+		}
+		if left := kv.backupTimeout - now.Sub(b.outOfSync); left > 0 {
+			acked = min(acked, b.seq)
+			if excludeIn == 0 || left < excludeIn {
+				excludeIn = left
+			}
+		}
+	}
+	return acked, excludeIn
+}
+
+// Helper method to send every in-sync backup the records it hasn't been
+// sent yet, in order. A backup that can't be reached falls out of sync. If a
+// backup knows of a newer primary, this replica steps down. Must hold
+// kv.replicating but not kv's lock.
+func (kv *KVService) sendRecords() {
+	type batch struct {
+		addr    string
+		records []kvs.ReplicateRequest
+		sent    int // how many of records the backup took
+		err     error
+		stale   bool // the backup rejected this replica as primary
+	}
+
+	kv.Lock()
+	if kv.role != kvs.RolePrimary || kv.backups == nil {
+		kv.Unlock()
+		return
+	}
+	term := kv.term
+	first := kv.seq - uint64(len(kv.backlog)) + 1
+	var batches []*batch
+	for addr, b := range kv.backups {
+		if b.inSync && b.seq < kv.seq {
+			batches = append(batches, &batch{addr: addr, records: kv.backlog[b.seq+1-first:]})
+		}
+	}
+	kv.Unlock()
+	if len(batches) == 0 {
+		return
+	}
+
+	for _, batch := range batches {
+		for i := range batch.records {
+			resp := kvs.ReplicateResponse{}
+			if batch.err = kv.peers.Call(batch.addr, "KVService.Replicate", &batch.records[i], &resp); batch.err != nil {
+				break
+			}
+			if resp.Status == kvs.StatusNotPrimary {
+				batch.stale = true
+				break
+			}
+			batch.sent++
+		}
+	}
+
+	kv.Lock()
+	defer kv.Unlock()
+	if kv.term != term || kv.role != kvs.RolePrimary {
+		return
+	}
+	for _, batch := range batches {
+		if batch.stale {
+			kv.stepDown()
+			return
+		}
+		b := kv.backups[batch.addr]
+		b.seq += uint64(batch.sent)
+		if batch.err != nil {
+			log.Printf("backup %s out of sync: %v", batch.addr, batch.err)
+			b.inSync = false
+			b.outOfSync = time.Now()
+		}
+	}
+	kv.trimBacklog()
+	close(kv.replicated)
+	kv.replicated = make(chan struct{})
+}
+
+// Helper method to drop the records every in-sync backup has. Backups that
+// are out of sync get a snapshot instead. Must hold kv's lock.
+func (kv *KVService) trimBacklog() {
+	keep := kv.seq
+	for _, b := range kv.backups {
+		if b.inSync {
+			keep = min(keep, b.seq)
+		}
+	}
+	first := kv.seq - uint64(len(kv.backlog)) + 1
+	if keep >= first {
+		kv.backlog = kv.backlog[keep+1-first:]
+	}
+}
+
+// syncBackups sends a snapshot to every other replica that is out of sync or
+// that this primary doesn't wait for, and then any records the backups
+// haven't been sent. Records are built while the snapshot is on its way, but
+// none are dropped from the backlog until the next send, so a replica that
+// takes the snapshot is sent the ones after it.
+func (kv *KVService) syncBackups() {
+	kv.replicating.Lock()
+	defer kv.replicating.Unlock()
+	defer kv.sendRecords()
+
+	kv.Lock()
+	if kv.role != kvs.RolePrimary || kv.backups == nil {
+		kv.Unlock()
+		return
+	}
+	term := kv.term
+	var stale []string
+	for _, addr := range kv.replicas {
+		if b, waited := kv.backups[addr]; addr != kv.addr && (!waited || !b.inSync) {
+			stale = append(stale, addr)
+		}
+	}
+	kv.Unlock()
+
+	// Don't build a snapshot for replicas that are down
+	var live []string
+	for _, addr := range stale {
+		if kv.peers.Call(addr, "KVService.Ping", &kvs.PingRequest{}, &kvs.PingResponse{}) == nil {
+			live = append(live, addr)
+		}
+	}
+	if len(live) == 0 {
+		return
+	}
+
+	kv.Lock()
+	if kv.term != term || kv.role != kvs.RolePrimary {
+		kv.Unlock()
+		return
+	}
+	snapshot, seq := kv.snapshot(), kv.seq
+	kv.Unlock()
+
+	var synced []string
+	for _, addr := range live {
+		resp := kvs.SnapshotResponse{}
+		if err := kv.peers.Call(addr, "KVService.InstallSnapshot", snapshot, &resp); err != nil {
+			continue
+		}
+		if resp.Status == kvs.StatusNotPrimary {
+			kv.Lock()
+			if kv.term == term && kv.role == kvs.RolePrimary {
+				kv.stepDown()
+			}
+			kv.Unlock()
+			return
+		}
+		synced = append(synced, addr)
+	}
+
+	kv.Lock()
+	defer kv.Unlock()
+	if kv.term != term || kv.role != kvs.RolePrimary {
+		return
+	}
+	for _, addr := range synced {
+		kv.backups[addr] = &backupSync{inSync: true, seq: seq}
+		log.Printf("backup %s in sync at version %d", addr, snapshot.Version)
+	}
+	close(kv.replicated)
+	kv.replicated = make(chan struct{})
+}
+
+// monitorPrimary runs on backups. If the primary hasn't answered for
+// failoverTimeout, the live replica with the most records takes over, the
+// first in promotion order if several have them all.
+func (kv *KVService) monitorPrimary() {
+	kv.Lock()
+	role, primary, lastHeard, stale := kv.role, kv.primary, kv.lastHeard, kv.needsSnapshot
+	appliedTerm, applied := kv.appliedTerm, kv.applied
+	kv.Unlock()
+
+	if role != kvs.RoleBackup {
+		return
+	}
+	if primary != "" {
+		resp := kvs.PingResponse{}
+		err := kv.peers.Call(primary, "KVService.Ping", &kvs.PingRequest{}, &resp)
+		if err == nil && resp.Role == kvs.RolePrimary {
+			kv.heardFrom(resp.Term, primary)
+			return
+		}
+	}
+	if time.Since(lastHeard) < kv.failoverTimeout {
+		return
+	}
+
+	// Look for a replica that has already taken over. Otherwise the live one
+	// with the most records is next in line, since a backup that fell out of
+	// sync may have missed records that were reported to clients.
+	successor, bestTerm, best := "", uint64(0), uint64(0)
+	consider := func(addr string, appliedTerm, applied uint64) {
+		if successor == "" || appliedTerm > bestTerm || (appliedTerm == bestTerm && applied > best) {
+			successor, bestTerm, best = addr, appliedTerm, applied
+		}
+	}
+	for _, addr := range kv.replicas {
+		if addr == primary {
+			continue
+		}
+		if addr == kv.addr {
+			if !stale {
+				consider(addr, appliedTerm, applied)
+			}
+			continue
+		}
+		resp := kvs.PingResponse{}
+		if err := kv.peers.Call(addr, "KVService.Ping", &kvs.PingRequest{}, &resp); err != nil {
+			continue
+		}
+		if resp.Role == kvs.RolePrimary {
+			kv.heardFrom(resp.Term, addr)
+			return
+		}
+		if !resp.Stale {
+			consider(addr, resp.AppliedTerm, resp.Applied)
+		}
+	}
+
+	kv.Lock()
+	defer kv.Unlock()
+	if successor == kv.addr && kv.role == kvs.RoleBackup && kv.lastHeard == lastHeard && !kv.needsSnapshot {
+		kv.promote()
+	}
+}
+
+// Helper method to note that primary answered with term.
+func (kv *KVService) heardFrom(term uint64, primary string) {
+	kv.Lock()
+	defer kv.Unlock()
+
+	if term >= kv.term && kv.role == kvs.RoleBackup {
+		kv.term = term
+		kv.primary = primary
+		kv.lastHeard = time.Now()
+	}
+}
+
+// Helper method to take over as primary. Every other replica starts out of
+// sync and gets a snapshot. Successful responses wait for all of them but
+// the primary this one replaces, which is presumed down, for up to
+// backupTimeout; the old primary gets a snapshot too if it comes back. Must
+// hold kv's lock.
+func (kv *KVService) promote() {
+	kv.role = kvs.RolePrimary
+	kv.term++
+	kv.backups = make(map[string]*backupSync)
+	now := time.Now()
+	for _, addr := range kv.replicas {
+		if addr != kv.addr && addr != kv.primary {
+			kv.backups[addr] = &backupSync{outOfSync: now}
+		}
+	}
+	kv.primary = kv.addr
+	kv.backlog = nil
+	kv.seq = 0
+	log.Printf("promoted to primary for term %d", kv.term)
+}
+
+// Helper method to become a backup after learning of a newer primary. The
+// new primary doesn't wait for this replica, so it may miss records until
+// it gets a snapshot. Must hold kv's lock.
+func (kv *KVService) stepDown() {
+	kv.role = kvs.RoleBackup
+	kv.primary = ""
+	kv.backups = nil
+	kv.backlog = nil
+	kv.lastHeard = time.Now()
+	kv.needsSnapshot = true
+	close(kv.replicated)
+	kv.replicated = make(chan struct{})
+	log.Printf("stepping down as primary for term %d", kv.term)
+}
+
+// Helper method to hold a prepared transaction's locks on a backup, so they
+// are still held if it takes over. Must hold kv's lock.
+func (kv *KVService) applyPrepare(req *kvs.ReplicateRequest) {
+	if _, exists := kv.transactions[req.TransactionID]; exists {
+		return
+	}
+	now := time.Now()
+	tx := &Transaction{
+		ID:           req.TransactionID,
+		ReadSet:      make(map[string]bool),
+		WriteSet:     writeSet(req.Writes),
+		Status:       "prepared",
+		StartTime:    now,
+		PreparedAt:   now,
+		Participants: req.Participants,
+		Coordinator:  req.Coordinator,
+	}
+	for _, key := range req.ReadSet {
+		tx.ReadSet[key] = true
+		kv.acquireReadLock(key, tx.ID)
+	}
+	for key := range tx.WriteSet {
+		kv.acquireWriteLock(key, tx.ID)
+	}
+	kv.transactions[tx.ID] = tx
+	kv.active++
+}
+
+// Helper method to build the prepare record for a transaction. Must hold
+// kv's lock.
+func (kv *KVService) prepareRecord(tx *Transaction) kvs.ReplicateRequest {
+	readSet := make([]string, 0, len(tx.ReadSet))
+	for key := range tx.ReadSet {
+		readSet = append(readSet, key)
+	}
+	sort.Strings(readSet)
+	return kvs.ReplicateRequest{
+		Type:          kvs.ReplicatePrepare,
+		TransactionID: tx.ID,
+		ReadSet:       readSet,
+		Writes:        committedWrites(tx.WriteSet),
+		Participants:  tx.Participants,
+		Coordinator:   tx.Coordinator,
+	}
+}
+
+// Helper method to copy everything a backup needs to take over, so it can be
+// sent after releasing kv's lock. Must hold kv's lock.
+func (kv *KVService) snapshot() *kvs.SnapshotRequest {
+	req := &kvs.SnapshotRequest{
+		Term:        kv.term,
+		Primary:     kv.addr,
+		Seq:         kv.seq,
+		Version:     kv.version,
+		Incarnation: kv.incarnation,
+		Entries:     make([]kvs.SnapshotEntry, 0, len(kv.mp)),
+		Outcomes:    maps.Clone(kv.outcomes),
+		Ranges:      kv.rangeInfos(),
+		Epoch:       kv.epoch,
+	}
+	for key, entry := range kv.mp {
+		req.Entries = append(req.Entries, kvs.SnapshotEntry{
+			Key:       key,
+			Value:     entry.Value,
+			Version:   entry.Version,
+			ExpiresAt: entry.ExpiresAt,
+		})
+	}
+	for _, tx := range kv.transactions {
+		if tx.Status == "prepared" {
+			req.Prepared = append(req.Prepared, kv.prepareRecord(tx))
+		}
+	}
+	return req
+}
+
+func committedWrites(writes map[string]Write) []kvs.CommittedWrite {
+	keys := make([]string, 0, len(writes))
+	for key := range writes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	result := make([]kvs.CommittedWrite, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, kvs.CommittedWrite{Key: key, Value: writes[key].Value, TTL: writes[key].TTL})
+	}
+	return result
+}
+
+func writeSet(writes []kvs.CommittedWrite) map[string]Write {
+	result := make(map[string]Write, len(writes))
+	for _, w := range writes {
+		result[w.Key] = Write{Value: w.Value, TTL: w.TTL}
+	}
+	return result
+}
+
+// Helper method to check whether addr is this server or another replica of
+// its shard
+func (kv *KVService) isReplica(addr string) bool {
+	return addr == kv.addr || slices.Contains(kv.replicas, addr)
+}
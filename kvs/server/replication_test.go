@@ -0,0 +1,333 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/rpc"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rstutsman/cs6450-labs/kvs"
+	"github.com/stretchr/testify/assert"
+)
+
+// testServer runs a KVService on its own listener, so a test can stop it the
+// way a crash would by closing the listener and every open connection.
+type testServer struct {
+	net.Listener
+	kv    *KVService
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func (s *testServer) Accept() (net.Conn, error) {
+	conn, err := s.Listener.Accept()
+	if err == nil {
+		s.mu.Lock()
+		s.conns = append(s.conns, conn)
+		s.mu.Unlock()
+	}
+	return conn, err
+}
+
+func (s *testServer) crash() {
+	s.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+}
+
+func startTestServer(t *testing.T, addr string) *testServer {
+	l, err := net.Listen("tcp", addr)
+	assert.Nil(t, err)
+
+	kv := NewKVService()
+	kv.addr = l.Addr().String()
+	server := rpc.NewServer()
+	server.RegisterName("KVService", kv)
+
+	s := &testServer{Listener: l, kv: kv}
+	go http.Serve(s, server)
+	t.Cleanup(s.crash)
+	return s
+}
+
+// Starts a shard with n replicas, the first of them primary, and brings the
+// backups in sync.
+func startShard(t *testing.T, n int) []*testServer {
+	servers := make([]*testServer, n)
+	addrs := make([]string, n)
+	for i := range servers {
+		servers[i] = startTestServer(t, "localhost:0")
+		addrs[i] = servers[i].kv.addr
+	}
+	for i, s := range servers {
+		s.kv.replicas = addrs
+		if i == 0 {
+			s.kv.promote()
+		} else {
+			s.kv.role = kvs.RoleBackup
+			s.kv.lastHeard = time.Now()
+		}
+	}
+	servers[0].kv.syncBackups()
+	return servers
+}
+
+func put(kv *KVService, txID, key, value string) kvs.Status {
+	resp := kvs.PutResponse{}
+	kv.Put(&kvs.PutRequest{Key: key, Value: []byte(value), TransactionID: txID}, &resp)
+	return resp.Status
+}
+
+func get(kv *KVService, txID, key string) (string, kvs.Status) {
+	resp := kvs.GetResponse{}
+	kv.Get(&kvs.GetRequest{Key: key, TransactionID: txID}, &resp)
+	return string(resp.Value), resp.Status
+}
+
+func commit(kv *KVService, txID string) kvs.Status {
+	resp := kvs.CommitResponse{}
+	kv.Commit(&kvs.CommitRequest{TransactionID: txID}, &resp)
+	return resp.Status
+}
+
+func committedValue(kv *KVService, key string) string {
+	kv.Lock()
+	defer kv.Unlock()
+	if entry, found := kv.mp[key]; found {
+		return string(entry.Value)
+	}
+	return ""
+}
+
+func TestBackupRejectsClients(t *testing.T) {
+	shard := startShard(t, 2)
+
+	_, status := get(shard[1].kv, "tx1", "key")
+	assert.Equal(t, kvs.StatusNotPrimary, status)
+	assert.Equal(t, kvs.StatusNotPrimary, put(shard[1].kv, "tx1", "key", "value"))
+	assert.Equal(t, kvs.StatusNotPrimary, commit(shard[1].kv, "tx1"))
+}
+
+func TestCommitReachesBackups(t *testing.T) {
+	shard := startShard(t, 3)
+
+	assert.Equal(t, kvs.StatusOK, put(shard[0].kv, "tx1", "key", "value"))
+	assert.Equal(t, kvs.StatusOK, commit(shard[0].kv, "tx1"))
+
+	for _, s := range shard[1:] {
+		assert.Equal(t, "value", committedValue(s.kv, "key"))
+		assert.Equal(t, shard[0].kv.version, s.kv.version)
+	}
+}
+
+func TestFailoverKeepsPreparedTransactions(t *testing.T) {
+	shard := startShard(t, 2)
+	primary, backup := shard[0].kv, shard[1].kv
+
+	assert.Equal(t, kvs.StatusOK, put(primary, "tx1", "before", "committed"))
+	assert.Equal(t, kvs.StatusOK, commit(primary, "tx1"))
+
+	assert.Equal(t, kvs.StatusOK, put(primary, "tx2", "key", "prepared"))
+	prepareResp := kvs.PrepareResponse{}
+	primary.Prepare(&kvs.PrepareRequest{TransactionID: "tx2", Participants: []string{primary.addr}}, &prepareResp)
+	assert.Equal(t, kvs.StatusOK, prepareResp.Status)
+
+	shard[0].crash()
+	backup.Promote(&kvs.PromoteRequest{}, &kvs.PromoteResponse{})
+
+	// The prepared transaction still holds its write lock on the new primary
+	value, status := get(backup, "tx3", "before")
+	assert.Equal(t, kvs.StatusOK, status)
+	assert.Equal(t, "committed", value)
+	assert.Equal(t, kvs.StatusWriteLockConflict, put(backup, "tx3", "key", "other"))
+
+	assert.Equal(t, kvs.StatusOK, commit(backup, "tx2"))
+	assert.Equal(t, "prepared", committedValue(backup, "key"))
+}
+
+func TestStalePrimaryStepsDown(t *testing.T) {
+	shard := startShard(t, 2)
+	oldPrimary, backup := shard[0].kv, shard[1].kv
+
+	assert.Equal(t, kvs.StatusOK, put(oldPrimary, "tx1", "key", "value"))
+	backup.Promote(&kvs.PromoteRequest{}, &kvs.PromoteResponse{})
+
+	// The commit can't reach the new primary's backups, so it must not be
+	// reported, and the old primary can't take over again until it gets a
+	// snapshot
+	assert.Equal(t, kvs.StatusNotPrimary, commit(oldPrimary, "tx1"))
+	assert.Equal(t, kvs.RoleBackup, oldPrimary.role)
+	assert.True(t, oldPrimary.needsSnapshot)
+	assert.Equal(t, "", committedValue(backup, "key"))
+}
+
+func TestSlowBackupDoesntBlockRequests(t *testing.T) {
+	shard := startShard(t, 2)
+	primary, backup := shard[0].kv, shard[1].kv
+
+	// The backup can't apply anything while its lock is held
+	backup.Lock()
+	assert.Equal(t, kvs.StatusOK, put(primary, "tx1", "a", "1"))
+	committed := make(chan kvs.Status)
+	go func() { committed <- commit(primary, "tx1") }()
+	assert.Eventually(t, func() bool { return committedValue(primary, "a") == "1" }, time.Second, time.Millisecond)
+
+	// The commit waits for the backup without holding up other requests
+	value, status := get(primary, "tx2", "a")
+	assert.Equal(t, kvs.StatusOK, status)
+	assert.Equal(t, "1", value)
+	assert.Equal(t, kvs.StatusOK, put(primary, "tx2", "b", "2"))
+
+	backup.Unlock()
+	assert.Equal(t, kvs.StatusOK, <-committed)
+	assert.Equal(t, "1", committedValue(backup, "a"))
+}
+
+func TestDeadBackupStopsBeingWaitedFor(t *testing.T) {
+	shard := startShard(t, 3)
+	primary := shard[0].kv
+	primary.backupTimeout = 100 * time.Millisecond
+	shard[1].crash()
+
+	// The dead backup holds up commits for backupTimeout and then stops
+	// being waited for
+	for _, txID := range []string{"tx1", "tx2"} {
+		assert.Equal(t, kvs.StatusOK, put(primary, txID, "key", txID))
+		assert.Equal(t, kvs.StatusOK, commit(primary, txID))
+		assert.Equal(t, txID, committedValue(shard[2].kv, "key"))
+	}
+	assert.Equal(t, "", committedValue(shard[1].kv, "key"))
+
+	// It missed the commits, so it doesn't take over from the backup that
+	// has them, though it comes first in promotion order
+	shard[0].crash()
+	for _, s := range shard[1:] {
+		s.kv.Lock()
+		s.kv.failoverTimeout = 100 * time.Millisecond
+		s.kv.lastHeard = time.Now().Add(-time.Second)
+		s.kv.Unlock()
+	}
+	shard[1].kv.monitorPrimary()
+	assert.Equal(t, kvs.RoleBackup, shard[1].kv.role)
+	shard[2].kv.monitorPrimary()
+	assert.Equal(t, kvs.RolePrimary, shard[2].kv.role)
+	assert.Equal(t, "tx2", committedValue(shard[2].kv, "key"))
+}
+
+func TestAutomaticFailover(t *testing.T) {
+	shard := startShard(t, 3)
+	for _, s := range shard[1:] {
+		s.kv.failoverTimeout = 100 * time.Millisecond
+	}
+
+	assert.Equal(t, kvs.StatusOK, put(shard[0].kv, "tx1", "key", "value"))
+	assert.Equal(t, kvs.StatusOK, commit(shard[0].kv, "tx1"))
+	shard[0].crash()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for shard[1].kv.role != kvs.RolePrimary && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+		shard[1].kv.monitorPrimary()
+		shard[2].kv.monitorPrimary()
+	}
+
+	// The next replica in promotion order takes over, and the other backup
+	// follows it
+	assert.Equal(t, kvs.RolePrimary, shard[1].kv.role)
+	shard[1].kv.syncBackups()
+	assert.Equal(t, kvs.RoleBackup, shard[2].kv.role)
+	assert.Equal(t, shard[1].kv.addr, shard[2].kv.primary)
+	assert.Equal(t, "value", committedValue(shard[1].kv, "key"))
+}
+
+// Restarts a crashed backup empty, the way main starts one.
+func restartBackup(t *testing.T, crashed *testServer) *testServer {
+	restarted := startTestServer(t, crashed.kv.addr)
+	restarted.kv.replicas = crashed.kv.replicas
+	restarted.kv.role = kvs.RoleBackup
+	restarted.kv.needsSnapshot = true
+	return restarted
+}
+
+func TestRestartedReplicaCatchesUp(t *testing.T) {
+	shard := startShard(t, 2)
+	shard[0].kv.replicateTimeout = 100 * time.Millisecond
+	shard[1].crash()
+
+	// The commit takes effect on the primary, but can't be reported until
+	// the backup has it
+	assert.Equal(t, kvs.StatusOK, put(shard[0].kv, "tx1", "key", "value"))
+	assert.Equal(t, kvs.StatusOutcomeUnknown, commit(shard[0].kv, "tx1"))
+
+	restarted := restartBackup(t, shard[1])
+	shard[0].kv.syncBackups()
+
+	assert.Equal(t, "value", committedValue(restarted.kv, "key"))
+	assert.Equal(t, shard[0].kv.addr, restarted.kv.primary)
+	assert.Equal(t, kvs.StatusOK, commit(shard[0].kv, "tx1"))
+	assert.Equal(t, kvs.StatusOK, put(shard[0].kv, "tx2", "key", "next"))
+	assert.Equal(t, kvs.StatusOK, commit(shard[0].kv, "tx2"))
+	assert.Equal(t, "next", committedValue(restarted.kv, "key"))
+}
+
+func TestStaleBackupCantTakeOver(t *testing.T) {
+	shard := startShard(t, 2)
+	primary := shard[0].kv
+	primary.replicateTimeout = 100 * time.Millisecond
+
+	shard[1].crash()
+	assert.Equal(t, kvs.StatusOK, put(primary, "tx1", "key", "value"))
+	assert.NotEqual(t, kvs.StatusOK, commit(primary, "tx1"))
+	shard[0].crash()
+
+	// The backup missed the commit, so it must not take over, whether the
+	// primary looks down or an operator asks
+	restarted := restartBackup(t, shard[1])
+	restarted.kv.primary = primary.addr
+	restarted.kv.failoverTimeout = time.Millisecond
+	restarted.kv.monitorPrimary()
+	assert.Equal(t, kvs.RoleBackup, restarted.kv.role)
+
+	resp := kvs.PromoteResponse{}
+	assert.Nil(t, restarted.kv.Promote(&kvs.PromoteRequest{}, &resp))
+	assert.Equal(t, kvs.StatusStaleReplica, resp.Status)
+	assert.Equal(t, kvs.RoleBackup, restarted.kv.role)
+}
+
+func TestRestartedPrimaryDoesntWipeBackups(t *testing.T) {
+	shard := startShard(t, 2)
+	assert.Equal(t, kvs.StatusOK, put(shard[0].kv, "tx1", "key", "value"))
+	assert.Equal(t, kvs.StatusOK, commit(shard[0].kv, "tx1"))
+	shard[0].crash()
+
+	// The restarted primary comes back empty, so the backup with the data
+	// takes over and the old primary catches up from it
+	restarted := startTestServer(t, shard[0].kv.addr)
+	restarted.kv.replicas = shard[0].kv.replicas
+	assert.Nil(t, restarted.kv.startPrimary())
+	assert.Equal(t, kvs.RoleBackup, restarted.kv.role)
+	assert.Equal(t, kvs.RolePrimary, shard[1].kv.role)
+
+	shard[1].kv.syncBackups()
+	assert.Equal(t, "value", committedValue(shard[1].kv, "key"))
+	assert.Equal(t, "value", committedValue(restarted.kv, "key"))
+	assert.False(t, restarted.kv.needsSnapshot)
+}
+
+func TestFirstPrimaryTakesOver(t *testing.T) {
+	primary := startTestServer(t, "localhost:0")
+	backup := startTestServer(t, "localhost:0")
+	replicas := []string{primary.kv.addr, backup.kv.addr}
+	primary.kv.replicas, backup.kv.replicas = replicas, replicas
+	backup.kv.startBackup(0, "")
+
+	// A new shard's backups have nothing to lose
+	assert.Nil(t, primary.kv.startPrimary())
+	assert.Equal(t, kvs.RolePrimary, primary.kv.role)
+	assert.Equal(t, kvs.RoleBackup, backup.kv.role)
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/rstutsman/cs6450-labs/kvs"
+)
+
+// Prepare records a yes vote for a transaction along with its fellow
+// participants. From here on only a commit or abort decision can end it.
+func (kv *KVService) Prepare(req *kvs.PrepareRequest, resp *kvs.PrepareResponse) error {
+	defer kv.rpcMetrics.observe("Prepare", time.Now())
+	defer kv.traceRPC(req.TraceID, "Prepare", time.Now(), &resp.Status)
+	if !slices.ContainsFunc(req.Participants, kv.isReplica) {
+		// Termination would ask this server about its own vote
+		return fmt.Errorf("participants %v don't include this server's address %s; set it with -addr", req.Participants, kv.addr)
+	}
+	if kv.raft != nil {
+		return propose(kv, opPrepare, req, resp, func() { resp.Status = kvs.StatusNotPrimary })
+	}
+
+	defer kv.syncOutcomes()
+	defer kv.awaitBackups(&resp.Status)
+	kv.Lock()
+	defer kv.Unlock()
+
+	if kv.role != kvs.RolePrimary {
+		resp.Status = kvs.StatusNotPrimary
+		return nil
+	}
+	return kv.prepare(req, resp)
+}
+
+// Helper method to prepare a transaction. Must hold kv's lock.
+func (kv *KVService) prepare(req *kvs.PrepareRequest, resp *kvs.PrepareResponse) error {
+	switch kv.outcomes[req.TransactionID] {
+	case outcomeCommitted:
+		resp.Status = kvs.StatusOK
+		return nil
+	case outcomeAborted:
+		resp.Status = kvs.StatusTransactionAborted
+		return nil
+	case outcomeExpired:
+		resp.Status = kvs.StatusTransactionExpired
+		return nil
+	}
+
+	tx, exists := kv.transactions[req.TransactionID]
+	if !exists {
+		resp.Status = kvs.StatusUnknownTransaction
+		return nil
+	}
+
+	if tx.Status != "prepared" {
+		// The vote has to survive a failover or a restart, so it isn't
+		// answered until the backups and the outcome log have it
+		tx.Participants = req.Participants
+		tx.Coordinator = req.Coordinator
+		record := kv.prepareRecord(tx)
+		kv.replicate(record)
+		if err := kv.recordPrepare(record); err != nil {
+			return err
+		}
+		tx.Status = "prepared"
+		tx.PreparedAt = kv.clock()
+	}
+
+	resp.Status = kvs.StatusOK
+	return nil
+}
+
+// TxStatus reports what this server knows about a transaction. If it hasn't
+// prepared the transaction, it aborts it first, which is safe since it never
+// voted to commit.
+func (kv *KVService) TxStatus(req *kvs.TxStatusRequest, resp *kvs.TxStatusResponse) error {
+	if kv.raft != nil {
+		return propose(kv, opTxStatus, req, resp, func() { kv.forwardTxStatus(req, resp) })
+	}
+
+	defer kv.syncOutcomes()
+	kv.Lock()
+	defer kv.Unlock()
+
+	// Backups only hear about prepared transactions, so they can't answer
+	if kv.role != kvs.RolePrimary {
+		resp.State = kvs.TxActive
+		return nil
+	}
+	return kv.txStatus(req, resp)
+}
+
+// Helper method to look up, or abort, a transaction for TxStatus. Must hold
+// kv's lock.
+func (kv *KVService) txStatus(req *kvs.TxStatusRequest, resp *kvs.TxStatusResponse) error {
+	switch kv.outcomes[req.TransactionID] {
+	case outcomeCommitted:
+		resp.State = kvs.TxCommitted
+		return nil
+	case outcomeAborted, outcomeExpired:
+		resp.State = kvs.TxAborted
+		return nil
+	}
+
+	if tx, exists := kv.transactions[req.TransactionID]; exists && tx.Status == "prepared" {
+		resp.State = kvs.TxPrepared
+		return nil
+	}
+
+	if err := kv.abortTransaction(req.TransactionID, outcomeAborted); err != nil {
+		return err
+	}
+	resp.State = kvs.TxAborted
+	return nil
+}
+
+// Helper method to pass TxStatus on to the Raft leader. Other servers only
+// know the replica that was leader when the transaction prepared, so this one
+// asks on their behalf, once. If there is no leader to ask, the transaction
+// is reported active so the caller asks again later.
+func (kv *KVService) forwardTxStatus(req *kvs.TxStatusRequest, resp *kvs.TxStatusResponse) {
+	resp.State = kvs.TxActive
+	leader := kv.leaderAddr()
+	if req.Forwarded || leader == "" || leader == kv.addr {
+		return
+	}
+	forwarded := *req
+	forwarded.Forwarded = true
+	if err := kv.peers.Call(leader, "KVService.TxStatus", &forwarded, resp); err != nil {
+		resp.State = kvs.TxActive
+	}
+}
+
+// Helper method to abort a transaction that is still active after the leader
+// found it had timed out. Must hold kv's lock.
+func (kv *KVService) expire(req *kvs.AbortRequest, resp *kvs.AbortResponse) error {
+	if tx, exists := kv.transactions[req.TransactionID]; exists && tx.Status == "active" {
+		if err := kv.abortTransaction(req.TransactionID, outcomeExpired); err != nil {
+			return err
+		}
+	}
+	resp.Status = kvs.StatusOK
+	return nil
+}
+
+// terminate expires transactions that have been active too long, which
+// happens when a client dies before preparing, and resolves transactions
+// that have been prepared for too long without a decision.
+func (kv *KVService) terminate() {
+	var inDoubt []*Transaction
+
+	kv.Lock()
+	if !kv.leading() {
+		// The primary or leader decides for every replica
+		kv.Unlock()
+		return
+	}
+	now := time.Now()
+	for id, tx := range kv.transactions {
+		switch {
+		case tx.Status == "active" && kv.txTimeout > 0 && now.Sub(tx.StartTime) > kv.txTimeout:
+			if kv.raft != nil {
+				kv.submit(opExpire, &kvs.AbortRequest{TransactionID: id})
+			} else if err := kv.abortTransaction(id, outcomeExpired); err != nil {
+				log.Printf("expire %s: %v", id, err)
+			}
+		case tx.Status == "prepared" && now.Sub(tx.PreparedAt) > kv.terminationTimeout:
+			inDoubt = append(inDoubt, tx)
+		}
+	}
+	kv.Unlock()
+
+	for _, tx := range inDoubt {
+		kv.resolve(tx.ID, tx.Coordinator, tx.Participants)
+	}
+}
+
+// Helper method to run cooperative termination for one prepared
+// transaction. If a coordinator decides the outcome, ask it first and wait
+// for it while it is still collecting votes. Otherwise, or if it can't be
+// reached: if any other participant committed, commit; if any aborted or
+// never prepared, abort. If every participant is prepared too, or some can't
+// be reached, the transaction stays in doubt until the next attempt.
+func (kv *KVService) resolve(txID string, coordinator string, participants []string) {
+	decision := ""
+	if coordinator != "" {
+		resp := kvs.TxStatusResponse{}
+		if err := kv.peers.Call(coordinator, "Coordinator.TxStatus", &kvs.TxStatusRequest{TransactionID: txID}, &resp); err == nil {
+			if resp.State != kvs.TxCommitted && resp.State != kvs.TxAborted {
+				// Still collecting votes
+				return
+			}
+			decision = resp.State
+		}
+	}
+	if decision == "" {
+		decision = kv.askParticipants(txID, participants)
+	}
+	if decision == "" {
+		return
+	}
+
+	// A decision may have arrived from the coordinator in the meantime, in
+	// which case this is a no-op
+	var status kvs.Status
+	var err error
+	if decision == kvs.TxCommitted {
+		resp := kvs.CommitResponse{}
+		err = kv.Commit(&kvs.CommitRequest{TransactionID: txID}, &resp)
+		status = resp.Status
+	} else {
+		resp := kvs.AbortResponse{}
+		err = kv.Abort(&kvs.AbortRequest{TransactionID: txID}, &resp)
+		status = resp.Status
+	}
+	if err == nil {
+		err = status.Err()
+	}
+	if err != nil {
+		log.Printf("resolve %s: %v", txID, err)
+		return
+	}
+	log.Printf("resolved in-doubt transaction %s: %s", txID, decision)
+}
+
+// Helper method to learn a transaction's outcome from the other participants.
+// Returns an empty string if none of them knows it.
+func (kv *KVService) askParticipants(txID string, participants []string) string {
+	for _, addr := range participants {
+		if addr == kv.addr {
+			continue
+		}
+		resp := kvs.TxStatusResponse{}
+		if err := kv.peers.Call(addr, "KVService.TxStatus", &kvs.TxStatusRequest{TransactionID: txID}, &resp); err != nil {
+			continue
+		}
+		if resp.State == kvs.TxCommitted || resp.State == kvs.TxAborted {
+			return resp.State
+		}
+	}
+	return ""
+}
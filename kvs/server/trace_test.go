@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rstutsman/cs6450-labs/kvs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTracedRequests(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.json")
+	kv := NewKVService()
+	var err error
+	kv.tracer, err = kvs.NewTracer(path, "kvsserver")
+	assert.Nil(t, err)
+
+	kv.Put(&kvs.PutRequest{Key: "a", Value: []byte("1"), TransactionID: "traced", TraceID: "t1"}, &kvs.PutResponse{})
+	kv.Commit(&kvs.CommitRequest{TransactionID: "traced", TraceID: "t1"}, &kvs.CommitResponse{})
+	assert.Equal(t, kvs.StatusOK, put(kv, "untraced", "b", "1"))
+	assert.Equal(t, kvs.StatusOK, commit(kv, "untraced"))
+	assert.Nil(t, kv.tracer.Close())
+
+	file, err := os.Open(path)
+	assert.Nil(t, err)
+	defer file.Close()
+	events, err := kvs.ReadTrace(file)
+	assert.Nil(t, err)
+	var spans []string
+	for _, event := range events {
+		if event.Phase == "X" {
+			spans = append(spans, event.Name)
+			assert.Equal(t, "t1", event.Args["trace_id"])
+		}
+	}
+	// Spans are written as they end, so apply comes before the Commit around it
+	assert.Equal(t, []string{"Put", "apply", "Commit"}, spans)
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rstutsman/cs6450-labs/kvs"
+)
+
+const defaultMaxHistory = 10000
+
+// Change is a committed write set, or a key whose TTL ran out, kept in
+// commit order so watchers and change log readers can catch up from any
+// retained version.
+type Change struct {
+	Version       uint64
+	TransactionID string // empty for an expiry
+	Writes        map[string]Write
+	Expired       string // the key that expired, if this is an expiry
+}
+
+// Helper method to append the write set committed at kv.version to the
+// history. Must hold kv's lock.
+func (kv *KVService) recordChange(txID string, writes map[string]Write) {
+	kv.appendChange(&Change{Version: kv.version, TransactionID: txID, Writes: writes})
+}
+
+// Helper method to give the expiry of key a version of its own and record
+// it, so watchers see the key go away. Must hold kv's lock.
+func (kv *KVService) recordExpiry(key string) {
+	kv.version++
+	kv.appendChange(&Change{Version: kv.version, Expired: key})
+}
+
+// Helper method to append a change to the history and wake up any waiting
+// watchers. Must hold kv's lock.
+func (kv *KVService) appendChange(change *Change) {
+	kv.history = append(kv.history, change)
+	if over := len(kv.history) - kv.maxHistory; over > 0 {
+		kv.history = append([]*Change(nil), kv.history[over:]...)
+	}
+
+	close(kv.changed)
+	kv.changed = make(chan struct{})
+}
+
+// Helper function to pick the incarnation of a server that starts with an
+// empty store, so its versions can't be mistaken for an earlier run's
+func newIncarnation() uint64 {
+	for {
+		if incarnation := rand.Uint64(); incarnation != 0 {
+			return incarnation
+		}
+	}
+}
+
+// Helper function to find the incarnation of a Raft group. Every replica
+// replays the same log from the start, so they number versions the same
+// way across restarts and share one incarnation.
+func raftIncarnation(replicas []string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(strings.Join(replicas, ",")))
+	return h.Sum64() | 1
+}
+
+// Helper method to find the retained changes newer than a version. It
+// reports compacted if some of them have already been dropped. Versions only
+// live in memory and start over when the server restarts, so a version from
+// another incarnation, or newer than any this server has assigned, also
+// reports compacted: the caller's resume point is from before the restart.
+// Must hold kv's lock.
+func (kv *KVService) changesSince(version, incarnation uint64) (changes []*Change, compacted bool) {
+	if version > kv.version || (incarnation != 0 && incarnation != kv.incarnation) {
+		return nil, true
+	}
+	if version == kv.version {
+		return nil, false
+	}
+
+	oldest := kv.version + 1
+	if len(kv.history) > 0 {
+		oldest = kv.history[0].Version
+	}
+	if version+1 < oldest {
+		return nil, true
+	}
+
+	start := sort.Search(len(kv.history), func(i int) bool {
+		return kv.history[i].Version > version
+	})
+	return kv.history[start:], false
+}
+
+// Helper method to collect the changes matching a watch request. Must hold
+// kv's lock.
+func (kv *KVService) collectChanges(req *kvs.WatchRequest, resp *kvs.WatchResponse) {
+	resp.Version = kv.version
+	resp.Incarnation = kv.incarnation
+	changes, compacted := kv.changesSince(req.FromVersion, req.Incarnation)
+	resp.Compacted = compacted
+
+	for _, change := range changes {
+		if change.Expired != "" {
+			if change.Expired == req.Key || (req.Prefix && strings.HasPrefix(change.Expired, req.Key)) {
+				resp.Events = append(resp.Events, kvs.WatchEvent{Key: change.Expired, Version: change.Version, Deleted: true})
+			}
+			continue
+		}
+		keys := make([]string, 0, len(change.Writes))
+		for key := range change.Writes {
+			if key == req.Key || (req.Prefix && strings.HasPrefix(key, req.Key)) {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			resp.Events = append(resp.Events, kvs.WatchEvent{
+				Key:     key,
+				Value:   change.Writes[key].Value,
+				Version: change.Version,
+			})
+		}
+	}
+}
+
+// Helper method to collect committed transactions for a change log request.
+// If the ones the reader asked for are gone, it gets the oldest ones still
+// retained, so it loses no more than it has to. Must hold kv's lock.
+func (kv *KVService) collectRecords(req *kvs.ChangeLogRequest, resp *kvs.ChangeLogResponse) {
+	resp.Version = kv.version
+	resp.Incarnation = kv.incarnation
+	changes, compacted := kv.changesSince(req.FromVersion, req.Incarnation)
+	resp.Compacted = compacted
+	if compacted {
+		changes = kv.history
+	}
+
+	if req.MaxRecords > 0 && len(changes) > req.MaxRecords {
+		changes = changes[:req.MaxRecords]
+		resp.Version = changes[len(changes)-1].Version
+	}
+
+	for _, change := range changes {
+		record := kvs.CommitRecord{
+			Version:       change.Version,
+			TransactionID: change.TransactionID,
+			Writes:        committedWrites(change.Writes),
+		}
+		if change.Expired != "" {
+			record.Writes = []kvs.CommittedWrite{{Key: change.Expired, Deleted: true}}
+		}
+		resp.Records = append(resp.Records, record)
+	}
+}
+
+// Helper method to long-poll until collect finds something to return or the
+// timeout passes.
+func (kv *KVService) waitForChanges(timeout time.Duration, collect func() bool) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		kv.Lock()
+		found := collect()
+		changed := kv.changed
+		kv.Unlock()
+
+		if found {
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			return
+		}
+	}
+}
+
+// Watch is a long-poll for committed changes to a key or key prefix. It
+// returns as soon as there is at least one change newer than FromVersion, or
+// with no events once Timeout passes.
+func (kv *KVService) Watch(req *kvs.WatchRequest, resp *kvs.WatchResponse) error {
+	kv.waitForChanges(req.Timeout, func() bool {
+		*resp = kvs.WatchResponse{}
+		kv.collectChanges(req, resp)
+		return len(resp.Events) > 0 || resp.Compacted
+	})
+	return nil
+}
+
+// ChangeLog is a long-poll for the transactions this server committed after
+// FromVersion, in commit order and with their full write sets.
+func (kv *KVService) ChangeLog(req *kvs.ChangeLogRequest, resp *kvs.ChangeLogResponse) error {
+	kv.waitForChanges(req.Timeout, func() bool {
+		*resp = kvs.ChangeLogResponse{}
+		kv.collectRecords(req, resp)
+		return len(resp.Records) > 0 || resp.Compacted
+	})
+	return nil
+}
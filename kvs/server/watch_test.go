@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/rstutsman/cs6450-labs/kvs"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChangesAfterRestart(t *testing.T) {
+	kv := NewKVService()
+	assert.Equal(t, kvs.StatusOK, put(kv, "tx1", "key", "value"))
+	assert.Equal(t, kvs.StatusOK, commit(kv, "tx1"))
+
+	// A resume point from before a restart is newer than anything this
+	// server has committed since
+	resp := kvs.WatchResponse{}
+	kv.Watch(&kvs.WatchRequest{Key: "key", FromVersion: kv.version + 5}, &resp)
+	assert.True(t, resp.Compacted)
+	assert.Equal(t, kv.version, resp.Version)
+
+	from, incarnation := resp.Version, resp.Incarnation
+	resp = kvs.WatchResponse{}
+	kv.Watch(&kvs.WatchRequest{Key: "key", FromVersion: from, Incarnation: incarnation}, &resp)
+	assert.False(t, resp.Compacted)
+}
+
+func TestChangesAfterRestartCatchesUp(t *testing.T) {
+	kv := NewKVService()
+	assert.Equal(t, kvs.StatusOK, put(kv, "tx1", "key", "before"))
+	assert.Equal(t, kvs.StatusOK, commit(kv, "tx1"))
+	resp := kvs.ChangeLogResponse{}
+	kv.ChangeLog(&kvs.ChangeLogRequest{}, &resp)
+	from, incarnation := resp.Version, resp.Incarnation
+
+	// The restarted server has numbered new commits past the old resume
+	// point, but they aren't the ones that came after it
+	restarted := NewKVService()
+	for _, txID := range []string{"tx2", "tx3"} {
+		assert.Equal(t, kvs.StatusOK, put(restarted, txID, "key", "after"))
+		assert.Equal(t, kvs.StatusOK, commit(restarted, txID))
+	}
+	resp = kvs.ChangeLogResponse{}
+	restarted.ChangeLog(&kvs.ChangeLogRequest{FromVersion: from, Incarnation: incarnation}, &resp)
+	assert.True(t, resp.Compacted)
+	assert.Equal(t, 2, len(resp.Records))
+	assert.Equal(t, "tx2", resp.Records[0].TransactionID)
+	assert.NotEqual(t, incarnation, resp.Incarnation)
+
+	watchResp := kvs.WatchResponse{}
+	restarted.Watch(&kvs.WatchRequest{Key: "key", FromVersion: from, Incarnation: incarnation}, &watchResp)
+	assert.True(t, watchResp.Compacted)
+	assert.Equal(t, 0, len(watchResp.Events))
+}
+
+func TestExpiryIsAChange(t *testing.T) {
+	kv := NewKVService()
+	resp := kvs.PutResponse{}
+	kv.Put(&kvs.PutRequest{Key: "session/a", Value: []byte("1"), TTL: time.Minute, TransactionID: "tx1"}, &resp)
+	assert.Equal(t, kvs.StatusOK, resp.Status)
+	assert.Equal(t, kvs.StatusOK, commit(kv, "tx1"))
+	committed := kv.version
+
+	assert.Equal(t, 1, kv.sweep(time.Now().Add(time.Hour)))
+
+	watchResp := kvs.WatchResponse{}
+	kv.Watch(&kvs.WatchRequest{Key: "session/", Prefix: true, FromVersion: committed}, &watchResp)
+	assert.Equal(t, []kvs.WatchEvent{{Key: "session/a", Version: committed + 1, Deleted: true}}, watchResp.Events)
+}
+
+func TestChangeLogResumes(t *testing.T) {
+	kv := NewKVService()
+	for i, key := range []string{"a", "b", "c"} {
+		txID := fmt.Sprintf("tx%d", i)
+		assert.Equal(t, kvs.StatusOK, put(kv, txID, key, "v"))
+		assert.Equal(t, kvs.StatusOK, commit(kv, txID))
+	}
+
+	resp := kvs.ChangeLogResponse{}
+	kv.ChangeLog(&kvs.ChangeLogRequest{MaxRecords: 2}, &resp)
+	assert.False(t, resp.Compacted)
+	assert.Equal(t, 2, len(resp.Records))
+	assert.Equal(t, "tx0", resp.Records[0].TransactionID)
+	assert.Equal(t, "a", resp.Records[0].Writes[0].Key)
+	assert.Equal(t, uint64(2), resp.Version)
+
+	// Resuming picks up where the batch ended
+	from := resp.Version
+	resp = kvs.ChangeLogResponse{}
+	kv.ChangeLog(&kvs.ChangeLogRequest{FromVersion: from}, &resp)
+	assert.Equal(t, 1, len(resp.Records))
+	assert.Equal(t, "tx2", resp.Records[0].TransactionID)
+	assert.Equal(t, uint64(3), resp.Version)
+
+	// Caught up, so the long-poll times out empty
+	resp = kvs.ChangeLogResponse{}
+	kv.ChangeLog(&kvs.ChangeLogRequest{FromVersion: 3, Timeout: 10 * time.Millisecond}, &resp)
+	assert.Equal(t, 0, len(resp.Records))
+	assert.False(t, resp.Compacted)
+}
+
+func TestChangeLogCompacted(t *testing.T) {
+	kv := NewKVService()
+	kv.maxHistory = 2
+	for i := 0; i < 3; i++ {
+		txID := fmt.Sprintf("tx%d", i)
+		assert.Equal(t, kvs.StatusOK, put(kv, txID, "key", "v"))
+		assert.Equal(t, kvs.StatusOK, commit(kv, txID))
+	}
+
+	// The reader gets what is left, starting with the oldest
+	resp := kvs.ChangeLogResponse{}
+	kv.ChangeLog(&kvs.ChangeLogRequest{MaxRecords: 1}, &resp)
+	assert.True(t, resp.Compacted)
+	assert.Equal(t, 1, len(resp.Records))
+	assert.Equal(t, "tx1", resp.Records[0].TransactionID)
+	assert.Equal(t, uint64(2), resp.Version)
+
+	// Everything after the oldest retained version is still there
+	resp = kvs.ChangeLogResponse{}
+	kv.ChangeLog(&kvs.ChangeLogRequest{FromVersion: 1}, &resp)
+	assert.False(t, resp.Compacted)
+	assert.Equal(t, 2, len(resp.Records))
+}
+
+func TestChangeLogExpiry(t *testing.T) {
+	kv := NewKVService()
+	putResp := kvs.PutResponse{}
+	kv.Put(&kvs.PutRequest{Key: "key", Value: []byte("v"), TTL: time.Minute, TransactionID: "tx1"}, &putResp)
+	assert.Equal(t, kvs.StatusOK, commit(kv, "tx1"))
+
+	// Expired keys are reclaimed when they're next touched, too
+	kv.Lock()
+	assert.True(t, kv.reclaimIfExpired("key", time.Now().Add(time.Hour)))
+	kv.Unlock()
+
+	resp := kvs.ChangeLogResponse{}
+	kv.ChangeLog(&kvs.ChangeLogRequest{FromVersion: 1}, &resp)
+	assert.Equal(t, []kvs.CommitRecord{{
+		Version: 2,
+		Writes:  []kvs.CommittedWrite{{Key: "key", Deleted: true}},
+	}}, resp.Records)
+}
@@ -0,0 +1,151 @@
+package kvs
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Ranges are spans of placement keys, the key itself or its hash tag (see
+// HashTag), so every key with the same tag falls in the same range. Scans
+// return keys in ScanLess order, which keeps the keys of each range together.
+
+// RangeInfo describes a contiguous range of placement keys and the server
+// that owns it.
+type RangeInfo struct {
+	Start  string  // first placement key in the range
+	End    string  // first placement key after the range; empty means no upper bound
+	Owner  string  // address of the server that owns the range
+	Keys   int     // keys stored in the range when last counted
+	Load   float64 // operations per second on the range when last measured
+	Fenced bool    // the range is moving to another server, so its owner refuses new locks in it
+}
+
+// Contains reports whether key falls in the range.
+func (r RangeInfo) Contains(key string) bool {
+	return InRange(key, r.Start, r.End)
+}
+
+// InRange reports whether key's placement key is in [start, end). An empty
+// end means no upper bound.
+func InRange(key, start, end string) bool {
+	key = HashTag(key)
+	return key >= start && (end == "" || key < end)
+}
+
+// ScanLess reports whether a comes before b in a scan: by placement key
+// first, then by the whole key.
+func ScanLess(a, b string) bool {
+	if tagA, tagB := HashTag(a), HashTag(b); tagA != tagB {
+		return tagA < tagB
+	}
+	return a < b
+}
+
+// ShardMap lists the ranges of every server in key order. Together they
+// cover every key exactly once. A map from the config service has an epoch
+// that grows with every change and lists the shards, whose host entries are
+// the owners of its ranges; a map built from the servers' own reports names
+// each owner by its address and has epoch zero.
+type ShardMap struct {
+	Epoch  uint64
+	Shards []string // host entry of every shard, each a |-separated list of replicas
+	Ranges []RangeInfo
+}
+
+// NewShardMap sorts ranges and checks that they cover every key without
+// gaps or overlaps.
+func NewShardMap(ranges []RangeInfo) (*ShardMap, error) {
+	ranges = append([]RangeInfo(nil), ranges...)
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].Start < ranges[j].Start })
+
+	if len(ranges) == 0 || ranges[0].Start != "" {
+		return nil, fmt.Errorf("shard map doesn't cover keys from the beginning")
+	}
+	for i, r := range ranges {
+		if r.End != "" && r.End <= r.Start {
+			return nil, fmt.Errorf("range [%q, %q) of %s is empty", r.Start, r.End, r.Owner)
+		}
+		if i == len(ranges)-1 {
+			if r.End != "" {
+				return nil, fmt.Errorf("shard map doesn't cover keys from %q on", r.End)
+			}
+		} else if next := ranges[i+1]; r.End != next.Start {
+			return nil, fmt.Errorf("range [%q, %q) of %s doesn't end where [%q, %q) of %s starts",
+				r.Start, r.End, r.Owner, next.Start, next.End, next.Owner)
+		}
+	}
+	return &ShardMap{Ranges: ranges}, nil
+}
+
+// Find returns the range that owns key.
+func (m *ShardMap) Find(key string) RangeInfo {
+	key = HashTag(key)
+	i := sort.Search(len(m.Ranges), func(i int) bool { return m.Ranges[i].Start > key })
+	return m.Ranges[i-1]
+}
+
+// Overlapping returns the ranges that hold placement keys in [start, end),
+// in key order, each cut down to the part inside [start, end). An empty end
+// means no upper bound.
+func (m *ShardMap) Overlapping(start, end string) []RangeInfo {
+	var ranges []RangeInfo
+	for _, r := range m.Ranges {
+		if !overlapsRange(r, start, end) {
+			continue
+		}
+		if r.Start < start {
+			r.Start = start
+		}
+		if end != "" && (r.End == "" || r.End > end) {
+			r.End = end
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges
+}
+
+// Owned returns the ranges owner owns, in key order.
+func (m *ShardMap) Owned(owner string) []RangeInfo {
+	var ranges []RangeInfo
+	for _, r := range m.Ranges {
+		if r.Owner == owner {
+			ranges = append(ranges, r)
+		}
+	}
+	return ranges
+}
+
+// Assign returns a copy of m, one epoch later, with [start, end) owned by
+// owner. Neighbouring ranges with the same owner are joined.
+func (m *ShardMap) Assign(start, end, owner string) *ShardMap {
+	var ranges []RangeInfo
+	for _, r := range m.Ranges {
+		if !overlapsRange(r, start, end) {
+			ranges = append(ranges, r)
+			continue
+		}
+		if r.Start < start {
+			ranges = append(ranges, RangeInfo{Start: r.Start, End: start, Owner: r.Owner})
+		}
+		if end != "" && (r.End == "" || r.End > end) {
+			ranges = append(ranges, RangeInfo{Start: end, End: r.End, Owner: r.Owner})
+		}
+	}
+	ranges = append(ranges, RangeInfo{Start: start, End: end, Owner: owner})
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].Start < ranges[j].Start })
+
+	joined := ranges[:1]
+	for _, r := range ranges[1:] {
+		if last := &joined[len(joined)-1]; last.Owner == r.Owner {
+			last.End = r.End
+		} else {
+			joined = append(joined, r)
+		}
+	}
+	return &ShardMap{Epoch: m.Epoch + 1, Shards: m.Shards, Ranges: joined}
+}
+
+// Helper function to check whether r holds placement keys in [start, end)
+func overlapsRange(r RangeInfo, start, end string) bool {
+	return (r.End == "" || start < r.End) && (end == "" || r.Start < end)
+}
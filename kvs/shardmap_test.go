@@ -0,0 +1,96 @@
+package kvs
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShardMap(t *testing.T) {
+	m, err := NewShardMap([]RangeInfo{
+		{Start: "n", Owner: "c:1"},
+		{Start: "", End: "g", Owner: "a:1"},
+		{Start: "g", End: "n", Owner: "b:1"},
+	})
+	assert.Nil(t, err)
+
+	assert.Equal(t, "a:1", m.Find("").Owner)
+	assert.Equal(t, "a:1", m.Find("apple").Owner)
+	assert.Equal(t, "b:1", m.Find("g").Owner)
+	assert.Equal(t, "c:1", m.Find("zebra").Owner)
+	assert.Equal(t, "a:1", m.Find("zebra:{apple}").Owner)
+
+	// Only the ranges that overlap the span, cut down to it
+	ranges := m.Overlapping("h", "p")
+	assert.Equal(t, 2, len(ranges))
+	assert.Equal(t, RangeInfo{Start: "h", End: "n", Owner: "b:1"}, ranges[0])
+	assert.Equal(t, RangeInfo{Start: "n", End: "p", Owner: "c:1"}, ranges[1])
+	assert.Equal(t, 3, len(m.Overlapping("", "")))
+	assert.Equal(t, 1, len(m.Overlapping("p", "")))
+	assert.Equal(t, 1, len(m.Overlapping("a", "g")))
+}
+
+func TestShardMapRejectsGapsAndOverlaps(t *testing.T) {
+	_, err := NewShardMap(nil)
+	assert.NotNil(t, err)
+	_, err = NewShardMap([]RangeInfo{{Start: "a"}})
+	assert.NotNil(t, err)
+	_, err = NewShardMap([]RangeInfo{{End: "g"}, {Start: "h"}})
+	assert.NotNil(t, err)
+	_, err = NewShardMap([]RangeInfo{{End: "g"}, {Start: "f"}})
+	assert.NotNil(t, err)
+	_, err = NewShardMap([]RangeInfo{{End: "g"}})
+	assert.NotNil(t, err)
+}
+
+func TestRangePartitionerShardMap(t *testing.T) {
+	p, err := NewRangePartitioner([]string{"g", "n"}, 3)
+	assert.Nil(t, err)
+
+	m, err := NewShardMap(p.ShardMap([]string{"a:1", "b:1", "c:1"}).Ranges)
+	assert.Nil(t, err)
+	for _, key := range []string{"", "apple", "g", "mango", "n", "zebra", "{a}z"} {
+		assert.Equal(t, []string{"a:1", "b:1", "c:1"}[p.Shard(key)], m.Find(key).Owner, key)
+	}
+}
+
+func TestScanLess(t *testing.T) {
+	assert.True(t, ScanLess("a", "b"))
+	assert.False(t, ScanLess("b", "a"))
+	assert.False(t, ScanLess("a", "a"))
+
+	// Tagged keys sort with their tag
+	assert.True(t, ScanLess("{b}:1", "c"))
+	assert.True(t, ScanLess("b", "{b}:1"))
+	assert.True(t, ScanLess("{b}:1", "{b}:2"))
+	assert.True(t, InRange("{b}:1", "b", "c"))
+	assert.False(t, InRange("{b}:1", "c", ""))
+}
+
+func TestShardMapAssign(t *testing.T) {
+	m, err := NewShardMap([]RangeInfo{{End: "g", Owner: "a"}, {Start: "g", End: "n", Owner: "b"}, {Start: "n", Owner: "c"}})
+	assert.Nil(t, err)
+	m.Epoch = 1
+
+	// Carved out of the middle of one range
+	moved := m.Assign("h", "k", "c")
+	assert.Equal(t, uint64(2), moved.Epoch)
+	assert.Equal(t, []RangeInfo{
+		{End: "g", Owner: "a"},
+		{Start: "g", End: "h", Owner: "b"},
+		{Start: "h", End: "k", Owner: "c"},
+		{Start: "k", End: "n", Owner: "b"},
+		{Start: "n", Owner: "c"},
+	}, moved.Ranges)
+	assert.Equal(t, 2, len(moved.Owned("c")))
+
+	// Moving a range next to its new owner's joins them
+	moved = moved.Assign("k", "n", "c")
+	assert.Equal(t, []RangeInfo{
+		{End: "g", Owner: "a"},
+		{Start: "g", End: "h", Owner: "b"},
+		{Start: "h", Owner: "c"},
+	}, moved.Ranges)
+	_, err = NewShardMap(moved.Ranges)
+	assert.Nil(t, err)
+}
@@ -0,0 +1,147 @@
+package kvs
+
+import "errors"
+
+// Status is the outcome of a request. Every response carries one, and a
+// server sets it explicitly even on success: the zero value is
+// StatusUnknown, so a response that was never filled in doesn't read as
+// success.
+type Status int
+
+const (
+	StatusUnknown              Status = iota // the response was never filled in
+	StatusOK                                 // the request succeeded
+	StatusReadLockConflict                   // another transaction holds the write lock
+	StatusWriteLockConflict                  // another transaction holds a read or write lock
+	StatusUpgradeConflict                    // other readers prevent upgrading a read lock
+	StatusUnknownTransaction                 // the server has no record of the transaction
+	StatusTransactionAborted                 // the transaction was already aborted
+	StatusTransactionExpired                 // the server aborted the transaction after a timeout
+	StatusPreconditionFailed                 // a conditional operation's check failed
+	StatusTooLarge                           // the key or value exceeds the server's size limit
+	StatusOverloaded                         // the server is not accepting new transactions
+	StatusTransactionCommitted               // the transaction was already committed
+	StatusNotPrimary                         // the server is a backup; try another replica of the shard
+	StatusWrongShard                         // the server doesn't own the key, or it is moving; refresh the shard map
+	StatusStaleEpoch                         // the request was placed by an old shard map; refresh it
+	StatusDraining                           // the server is shutting down and takes no new transactions; try another replica
+	StatusOutcomeUnknown                     // the request may or may not have taken effect; don't run it again blindly
+	StatusStaleReplica                       // the replica may have missed records, so it can't take over
+	StatusTransactionPrepared                // the transaction is prepared, so only two-phase commit can end it
+	StatusDeadlockVictim                     // waiting for the lock would deadlock with transactions waiting on this one
+)
+
+var statusNames = map[Status]string{
+	StatusUnknown:              "no status",
+	StatusOK:                   "ok",
+	StatusReadLockConflict:     "read lock conflict",
+	StatusWriteLockConflict:    "write lock conflict",
+	StatusUpgradeConflict:      "lock upgrade conflict",
+	StatusUnknownTransaction:   "unknown transaction",
+	StatusTransactionAborted:   "transaction aborted",
+	StatusTransactionCommitted: "transaction already committed",
+	StatusTransactionExpired:   "transaction expired",
+	StatusPreconditionFailed:   "precondition failed",
+	StatusTooLarge:             "too large",
+	StatusOverloaded:           "server overloaded",
+	StatusNotPrimary:           "not primary",
+	StatusWrongShard:           "wrong shard",
+	StatusStaleEpoch:           "stale shard map",
+	StatusDraining:             "server draining",
+	StatusOutcomeUnknown:       "outcome unknown",
+	StatusStaleReplica:         "stale replica",
+	StatusTransactionPrepared:  "transaction prepared",
+	StatusDeadlockVictim:       "deadlock victim",
+}
+
+func (s Status) String() string {
+	if name, ok := statusNames[s]; ok {
+		return name
+	}
+	return "unknown status"
+}
+
+// StatusError is the error for a non-OK status. Lock conflicts of every kind
+// also match ErrLockConflict with errors.Is.
+type StatusError struct {
+	Status Status
+	parent error
+}
+
+func (e *StatusError) Error() string { return e.Status.String() }
+func (e *StatusError) Unwrap() error { return e.parent }
+
+// ErrLockConflict matches any lock conflict.
+var ErrLockConflict = errors.New("lock conflict")
+
+// Sentinel errors for each status, to match with errors.Is.
+var (
+	ErrNoStatus             = &StatusError{Status: StatusUnknown}
+	ErrReadLockConflict     = &StatusError{StatusReadLockConflict, ErrLockConflict}
+	ErrWriteLockConflict    = &StatusError{StatusWriteLockConflict, ErrLockConflict}
+	ErrUpgradeConflict      = &StatusError{StatusUpgradeConflict, ErrLockConflict}
+	ErrUnknownTransaction   = &StatusError{Status: StatusUnknownTransaction}
+	ErrTransactionAborted   = &StatusError{Status: StatusTransactionAborted}
+	ErrTransactionCommitted = &StatusError{Status: StatusTransactionCommitted}
+	ErrTransactionExpired   = &StatusError{Status: StatusTransactionExpired}
+	ErrPreconditionFailed   = &StatusError{Status: StatusPreconditionFailed}
+	ErrTooLarge             = &StatusError{Status: StatusTooLarge}
+	ErrOverloaded           = &StatusError{Status: StatusOverloaded}
+	ErrNotPrimary           = &StatusError{Status: StatusNotPrimary}
+	ErrWrongShard           = &StatusError{Status: StatusWrongShard}
+	ErrStaleEpoch           = &StatusError{Status: StatusStaleEpoch}
+	ErrDraining             = &StatusError{Status: StatusDraining}
+	ErrOutcomeUnknown       = &StatusError{Status: StatusOutcomeUnknown}
+	ErrStaleReplica         = &StatusError{Status: StatusStaleReplica}
+	ErrTransactionPrepared  = &StatusError{Status: StatusTransactionPrepared}
+	ErrDeadlockVictim       = &StatusError{Status: StatusDeadlockVictim}
+)
+
+var statusErrors = map[Status]error{
+	StatusUnknown:              ErrNoStatus,
+	StatusReadLockConflict:     ErrReadLockConflict,
+	StatusWriteLockConflict:    ErrWriteLockConflict,
+	StatusUpgradeConflict:      ErrUpgradeConflict,
+	StatusUnknownTransaction:   ErrUnknownTransaction,
+	StatusTransactionAborted:   ErrTransactionAborted,
+	StatusTransactionCommitted: ErrTransactionCommitted,
+	StatusTransactionExpired:   ErrTransactionExpired,
+	StatusPreconditionFailed:   ErrPreconditionFailed,
+	StatusTooLarge:             ErrTooLarge,
+	StatusOverloaded:           ErrOverloaded,
+	StatusNotPrimary:           ErrNotPrimary,
+	StatusWrongShard:           ErrWrongShard,
+	StatusStaleEpoch:           ErrStaleEpoch,
+	StatusDraining:             ErrDraining,
+	StatusOutcomeUnknown:       ErrOutcomeUnknown,
+	StatusStaleReplica:         ErrStaleReplica,
+	StatusTransactionPrepared:  ErrTransactionPrepared,
+	StatusDeadlockVictim:       ErrDeadlockVictim,
+}
+
+// Err returns the sentinel error for s, or nil for StatusOK.
+func (s Status) Err() error {
+	if s == StatusOK {
+		return nil
+	}
+	if err, ok := statusErrors[s]; ok {
+		return err
+	}
+	return &StatusError{Status: s}
+}
+
+// IsRetryable reports whether err means the transaction failed for a
+// transient reason, so running it again from Begin may succeed. A response
+// without a status says nothing about what happened, and a commit whose
+// outcome is unknown may have taken effect, so neither is.
+func IsRetryable(err error) bool {
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) {
+		return false
+	}
+	switch statusErr.Status {
+	case StatusUnknown, StatusPreconditionFailed, StatusTooLarge, StatusTransactionCommitted, StatusOutcomeUnknown:
+		return false
+	}
+	return true
+}
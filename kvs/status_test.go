@@ -0,0 +1,21 @@
+package kvs
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnfilledStatusFails(t *testing.T) {
+	var resp PutResponse
+	assert.NotEqual(t, StatusOK, resp.Status)
+	err := resp.Status.Err()
+	assert.True(t, errors.Is(err, ErrNoStatus))
+	assert.False(t, IsRetryable(err))
+
+	assert.Nil(t, StatusOK.Err())
+	assert.True(t, errors.Is(StatusWriteLockConflict.Err(), ErrLockConflict))
+	assert.True(t, IsRetryable(StatusWriteLockConflict.Err()))
+	assert.False(t, IsRetryable(StatusOutcomeUnknown.Err()))
+}
@@ -0,0 +1,187 @@
+package kvs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+)
+
+// TraceEvent is an event in the Chrome trace-event format. Spans are
+// complete ("X") events; metadata ("M") events name processes and threads.
+type TraceEvent struct {
+	Name  string         `json:"name"`
+	Phase string         `json:"ph"`
+	TS    int64          `json:"ts"` // microseconds since the Unix epoch
+	Dur   int64          `json:"dur,omitempty"`
+	PID   uint32         `json:"pid"`
+	TID   uint32         `json:"tid"`
+	Args  map[string]any `json:"args,omitempty"`
+}
+
+// Tracer writes spans to a file in the Chrome trace-event format, which
+// chrome://tracing and ui.perfetto.dev open. Every process writes its own
+// file, as a process named after it; within it, each trace gets a thread of
+// its own. MergeTraces joins the files of a run, so a transaction can be
+// followed through the client and every shard. A nil Tracer records nothing.
+type Tracer struct {
+	sync.Mutex
+	file    *os.File
+	pid     uint32
+	written int
+	threads map[string]bool // traces whose thread has been named
+}
+
+// NewTraceID returns a random ID for a new trace.
+func NewTraceID() string {
+	return fmt.Sprintf("%016x", rand.Uint64())
+}
+
+// Helper function to pick a stable ID for the process or thread name, so
+// files from different hosts can be merged
+func traceHash(name string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return h.Sum32() & 0x7fffffff
+}
+
+// NewTracer creates a trace file at path for the process named process.
+func NewTracer(path, process string) (*Tracer, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.WriteString("[\n"); err != nil {
+		file.Close()
+		return nil, err
+	}
+	t := &Tracer{file: file, pid: traceHash(process), threads: make(map[string]bool)}
+	t.write(TraceEvent{Name: "process_name", Phase: "M", PID: t.pid, Args: map[string]any{"name": process}})
+	return t, nil
+}
+
+// Span records a span of the trace traceID named name that began at start
+// and ends now, with args as pairs of keys and values. It does nothing if
+// traceID is empty, so callers can pass the ID of a request whether or not
+// it is traced.
+func (t *Tracer) Span(traceID, name string, start time.Time, args ...string) {
+	if t == nil || traceID == "" {
+		return
+	}
+	end := time.Now()
+	event := TraceEvent{
+		Name:  name,
+		Phase: "X",
+		TS:    start.UnixMicro(),
+		Dur:   max(end.Sub(start).Microseconds(), 1),
+		PID:   t.pid,
+		TID:   traceHash(traceID),
+		Args:  map[string]any{"trace_id": traceID},
+	}
+	for i := 0; i+1 < len(args); i += 2 {
+		event.Args[args[i]] = args[i+1]
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	if !t.threads[traceID] {
+		t.threads[traceID] = true
+		t.write(TraceEvent{Name: "thread_name", Phase: "M", PID: t.pid, TID: event.TID, Args: map[string]any{"name": "trace " + traceID}})
+	}
+	t.write(event)
+}
+
+// Helper method to append an event to the file. Errors are dropped; a
+// trace is best effort. Must hold t's lock, except while t is created.
+func (t *Tracer) write(event TraceEvent) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	if t.written > 0 {
+		data = append([]byte(",\n"), data...)
+	}
+	if _, err := t.file.Write(data); err == nil {
+		t.written++
+	}
+}
+
+// Close ends the trace file. A file that isn't closed, because its process
+// was killed, is still valid, since the format allows the closing bracket to
+// be missing.
+func (t *Tracer) Close() error {
+	if t == nil {
+		return nil
+	}
+	t.Lock()
+	defer t.Unlock()
+	if _, err := t.file.WriteString("\n]\n"); err != nil {
+		t.file.Close()
+		return err
+	}
+	return t.file.Close()
+}
+
+// ReadTrace reads the events in a trace file, which may be missing its
+// closing bracket.
+func ReadTrace(r io.Reader) ([]TraceEvent, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.TrimSpace(data)
+	if !bytes.HasSuffix(data, []byte("]")) {
+		data = append(bytes.TrimRight(data, ",\n"), ']')
+	}
+	var events []TraceEvent
+	if err := json.Unmarshal(data, &events); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// MergeTraces writes the events of every trace file in paths to w as one
+// trace file. If traceID isn't empty, only that trace's spans are kept.
+func MergeTraces(w io.Writer, traceID string, paths ...string) error {
+	var merged []TraceEvent
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		events, err := ReadTrace(file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		for _, event := range events {
+			if traceID == "" || event.Args["trace_id"] == traceID ||
+				(event.Phase == "M" && (event.TID == 0 || event.TID == traceHash(traceID))) {
+				merged = append(merged, event)
+			}
+		}
+	}
+
+	if _, err := io.WriteString(w, "[\n"); err != nil {
+		return err
+	}
+	for i, event := range merged {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			data = append([]byte(",\n"), data...)
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "\n]\n")
+	return err
+}
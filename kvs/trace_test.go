@@ -0,0 +1,55 @@
+package kvs
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTraceFilesMerge(t *testing.T) {
+	dir := t.TempDir()
+	clientPath := filepath.Join(dir, "client.json")
+	serverPath := filepath.Join(dir, "server.json")
+	client, err := NewTracer(clientPath, "kvsclient")
+	assert.Nil(t, err)
+	server, err := NewTracer(serverPath, "kvsserver localhost:8080")
+	assert.Nil(t, err)
+
+	began := time.Now()
+	server.Span("slow", "Get", began, "key", "a")
+	server.Span("fast", "Get", began, "key", "b")
+	server.Span("", "Get", began) // not traced
+	client.Span("slow", "transaction", began.Add(-time.Millisecond), "outcome", "committed")
+	var untraced *Tracer
+	untraced.Span("slow", "Get", began)
+	assert.Nil(t, client.Close())
+
+	// The server's file is still valid without being closed
+	data, err := os.ReadFile(serverPath)
+	assert.Nil(t, err)
+	events, err := ReadTrace(bytes.NewReader(data))
+	assert.Nil(t, err)
+	assert.Equal(t, 5, len(events)) // the process, two threads and two spans
+
+	merged := bytes.Buffer{}
+	assert.Nil(t, MergeTraces(&merged, "slow", clientPath, serverPath))
+	events, err = ReadTrace(&merged)
+	assert.Nil(t, err)
+	var spans []string
+	processes := map[uint32]bool{}
+	for _, event := range events {
+		if event.Phase == "X" {
+			spans = append(spans, event.Name)
+			assert.Equal(t, "slow", event.Args["trace_id"])
+			assert.True(t, event.Dur >= 1)
+			processes[event.PID] = true
+		}
+	}
+	assert.Equal(t, []string{"transaction", "Get"}, spans)
+	assert.Equal(t, 2, len(processes))
+	assert.Nil(t, server.Close())
+}
@@ -0,0 +1,308 @@
+package kvs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Log is an append-only file of JSON records, one per line. Appends are
+// synced to disk before they return unless syncing is turned off. Writers
+// that only need a record to be durable before they answer someone can
+// Write it while holding their own locks and WaitDurable after releasing
+// them; writers waiting at the same time share one sync.
+type Log struct {
+	sync.Mutex
+	path    string
+	file    *os.File
+	sync    bool
+	size    int64      // bytes written so far
+	written uint64     // records written so far
+	synced  uint64     // records known to be on disk
+	syncing sync.Mutex // held while syncing, so waiters queue for the next sync; taken before the Log's lock
+}
+
+// OpenLog opens the log at path for appending, creating it if needed. A torn
+// last line, left by a crash in the middle of an append, is cut off so the
+// next record starts on a line of its own.
+func OpenLog(path string, sync bool) (*Log, error) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	size, err := trimTornLine(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &Log{path: path, file: file, sync: sync, size: size}, nil
+}
+
+// Helper function to truncate file after its last newline and sync the
+// truncation, returning the new size
+func trimTornLine(file *os.File) (int64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	end := info.Size()
+	buf := make([]byte, 4096)
+	complete := int64(0)
+	for end > 0 {
+		start := max(end-int64(len(buf)), 0)
+		chunk := buf[:end-start]
+		if _, err := file.ReadAt(chunk, start); err != nil {
+			return 0, err
+		}
+		if i := bytes.LastIndexByte(chunk, '\n'); i >= 0 {
+			complete = start + int64(i) + 1
+			break
+		}
+		end = start
+	}
+	if complete == info.Size() {
+		return complete, nil
+	}
+	if err := file.Truncate(complete); err != nil {
+		return 0, err
+	}
+	return complete, file.Sync()
+}
+
+// Append writes record as one line and waits until it is durable.
+func (l *Log) Append(record any) error {
+	if err := l.Write(record); err != nil {
+		return err
+	}
+	return l.WaitDurable()
+}
+
+// Write writes record as one line without waiting for it to be durable.
+func (l *Log) Write(record any) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.Lock()
+	defer l.Unlock()
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		return err
+	}
+	l.written++
+	return nil
+}
+
+// WaitDurable returns once every record written so far is on disk, or right
+// away if syncing is turned off. If another sync is already running, it waits
+// for that one and then syncs everything written meanwhile in one go.
+func (l *Log) WaitDurable() error {
+	if !l.sync {
+		return nil
+	}
+	return l.syncTo(l.count())
+}
+
+// Sync flushes everything written so far to disk, even if syncing is turned
+// off.
+func (l *Log) Sync() error {
+	return l.syncTo(l.count())
+}
+
+// Helper method to count the records written so far
+func (l *Log) count() uint64 {
+	l.Lock()
+	defer l.Unlock()
+	return l.written
+}
+
+// Helper method to sync until at least target records are on disk
+func (l *Log) syncTo(target uint64) error {
+	l.syncing.Lock()
+	defer l.syncing.Unlock()
+
+	l.Lock()
+	if l.synced >= target {
+		l.Unlock()
+		return nil
+	}
+	file, written := l.file, l.written
+	l.Unlock()
+
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	l.Lock()
+	l.synced = max(l.synced, written)
+	l.Unlock()
+	return nil
+}
+
+// Size returns how many bytes have been written to the log, to pass to
+// Compact.
+func (l *Log) Size() int64 {
+	l.Lock()
+	defer l.Unlock()
+	return l.size
+}
+
+// Compact replaces the log with records, followed by everything written
+// after the first since bytes, as Size reported them. The new log is written
+// to a temporary file and renamed into place, so a crash leaves either the
+// old log or the new one. Writes wait only while the records written after
+// since are copied over and the new log is synced.
+func (l *Log) Compact(records []any, since int64) error {
+	tmp := l.path + ".compact"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp) // fails harmlessly once renamed
+	writer := bufio.NewWriter(file)
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		writer.Write(line)
+		writer.WriteByte('\n')
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+
+	l.syncing.Lock()
+	defer l.syncing.Unlock()
+	l.Lock()
+	defer l.Unlock()
+
+	// Copy what was written while the records were
+	if err := copyTail(file, l.path, since); err != nil {
+		file.Close()
+		return err
+	}
+	info, err := file.Stat()
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	// Open the new log before it replaces the old one, so a failure leaves
+	// the old one in use
+	appendFile, err := os.OpenFile(tmp, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, l.path); err != nil {
+		appendFile.Close()
+		return err
+	}
+	l.file.Close()
+	l.file = appendFile
+	l.size = info.Size()
+	l.synced = l.written
+	return syncDir(filepath.Dir(l.path))
+}
+
+// Helper function to append everything in the file at path after offset to
+// w
+func copyTail(w io.Writer, path string, offset int64) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = io.Copy(w, file)
+	return err
+}
+
+// WriteFileAtomic replaces the file at path with data. The data is written
+// to a temporary file and synced before it is renamed into place, and the
+// rename is synced too, so a crash leaves either the old file or the new one.
+func WriteFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp) // fails harmlessly once renamed
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// Helper function to make a rename in dir durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (l *Log) Close() error {
+	l.syncing.Lock()
+	defer l.syncing.Unlock()
+	l.Lock()
+	defer l.Unlock()
+	return l.file.Close()
+}
+
+// ReplayLog calls fn with each line of the log at path, oldest first. A
+// missing log replays nothing. A torn last line, left by a crash in the
+// middle of an append, is ignored; OpenLog cuts it off.
+func ReplayLog(path string, fn func(line []byte) error) error {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// Anything after the last newline is an incomplete append
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(line); err != nil {
+			return err
+		}
+	}
+}
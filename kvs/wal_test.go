@@ -0,0 +1,104 @@
+package kvs
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testRecord struct {
+	N int `json:"n"`
+}
+
+func replayed(t *testing.T, path string) []int {
+	var ns []int
+	assert.Nil(t, ReplayLog(path, func(line []byte) error {
+		var record testRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return err
+		}
+		ns = append(ns, record.N)
+		return nil
+	}))
+	return ns
+}
+
+func TestLogGroupCommit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.log")
+	l, err := OpenLog(path, true)
+	assert.Nil(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Nil(t, l.Append(testRecord{N: 1}))
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, uint64(20), l.synced)
+	assert.Nil(t, l.Close())
+	assert.Equal(t, 20, len(replayed(t, path)))
+}
+
+func TestLogCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.log")
+	l, err := OpenLog(path, true)
+	assert.Nil(t, err)
+	for i := 1; i <= 3; i++ {
+		assert.Nil(t, l.Write(testRecord{N: i}))
+	}
+
+	// Records written after the size was taken survive the compaction
+	since := l.Size()
+	assert.Nil(t, l.Write(testRecord{N: 4}))
+	assert.Nil(t, l.Compact([]any{testRecord{N: 3}}, since))
+	assert.Nil(t, l.Append(testRecord{N: 5}))
+	assert.Nil(t, l.Close())
+	assert.Equal(t, []int{3, 4, 5}, replayed(t, path))
+
+	reopened, err := OpenLog(path, true)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3*len(`{"n":0}`+"\n")), reopened.Size())
+	assert.Nil(t, reopened.Close())
+}
+
+func TestLogTornTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.log")
+	torn := `{"n":1}` + "\n" + `{"n":2}` + "\n" + `{"n"`
+	assert.Nil(t, os.WriteFile(path, []byte(torn), 0644))
+	assert.Equal(t, []int{1, 2}, replayed(t, path))
+
+	// The next record doesn't get glued onto the torn one
+	l, err := OpenLog(path, true)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2*len(`{"n":0}`+"\n")), l.Size())
+	assert.Nil(t, l.Append(testRecord{N: 3}))
+	assert.Nil(t, l.Close())
+	assert.Equal(t, []int{1, 2, 3}, replayed(t, path))
+
+	// A torn first line leaves an empty log
+	assert.Nil(t, os.WriteFile(path, []byte(`{"n"`), 0644))
+	l, err = OpenLog(path, true)
+	assert.Nil(t, err)
+	assert.Nil(t, l.Append(testRecord{N: 4}))
+	assert.Nil(t, l.Close())
+	assert.Equal(t, []int{4}, replayed(t, path))
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "map.json")
+	assert.Nil(t, WriteFileAtomic(path, []byte("old")))
+	assert.Nil(t, WriteFileAtomic(path, []byte("new")))
+
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "new", string(data))
+	_, err = os.Stat(path + ".tmp")
+	assert.True(t, os.IsNotExist(err))
+}
@@ -137,7 +137,7 @@ cleanup() {
     echo "Cleaning up processes on all nodes..."
     for node in "${SERVER_NODES[@]}" "${CLIENT_NODES[@]}"; do
         echo "Cleaning up processes on $node..."
-        ${SSH} $node "pkill -f 'kvs(server|client)' || true" 2>/dev/null || true
+        ${SSH} $node "pkill -f 'kvs(server|client)'; while pgrep -x kvsserver >/dev/null; do sleep 0.1; done" 2>/dev/null || true
     done
     echo "Cleanup complete."
     echo
@@ -157,12 +157,9 @@ echo
 # Start servers
 for node in "${SERVER_NODES[@]}"; do
     echo "Starting server on $node..."
-    ${SSH} $node "${ROOT}/bin/kvsserver $SERVER_ARGS > \"$LOG_DIR/kvsserver-$node.log\" 2>&1 &"
+    ${SSH} $node "${ROOT}/bin/kvsserver -addr $node:8080 $SERVER_ARGS > \"$LOG_DIR/kvsserver-$node.log\" 2>&1 &"
 done
 
-# Give servers time to start
-sleep 2
-
 # Start clients with a unique marker for identification
 # Build comma-separated list of server hosts with port 8080
 SERVER_HOSTS=""
@@ -174,6 +171,9 @@ for node in "${SERVER_NODES[@]}"; do
     fi
 done
 
+# Wait for the servers to be ready
+"${ROOT}/bin/kvsctl" ready ${SERVER_HOSTS//,/ }
+
 CLIENT_PIDS=()
 for node in "${CLIENT_NODES[@]}"; do
     echo "Starting client on $node..."
@@ -138,6 +138,8 @@ echo "Logs will be in $LOG_DIR"
 cleanup() {
     echo "Cleaning up processes locally..."
     pkill -f 'kvs(server|client)' 2>/dev/null || true
+    # Servers drain before exiting; wait until their ports are free
+    while pgrep -x kvsserver >/dev/null; do sleep 0.1; done
     echo "Cleanup complete."
     echo
 }
@@ -157,12 +159,9 @@ echo
 for ((i=0; i<SERVER_COUNT; i++)); do
     echo "Starting server $i..."
     port=$((8080 + i))
-    "${ROOT}/bin/kvsserver" -port $port $SERVER_ARGS > "$LOG_DIR/kvsserver-$i.log" 2>&1 &
+    "${ROOT}/bin/kvsserver" -port $port -addr localhost:$port $SERVER_ARGS > "$LOG_DIR/kvsserver-$i.log" 2>&1 &
 done
 
-# Give servers time to start
-sleep 2
-
 # Start clients with a unique marker for identification
 # Build comma-separated list of server hosts with different ports
 SERVER_HOSTS=""
@@ -175,6 +174,9 @@ for ((i=0; i<SERVER_COUNT; i++)); do
     fi
 done
 
+# Wait for the servers to be ready
+"${ROOT}/bin/kvsctl" ready ${SERVER_HOSTS//,/ }
+
 CLIENT_PIDS=()
 for ((i=0; i<CLIENT_COUNT; i++)); do
     echo "Starting client $i..."